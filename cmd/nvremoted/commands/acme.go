@@ -0,0 +1,60 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"crypto/tls"
+	"net/http"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeTLSConfig creates a TLS configuration that obtains and renews certificates for domains from Let's Encrypt.
+// Challenges are answered with TLS-ALPN-01 on the server's own port,
+// and with HTTP-01 if tls.acmeHttpBind is set.
+func acmeTLSConfig(domains []string) *tls.Config {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(os.ExpandEnv(viper.GetString("tls.acmeCacheDir"))),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      viper.GetString("tls.acmeEmail"),
+	}
+	if directory := viper.GetString("tls.acmeDirectory"); directory != "" {
+		manager.Client = &acme.Client{DirectoryURL: directory}
+	}
+
+	if httpBind := viper.GetString("tls.acmeHttpBind"); httpBind != "" {
+		go func() {
+			log.WithField("addr", httpBind).Info("Answering ACME HTTP-01 challenges")
+			// Requests that aren't challenges are redirected to https, which is harmless for a server that only speaks NVDA Remote.
+			if err := http.ListenAndServe(httpBind, manager.HTTPHandler(nil)); err != nil {
+				log.WithError(err).Error("Error answering ACME HTTP-01 challenges")
+			}
+		}()
+	}
+
+	config := manager.TLSConfig()
+	getCertificate := config.GetCertificate
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		// NVDA Remote clients don't always send the server name,
+		// which the manager needs to pick a certificate.
+		if hello.ServerName == "" {
+			hello.ServerName = domains[0]
+		}
+		cert, err := getCertificate(hello)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"server_name": hello.ServerName,
+				"error":       err,
+			}).Warn("Error getting ACME certificate")
+		}
+		return cert, err
+	}
+	return config
+}
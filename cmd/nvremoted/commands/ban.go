@@ -0,0 +1,108 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/n0ot/nvremoted/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	banDuration time.Duration
+	banReason   string
+)
+
+// banCmd represents the ban command
+var banCmd = &cobra.Command{
+	Use:   "ban",
+	Short: "Manage the addresses banned from a running NVRemoted server",
+	Long: `ban manages the IP addresses and networks, in CIDR notation, that may not connect to the server.
+
+Bans are saved to server.banFile, so they last across restarts.
+Connections that already exist aren't affected by new bans.
+
+If the host is omitted, the local nvremoted server will be used.`,
+}
+
+var banListCmd = &cobra.Command{
+	Use:   "list [host]",
+	Short: "List banned addresses",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var bans []server.Ban
+		if err := adminRequest(remoteHost(args), "bans", nil, &bans); err != nil {
+			return err
+		}
+		printBans(bans)
+		return nil
+	},
+}
+
+var banAddCmd = &cobra.Command{
+	Use:   "add <address> [host]",
+	Short: "Ban an IP address or network",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		banArgs := server.BanArgs{
+			Addr:   args[0],
+			Reason: banReason,
+		}
+		if banDuration > 0 {
+			banArgs.Duration = banDuration.String()
+		}
+		var bans []server.Ban
+		if err := adminRequest(remoteHost(args[1:]), "ban", banArgs, &bans); err != nil {
+			return err
+		}
+		printBans(bans)
+		return nil
+	},
+}
+
+var banRemoveCmd = &cobra.Command{
+	Use:   "remove <address> [host]",
+	Short: "Lift the ban on an IP address or network",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var bans []server.Ban
+		if err := adminRequest(remoteHost(args[1:]), "unban", server.UnbanArgs{Addr: args[0]}, &bans); err != nil {
+			return err
+		}
+		printBans(bans)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(banCmd)
+	for _, cmd := range []*cobra.Command{banListCmd, banAddCmd, banRemoveCmd} {
+		banCmd.AddCommand(cmd)
+		addRemoteFlags(cmd)
+	}
+	banAddCmd.Flags().DurationVar(&banDuration, "for", 0, "how long the ban lasts (default permanent)")
+	banAddCmd.Flags().StringVar(&banReason, "reason", "", "why the address is banned")
+}
+
+func printBans(bans []server.Ban) {
+	if len(bans) == 0 {
+		fmt.Println("No addresses are banned.")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tEXPIRES\tREJECTED\tREASON")
+	for _, b := range bans {
+		expires := "never"
+		if !b.Expires.IsZero() {
+			expires = b.Expires.Local().Format(time.RFC1123)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", b.Addr, expires, b.Rejected, b.Reason)
+	}
+	w.Flush()
+}
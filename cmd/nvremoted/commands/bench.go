@@ -0,0 +1,297 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/n0ot/nvremoted/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	benchClients  int
+	benchChannels int
+	benchRate     float64
+	benchDuration time.Duration
+)
+
+// benchCmd represents the bench command
+var benchCmd = &cobra.Command{
+	Use:   "bench host",
+	Short: "Load test an NVRemoted server with synthetic clients",
+	Long: `bench connects synthetic NVDA Remote clients to a running server, and measures how it performs.
+
+The clients are spread evenly over the channels.
+In each channel, the first client sends messages at the given rate,
+which are relayed to the channel's other clients.
+
+When the test ends, the latency of connecting, joining channels, and relaying messages is printed,
+along with the number of connections that failed, messages that were dropped, and clients that were disconnected.
+Channel names are random, so they won't collide with channels in use.
+Servers with rate limits, or that only allow certain channels, may reject the synthetic clients.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if benchChannels < 1 {
+			return errors.New("At least one channel is required")
+		}
+		if benchClients < benchChannels {
+			return errors.New("There must be at least as many clients as channels")
+		}
+		if benchRate <= 0 {
+			return errors.New("--rate must be greater than 0")
+		}
+		return bench(args[0])
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(benchCmd)
+	benchCmd.Flags().IntVar(&benchClients, "clients", 100, "number of clients to connect")
+	benchCmd.Flags().IntVar(&benchChannels, "channels", 50, "number of channels to spread the clients over")
+	benchCmd.Flags().Float64Var(&benchRate, "rate", 10, "messages per second sent in each channel")
+	benchCmd.Flags().DurationVarP(&benchDuration, "duration", "t", 30*time.Second, "how long to send messages for, once a channel's clients have joined")
+	benchCmd.Flags().StringVarP(&remotePort, "port", "P", "", "port of the server to test (default from the host's _nvremoted._tcp SRV record, or "+client.DefaultPort+")")
+	benchCmd.Flags().BoolVarP(&disableTLS, "disable-tls", "d", false, "disable connecting over TLS")
+	benchCmd.Flags().BoolVarP(&skipTLSVerification, "no-tls-verify", "n", false, "skip TLS verification")
+	benchCmd.Flags().StringVarP(&remoteServerCertificate, "server-certificate", "s", "", "file containing the PEM encoded certificate to use for server verification, instead of the system's certificate store")
+}
+
+// benchResults holds what happened to all synthetic clients.
+type benchResults struct {
+	lock sync.Mutex
+
+	connectLatencies []time.Duration
+	joinLatencies    []time.Duration
+	relayLatencies   []time.Duration
+
+	connectErrors int
+	joinErrors    int
+	disconnects   int
+	sent          int
+	expected      int // Number of relayed messages that should have been received
+	received      int
+}
+
+func (r *benchResults) update(f func(r *benchResults)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	f(r)
+}
+
+// bench runs the load test against host.
+func bench(host string) error {
+	// Keep names unique between runs, so channels left by a previous run don't interfere.
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	prefix := "bench_" + hex.EncodeToString(id)
+
+	fmt.Printf("Benchmarking %s with %d clients in %d channels, sending %g messages per second per channel for %s\n",
+		host, benchClients, benchChannels, benchRate, benchDuration)
+
+	start := time.Now()
+	results := &benchResults{}
+	var wg sync.WaitGroup
+	for i := 0; i < benchChannels; i++ {
+		// Spread any remaining clients over the first channels.
+		members := benchClients / benchChannels
+		if i < benchClients%benchChannels {
+			members++
+		}
+		wg.Add(1)
+		go func(i, members int) {
+			defer wg.Done()
+			benchChannel(host, fmt.Sprintf("%s_%d", prefix, i), members, start, results)
+		}(i, members)
+	}
+	wg.Wait()
+
+	printBenchReport(results, time.Since(start))
+	return nil
+}
+
+// benchChannel joins members clients to a channel, and sends messages from the first to the rest.
+func benchChannel(host, channel string, members int, start time.Time, results *benchResults) {
+	var clients []*client.Client
+	for i := 0; i < members; i++ {
+		connectionType := "slave"
+		if i == 0 {
+			connectionType = "master"
+		}
+		c, err := benchJoin(host, channel, connectionType, results)
+		if err != nil {
+			continue
+		}
+		defer c.Close()
+		clients = append(clients, c)
+	}
+	if len(clients) < 2 {
+		return
+	}
+	sender, receivers := clients[0], clients[1:]
+
+	// The sender's events aren't measured, but must be read so the server doesn't consider it slow.
+	go func() {
+		for range sender.Events() {
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, receiver := range receivers {
+		wg.Add(1)
+		go func(c *client.Client) {
+			defer wg.Done()
+			for event := range c.Events() {
+				var msg simMessage
+				if err := event.Decode(&msg); err != nil || msg.SimSeq == 0 {
+					continue // Not benchmark traffic
+				}
+				latency := time.Since(start) - time.Duration(msg.SimSent)
+				results.update(func(r *benchResults) {
+					r.received++
+					r.relayLatencies = append(r.relayLatencies, latency)
+				})
+			}
+			// Err is nil if the benchmark closed the connection itself.
+			if c.Err() != nil {
+				results.update(func(r *benchResults) { r.disconnects++ })
+			}
+		}(receiver)
+	}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / benchRate))
+	deadline := time.Now().Add(benchDuration)
+	for seq := int64(1); time.Now().Before(deadline); seq++ {
+		<-ticker.C
+		err := sender.Send(map[string]interface{}{
+			"type":     "key",
+			"vk_code":  65,
+			"pressed":  true,
+			"sim_seq":  seq,
+			"sim_sent": int64(time.Since(start)),
+		})
+		if err != nil {
+			results.update(func(r *benchResults) { r.disconnects++ })
+			break
+		}
+		results.update(func(r *benchResults) {
+			r.sent++
+			r.expected += len(receivers)
+		})
+	}
+	ticker.Stop()
+
+	// Give messages still being relayed a chance to arrive before they're counted as dropped.
+	time.Sleep(time.Second)
+	for _, receiver := range receivers {
+		receiver.Close()
+	}
+	wg.Wait()
+}
+
+// benchKeepAliveInterval is how often synthetic clients send pings.
+const benchKeepAliveInterval = time.Second
+
+// benchKeepAlive pings the server from a client until it is closed,
+// so clients that only receive aren't timed out.
+func benchKeepAlive(c *client.Client) {
+	ticker := time.NewTicker(benchKeepAliveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := c.Send(map[string]interface{}{"type": "ping"}); err != nil {
+			return
+		}
+	}
+}
+
+// benchJoin connects a synthetic client to the server, and joins it to a channel, recording how long each step took.
+// Events received after the join completed are left for the caller.
+func benchJoin(host, channel, connectionType string, results *benchResults) (*client.Client, error) {
+	connectStart := time.Now()
+	conn, err := dialRemote(host)
+	if err != nil {
+		results.update(func(r *benchResults) { r.connectErrors++ })
+		return nil, err
+	}
+	joinStart := time.Now()
+	results.update(func(r *benchResults) { r.connectLatencies = append(r.connectLatencies, joinStart.Sub(connectStart)) })
+
+	c := client.New(conn)
+	fail := func(err error) (*client.Client, error) {
+		c.Close()
+		results.update(func(r *benchResults) { r.joinErrors++ })
+		return nil, errors.Wrap(err, "Join channel")
+	}
+	if err := c.JoinChannel(channel, connectionType); err != nil {
+		return fail(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for event := range c.Events() {
+		if err := event.AsError(); err != nil {
+			return fail(err)
+		}
+		if event.Type == "channel_joined" {
+			latency := time.Since(joinStart)
+			results.update(func(r *benchResults) { r.joinLatencies = append(r.joinLatencies, latency) })
+			go benchKeepAlive(c)
+			return c, nil
+		}
+	}
+	return fail(c.Err())
+}
+
+// printBenchReport prints the latencies and error counts of a load test.
+func printBenchReport(results *benchResults, elapsed time.Duration) {
+	results.lock.Lock()
+	defer results.lock.Unlock()
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "LATENCY\tCOUNT\tMIN\tAVG\tP50\tP95\tP99\tMAX\t")
+	for _, row := range []struct {
+		name      string
+		latencies []time.Duration
+	}{
+		{"connect", results.connectLatencies},
+		{"join", results.joinLatencies},
+		{"relay", results.relayLatencies},
+	} {
+		lat := row.latencies
+		sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			row.name, len(lat), latencyAt(lat, 0), latencyAvg(lat), latencyAt(lat, 0.5), latencyAt(lat, 0.95), latencyAt(lat, 0.99), latencyAt(lat, 1))
+	}
+	w.Flush()
+
+	fmt.Println()
+	fmt.Printf("Connect errors: %d of %d (%s)\n", results.connectErrors, benchClients, percent(results.connectErrors, benchClients))
+	connected := benchClients - results.connectErrors
+	fmt.Printf("Join errors: %d of %d (%s)\n", results.joinErrors, connected, percent(results.joinErrors, connected))
+	fmt.Printf("Disconnects: %d\n", results.disconnects)
+	dropped := results.expected - results.received
+	fmt.Printf("Messages sent: %d, relayed: %d of %d, dropped: %d (%s)\n",
+		results.sent, results.received, results.expected, dropped, percent(dropped, results.expected))
+	fmt.Printf("Relay throughput: %.1f messages per second\n", float64(results.received)/elapsed.Seconds())
+}
+
+// percent formats n as a percentage of total.
+func percent(n, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f%%", 100*float64(n)/float64(total))
+}
@@ -0,0 +1,90 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/n0ot/nvremoted/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+// blocklistCmd represents the blocklist command
+var blocklistCmd = &cobra.Command{
+	Use:   "blocklist",
+	Short: "Manage the channel blocklist of a running NVRemoted server",
+	Long: `blocklist manages patterns of channel names that clients may not join.
+
+Patterns are globs, where * matches anything and ? matches any one character.
+Prefix a pattern with "re:" to use a regular expression instead.
+Changes last until the server is restarted; add patterns to server.blockedChannels in the configuration to keep them.
+
+If the host is omitted, the local nvremoted server will be used.`,
+}
+
+var blocklistListCmd = &cobra.Command{
+	Use:   "list [host]",
+	Short: "List blocked channel patterns",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var blocked []server.BlockedChannel
+		if err := adminRequest(remoteHost(args), "blocked_channels", nil, &blocked); err != nil {
+			return err
+		}
+		printBlocklist(blocked)
+		return nil
+	},
+}
+
+var blocklistAddCmd = &cobra.Command{
+	Use:   "add <pattern> [host]",
+	Short: "Block channels matching a pattern",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var blocked []server.BlockedChannel
+		if err := adminRequest(remoteHost(args[1:]), "block_channel", server.ChannelPatternArgs{Pattern: args[0]}, &blocked); err != nil {
+			return err
+		}
+		printBlocklist(blocked)
+		return nil
+	},
+}
+
+var blocklistRemoveCmd = &cobra.Command{
+	Use:   "remove <pattern> [host]",
+	Short: "Unblock channels matching a pattern",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var blocked []server.BlockedChannel
+		if err := adminRequest(remoteHost(args[1:]), "unblock_channel", server.ChannelPatternArgs{Pattern: args[0]}, &blocked); err != nil {
+			return err
+		}
+		printBlocklist(blocked)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(blocklistCmd)
+	for _, cmd := range []*cobra.Command{blocklistListCmd, blocklistAddCmd, blocklistRemoveCmd} {
+		blocklistCmd.AddCommand(cmd)
+		addRemoteFlags(cmd)
+	}
+}
+
+func printBlocklist(blocked []server.BlockedChannel) {
+	if len(blocked) == 0 {
+		fmt.Println("No channels are blocked.")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PATTERN\tREJECTED JOINS")
+	for _, b := range blocked {
+		fmt.Fprintf(w, "%s\t%d\n", b.Pattern, b.Rejected)
+	}
+	w.Flush()
+}
@@ -0,0 +1,37 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+
+	"github.com/n0ot/nvremoted/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+// broadcastCmd represents the broadcast command
+var broadcastCmd = &cobra.Command{
+	Use:   "broadcast <message> [host]",
+	Short: "Show an announcement to every client of a running NVRemoted server",
+	Long: `broadcast sends a message to every connected client, such as "server restarting in 10 minutes".
+Clients show it like a message of the day, even if they've seen it before.
+Clients that are too far behind on their output miss the announcement.
+
+If the host is omitted, the local nvremoted server will be used.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var result server.BroadcastResult
+		if err := adminRequest(remoteHost(args[1:]), "broadcast", server.BroadcastArgs{Message: args[0]}, &result); err != nil {
+			return err
+		}
+		fmt.Printf("Sent to %d client(s).\n", result.Clients)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(broadcastCmd)
+	addRemoteFlags(broadcastCmd)
+}
@@ -0,0 +1,136 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	certgenHosts  []string
+	certgenOutDir string
+	certgenDays   int
+	certgenForce  bool
+)
+
+// certgenCmd represents the certgen command
+var certgenCmd = &cobra.Command{
+	Use:   "certgen",
+	Short: "Create a self-signed TLS certificate",
+	Long: `certgen creates a private key, and a self-signed certificate for the given hosts,
+which can be used by the TLS listener.
+
+The key and certificate are written to cert.key and cert.pem in the output directory,
+which are where tls.keyFile and tls.certFile point by default.
+NVDA Remote clients don't verify the server's certificate, so a self-signed certificate is enough to get started,
+but one from a trusted CA, such as Let's Encrypt, is better if you have a domain name.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(certgenHosts) == 0 {
+			return errors.New("At least one host is required; use --host")
+		}
+		if certgenDays <= 0 {
+			return errors.New("--days must be greater than 0")
+		}
+
+		outDir := os.ExpandEnv(certgenOutDir)
+		certFile := filepath.Join(outDir, "cert.pem")
+		keyFile := filepath.Join(outDir, "cert.key")
+		if !certgenForce {
+			for _, path := range []string{certFile, keyFile} {
+				if _, err := os.Stat(path); err == nil {
+					return errors.Errorf("%s already exists; use --force to overwrite it", path)
+				}
+			}
+		}
+
+		certPEM, keyPEM, err := generateCertificate(certgenHosts, time.Duration(certgenDays)*24*time.Hour)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(outDir, 0700); err != nil {
+			return errors.Wrap(err, "Create output directory")
+		}
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return errors.Wrap(err, "Write private key")
+		}
+		if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+			return errors.Wrap(err, "Write certificate")
+		}
+
+		fmt.Printf("Wrote certificate to %s\n", certFile)
+		fmt.Printf("Wrote private key to %s\n", keyFile)
+		fmt.Printf("Set tls.certFile and tls.keyFile to these paths, if they aren't the defaults.\n")
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(certgenCmd)
+	certgenCmd.Flags().StringSliceVar(&certgenHosts, "host", nil, "Host name or IP address the certificate is for; can be given more than once")
+	certgenCmd.Flags().StringVar(&certgenOutDir, "out-dir", "$CONFDIR/certificates", "Directory to write cert.pem and cert.key to")
+	certgenCmd.Flags().IntVar(&certgenDays, "days", 3650, "Number of days the certificate is valid for")
+	certgenCmd.Flags().BoolVar(&certgenForce, "force", false, "Overwrite an existing certificate and key")
+}
+
+// generateCertificate creates an ECDSA P-256 key, and a self-signed certificate for hosts that is valid for validFor.
+// The certificate and key are returned PEM encoded.
+func generateCertificate(hosts []string, validFor time.Duration) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Generate private key")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Generate serial number")
+	}
+
+	notBefore := time.Now().Add(-time.Hour) // Allow for clock skew
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"NVRemoted"}},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Create certificate")
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Encode private key")
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,73 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/n0ot/nvremoted/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+// channelsCmd represents the channels command
+var channelsCmd = &cobra.Command{
+	Use:   "channels [host]",
+	Short: "List the active channels on a running NVRemoted server",
+	Long: `channels lists the channels on an NVRemoted server,
+with the number of members of each connection type, how long each channel has existed,
+and the bytes sent to its members this hour and today, which count against channel quotas.
+
+If the host is omitted, the local nvremoted server will be queried.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var channels []server.ChannelInfo
+		if err := adminRequest(remoteHost(args), "channels", nil, &channels); err != nil {
+			return err
+		}
+		if len(channels) == 0 {
+			fmt.Println("No channels are active.")
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "CHANNEL\tMEMBERS\tUPTIME\tE2E\tHOUR\tTODAY")
+		for _, c := range channels {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%s\n", c.Name, formatMembers(c.Members), formatUptime(c.Created), c.E2e,
+				formatBytes(uint64(c.HourBytes)), formatBytes(uint64(c.DayBytes)))
+		}
+		return w.Flush()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(channelsCmd)
+	addRemoteFlags(channelsCmd)
+}
+
+// formatMembers formats member counts by connection type, such as "1 master, 2 slave".
+func formatMembers(members map[string]int) string {
+	if len(members) == 0 {
+		return "none"
+	}
+	types := make([]string, 0, len(members))
+	for connectionType := range members {
+		types = append(types, connectionType)
+	}
+	sort.Strings(types)
+	counts := make([]string, len(types))
+	for i, connectionType := range types {
+		counts[i] = fmt.Sprintf("%d %s", members[connectionType], connectionType)
+	}
+	return strings.Join(counts, ", ")
+}
+
+// formatUptime formats the time since t, to the second.
+func formatUptime(t time.Time) string {
+	return time.Since(t).Round(time.Second).String()
+}
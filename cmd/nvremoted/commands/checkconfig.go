@@ -0,0 +1,457 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// checkconfigCmd represents the checkconfig command
+var checkconfigCmd = &cobra.Command{
+	Use:   "checkconfig",
+	Short: "Check the configuration for errors without starting the server",
+	Long: `checkconfig loads the configuration the start command would use, and checks it for problems:
+options with the wrong type or unknown names, files that don't exist or can't be read,
+addresses that can't be bound, and invalid TLS settings.
+
+Every problem found is printed, with a suggested fix.
+If the server is already running, the addresses it listens on will be reported as in use.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var problems configProblems
+		problems.checkTypes()
+		if len(problems.errors()) == 0 {
+			// The remaining checks read options with viper's getters, which would silently convert wrongly typed values.
+			problems.checkServer()
+			problems.checkLog()
+			problems.checkFiles()
+			problems.checkTLS(cmd)
+			problems.checkAddrs(cmd)
+		}
+
+		fmt.Printf("Checked %s\n", viper.ConfigFileUsed())
+		for _, problem := range problems {
+			if problem.key == "" {
+				fmt.Printf("%s: %s\n", problem.severity, problem.message)
+			} else {
+				fmt.Printf("%s: %s: %s\n", problem.severity, problem.key, problem.message)
+			}
+			if problem.fix != "" {
+				fmt.Printf("    Fix: %s\n", problem.fix)
+			}
+		}
+		if n := len(problems.errors()); n > 0 {
+			return errors.Errorf("Errors found in the configuration: %d", n)
+		}
+		if len(problems) == 0 {
+			fmt.Println("No problems found")
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(checkconfigCmd)
+}
+
+// Severities of configuration problems.
+const (
+	configError   = "error"
+	configWarning = "warning"
+)
+
+type configProblem struct {
+	severity string
+	key      string
+	message  string
+	fix      string // How to fix the problem, if there is one
+}
+
+type configProblems []configProblem
+
+func (problems *configProblems) add(severity, key, message, fix string) {
+	*problems = append(*problems, configProblem{severity, key, message, fix})
+}
+
+func (problems configProblems) errors() configProblems {
+	var errs configProblems
+	for _, problem := range problems {
+		if problem.severity == configError {
+			errs = append(errs, problem)
+		}
+	}
+	return errs
+}
+
+// Types of configuration options.
+const (
+	optionString  = "a string"
+	optionBool    = "a boolean"
+	optionInt     = "an integer"
+	optionFloat   = "a number"
+	optionList    = "a list of strings"
+	optionIntList = "a list of integers"
+	optionTables  = "an array of tables"
+)
+
+// configOptions are the types of every configuration option NVRemoted reads.
+var configOptions = map[string]string{
+	"server.bind":                      optionString,
+	"server.bindFallbacks":             optionList,
+	"server.bindRetries":               optionInt,
+	"server.bindRetryDelay":            optionInt,
+	"server.hostname":                  optionString,
+	"server.timeBetweenPings":          optionInt,
+	"server.pingsUntilTimeout":         optionInt,
+	"server.writeTimeout":              optionInt,
+	"server.reverseDns":                optionBool,
+	"server.privacy":                   optionBool,
+	"server.privacyKey":                optionString,
+	"server.randomClientIds":           optionBool,
+	"server.reverseDnsTimeout":         optionInt,
+	"server.reverseDnsCacheTtl":        optionInt,
+	"server.flushSize":                 optionInt,
+	"server.flushDelay":                optionInt,
+	"server.queueSize":                 optionInt,
+	"server.maxConnections":            optionInt,
+	"server.maxClients":                optionInt,
+	"server.maxChannels":               optionInt,
+	"server.maxAcceptRate":             optionFloat,
+	"server.channelCreationsPerMinute": optionInt,
+	"server.channelCreationsPerHour":   optionInt,
+	"server.compression":               optionList,
+	"server.slowClientPolicy":          optionString,
+	"server.masterPolicy":              optionString,
+	"server.relayMode":                 optionString,
+	"server.sessionGrace":              optionInt,
+	"server.dispatchShards":            optionInt,
+	"server.rateLimit":                 optionFloat,
+	"server.rateLimitBurst":            optionInt,
+	"server.rateLimitKickAfter":        optionInt,
+	"server.maxMessageDepth":           optionInt,
+	"server.maxMessageKeys":            optionInt,
+	"server.channelQuotaHourlySoft":    optionInt,
+	"server.channelQuotaHourlyHard":    optionInt,
+	"server.channelQuotaDailySoft":     optionInt,
+	"server.channelQuotaDailyHard":     optionInt,
+	"server.e2eOnly":                   optionBool,
+	"server.advertiseCapabilities":     optionBool,
+	"server.protocolVersions":          optionIntList,
+	"server.allowedChannels":           optionList,
+	"server.blockedChannels":           optionList,
+	"server.statsPassword":             optionString,
+	"server.banFile":                   optionString,
+	"server.abuseStrikes":              optionInt,
+	"server.abuseWindow":               optionInt,
+	"server.abuseBanDuration":          optionInt,
+	"server.ipAllowlistFile":           optionString,
+	"server.ipDenylistFile":            optionString,
+	"server.ipDenylistUrls":            optionList,
+	"server.ipDenylistInterval":        optionInt,
+	"server.controlSocket":             optionString,
+	"server.controlSocketMode":         optionString,
+	"server.healthBind":                optionString,
+	"server.pprof":                     optionBool,
+	"server.dashboard":                 optionBool,
+	"server.statsd":                    optionString,
+	"server.statsdPrefix":              optionString,
+	"server.statsdInterval":            optionInt,
+	"server.historyFile":               optionString,
+	"server.historyInterval":           optionInt,
+	"server.historyRetention":          optionInt,
+	"server.restartDrainTimeout":       optionInt,
+	"server.cluster":                   optionString,
+	"server.clusterNode":               optionString,
+	"server.clusterPrefix":             optionString,
+	"server.clusterHeartbeat":          optionInt,
+	"server.clusterCaFile":             optionString,
+	"server.clusterCertFile":           optionString,
+	"server.clusterKeyFile":            optionString,
+	"server.webhooks":                  optionList,
+	"server.listeners":                 optionTables,
+	"server.channelPasswords":          optionTables,
+	"server.tokens":                    optionTables,
+	"server.authTokens":                optionTables,
+	"server.authUrl":                   optionString,
+	"nvremoted.motdFile":               optionString,
+	"nvremoted.motdReloadInterval":     optionInt,
+	"nvremoted.motdBroadcast":          optionBool,
+	"nvremoted.motdUrl":                optionString,
+	"nvremoted.motdCacheFile":          optionString,
+	"nvremoted.motdRefreshInterval":    optionInt,
+	"log.format":                       optionString,
+	"log.level":                        optionString,
+	"log.output":                       optionString,
+	"log.securityOutput":               optionString,
+	"log.maxSize":                      optionInt,
+	"log.maxAge":                       optionInt,
+	"log.maxBackups":                   optionInt,
+	"tracing.enabled":                  optionBool,
+	"tracing.endpoint":                 optionString,
+	"tracing.insecure":                 optionBool,
+	"tracing.sampleRatio":              optionFloat,
+	"tls.useTls":                       optionBool,
+	"tls.certFile":                     optionString,
+	"tls.keyFile":                      optionString,
+	"tls.reloadInterval":               optionInt,
+	"tls.minVersion":                   optionString,
+	"tls.maxVersion":                   optionString,
+	"tls.cipherSuites":                 optionList,
+	"tls.acmeDomains":                  optionList,
+	"tls.acmeEmail":                    optionString,
+	"tls.acmeCacheDir":                 optionString,
+	"tls.acmeHttpBind":                 optionString,
+	"tls.acmeDirectory":                optionString,
+}
+
+// checkTypes checks that every option is known, and has the right type.
+func (problems *configProblems) checkTypes() {
+	// viper lowercases keys, so look options up by their lowercased names.
+	names := make(map[string]string, len(configOptions))
+	for name := range configOptions {
+		names[strings.ToLower(name)] = name
+	}
+
+	for _, key := range viper.AllKeys() {
+		name, ok := names[key]
+		if !ok {
+			problems.add(configWarning, key, "unknown option; it will be ignored", "Check its spelling and section against examples/nvremoted.toml")
+			continue
+		}
+		want := configOptions[name]
+		if !hasOptionType(viper.Get(key), want) {
+			problems.add(configError, name, fmt.Sprintf("must be %s, but is %T", want, viper.Get(key)), "")
+		}
+	}
+}
+
+func hasOptionType(value interface{}, want string) bool {
+	switch v := value.(type) {
+	case string:
+		return want == optionString
+	case bool:
+		return want == optionBool
+	case int, int64:
+		return want == optionInt || want == optionFloat
+	case float64:
+		return want == optionFloat
+	case []string:
+		return want == optionList
+	case []int:
+		return want == optionIntList
+	case []interface{}:
+		// Empty arrays, and arrays read from the config file, aren't typed.
+		for _, item := range v {
+			if _, ok := item.(string); ok && want == optionList {
+				continue
+			}
+			if _, ok := item.(int64); ok && want == optionIntList {
+				continue
+			}
+			if _, ok := item.(map[string]interface{}); ok && want == optionTables {
+				continue
+			}
+			return false
+		}
+		return want == optionList || want == optionIntList || want == optionTables
+	case []map[string]interface{}:
+		return want == optionTables
+	}
+	return false
+}
+
+// checkServer checks the options the server is created from.
+func (problems *configProblems) checkServer() {
+	if _, err := newServer(logrus.New()); err != nil {
+		// The error already names the option.
+		problems.add(configError, "", err.Error(), "")
+	}
+	for _, key := range []string{"server.timeBetweenPings", "server.pingsUntilTimeout", "server.writeTimeout", "server.reverseDnsTimeout", "server.reverseDnsCacheTtl", "server.flushSize", "server.flushDelay", "server.queueSize", "server.maxConnections", "server.maxClients", "server.maxChannels", "server.channelCreationsPerMinute", "server.channelCreationsPerHour", "server.clusterHeartbeat", "server.ipDenylistInterval", "server.abuseStrikes", "server.abuseWindow", "server.abuseBanDuration", "server.sessionGrace", "server.maxMessageDepth", "server.maxMessageKeys"} {
+		if viper.GetInt(key) < 0 {
+			problems.add(configError, key, "is negative", "Set it to 0 or more")
+		}
+	}
+	if strings.HasPrefix(viper.GetString("server.authUrl"), "http:") {
+		problems.add(configWarning, "server.authUrl", "sends clients' auth tokens unencrypted", "Use an https URL, unless the auth service runs on this machine")
+	}
+	if _, err := strconv.ParseUint(viper.GetString("server.controlSocketMode"), 8, 32); err != nil {
+		problems.add(configError, "server.controlSocketMode", err.Error(), `Set it to an octal file mode, such as "0600"`)
+	}
+	if viper.GetBool("tracing.enabled") {
+		if ratio := viper.GetFloat64("tracing.sampleRatio"); ratio < 0 || ratio > 1 {
+			problems.add(configError, "tracing.sampleRatio", fmt.Sprintf("%g is not between 0 and 1", ratio), "")
+		}
+	}
+}
+
+// checkLog checks the log section.
+func (problems *configProblems) checkLog() {
+	if format := viper.GetString("log.format"); format != "text" && format != "json" {
+		problems.add(configError, "log.format", fmt.Sprintf("unknown format %q", format), `Set it to "text" or "json"`)
+	}
+	if _, err := logrus.ParseLevel(viper.GetString("log.level")); err != nil {
+		problems.add(configError, "log.level", err.Error(), "Set it to one of trace, debug, info, warning, error, fatal, or panic")
+	}
+	switch output := viper.GetString("log.output"); output {
+	case "", "stderr", "stdout", "syslog":
+	default:
+		problems.checkDir("log.output", os.ExpandEnv(output))
+	}
+	switch output := viper.GetString("log.securityOutput"); output {
+	case "", "stderr", "stdout", "syslog":
+	default:
+		problems.checkDir("log.securityOutput", os.ExpandEnv(output))
+	}
+}
+
+// checkFiles checks that files the server reads exist,
+// and that the directories of files it writes exist.
+func (problems *configProblems) checkFiles() {
+	if path := os.ExpandEnv(viper.GetString("nvremoted.motdFile")); path != "" && viper.GetString("nvremoted.motdUrl") == "" {
+		if err := checkReadable(path); err != nil {
+			problems.add(configWarning, "nvremoted.motdFile", err.Error(), "Create the file, or set nvremoted.motdFile to an empty string to have no MOTD")
+		}
+	}
+	for _, key := range []string{"server.ipAllowlistFile", "server.ipDenylistFile"} {
+		if path := os.ExpandEnv(viper.GetString(key)); path != "" {
+			if err := checkReadable(path); err != nil {
+				problems.add(configError, key, err.Error(), fmt.Sprintf("Create the file, or set %s to an empty string", key))
+			}
+		}
+	}
+	for _, key := range []string{"server.banFile", "server.historyFile", "server.controlSocket", "nvremoted.motdCacheFile"} {
+		if path := os.ExpandEnv(viper.GetString(key)); path != "" {
+			problems.checkDir(key, path)
+		}
+	}
+}
+
+// checkDir checks that the directory a file will be written to exists.
+func (problems *configProblems) checkDir(key, path string) {
+	dir := filepath.Dir(path)
+	info, err := os.Stat(dir)
+	if err != nil {
+		problems.add(configError, key, err.Error(), fmt.Sprintf("Create the directory %s", dir))
+	} else if !info.IsDir() {
+		problems.add(configError, key, fmt.Sprintf("%s is not a directory", dir), "")
+	}
+}
+
+// checkReadable checks that a file exists and can be read.
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// checkTLS checks the certificate and key, if any listener uses TLS and they aren't obtained with ACME.
+func (problems *configProblems) checkTLS(cmd *cobra.Command) {
+	useTLS := viper.GetBool("tls.useTls")
+	if listeners, err := listenConfigs(cmd); err == nil && listeners != nil {
+		useTLS = false
+		for _, listener := range listeners {
+			useTLS = useTLS || listener.TLS
+		}
+	}
+	if !useTLS {
+		problems.add(configWarning, "tls.useTls", "TLS is disabled", "NVDA Remote clients only connect over TLS; enable it unless TLS is terminated in front of NVRemoted")
+		return
+	}
+	if len(viper.GetStringSlice("tls.acmeDomains")) > 0 {
+		if viper.GetString("tls.acmeEmail") == "" {
+			problems.add(configWarning, "tls.acmeEmail", "not set", "Set an email address, so Let's Encrypt can tell you about problems with your certificates")
+		}
+		problems.checkDir("tls.acmeCacheDir", filepath.Join(os.ExpandEnv(viper.GetString("tls.acmeCacheDir")), "certificate"))
+		return
+	}
+
+	certFile := os.ExpandEnv(viper.GetString("tls.certFile"))
+	keyFile := os.ExpandEnv(viper.GetString("tls.keyFile"))
+	failed := false
+	for _, file := range []struct{ key, path string }{{"tls.certFile", certFile}, {"tls.keyFile", keyFile}} {
+		if file.path == "" {
+			problems.add(configError, file.key, "not set", "Set it to the path of a PEM file, or create a self-signed certificate with `nvremoted certgen`")
+			failed = true
+		} else if err := checkReadable(file.path); err != nil {
+			problems.add(configError, file.key, err.Error(), "Point it at a readable PEM file, or create a self-signed certificate with `nvremoted certgen`")
+			failed = true
+		}
+	}
+	if failed {
+		return
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		problems.add(configError, "tls.certFile", err.Error(), "Check that tls.certFile and tls.keyFile hold a PEM certificate and its private key")
+		return
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		problems.add(configError, "tls.certFile", err.Error(), "Replace the certificate")
+		return
+	}
+	if time.Now().After(leaf.NotAfter) {
+		problems.add(configError, "tls.certFile", fmt.Sprintf("the certificate expired on %s", leaf.NotAfter.Format(time.RFC1123)), "Renew the certificate")
+	} else if time.Now().Before(leaf.NotBefore) {
+		problems.add(configError, "tls.certFile", fmt.Sprintf("the certificate isn't valid until %s", leaf.NotBefore.Format(time.RFC1123)), "Check the system clock")
+	}
+}
+
+// checkAddrs checks that every address the server listens on is valid, and can be bound.
+func (problems *configProblems) checkAddrs(cmd *cobra.Command) {
+	type addr struct {
+		key, addr string
+	}
+	var addrs []addr
+	listeners, err := listenConfigs(cmd)
+	if err != nil {
+		problems.add(configError, "server.listeners", err.Error(), "")
+	} else if listeners != nil {
+		for _, listener := range listeners {
+			addrs = append(addrs, addr{"server.listeners", listener.Addr})
+		}
+	} else {
+		addrs = append(addrs, addr{"server.bind", viper.GetString("server.bind")})
+	}
+	for _, key := range []string{"server.healthBind", "tls.acmeHttpBind"} {
+		if a := viper.GetString(key); a != "" {
+			addrs = append(addrs, addr{key, a})
+		}
+	}
+
+	for _, a := range addrs {
+		if _, _, err := net.SplitHostPort(a.addr); err != nil {
+			problems.add(configError, a.key, err.Error(), `Use "host:port", such as ":6837"`)
+			continue
+		}
+		listener, err := net.Listen("tcp", a.addr)
+		if err != nil {
+			problems.add(configError, a.key, fmt.Sprintf("can't bind %s: %s", a.addr, err),
+				"Stop whatever is using the port, or choose another; if NVRemoted is already running, this is expected")
+			continue
+		}
+		listener.Close()
+	}
+	if statsd := viper.GetString("server.statsd"); statsd != "" {
+		if _, _, err := net.SplitHostPort(statsd); err != nil {
+			problems.add(configError, "server.statsd", err.Error(), `Use "host:port", such as "127.0.0.1:8125"`)
+		}
+	}
+}
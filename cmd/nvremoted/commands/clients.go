@@ -0,0 +1,85 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/n0ot/nvremoted/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+// clientsCmd represents the clients command
+var clientsCmd = &cobra.Command{
+	Use:   "clients [host]",
+	Short: "List the clients connected to a running NVRemoted server",
+	Long: `clients lists the clients connected to an NVRemoted server,
+with the channel and connection type of those who have joined one, how long they've been connected, and where from.
+If the server authenticates clients, the annotations its authenticator attached to them, such as the auth token they joined with, are also shown.
+If any client has sent messages over the server's message limits, the number each has sent is shown too.
+The IDs can be given to kick.
+
+If the host is omitted, the local nvremoted server will be queried.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var clients []server.ClientInfo
+		if err := adminRequest(remoteHost(args), "clients", nil, &clients); err != nil {
+			return err
+		}
+		// Annotations are only shown if the server has an authenticator that attaches them,
+		// and limit violations and round trip times only if there are any.
+		annotated, violated, measured := false, false, false
+		for _, c := range clients {
+			annotated = annotated || len(c.Annotations) > 0
+			violated = violated || c.LimitViolations > 0
+			measured = measured || c.AvgRTT > 0
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprint(w, "ID\tCHANNEL\tTYPE\tUPTIME\tREMOTE HOST")
+		if annotated {
+			fmt.Fprint(w, "\tANNOTATIONS")
+		}
+		if violated {
+			fmt.Fprint(w, "\tLIMIT VIOLATIONS")
+		}
+		if measured {
+			fmt.Fprint(w, "\tRTT (AVG/MAX)")
+		}
+		fmt.Fprintln(w)
+		for _, c := range clients {
+			channel, connectionType := c.Channel, c.ConnectionType
+			if channel == "" {
+				channel, connectionType = "-", "-"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s", c.ID, channel, connectionType, formatUptime(c.Connected), c.RemoteHost)
+			if annotated {
+				annotations := c.Annotations.String()
+				if annotations == "" {
+					annotations = "-"
+				}
+				fmt.Fprintf(w, "\t%s", annotations)
+			}
+			if violated {
+				fmt.Fprintf(w, "\t%d", c.LimitViolations)
+			}
+			if measured {
+				rtt := "-"
+				if c.AvgRTT > 0 {
+					rtt = fmt.Sprintf("%s/%s", formatRTT(c.AvgRTT), formatRTT(c.MaxRTT))
+				}
+				fmt.Fprintf(w, "\t%s", rtt)
+			}
+			fmt.Fprintln(w)
+		}
+		return w.Flush()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(clientsCmd)
+	addRemoteFlags(clientsCmd)
+}
@@ -0,0 +1,130 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the NVRemoted configuration",
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show [start flags]",
+	Short: "Print the effective configuration",
+	Long: `show prints the configuration the start command would use,
+after merging defaults, the config file, and any start flags given to show,
+with the source of each value.
+
+Passwords are masked. Environment variables aren't read as options,
+but they are expanded in paths, and the expanded paths are shown.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file := viper.New()
+		file.SetConfigFile(viper.ConfigFileUsed())
+		if err := file.ReadInConfig(); err != nil {
+			return errors.Wrap(err, "Read config file")
+		}
+
+		fmt.Printf("# Effective configuration, loaded from %s\n", viper.ConfigFileUsed())
+		keys := viper.AllKeys()
+		sort.Strings(keys)
+		section := ""
+		for _, key := range keys {
+			keySection, name := "", key
+			if i := strings.LastIndex(key, "."); i >= 0 {
+				keySection, name = key[:i], key[i+1:]
+			}
+			if keySection != section {
+				section = keySection
+				fmt.Printf("\n[%s]\n", section)
+			}
+
+			value := viper.Get(key)
+			source := configSource(key, file)
+			// --disable-tls isn't bound to tls.useTls, because it inverts it.
+			if key == "tls.usetls" && disableTLS {
+				value = false
+				source = "flag --disable-tls"
+			}
+			if s, ok := value.(string); ok && strings.Contains(s, "$") {
+				source += fmt.Sprintf("; expands to %q", os.ExpandEnv(s))
+			}
+			fmt.Printf("%s = %s  # %s\n", name, formatConfigValue(key, value), source)
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configShowCmd)
+}
+
+// configSource describes where the effective value of a config key came from.
+// file holds only the config file's values.
+func configSource(key string, file *viper.Viper) string {
+	if flag := startFlags[key]; flag != nil {
+		if flag.Changed {
+			return "flag --" + flag.Name
+		}
+		if !file.IsSet(key) {
+			return "default of flag --" + flag.Name
+		}
+	}
+	if file.IsSet(key) {
+		return "config file"
+	}
+	return "default"
+}
+
+// formatConfigValue formats a config value as it would be written in TOML, masking secrets.
+func formatConfigValue(key string, value interface{}) string {
+	if strings.Contains(key, "password") {
+		if s, ok := value.(string); ok && s != "" {
+			return `"********"`
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return strconv.Quote(v)
+	case []string:
+		quoted := make([]string, len(v))
+		for i, s := range v {
+			quoted[i] = strconv.Quote(s)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		formatted := make([]string, len(names))
+		for i, name := range names {
+			formatted[i] = name + " = " + formatConfigValue(name, v[name])
+		}
+		return "{" + strings.Join(formatted, ", ") + "}"
+	case []interface{}:
+		formatted := make([]string, len(v))
+		for i, item := range v {
+			formatted[i] = formatConfigValue(key, item)
+		}
+		return "[" + strings.Join(formatted, ", ") + "]"
+	}
+	return fmt.Sprint(value)
+}
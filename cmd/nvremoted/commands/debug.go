@@ -0,0 +1,216 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/n0ot/nvremoted/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// debugCmd represents the debug command
+var debugCmd = &cobra.Command{
+	Use:   "debug",
+	Short: "Diagnose problems with an NVRemoted server",
+}
+
+// debugGoroutinesCmd represents the debug goroutines command
+var debugGoroutinesCmd = &cobra.Command{
+	Use:   "goroutines [host]",
+	Short: "Print goroutine counts from an NVRemoted server",
+	Long: `goroutines prints the number of goroutines running in an NVRemoted server,
+grouped by the function that started them.
+
+Counts that don't add up, such as clients with only one of their two goroutines still running,
+or goroutines growing while clients and channels don't, are flagged as possible leaks.
+
+If the host is omitted, the local nvremoted server will be queried.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var report server.GoroutineReport
+		if err := adminRequest(remoteHost(args), "goroutines", nil, &report); err != nil {
+			return err
+		}
+
+		fmt.Printf("Goroutines: %d\nConnections: %d\nChannels: %d\n\n", report.Total, report.Connections, report.Channels)
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "COUNT\tFUNCTION")
+		for _, count := range report.ByFunction {
+			fmt.Fprintf(w, "%d\t%s\n", count.Count, count.Function)
+		}
+		w.Flush()
+
+		if len(report.Warnings) > 0 {
+			fmt.Println()
+			for _, warning := range report.Warnings {
+				fmt.Printf("Warning: %s\n", warning)
+			}
+		}
+		return nil
+	},
+}
+
+var debugChannelDuration time.Duration
+
+// debugChannelCmd represents the debug channel command
+var debugChannelCmd = &cobra.Command{
+	Use:   "channel <name> [host]",
+	Short: "Log activity on one channel in detail for a while",
+	Long: `channel makes an NVRemoted server log the activity on one channel in detail,
+including the type, size and relay timings of each message, and sessions being resumed.
+Message contents are never logged. Joins and parts are logged whether a channel is being debugged or not.
+
+Logging stops after the duration given with --for, or immediately if it is 0.
+The channel does not need to exist yet.
+
+If the host is omitted, the local nvremoted server will be used.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var result server.ChannelDebugResult
+		debugArgs := server.ChannelDebugArgs{
+			Channel:  args[0],
+			Duration: debugChannelDuration.String(),
+		}
+		if err := adminRequest(remoteHost(args[1:]), "debug_channel", debugArgs, &result); err != nil {
+			return err
+		}
+		if result.Until.IsZero() {
+			fmt.Printf("Stopped debug logging for %s\n", result.Channel)
+		} else {
+			fmt.Printf("Debug logging %s until %s\n", result.Channel, result.Until.Local().Format(time.RFC1123))
+		}
+		return nil
+	},
+}
+
+var debugClientDuration time.Duration
+
+// debugClientCmd represents the debug client command
+var debugClientCmd = &cobra.Command{
+	Use:   "client <client-id|address> [host]",
+	Short: "Log every message one client sends and receives for a while",
+	Long: `client makes an NVRemoted server log each message a client sends and is sent,
+with its type and size, whatever the server's log level, to debug a single session.
+Message contents are never logged.
+
+The client is given by its ID, or by an IP address or network, in CIDR notation,
+in which case the clients connected from it are logged, and so are those that connect from it until logging stops.
+
+Logging stops after the duration given with --for, or immediately if it is 0.
+
+If the host is omitted, the local nvremoted server will be used.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		debugArgs := server.ClientDebugArgs{Duration: debugClientDuration.String()}
+		target := args[0]
+		if id, err := strconv.ParseUint(args[0], 10, 64); err == nil {
+			debugArgs.ID = &id
+			target = "client " + args[0]
+		} else {
+			debugArgs.Addr = args[0]
+		}
+		var result server.ClientDebugResult
+		if err := adminRequest(remoteHost(args[1:]), "debug_client", debugArgs, &result); err != nil {
+			return err
+		}
+		if result.Until.IsZero() {
+			fmt.Printf("Stopped debug logging for %s\n", target)
+		} else {
+			fmt.Printf("Debug logging %s until %s\n", target, result.Until.Local().Format(time.RFC1123))
+		}
+		if len(result.Clients) > 0 {
+			ids := make([]string, len(result.Clients))
+			for i, id := range result.Clients {
+				ids[i] = strconv.FormatUint(id, 10)
+			}
+			fmt.Printf("Connected clients: %s\n", strings.Join(ids, ", "))
+		}
+		return nil
+	},
+}
+
+var debugDumpOutput string
+
+// debugDumpCmd represents the debug dump command
+var debugDumpCmd = &cobra.Command{
+	Use:   "dump [host]",
+	Short: "Dump a snapshot of an NVRemoted server's internal state as JSON, for bug reports",
+	Long: `dump prints a snapshot of an NVRemoted server's internal state as JSON,
+to attach to bug reports, such as about channels that are stuck.
+It includes each shard's queue, each channel's members, pending joins and queue depths,
+each client's queue and whether it is being disconnected, and the server's goroutine counts.
+
+The dump is sanitized so that it can be shared: clients' addresses are left out,
+and channels are identified by a keyed hash of their names, rather than by name.
+To find a channel in a dump, get the hash of its name with the channel-hash command.
+
+If the host is omitted, the local nvremoted server will be queried.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var dump server.StateDump
+		if err := adminRequest(remoteHost(args), "dump", nil, &dump); err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(dump, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "Encode state dump")
+		}
+		data = append(data, '\n')
+		if debugDumpOutput == "" {
+			_, err = os.Stdout.Write(data)
+			return err
+		}
+		if err := os.WriteFile(debugDumpOutput, data, 0600); err != nil {
+			return errors.Wrap(err, "Write state dump")
+		}
+		fmt.Printf("Wrote state dump to %s\n", debugDumpOutput)
+		return nil
+	},
+}
+
+// debugChannelHashCmd represents the debug channel-hash command
+var debugChannelHashCmd = &cobra.Command{
+	Use:   "channel-hash <name> [host]",
+	Short: "Print the hash identifying a channel in an NVRemoted server's dumps, and in privacy mode, its logs and stats",
+	Long: `channel-hash prints the hash an NVRemoted server identifies a channel by,
+in state dumps, and in its logs, stats and events when it is in privacy mode.
+Hashes are keyed with a secret, so only the server can work them out;
+unless server.privacyKey is set, they change whenever the server restarts.
+
+If the host is omitted, the local nvremoted server will be queried.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var result server.ChannelHashResult
+		if err := adminRequest(remoteHost(args[1:]), "channel_hash", server.ChannelHashArgs{Channel: args[0]}, &result); err != nil {
+			return err
+		}
+		fmt.Println(result.Hash)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(debugCmd)
+	debugCmd.AddCommand(debugGoroutinesCmd)
+	addRemoteFlags(debugGoroutinesCmd)
+	debugCmd.AddCommand(debugChannelCmd)
+	addRemoteFlags(debugChannelCmd)
+	debugChannelCmd.Flags().DurationVar(&debugChannelDuration, "for", 10*time.Minute, "how long to log the channel for")
+	debugCmd.AddCommand(debugClientCmd)
+	addRemoteFlags(debugClientCmd)
+	debugClientCmd.Flags().DurationVar(&debugClientDuration, "for", 10*time.Minute, "how long to log the client for")
+	debugCmd.AddCommand(debugDumpCmd)
+	addRemoteFlags(debugDumpCmd)
+	debugDumpCmd.Flags().StringVarP(&debugDumpOutput, "output", "o", "", "write the dump to this file, instead of printing it")
+	debugCmd.AddCommand(debugChannelHashCmd)
+	addRemoteFlags(debugChannelHashCmd)
+}
@@ -0,0 +1,275 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var doctorNTPServer string
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the environment NVRemoted runs in for problems",
+	Long: `doctor checks the configuration and environment of the local NVRemoted server,
+and suggests fixes for any problems found.
+
+The checks include configuration validity, the TLS certificate's expiry and chain,
+whether the server's port can be connected to, file descriptor limits, clock skew,
+and DNS for the host name in server.hostname.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		failed := false
+		for _, check := range doctorChecks() {
+			result := check.run()
+			fmt.Printf("[%s] %s: %s\n", result.status, check.name, result.detail)
+			if result.fix != "" {
+				fmt.Printf("       Fix: %s\n", result.fix)
+			}
+			if result.status == doctorFail {
+				failed = true
+			}
+		}
+		if failed {
+			return errors.New("Some checks failed")
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(doctorCmd)
+	doctorCmd.Flags().StringVar(&doctorNTPServer, "ntp-server", "pool.ntp.org", "NTP server to check the clock against")
+}
+
+// Statuses of doctor checks, padded to the same width.
+const (
+	doctorOK   = " OK "
+	doctorWarn = "WARN"
+	doctorFail = "FAIL"
+	doctorSkip = "SKIP"
+)
+
+type doctorCheck struct {
+	name string
+	run  func() doctorResult
+}
+
+type doctorResult struct {
+	status string
+	detail string
+	fix    string // How to fix the problem, if there is one
+}
+
+func doctorChecks() []doctorCheck {
+	return []doctorCheck{
+		{"Configuration", checkConfig},
+		{"TLS certificate", checkCertificate},
+		{"Server port", checkPort},
+		{"File descriptor limit", checkFileLimit},
+		{"Clock", checkClock},
+		{"DNS", checkDNS},
+	}
+}
+
+func checkConfig() doctorResult {
+	file := viper.ConfigFileUsed()
+	if _, err := newServer(logrus.New()); err != nil {
+		return doctorResult{doctorFail, err.Error(), fmt.Sprintf("Correct the option in %s", file)}
+	}
+	if _, _, err := net.SplitHostPort(viper.GetString("server.bind")); err != nil {
+		return doctorResult{doctorFail, fmt.Sprintf("server.bind is invalid: %s", err), `Set server.bind to "host:port", such as ":6837"`}
+	}
+	for _, key := range []string{"server.timeBetweenPings", "server.pingsUntilTimeout", "server.writeTimeout", "server.flushSize", "server.flushDelay"} {
+		if viper.GetInt(key) < 0 {
+			return doctorResult{doctorFail, fmt.Sprintf("%s is negative", key), fmt.Sprintf("Set %s to 0 or more in %s", key, file)}
+		}
+	}
+	if viper.GetString("server.statsPassword") == "" {
+		return doctorResult{doctorWarn, fmt.Sprintf("loaded %s, but server.statsPassword is empty, so stats and admin commands are disabled", file),
+			"Set server.statsPassword if you want to use stats or admin commands"}
+	}
+	return doctorResult{doctorOK, fmt.Sprintf("loaded %s", file), ""}
+}
+
+// certificateExpiryWarning is how soon before a certificate expires doctor warns about it.
+const certificateExpiryWarning = 14 * 24 * time.Hour
+
+func checkCertificate() doctorResult {
+	if !viper.GetBool("tls.useTls") {
+		return doctorResult{doctorWarn, "TLS is disabled", "NVDA Remote clients only connect over TLS; set tls.useTls = true unless TLS is terminated in front of NVRemoted"}
+	}
+	if domains := viper.GetStringSlice("tls.acmeDomains"); len(domains) > 0 {
+		return doctorResult{doctorOK, fmt.Sprintf("obtained automatically from Let's Encrypt for %v", domains), ""}
+	}
+	certFile := os.ExpandEnv(viper.GetString("tls.certFile"))
+	keyFile := os.ExpandEnv(viper.GetString("tls.keyFile"))
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return doctorResult{doctorFail, err.Error(), "Check that tls.certFile and tls.keyFile point to a readable PEM certificate and its private key"}
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return doctorResult{doctorFail, err.Error(), "Replace the certificate in tls.certFile"}
+	}
+
+	remaining := time.Until(leaf.NotAfter)
+	if remaining <= 0 {
+		return doctorResult{doctorFail, fmt.Sprintf("expired on %s", leaf.NotAfter.Format(time.RFC1123)), "Renew the certificate"}
+	}
+	if time.Now().Before(leaf.NotBefore) {
+		return doctorResult{doctorFail, fmt.Sprintf("not valid until %s", leaf.NotBefore.Format(time.RFC1123)), "Check the system clock, or wait until the certificate is valid"}
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, der := range pair.Certificate[1:] {
+		if cert, err := x509.ParseCertificate(der); err == nil {
+			intermediates.AddCert(cert)
+		}
+	}
+	opts := x509.VerifyOptions{
+		Intermediates: intermediates,
+		DNSName:       viper.GetString("server.hostname"),
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		fix := "If clients should verify the server, use a certificate from a trusted CA, such as Let's Encrypt, and include its intermediates in tls.certFile"
+		if opts.DNSName != "" {
+			fix += fmt.Sprintf(", issued for %s", opts.DNSName)
+		}
+		return doctorResult{doctorWarn, fmt.Sprintf("does not verify: %s", err), fix}
+	}
+
+	detail := fmt.Sprintf("valid for %s, until %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC1123))
+	if remaining < certificateExpiryWarning {
+		return doctorResult{doctorWarn, detail, "Renew the certificate soon"}
+	}
+	return doctorResult{doctorOK, detail, ""}
+}
+
+func checkPort() doctorResult {
+	bindAddr := viper.GetString("server.bind")
+	host, port, err := net.SplitHostPort(bindAddr)
+	if err != nil {
+		return doctorResult{doctorSkip, "server.bind is invalid", ""}
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), 5*time.Second)
+	if err != nil {
+		// Nothing is listening; see whether the server would be able to.
+		listener, err := net.Listen("tcp", bindAddr)
+		if err != nil {
+			return doctorResult{doctorFail, fmt.Sprintf("the server isn't running, and %s can't be bound: %s", bindAddr, err),
+				"Stop whatever is using the port, change server.bind, or run as a user allowed to bind low ports"}
+		}
+		listener.Close()
+		return doctorResult{doctorWarn, fmt.Sprintf("the server isn't running, but %s can be bound", bindAddr), "Start the server with `nvremoted start`"}
+	}
+	conn.Close()
+
+	hostname := viper.GetString("server.hostname")
+	if hostname == "" {
+		return doctorResult{doctorOK, fmt.Sprintf("accepting connections on %s", bindAddr), ""}
+	}
+	conn, err = net.DialTimeout("tcp", net.JoinHostPort(hostname, port), 5*time.Second)
+	if err != nil {
+		return doctorResult{doctorWarn, fmt.Sprintf("accepting connections on %s, but %s can't be connected to: %s", bindAddr, net.JoinHostPort(hostname, port), err),
+			"Check firewalls and port forwarding; some routers also can't connect to their own public address from inside the network"}
+	}
+	conn.Close()
+	return doctorResult{doctorOK, fmt.Sprintf("accepting connections on %s and %s", bindAddr, net.JoinHostPort(hostname, port)), ""}
+}
+
+// recommendedFileLimit is the minimum open file limit doctor recommends.
+// Each client holds one file descriptor.
+const recommendedFileLimit = 4096
+
+func checkFileLimit() doctorResult {
+	soft, hard, err := fileLimit()
+	if err != nil {
+		return doctorResult{doctorSkip, err.Error(), ""}
+	}
+	detail := fmt.Sprintf("soft limit %d, hard limit %d", soft, hard)
+	if soft < recommendedFileLimit {
+		return doctorResult{doctorWarn, detail, fmt.Sprintf("Raise the limit to at least %d with `ulimit -n`, or LimitNOFILE= in a systemd unit, so the server can accept more clients", recommendedFileLimit)}
+	}
+	return doctorResult{doctorOK, detail, ""}
+}
+
+// maxClockSkew is how far the clock may be off before doctor warns about it.
+// Certificate validation is the main thing sensitive to skew.
+const maxClockSkew = 5 * time.Second
+
+func checkClock() doctorResult {
+	skew, err := ntpClockSkew(doctorNTPServer)
+	if err != nil {
+		return doctorResult{doctorSkip, fmt.Sprintf("can't query %s: %s", doctorNTPServer, err), ""}
+	}
+	detail := fmt.Sprintf("%s from %s", skew.Round(time.Millisecond), doctorNTPServer)
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return doctorResult{doctorWarn, detail, "Synchronize the clock with NTP, such as with systemd-timesyncd or chrony"}
+	}
+	return doctorResult{doctorOK, detail, ""}
+}
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900) and the Unix epoch (1970).
+const ntpEpochOffset = 2208988800
+
+// ntpClockSkew measures how far the local clock is from an NTP server's with a single SNTP request.
+// A positive skew means the local clock is ahead.
+func ntpClockSkew(server string) (time.Duration, error) {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(server, "123"), 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := make([]byte, 48)
+	req[0] = 0x1b // No leap indicator, version 3, client mode
+	sent := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	if _, err := conn.Read(resp); err != nil {
+		return 0, err
+	}
+	received := time.Now()
+
+	// The server's transmit timestamp is 32 bits of seconds, then 32 bits of fractional seconds.
+	secs := binary.BigEndian.Uint32(resp[40:44])
+	frac := binary.BigEndian.Uint32(resp[44:48])
+	serverTime := time.Unix(int64(secs)-ntpEpochOffset, int64(frac)*1e9>>32)
+
+	// Assume the response took half the round trip to arrive.
+	localTime := sent.Add(received.Sub(sent) / 2)
+	return localTime.Sub(serverTime), nil
+}
+
+func checkDNS() doctorResult {
+	hostname := viper.GetString("server.hostname")
+	if hostname == "" {
+		return doctorResult{doctorSkip, "server.hostname is not set", "Set server.hostname to the name clients connect to, so it can be checked"}
+	}
+	addrs, err := net.LookupHost(hostname)
+	if err != nil {
+		return doctorResult{doctorFail, err.Error(), fmt.Sprintf("Create A and/or AAAA records for %s pointing at this server", hostname)}
+	}
+	return doctorResult{doctorOK, fmt.Sprintf("%s resolves to %v", hostname, addrs), ""}
+}
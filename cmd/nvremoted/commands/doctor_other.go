@@ -0,0 +1,14 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+//go:build !unix
+
+package commands
+
+import "github.com/pkg/errors"
+
+// fileLimit gets the soft and hard limits on open files for this process.
+func fileLimit() (uint64, uint64, error) {
+	return 0, 0, errors.New("open file limits aren't supported on this platform")
+}
@@ -0,0 +1,94 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/n0ot/nvremoted/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	drainMigrate bool
+	drainRate    float64
+	drainCancel  bool
+	drainStatus  bool
+	drainWait    bool
+)
+
+// drainCmd represents the drain command
+var drainCmd = &cobra.Command{
+	Use:   "drain [host]",
+	Short: "Drain a running NVRemoted server of its channels, for maintenance",
+	Long: `drain stops an NVRemoted server from creating channels, so that it can be taken down without disrupting anyone.
+Clients may still join the channels it has, and /readyz fails, so that load balancers stop sending it clients.
+
+If the server is a node of a cluster, the channels it owns are handed over to the other nodes.
+With --migrate, its clients are moved to them too, by kicking --rate of them a second;
+they reconnect through the load balancer to another node, and rejoin their channels there.
+Otherwise, the drain waits for the channels to empty.
+
+With --wait, progress is printed every second until no clients are left.
+With --status, the progress of a drain is printed without starting one, and --cancel lets the server create channels again.
+
+If the host is omitted, the local nvremoted server will be used.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		host := remoteHost(args)
+		drainArgs := server.DrainArgs{
+			Migrate: drainMigrate,
+			Rate:    drainRate,
+			Cancel:  drainCancel,
+			Status:  drainStatus,
+		}
+		var status server.DrainStatus
+		if err := adminRequest(host, "drain", drainArgs, &status); err != nil {
+			return err
+		}
+		if drainCancel {
+			fmt.Println("Drain canceled.")
+			return nil
+		}
+		fmt.Println(formatDrain(status))
+		for drainWait && status.Draining && status.NumClients > 0 {
+			time.Sleep(time.Second)
+			if err := adminRequest(host, "drain", server.DrainArgs{Status: true}, &status); err != nil {
+				return err
+			}
+			fmt.Println(formatDrain(status))
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(drainCmd)
+	addRemoteFlags(drainCmd)
+	drainCmd.Flags().BoolVar(&drainMigrate, "migrate", false, "move clients to other nodes of the cluster")
+	drainCmd.Flags().Float64Var(&drainRate, "rate", 0, "clients moved per second with --migrate (default 5)")
+	drainCmd.Flags().BoolVar(&drainCancel, "cancel", false, "stop draining, letting the server create channels again")
+	drainCmd.Flags().BoolVar(&drainStatus, "status", false, "print the progress of a drain, without starting one")
+	drainCmd.Flags().BoolVar(&drainWait, "wait", false, "print progress every second until the server is empty")
+}
+
+// formatDrain formats the progress of a drain.
+func formatDrain(status server.DrainStatus) string {
+	if !status.Draining {
+		return "Not draining."
+	}
+	if status.NumClients == 0 {
+		return fmt.Sprintf("Drained, having drained for %s; %d clients moved.", formatUptime(status.Since), status.Migrated)
+	}
+	progress := fmt.Sprintf("Draining for %s: %d clients in %d channels left", formatUptime(status.Since), status.NumClients, status.NumChannels)
+	if status.Migrate {
+		progress += fmt.Sprintf(", %d moved at %g a second", status.Migrated, status.Rate)
+	}
+	if status.OwnedChannels > 0 {
+		progress += fmt.Sprintf(", still owning %d channels", status.OwnedChannels)
+	}
+	return progress + "."
+}
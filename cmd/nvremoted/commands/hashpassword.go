@@ -0,0 +1,52 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+
+	"github.com/howeyc/gopass"
+	"github.com/n0ot/nvremoted/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// hashPasswordCmd represents the hash-password command
+var hashPasswordCmd = &cobra.Command{
+	Use:   "hash-password",
+	Short: "Hash a stats password for the configuration file",
+	Long: `hash-password prompts for a stats password, and prints its bcrypt hash,
+which can be used as server.statsPassword so that the password itself isn't stored in the configuration file.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		fmt.Printf("Password: ")
+		password, err := gopass.GetPasswd()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Confirm password: ")
+		confirm, err := gopass.GetPasswd()
+		if err != nil {
+			return err
+		}
+		if string(password) != string(confirm) {
+			return errors.New("The passwords don't match")
+		}
+		if len(password) == 0 {
+			return errors.New("The password is empty")
+		}
+
+		hash, err := server.HashPassword(string(password))
+		if err != nil {
+			return err
+		}
+		fmt.Println(hash)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(hashPasswordCmd)
+}
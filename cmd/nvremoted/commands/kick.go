@@ -0,0 +1,53 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/n0ot/nvremoted/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+var kickReason string
+
+// kickCmd represents the kick command
+var kickCmd = &cobra.Command{
+	Use:   "kick <client-id|address> [host]",
+	Short: "Disconnect clients from a running NVRemoted server",
+	Long: `kick disconnects a client by its ID, or all clients connected from an IP address or network, in CIDR notation.
+Kicked clients are sent the reason as an error before being disconnected.
+
+Clients may reconnect straight away; use ban to keep them out.
+
+If the host is omitted, the local nvremoted server will be used.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		kickArgs := server.KickArgs{Reason: kickReason}
+		if id, err := strconv.ParseUint(args[0], 10, 64); err == nil {
+			kickArgs.ID = &id
+		} else {
+			kickArgs.Addr = args[0]
+		}
+		var result server.KickResult
+		if err := adminRequest(remoteHost(args[1:]), "kick", kickArgs, &result); err != nil {
+			return err
+		}
+		ids := make([]string, len(result.Kicked))
+		for i, id := range result.Kicked {
+			ids[i] = strconv.FormatUint(id, 10)
+		}
+		fmt.Printf("Kicked %d client(s): %s\n", len(ids), strings.Join(ids, ", "))
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(kickCmd)
+	addRemoteFlags(kickCmd)
+	kickCmd.Flags().StringVar(&kickReason, "reason", "", "why the client is being kicked, which is sent to it (default \"kicked by an administrator\")")
+}
@@ -0,0 +1,91 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/n0ot/nvremoted/pkg/logfile"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	viper.SetDefault("log.format", "text")
+	viper.SetDefault("log.level", "debug")
+	viper.SetDefault("log.output", "stderr")
+	viper.SetDefault("log.maxSize", 100)
+	viper.SetDefault("log.maxAge", 30)
+	viper.SetDefault("log.maxBackups", 5)
+}
+
+// configureLogger sets the logger's format, level, and output from the log section of the configuration.
+// The output is "stderr", "stdout", "syslog", or the path of a file to append to, which is rotated as it grows.
+func configureLogger(log *logrus.Logger) error {
+	switch format := viper.GetString("log.format"); format {
+	case "text":
+		log.Formatter = new(logrus.TextFormatter)
+	case "json":
+		log.Formatter = new(logrus.JSONFormatter)
+	default:
+		return errors.Errorf("log.format: unknown format %q; must be text or json", format)
+	}
+
+	level, err := logrus.ParseLevel(viper.GetString("log.level"))
+	if err != nil {
+		return errors.Wrap(err, "log.level")
+	}
+	log.Level = level
+
+	switch output := viper.GetString("log.output"); output {
+	case "", "stderr":
+		log.Out = os.Stderr
+	case "stdout":
+		log.Out = os.Stdout
+	case "syslog":
+		hook, err := newSyslogHook()
+		if err != nil {
+			return errors.Wrap(err, "log.output")
+		}
+		log.AddHook(hook)
+		log.Out = io.Discard
+	default:
+		file, err := logfile.Open(os.ExpandEnv(output),
+			viper.GetInt64("log.maxSize")*1024*1024,
+			viper.GetDuration("log.maxAge")*24*time.Hour,
+			viper.GetInt("log.maxBackups"))
+		if err != nil {
+			return err
+		}
+		log.Out = file
+	}
+	return nil
+}
+
+// openSecurityLog opens the security log configured by log.securityOutput, or returns nil if it isn't set.
+// The output is "stderr", "stdout", "syslog", or the path of a file to append to, which is rotated like the main log.
+func openSecurityLog() (io.Writer, error) {
+	switch output := viper.GetString("log.securityOutput"); output {
+	case "":
+		return nil, nil
+	case "stderr":
+		return os.Stderr, nil
+	case "stdout":
+		return os.Stdout, nil
+	case "syslog":
+		w, err := newSecuritySyslog()
+		return w, errors.Wrap(err, "log.securityOutput")
+	default:
+		file, err := logfile.Open(os.ExpandEnv(output),
+			viper.GetInt64("log.maxSize")*1024*1024,
+			viper.GetDuration("log.maxAge")*24*time.Hour,
+			viper.GetInt("log.maxBackups"))
+		return file, errors.Wrap(err, "log.securityOutput")
+	}
+}
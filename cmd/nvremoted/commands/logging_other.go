@@ -0,0 +1,23 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+//go:build !unix
+
+package commands
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// newSyslogHook fails, since syslog isn't supported on this platform.
+func newSyslogHook() (logrus.Hook, error) {
+	return nil, errors.New("syslog isn't supported on this platform")
+}
+
+func newSecuritySyslog() (io.Writer, error) {
+	return nil, errors.New("syslog isn't supported on this platform")
+}
@@ -0,0 +1,25 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+//go:build unix
+
+package commands
+
+import (
+	"io"
+	"log/syslog"
+
+	"github.com/sirupsen/logrus"
+	logrus_syslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// newSyslogHook creates a hook that sends log entries to the local syslog daemon.
+func newSyslogHook() (logrus.Hook, error) {
+	return logrus_syslog.NewSyslogHook("", "", syslog.LOG_INFO|syslog.LOG_DAEMON, "nvremoted")
+}
+
+// newSecuritySyslog opens syslog's auth facility for the security log, where tools like fail2ban usually look.
+func newSecuritySyslog() (io.Writer, error) {
+	return syslog.New(syslog.LOG_WARNING|syslog.LOG_AUTH, "nvremoted")
+}
@@ -0,0 +1,73 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+
+	"github.com/n0ot/nvremoted/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+var motdBroadcast bool
+
+// motdCmd represents the motd command
+var motdCmd = &cobra.Command{
+	Use:   "motd",
+	Short: "Show or change the message of the day on a running NVRemoted server",
+	Long: `motd shows or changes the message of the day sent to clients when they connect.
+
+A MOTD set with this command lasts until the server restarts,
+or until it is reloaded from nvremoted.motdFile or nvremoted.motdUrl because that changed.
+
+If the host is omitted, the local nvremoted server will be used.`,
+}
+
+var motdShowCmd = &cobra.Command{
+	Use:   "show [host]",
+	Short: "Show the message of the day",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return motdRequest(remoteHost(args), server.MOTDArgs{Broadcast: motdBroadcast})
+	},
+}
+
+var motdSetCmd = &cobra.Command{
+	Use:   "set <message> [host]",
+	Short: "Change the message of the day",
+	Long: `set changes the message of the day. An empty message disables it.
+
+With --broadcast, the new MOTD is also sent to clients that are already connected.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return motdRequest(remoteHost(args[1:]), server.MOTDArgs{MOTD: &args[0], Broadcast: motdBroadcast})
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(motdCmd)
+	for _, cmd := range []*cobra.Command{motdShowCmd, motdSetCmd} {
+		motdCmd.AddCommand(cmd)
+		addRemoteFlags(cmd)
+		cmd.Flags().BoolVar(&motdBroadcast, "broadcast", false, "send the MOTD to all connected clients")
+	}
+}
+
+// motdRequest runs the motd admin command, and prints the result.
+func motdRequest(host string, motdArgs server.MOTDArgs) error {
+	var result server.MOTDResult
+	if err := adminRequest(host, "motd", motdArgs, &result); err != nil {
+		return err
+	}
+	if result.MOTD == "" {
+		fmt.Println("No MOTD is set.")
+	} else {
+		fmt.Printf("MOTD: %s\n", result.MOTD)
+	}
+	if motdArgs.Broadcast {
+		fmt.Printf("Broadcast to %d client(s).\n", result.Broadcast)
+	}
+	return nil
+}
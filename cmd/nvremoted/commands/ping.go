@@ -0,0 +1,168 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/n0ot/nvremoted/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	pingCount    int
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+)
+
+// pingCmd represents the ping command
+var pingCmd = &cobra.Command{
+	Use:   "ping host",
+	Short: "Measure the latency to an NVRemoted server",
+	Long: `ping connects to an NVRemoted server several times, and measures how long the TCP and TLS handshakes take,
+and the round trip time of a ping answered by the server.
+
+When it finishes, the minimum, average, and maximum of each are printed.
+This helps tell whether lag in a remote session comes from the network path to the server.
+Servers other than NVRemoted, and older versions of it, don't answer pings.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if pingCount < 1 {
+			return errors.New("--count must be at least 1")
+		}
+		return ping(args[0])
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(pingCmd)
+	pingCmd.Flags().IntVarP(&pingCount, "count", "c", 5, "number of samples to take")
+	pingCmd.Flags().DurationVarP(&pingInterval, "interval", "i", time.Second, "time to wait between samples")
+	pingCmd.Flags().DurationVarP(&pingTimeout, "timeout", "W", 5*time.Second, "time to wait for each connection and ping")
+	pingCmd.Flags().StringVarP(&remotePort, "port", "P", "", "port of the server to ping (default from the host's _nvremoted._tcp SRV record, or "+client.DefaultPort+")")
+	pingCmd.Flags().BoolVarP(&disableTLS, "disable-tls", "d", false, "disable connecting over TLS")
+	pingCmd.Flags().BoolVarP(&skipTLSVerification, "no-tls-verify", "n", false, "skip TLS verification")
+	pingCmd.Flags().StringVarP(&remoteServerCertificate, "server-certificate", "s", "", "file containing the PEM encoded certificate to use for server verification, instead of the system's certificate store")
+}
+
+// pingSample is how long each step of one ping took.
+type pingSample struct {
+	tcp, tls, rtt time.Duration
+}
+
+// ping samples the latency to host pingCount times, and prints a summary.
+func ping(host string) error {
+	addrs, err := remoteAddrs(host)
+	if err != nil {
+		return err
+	}
+	addr := addrs[0]
+	var tlsConfig *tls.Config
+	if !disableTLS {
+		if tlsConfig, err = remoteTLSConfig(); err != nil {
+			return err
+		}
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+
+	fmt.Printf("PING %s (%s)\n", host, addr)
+	var tcpTimes, tlsTimes, rtts []time.Duration
+	for seq := 1; seq <= pingCount; seq++ {
+		if seq > 1 {
+			time.Sleep(pingInterval)
+		}
+		sample, err := pingOnce(addr, tlsConfig, int64(seq))
+		if err != nil {
+			fmt.Printf("seq=%d: %s\n", seq, err)
+			continue
+		}
+		tcpTimes = append(tcpTimes, sample.tcp)
+		line := fmt.Sprintf("seq=%d tcp=%s", seq, sample.tcp.Round(time.Microsecond))
+		if tlsConfig != nil {
+			tlsTimes = append(tlsTimes, sample.tls)
+			line += fmt.Sprintf(" tls=%s", sample.tls.Round(time.Microsecond))
+		}
+		rtts = append(rtts, sample.rtt)
+		fmt.Printf("%s rtt=%s\n", line, sample.rtt.Round(time.Microsecond))
+	}
+
+	fmt.Printf("\n--- %s ping statistics ---\n", host)
+	fmt.Printf("%d samples, %d answered, %s lost\n", pingCount, len(rtts), percent(pingCount-len(rtts), pingCount))
+	for _, stat := range []struct {
+		name  string
+		times []time.Duration
+	}{
+		{"tcp handshake", tcpTimes},
+		{"tls handshake", tlsTimes},
+		{"rtt", rtts},
+	} {
+		if len(stat.times) == 0 {
+			continue
+		}
+		sort.Slice(stat.times, func(i, j int) bool { return stat.times[i] < stat.times[j] })
+		fmt.Printf("%s min/avg/max = %s/%s/%s\n", stat.name, latencyAt(stat.times, 0), latencyAvg(stat.times), latencyAt(stat.times, 1))
+	}
+	if len(rtts) == 0 {
+		return errors.New("The server didn't answer any pings")
+	}
+	return nil
+}
+
+// pingOnce connects to addr, with TLS unless tlsConfig is nil, and pings the server once.
+func pingOnce(addr string, tlsConfig *tls.Config, seq int64) (pingSample, error) {
+	var sample pingSample
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+
+	start := time.Now()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return sample, errors.Wrap(err, "Connect")
+	}
+	sample.tcp = time.Since(start)
+	defer conn.Close()
+
+	if tlsConfig != nil {
+		start = time.Now()
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return sample, errors.Wrap(err, "TLS handshake")
+		}
+		sample.tls = time.Since(start)
+		conn = tlsConn
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+	c := client.New(conn)
+	defer c.Close()
+	start = time.Now()
+	if err := c.Send(map[string]interface{}{"type": "server_ping", "seq": seq}); err != nil {
+		return sample, err
+	}
+	for event := range c.Events() {
+		if err := event.AsError(); err != nil {
+			return sample, errors.Wrap(err, "Ping")
+		}
+		var pong struct {
+			Seq int64 `json:"seq"`
+		}
+		if event.Type == "server_pong" && event.Decode(&pong) == nil && pong.Seq == seq {
+			sample.rtt = time.Since(start)
+			return sample, nil
+		}
+	}
+	if err := c.Err(); err != nil {
+		return sample, errors.Wrap(err, "Ping")
+	}
+	return sample, errors.New("Ping: the server closed the connection")
+}
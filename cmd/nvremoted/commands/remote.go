@@ -0,0 +1,285 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/howeyc/gopass"
+	"github.com/n0ot/nvremoted/pkg/client"
+	"github.com/n0ot/nvremoted/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Options for commands that talk to a running NVRemoted server.
+var (
+	remotePort              string
+	skipTLSVerification     bool
+	remoteServerCertificate string
+	remotePassword          string
+	promptForPassword       bool
+
+	// controlSocket is the path to the local server's control socket, if it is being used instead of connecting over the network.
+	controlSocket string
+)
+
+// addRemoteFlags adds the flags used to connect to an NVRemoted server to cmd.
+func addRemoteFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&remotePort, "port", "P", "", "port of the server to query (default from the host's _nvremoted._tcp SRV record, or "+client.DefaultPort+")")
+	cmd.Flags().BoolVarP(&disableTLS, "disable-tls", "d", false, "disable connecting over TLS")
+	cmd.Flags().BoolVarP(&skipTLSVerification, "no-tls-verify", "n", false, "skip TLS verification\n    This is insecure, an attacker can get your password, and you should only use this for testing")
+	cmd.Flags().StringVarP(&remoteServerCertificate, "server-certificate", "s", "", "file containing the PEM encoded certificate to use for server verification, instead of the system's certificate store")
+	cmd.Flags().BoolVarP(&promptForPassword, "prompt-for-password", "p", false, "prompt for the server's stats password\n    If unset, the password is the same as the local server's.")
+}
+
+// remoteHost gets the host to connect to from a command's arguments.
+// If no host is given, the local server is used, through its control socket if it has one,
+// or with options taken from its configuration.
+func remoteHost(args []string) string {
+	if len(args) > 0 {
+		if disableTLS {
+			fmt.Fprintln(os.Stderr, "Warning: TLS is disabled. All traffic including your stats password will be sent in the clear.")
+		} else if skipTLSVerification {
+			fmt.Fprintln(os.Stderr, "Warning: skipping TLS verification is insecure.")
+		}
+		return args[0]
+	}
+
+	// The control socket needs no password, and works even if the server doesn't listen on localhost.
+	if path := os.ExpandEnv(viper.GetString("server.controlSocket")); path != "" {
+		if _, err := os.Stat(path); err == nil {
+			controlSocket = path
+			return "127.0.0.1"
+		}
+	}
+
+	// Use the options from the local server's configuration.
+	if _, port, err := net.SplitHostPort(viper.GetString("server.bind")); err != nil {
+		if remotePort == "" {
+			remotePort = client.DefaultPort
+		}
+		fmt.Fprintf(os.Stderr, "Warning: cannot determine local server port from config; using \"%s\"\n", remotePort)
+	} else {
+		remotePort = port
+	}
+	disableTLS = !viper.GetBool("tls.useTls")
+	skipTLSVerification = true
+	if password := viper.GetString("server.statsPassword"); !server.IsPasswordHash(password) {
+		remotePassword = password
+	}
+	if !disableTLS {
+		fmt.Fprintln(os.Stderr, "Skipping TLS verification for local server query")
+	}
+	return "127.0.0.1"
+}
+
+// getRemotePassword gets the password used to authenticate with the server,
+// prompting for it if requested.
+func getRemotePassword() (string, error) {
+	if promptForPassword {
+		fmt.Printf("Password: ")
+		pass, err := gopass.GetPasswd()
+		if err != nil {
+			return "", err
+		}
+		remotePassword = string(pass)
+	}
+
+	if remotePassword == "" {
+		remotePassword = os.Getenv("NVREMOTED_STATS_PASSWORD")
+	}
+
+	if remotePassword == "" {
+		return "", errors.New("A stats password is required")
+	}
+	return remotePassword, nil
+}
+
+// dialRemote connects to the NVRemoted server at host.
+// If no port was given, the host's SRV records are used to find the server,
+// and each address they point to is tried in turn.
+func dialRemote(host string) (net.Conn, error) {
+	addrs, err := remoteAddrs(host)
+	if err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	if !disableTLS {
+		if tlsConfig, err = remoteTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	var conn net.Conn
+	for _, addr := range addrs {
+		if disableTLS {
+			conn, err = net.Dial("tcp", addr)
+		} else {
+			conn, err = tls.Dial("tcp", addr, tlsConfig)
+		}
+		if err == nil {
+			return conn, nil
+		}
+		if len(addrs) > 1 {
+			fmt.Fprintf(os.Stderr, "Warning: cannot connect to %s: %s\n", addr, err)
+		}
+	}
+	return nil, errors.Wrap(err, "Connect to NVRemoted server")
+}
+
+// remoteAddrs gets the addresses to try when connecting to the NVRemoted server at host.
+func remoteAddrs(host string) ([]string, error) {
+	if remotePort != "" {
+		return []string{net.JoinHostPort(host, remotePort)}, nil
+	}
+	addrs, err := client.Resolve(context.Background(), host)
+	if err != nil {
+		return nil, errors.Wrap(err, "Find NVRemoted server")
+	}
+	return addrs, nil
+}
+
+// remoteTLSConfig gets the TLS configuration used to connect to NVRemoted servers.
+func remoteTLSConfig() (*tls.Config, error) {
+	var certPool *x509.CertPool
+	if remoteServerCertificate != "" {
+		cert, err := ioutil.ReadFile(remoteServerCertificate)
+		if err != nil {
+			return nil, errors.Wrap(err, "Open server certificate")
+		}
+		certPool = x509.NewCertPool()
+		certPool.AppendCertsFromPEM(cert)
+	}
+	return &tls.Config{
+		InsecureSkipVerify: skipTLSVerification,
+		RootCAs:            certPool,
+	}, nil
+}
+
+// remoteResponseHandler handles a response of type msgType from the server.
+// It returns true once no more responses are expected.
+type remoteResponseHandler func(msgType string, raw json.RawMessage) (bool, error)
+
+// remoteRequest sends a request to the server at host, and passes responses to handle until it is done.
+// Error responses are returned as errors without being passed to handle.
+func remoteRequest(host string, req server.Message, handle remoteResponseHandler) error {
+	conn, err := dialRemote(host)
+	if err != nil {
+		return err
+	}
+	c := client.New(conn)
+	defer c.Close()
+
+	if err := c.Send(req); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	for event := range c.Events() {
+		if err := event.AsError(); err != nil {
+			return err
+		}
+		done, err := handle(event.Type, event.Raw)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+	return c.Err()
+}
+
+// adminRequest runs an admin command on the server at host,
+// and unmarshals its result into result.
+// args may be nil if the command takes no arguments.
+func adminRequest(host, command string, args interface{}, result interface{}) error {
+	if controlSocket != "" {
+		return controlRequest(controlSocket, command, args, result)
+	}
+
+	password, err := getRemotePassword()
+	if err != nil {
+		return err
+	}
+
+	req := server.ClientAdminMessage{
+		GenericClientMessage: server.GenericClientMessage{
+			Type: "admin",
+		},
+		Password: password,
+		Command:  command,
+	}
+	if args != nil {
+		if req.Args, err = json.Marshal(args); err != nil {
+			return errors.Wrap(err, "Marshal admin command arguments")
+		}
+	}
+
+	return remoteRequest(host, req, func(msgType string, raw json.RawMessage) (bool, error) {
+		if msgType != "admin_result" {
+			return false, nil // Ignore all unknown messages
+		}
+		var resp struct {
+			Result json.RawMessage `json:"result"`
+		}
+		if err := json.Unmarshal(raw, &resp); err != nil {
+			return true, errors.Wrap(err, "Get admin result from server")
+		}
+		if result == nil {
+			return true, nil
+		}
+		return true, errors.Wrap(json.Unmarshal(resp.Result, result), "Get admin result from server")
+	})
+}
+
+// controlRequest runs an admin command over the control socket at path,
+// and unmarshals its result into result.
+// args may be nil if the command takes no arguments.
+func controlRequest(path, command string, args interface{}, result interface{}) error {
+	req := server.ControlRequest{Command: command}
+	if args != nil {
+		var err error
+		if req.Args, err = json.Marshal(args); err != nil {
+			return errors.Wrap(err, "Marshal admin command arguments")
+		}
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return errors.Wrap(err, "Connect to control socket")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return errors.Wrap(err, "Send to control socket")
+	}
+
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  string          `json:"error"`
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return errors.Wrap(err, "Get admin result from control socket")
+	}
+	if resp.Error != "" {
+		return errors.Errorf("Server returned an error: %s", resp.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(resp.Result, result), "Get admin result from control socket")
+}
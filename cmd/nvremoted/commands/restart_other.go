@@ -0,0 +1,17 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+//go:build !unix
+
+package commands
+
+import "github.com/n0ot/nvremoted/pkg/server"
+
+// watchRestart does nothing, since listeners can't be handed to a new process on this platform.
+func watchRestart(srv *server.Server) {}
+
+// inheritListeners does nothing, since listeners can't be inherited on this platform.
+func inheritListeners(srv *server.Server) (func(), error) {
+	return func() {}, nil
+}
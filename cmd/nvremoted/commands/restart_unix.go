@@ -0,0 +1,130 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+//go:build unix
+
+package commands
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/n0ot/nvremoted/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// listenersEnv passes the addresses of inherited listeners to a replacement server, one per line.
+// The replacement's first extra file (descriptor 3) is a pipe it writes to once it is ready,
+// and the listeners follow, in the same order as the addresses.
+const listenersEnv = "NVREMOTED_LISTENERS"
+
+// restartReadyTimeout is how long a replacement server has to become ready before it is killed.
+const restartReadyTimeout = 30 * time.Second
+
+// watchRestart re-executes nvremoted when SIGUSR2 is received, handing the listeners to the new process,
+// which serves new connections while this one drains its own and exits.
+// If the new process fails to start, this one keeps serving.
+func watchRestart(srv *server.Server) {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for range usr2 {
+			log.Info("Received SIGUSR2; restarting")
+			if err := restart(srv); err != nil {
+				log.WithError(err).Error("Error restarting; still serving")
+				continue
+			}
+			signal.Stop(usr2)
+			srv.Handoff(viper.GetDuration("server.restartDrainTimeout") * time.Second)
+			return
+		}
+	}()
+}
+
+// restart starts a new nvremoted process with the server's listeners, and waits for it to be ready.
+func restart(srv *server.Server) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "Find executable")
+	}
+	files, addrs, err := srv.ListenerFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "Create ready pipe")
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), listenersEnv+"="+strings.Join(addrs, "\n"))
+	cmd.ExtraFiles = append([]*os.File{readyW}, files...)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return errors.Wrap(err, "Start new process")
+	}
+
+	// The pipe is closed without being written to if the new process exits before it is ready.
+	ready := make(chan bool, 1)
+	go func() {
+		n, _ := readyR.Read(make([]byte, 1))
+		ready <- n > 0
+	}()
+	select {
+	case ok := <-ready:
+		if !ok {
+			return errors.Errorf("New process exited before it was ready: %v", cmd.Wait())
+		}
+	case <-time.After(restartReadyTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return errors.New("New process wasn't ready in time")
+	}
+	log.WithField("pid", cmd.Process.Pid).Info("New process is ready")
+	return nil
+}
+
+// inheritListeners adopts the listeners passed on by a restarting server, if there are any.
+// It returns a function to tell the previous server that this one is ready to serve.
+func inheritListeners(srv *server.Server) (func(), error) {
+	env, ok := os.LookupEnv(listenersEnv)
+	if !ok {
+		return func() {}, nil
+	}
+	os.Unsetenv(listenersEnv)
+	ready := os.NewFile(3, "ready")
+	var addrs []string
+	if env != "" {
+		addrs = strings.Split(env, "\n")
+	}
+	files := make([]*os.File, len(addrs))
+	for i, addr := range addrs {
+		files[i] = os.NewFile(uintptr(4+i), addr)
+	}
+	if err := srv.InheritListeners(files, addrs); err != nil {
+		ready.Close()
+		return nil, err
+	}
+	log.WithField("listeners", len(addrs)).Info("Inherited listeners from the previous process")
+	return func() {
+		io.WriteString(ready, "1")
+		ready.Close()
+	}, nil
+}
@@ -0,0 +1,331 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/n0ot/nvremoted/pkg/client"
+	"github.com/n0ot/nvremoted/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	simChannels   int
+	simDuration   time.Duration
+	simProfiles   []string
+	simFlushSize  int
+	simFlushDelay time.Duration
+)
+
+// simulateCmd represents the simulate command
+var simulateCmd = &cobra.Command{
+	Use:   "simulate",
+	Short: "Simulate traffic against an in-process server",
+	Long: `simulate starts an NVRemoted server in this process, configured like the start command,
+and creates channels with two clients each, which exchange scripted traffic.
+
+Each channel is assigned one of the traffic profiles in turn:
+  typing  bursts of key presses separated by pauses
+  speech  a continuous stream of speech
+  idle    an occasional message, with the connection otherwise quiet
+
+When the simulation ends, a report of relay latency and dropped messages is printed for each profile.
+This is useful for evaluating tuning changes, such as flushDelay, without real clients.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		profiles := make([]simProfile, 0, len(simProfiles))
+		for _, name := range simProfiles {
+			profile, ok := simProfilesByName[name]
+			if !ok {
+				return errors.Errorf("Unknown traffic profile: %s", name)
+			}
+			profiles = append(profiles, profile)
+		}
+		if len(profiles) == 0 {
+			return errors.New("At least one traffic profile is required")
+		}
+		if simChannels < 1 {
+			return errors.New("At least one channel is required")
+		}
+		opts := []server.Option{server.WithMOTD("")}
+		if cmd.Flags().Changed("flush-size") {
+			opts = append(opts, server.WithFlushSize(simFlushSize))
+		}
+		if cmd.Flags().Changed("flush-delay") {
+			opts = append(opts, server.WithFlushDelay(simFlushDelay))
+		}
+		// Only problems are logged, so they don't bury the results.
+		log := logrus.New()
+		log.Out = os.Stderr
+		log.Level = logrus.WarnLevel
+		srv, err := newServer(log, opts...)
+		if err != nil {
+			return err
+		}
+		return simulate(srv, profiles)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(simulateCmd)
+	simulateCmd.Flags().IntVarP(&simChannels, "channels", "c", 10, "number of channels to simulate")
+	simulateCmd.Flags().DurationVarP(&simDuration, "duration", "t", 30*time.Second, "how long to generate traffic for")
+	simulateCmd.Flags().StringSliceVar(&simProfiles, "profiles", []string{"typing", "speech", "idle"}, "traffic profiles to assign to channels, in turn")
+	simulateCmd.Flags().IntVar(&simFlushSize, "flush-size", 4096, "override the configured size of each client's output buffer")
+	simulateCmd.Flags().DurationVar(&simFlushDelay, "flush-delay", 5*time.Millisecond, "override the configured flush delay")
+}
+
+// A simProfile generates the traffic sent by the controlling client in a simulated channel.
+type simProfile struct {
+	name string
+	// next returns how long to wait before sending the next message, and the message to send.
+	next func(r *rand.Rand) (time.Duration, map[string]interface{})
+}
+
+var simProfilesByName = map[string]simProfile{
+	"typing": {
+		name: "typing",
+		next: func(r *rand.Rand) (time.Duration, map[string]interface{}) {
+			wait := time.Duration(30+r.Intn(120)) * time.Millisecond
+			if r.Intn(10) == 0 {
+				// Pause between words.
+				wait = time.Duration(500+r.Intn(2500)) * time.Millisecond
+			}
+			return wait, map[string]interface{}{
+				"type":    "key",
+				"vk_code": 65 + r.Intn(26),
+				"pressed": true,
+			}
+		},
+	},
+	"speech": {
+		name: "speech",
+		next: func(r *rand.Rand) (time.Duration, map[string]interface{}) {
+			return time.Duration(20+r.Intn(80)) * time.Millisecond, map[string]interface{}{
+				"type":     "speak",
+				"sequence": []string{strings.Repeat("speech ", 5+r.Intn(40))},
+				"priority": 0,
+			}
+		},
+	},
+	"idle": {
+		name: "idle",
+		next: func(r *rand.Rand) (time.Duration, map[string]interface{}) {
+			return time.Duration(5+r.Intn(10)) * time.Second, map[string]interface{}{
+				"type": "set_clipboard_text",
+				"text": "idle",
+			}
+		},
+	},
+}
+
+// simResult holds what happened in one simulated channel.
+type simResult struct {
+	profile      string
+	sent         int
+	received     int
+	latencies    []time.Duration
+	disconnected bool
+	err          error
+}
+
+// simMessage is the part of a relayed message the simulation needs to measure it.
+// sim_sent is relative to the start of the simulation, which keeps it small enough to survive the server's float64 round trip.
+type simMessage struct {
+	Type    string `json:"type"`
+	SimSeq  int64  `json:"sim_seq"`
+	SimSent int64  `json:"sim_sent"`
+}
+
+// simulate runs the simulation against srv.
+func simulate(srv *server.Server, profiles []simProfile) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return errors.Wrap(err, "Listen")
+	}
+	defer listener.Close()
+	go srv.Serve(listener)
+	addr := listener.Addr().String()
+
+	fmt.Printf("Simulating %d channels for %s (flush delay %s, flush size %d)\n",
+		simChannels, simDuration, srv.FlushDelay, srv.FlushSize)
+
+	start := time.Now()
+	results := make([]*simResult, simChannels)
+	var wg sync.WaitGroup
+	for i := 0; i < simChannels; i++ {
+		results[i] = &simResult{profile: profiles[i%len(profiles)].name}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			simulateChannel(addr, fmt.Sprintf("simulate_%d", i), profiles[i%len(profiles)], start, results[i])
+		}(i)
+	}
+	wg.Wait()
+
+	printSimReport(results)
+	return nil
+}
+
+// simulateChannel runs one channel with a controlling client sending the profile's traffic,
+// and a controlled client measuring what it receives.
+func simulateChannel(addr, channel string, profile simProfile, start time.Time, result *simResult) {
+	master, err := simJoin(addr, channel, "master")
+	if err != nil {
+		result.err = err
+		return
+	}
+	defer master.Close()
+	slave, err := simJoin(addr, channel, "slave")
+	if err != nil {
+		result.err = err
+		return
+	}
+	defer slave.Close()
+
+	// The receiver records whether the slave lost its connection here, rather than in result,
+	// which the send loop also writes; it's only read once the receiver has finished.
+	received := make(chan struct{})
+	var slaveLost bool
+	go func() {
+		defer close(received)
+		for event := range slave.Events() {
+			var msg simMessage
+			if err := event.Decode(&msg); err != nil || msg.SimSeq == 0 {
+				continue // Not simulated traffic
+			}
+			now := time.Since(start)
+			result.received++
+			result.latencies = append(result.latencies, now-time.Duration(msg.SimSent))
+		}
+		// Err is nil if the simulation closed the connection itself.
+		slaveLost = slave.Err() != nil
+	}()
+
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	deadline := start.Add(simDuration)
+	for seq := int64(1); ; seq++ {
+		wait, msg := profile.next(r)
+		if time.Now().Add(wait).After(deadline) {
+			break
+		}
+		time.Sleep(wait)
+		msg["sim_seq"] = seq
+		msg["sim_sent"] = int64(time.Since(start))
+		if err := master.Send(msg); err != nil {
+			result.disconnected = true
+			break
+		}
+		result.sent++
+	}
+
+	// Give messages still being relayed a chance to arrive before they're counted as dropped.
+	time.Sleep(time.Second)
+	slave.Close()
+	<-received
+	if slaveLost {
+		result.disconnected = true
+	}
+}
+
+// simJoin connects a simulated client to the server, and joins it to a channel.
+// Events received after the join completed are left for the caller.
+func simJoin(addr, channel, connectionType string) (*client.Client, error) {
+	c, err := client.Dial(context.Background(), addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "Connect to simulated server")
+	}
+	if err := c.JoinChannel(channel, connectionType); err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "Join channel")
+	}
+
+	c.Conn().SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer c.Conn().SetReadDeadline(time.Time{})
+	for event := range c.Events() {
+		if err := event.AsError(); err != nil {
+			c.Close()
+			return nil, errors.Wrap(err, "Join channel")
+		}
+		if event.Type == "channel_joined" {
+			return c, nil
+		}
+	}
+	return nil, errors.Wrap(c.Err(), "Join channel")
+}
+
+// printSimReport prints latency and drop statistics for each traffic profile.
+func printSimReport(results []*simResult) {
+	type profileReport struct {
+		channels, sent, received, disconnects, failures int
+		latencies                                       []time.Duration
+	}
+	reports := make(map[string]*profileReport)
+	var names []string
+	for _, result := range results {
+		report := reports[result.profile]
+		if report == nil {
+			report = &profileReport{}
+			reports[result.profile] = report
+			names = append(names, result.profile)
+		}
+		report.channels++
+		if result.err != nil {
+			report.failures++
+			fmt.Fprintf(os.Stderr, "Warning: %s channel failed: %s\n", result.profile, result.err)
+			continue
+		}
+		report.sent += result.sent
+		report.received += result.received
+		report.latencies = append(report.latencies, result.latencies...)
+		if result.disconnected {
+			report.disconnects++
+		}
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "PROFILE\tCHANNELS\tSENT\tDROPPED\tDISCONNECTS\tMIN\tAVG\tP50\tP95\tP99\tMAX\t")
+	for _, name := range names {
+		report := reports[name]
+		lat := report.latencies
+		sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			name, report.channels, report.sent, report.sent-report.received, report.disconnects+report.failures,
+			latencyAt(lat, 0), latencyAvg(lat), latencyAt(lat, 0.5), latencyAt(lat, 0.95), latencyAt(lat, 0.99), latencyAt(lat, 1))
+	}
+	w.Flush()
+}
+
+// latencyAt gets the latency at quantile q of sorted latencies.
+func latencyAt(sorted []time.Duration, q float64) string {
+	if len(sorted) == 0 {
+		return "-"
+	}
+	i := int(q * float64(len(sorted)-1))
+	return sorted[i].Round(time.Microsecond).String()
+}
+
+func latencyAvg(latencies []time.Duration) string {
+	if len(latencies) == 0 {
+		return "-"
+	}
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+	return (total / time.Duration(len(latencies))).Round(time.Microsecond).String()
+}
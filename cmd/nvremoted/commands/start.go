@@ -5,21 +5,31 @@
 package commands
 
 import (
-	"io/ioutil"
+	"context"
+	"crypto/tls"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/n0ot/nvremoted/pkg/motd"
 	"github.com/n0ot/nvremoted/pkg/server"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 var (
 	log        *logrus.Logger
-	motd       string
+	localMOTD  string
 	disableTLS bool
+
+	// clusterCerts is the certificate the node presents to the cluster's backplane, if server.clusterCertFile is set.
+	clusterCerts *server.CertificateReloader
 )
 
 // startCmd represents the start command
@@ -33,45 +43,610 @@ func init() {
 	RootCmd.AddCommand(startCmd)
 
 	startCmd.Flags().StringP("bind", "b", "127.0.0.1:6837", "Bind the server to host:port. Leave host empty to bind to all interfaces.")
-	viper.BindPFlag("server.bind", startCmd.Flags().Lookup("bind"))
+	bindStartFlag("server.bind", "bind")
+	startCmd.Flags().StringSlice("bind-fallback", nil, "Addresses to bind, in order, if the bind address can't be bound")
+	bindStartFlag("server.bindFallbacks", "bind-fallback")
+	startCmd.Flags().Int("bind-retries", 0, "Number of times to retry binding if no address can be bound")
+	bindStartFlag("server.bindRetries", "bind-retries")
+	startCmd.Flags().Int("bind-retry-delay", 1, "Number of seconds to wait between bind retries")
+	bindStartFlag("server.bindRetryDelay", "bind-retry-delay")
 	startCmd.Flags().IntP("time-between-pings", "t", 30, "How often pings should be sent in seconds (0 disables)")
-	viper.BindPFlag("server.timeBetweenPings", startCmd.Flags().Lookup("time-between-pings"))
+	bindStartFlag("server.timeBetweenPings", "time-between-pings")
 	startCmd.Flags().IntP("pings-until-timeout", "p", 2, "Number of pings that can pass before inactive clients are dropped (0 disables timeout)")
-	viper.BindPFlag("server.pingsUntilTimeout", startCmd.Flags().Lookup("pings-until-timeout"))
+	bindStartFlag("server.pingsUntilTimeout", "pings-until-timeout")
+	startCmd.Flags().IntP("write-timeout", "w", 30, "Number of seconds a write to a client may block before its connection is considered lost (0 disables)")
+	bindStartFlag("server.writeTimeout", "write-timeout")
+	startCmd.Flags().Int("flush-size", 4096, "Size in bytes of each client's output buffer, which is written as soon as it fills")
+	bindStartFlag("server.flushSize", "flush-size")
+	startCmd.Flags().Int("flush-delay", 5, "Number of milliseconds output may wait to be coalesced with more output before being written (0 disables)")
+	bindStartFlag("server.flushDelay", "flush-delay")
 	startCmd.Flags().BoolVarP(&disableTLS, "disable-tls", "d", false, "Overrides config option to enable TLS")
 
+	// config show takes the same flags, so it can show how they change the configuration.
+	configShowCmd.Flags().AddFlagSet(startCmd.Flags())
+
 	viper.SetDefault("server.statsPassword", "")
+	viper.SetDefault("server.reverseDns", true)
+	viper.SetDefault("server.reverseDnsTimeout", 2)
+	viper.SetDefault("server.reverseDnsCacheTtl", 600)
+	viper.SetDefault("server.banFile", "$CONFDIR/bans.json")
+	viper.SetDefault("server.controlSocket", "$CONFDIR/control.sock")
+	viper.SetDefault("server.controlSocketMode", "0600")
+	viper.SetDefault("server.restartDrainTimeout", 600)
+	viper.SetDefault("server.statsdPrefix", "nvremoted.")
+	viper.SetDefault("server.historyFile", "$CONFDIR/history.db")
+	viper.SetDefault("server.historyInterval", 300)
+	viper.SetDefault("server.ipDenylistInterval", 3600)
+	viper.SetDefault("server.abuseStrikes", 10)
+	viper.SetDefault("server.channelCreationsPerMinute", 20)
+	viper.SetDefault("server.channelCreationsPerHour", 200)
+	viper.SetDefault("server.abuseWindow", 60)
+	viper.SetDefault("server.abuseBanDuration", 3600)
+	viper.SetDefault("server.historyRetention", 30)
+	viper.SetDefault("server.statsdInterval", 10)
+	viper.SetDefault("server.clusterPrefix", "nvremoted.")
+	viper.SetDefault("server.clusterHeartbeat", 5)
+	viper.SetDefault("server.rateLimitBurst", 100)
+	viper.SetDefault("server.rateLimitKickAfter", 30)
+	viper.SetDefault("server.maxMessageDepth", 32)
+	viper.SetDefault("server.maxMessageKeys", 1000)
+	viper.SetDefault("server.advertiseCapabilities", true)
+	viper.SetDefault("server.protocolVersions", []int{2})
 	viper.SetDefault("tls.useTls", true)
+	viper.SetDefault("tls.reloadInterval", 60)
+	viper.SetDefault("tls.acmeCacheDir", "$CONFDIR/acme")
+	viper.SetDefault("nvremoted.motdCacheFile", "$CONFDIR/motd.cache")
+	viper.SetDefault("nvremoted.motdRefreshInterval", 300)
+	viper.SetDefault("nvremoted.motdReloadInterval", 5)
+}
+
+// startFlags maps config keys to the start flags that override them.
+var startFlags = make(map[string]*pflag.Flag)
+
+// bindStartFlag binds a config key to a start flag, so the flag overrides the key when given.
+func bindStartFlag(key, name string) {
+	flag := startCmd.Flags().Lookup(name)
+	viper.BindPFlag(key, flag)
+	startFlags[strings.ToLower(key)] = flag
 }
 
 func runServer(cmd *cobra.Command, args []string) {
 	log = logrus.New()
-	log.Out = os.Stderr
-	log.Formatter = new(logrus.TextFormatter)
-	log.Level = logrus.DebugLevel
+	if err := configureLogger(log); err != nil {
+		log.Fatal(err)
+	}
 
-	motdFile := os.ExpandEnv(viper.GetString("nvremoted.motdFile"))
-	if motdBuf, err := ioutil.ReadFile(motdFile); err == nil {
-		motd = string(motdBuf)
+	motdFile := motd.NewFile(os.ExpandEnv(viper.GetString("nvremoted.motdFile")))
+	if text, err := motdFile.Load(); err == nil {
+		localMOTD = text
+	} else {
+		log.WithError(err).Warn("Error loading MOTD")
 	}
 
-	srv := &server.Server{
-		TimeBetweenPings:  viper.GetDuration("server.timeBetweenPings") * time.Second,
-		PingsUntilTimeout: viper.GetInt("server.pingsUntilTimeout"),
-		MOTD:              strings.TrimSpace(motd),
-		StatsPassword:     viper.GetString("server.statsPassword"),
-		Log:               log,
+	tracerProvider, err := newTracerProvider()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var opts []server.Option
+	if tracerProvider != nil {
+		opts = append(opts, server.WithTracerProvider(tracerProvider))
+	}
+	securityLog, err := openSecurityLog()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if securityLog != nil {
+		opts = append(opts, server.WithSecurityLog(securityLog))
+	}
+	srv, err := newServer(log, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if clusterCerts != nil {
+		watchCertificate(clusterCerts, "cluster certificate")
+	}
+	ready, err := inheritListeners(srv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if motdURL := viper.GetString("nvremoted.motdUrl"); motdURL != "" {
+		if err := startRemoteMOTD(srv, motdURL); err != nil {
+			log.Fatal(err)
+		}
+	} else if motdFile.Path != "" {
+		watchMOTDFile(srv, motdFile)
 	}
 
-	bindAddr := viper.GetString("server.bind")
-	certFile := os.ExpandEnv(viper.GetString("tls.certFile"))
-	keyFile := os.ExpandEnv(viper.GetString("tls.keyFile"))
-	useTLS := viper.GetBool("tls.useTls")
+	if path := os.ExpandEnv(viper.GetString("server.controlSocket")); path != "" {
+		perm, err := strconv.ParseUint(viper.GetString("server.controlSocketMode"), 8, 32)
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "server.controlSocketMode"))
+		}
+		go func() {
+			if err := srv.ListenAndServeControl(path, os.FileMode(perm)); err != nil {
+				log.WithFields(logrus.Fields{
+					"path":  path,
+					"error": err,
+				}).Error("Error serving control socket")
+			}
+		}()
+	}
+
+	if addr := viper.GetString("server.healthBind"); addr != "" {
+		go func() {
+			if err := srv.ListenAndServeHealth(addr); err != nil {
+				log.WithFields(logrus.Fields{
+					"addr":  addr,
+					"error": err,
+				}).Error("Error serving health checks")
+			}
+		}()
+	} else {
+		if srv.Pprof {
+			log.Warn("server.pprof is set, but profiles are only served when server.healthBind is set")
+		}
+		if srv.Dashboard {
+			log.Warn("server.dashboard is set, but the dashboard is only served when server.healthBind is set")
+		}
+	}
 
+	// Interrupting or terminating the server kicks its clients, rather than leaving them to time out.
+	// Once that has started, a second signal stops the server immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+
+	watchTokens(srv)
+	watchRestart(srv)
 	log.Info("Starting NVRemoted")
-	if useTLS && !disableTLS {
-		log.Fatal(srv.ListenAndServeTLS(bindAddr, certFile, keyFile))
+	ready()
+	if err := serve(ctx, cmd, srv); err != nil {
+		log.Fatal(err)
+	}
+	if tracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			log.WithError(err).Warn("Error flushing traces")
+		}
+		cancel()
+	}
+	log.Info("NVRemoted stopped")
+}
+
+// serve serves clients on the configured addresses, until the server is shut down or ctx is canceled.
+func serve(ctx context.Context, cmd *cobra.Command, srv *server.Server) error {
+	listeners, err := listenConfigs(cmd)
+	if err != nil {
+		return err
+	}
+	if listeners != nil {
+		for _, listener := range listeners {
+			if listener.TLS {
+				setupTLS(srv)
+				break
+			}
+		}
+		return srv.ListenAndServeAllContext(ctx, listeners)
+	}
+
+	bindAddr := viper.GetString("server.bind")
+	if viper.GetBool("tls.useTls") && !disableTLS {
+		setupTLS(srv)
+		return srv.ListenAndServeTLSContext(ctx, bindAddr, "", "")
+	}
+	return srv.ListenAndServeContext(ctx, bindAddr)
+}
+
+// listenConfigs gets the addresses configured in server.listeners,
+// or nil if the server should only listen on server.bind, which is also the case if --bind was given.
+// With --disable-tls, none of the listeners use TLS.
+func listenConfigs(cmd *cobra.Command) ([]server.ListenConfig, error) {
+	if cmd.Flags().Changed("bind") {
+		return nil, nil
+	}
+	var configs []struct {
+		Bind string
+		TLS  bool
+	}
+	if err := viper.UnmarshalKey("server.listeners", &configs); err != nil {
+		return nil, errors.Wrap(err, "server.listeners")
+	}
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	listeners := make([]server.ListenConfig, 0, len(configs))
+	for _, config := range configs {
+		if config.Bind == "" {
+			return nil, errors.New("server.listeners: every listener needs a bind address")
+		}
+		listeners = append(listeners, server.ListenConfig{
+			Addr: config.Bind,
+			TLS:  config.TLS && !disableTLS,
+		})
+	}
+	return listeners, nil
+}
+
+// configTokens gets the tokens configured in server.tokens.
+func configTokens() ([]server.Token, error) {
+	var tokens []server.Token
+	if err := viper.UnmarshalKey("server.tokens", &tokens); err != nil {
+		return nil, errors.Wrap(err, "server.tokens")
+	}
+	for _, token := range tokens {
+		if err := token.Validate(); err != nil {
+			return nil, errors.Wrap(err, "server.tokens")
+		}
+	}
+	return tokens, nil
+}
+
+// configAuthenticator creates the authenticator configured by server.authTokens or server.authUrl, if either is set.
+func configAuthenticator() (server.Authenticator, error) {
+	var authTokens []server.AuthToken
+	if err := viper.UnmarshalKey("server.authTokens", &authTokens); err != nil {
+		return nil, errors.Wrap(err, "server.authTokens")
+	}
+	authURL := viper.GetString("server.authUrl")
+	switch {
+	case len(authTokens) > 0 && authURL != "":
+		return nil, errors.New("server.authTokens and server.authUrl can't both be set")
+	case len(authTokens) > 0:
+		auth, err := server.NewStaticTokenAuthenticator(authTokens...)
+		if err != nil {
+			return nil, errors.Wrap(err, "server.authTokens")
+		}
+		return auth, nil
+	case authURL != "":
+		auth, err := server.NewHTTPAuthenticator(authURL, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "server.authUrl")
+		}
+		return auth, nil
+	}
+	return nil, nil
+}
+
+// configCluster gets the cluster configured by server.cluster, if it is set.
+// Nothing connects to the backplane until the server starts.
+func configCluster() (server.Cluster, error) {
+	url := viper.GetString("server.cluster")
+	if url == "" {
+		return server.Cluster{}, nil
+	}
+	tlsConfig, err := configClusterTLS()
+	if err != nil {
+		return server.Cluster{}, err
+	}
+	backplane, err := server.NewBackplane(url, tlsConfig)
+	if err != nil {
+		return server.Cluster{}, errors.Wrap(err, "server.cluster")
+	}
+	return server.Cluster{
+		Backplane: backplane,
+		Node:      viper.GetString("server.clusterNode"),
+		Prefix:    viper.GetString("server.clusterPrefix"),
+		Heartbeat: viper.GetDuration("server.clusterHeartbeat") * time.Second,
+	}, nil
+}
+
+// configClusterTLS gets the TLS configuration for connecting to the cluster's backplane with mutual TLS,
+// from server.clusterCaFile, server.clusterCertFile and server.clusterKeyFile, or nil if they aren't set.
+func configClusterTLS() (*tls.Config, error) {
+	caFile := os.ExpandEnv(viper.GetString("server.clusterCaFile"))
+	certFile := os.ExpandEnv(viper.GetString("server.clusterCertFile"))
+	keyFile := os.ExpandEnv(viper.GetString("server.clusterKeyFile"))
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if caFile == "" || certFile == "" || keyFile == "" {
+		return nil, errors.New("server.clusterCaFile, server.clusterCertFile and server.clusterKeyFile must be set together")
+	}
+	certs, err := server.NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "server.clusterCertFile")
+	}
+	tlsConfig, err := server.ClusterTLSConfig(caFile, certs)
+	if err != nil {
+		return nil, errors.Wrap(err, "server.clusterCaFile")
+	}
+	clusterCerts = certs
+	return tlsConfig, nil
+}
+
+// watchTokens reloads server.tokens from the configuration file when SIGHUP is received,
+// so tokens can be added or revoked without restarting.
+func watchTokens(srv *server.Server) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := viper.ReadInConfig(); err != nil {
+				log.WithError(err).Warn("Error reloading tokens; still using the previous tokens")
+				continue
+			}
+			tokens, err := configTokens()
+			if err == nil {
+				err = srv.SetTokens(tokens)
+			}
+			if err != nil {
+				log.WithError(err).Warn("Error reloading tokens; still using the previous tokens")
+				continue
+			}
+			log.WithField("tokens", len(tokens)).Info("Received SIGHUP; reloaded tokens")
+		}
+	}()
+}
+
+// setupTLS sets the server's TLS configuration to use certificates from Let's Encrypt,
+// or from tls.certFile and tls.keyFile.
+func setupTLS(srv *server.Server) {
+	if domains := viper.GetStringSlice("tls.acmeDomains"); len(domains) > 0 {
+		srv.TLSConfig = acmeTLSConfig(domains)
+		return
+	}
+	certs, err := server.NewCertificateReloader(os.ExpandEnv(viper.GetString("tls.certFile")), os.ExpandEnv(viper.GetString("tls.keyFile")))
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv.TLSConfig = certs.TLSConfig()
+	watchCertificate(certs, "certificate")
+}
+
+// watchCertificate reloads a certificate when its files change, or when SIGHUP is received,
+// so that renewed certificates are used without restarting.
+// what names the certificate in logs.
+func watchCertificate(certs *server.CertificateReloader, what string) {
+	if interval := viper.GetDuration("tls.reloadInterval") * time.Second; interval > 0 {
+		go certs.Poll(context.Background(), interval, func() {
+			log.Info("Certificate files changed; reloaded " + what)
+		}, func(err error) {
+			log.WithError(err).Warn("Error reloading " + what + "; still using the previous one")
+		})
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := certs.Reload(); err != nil {
+				log.WithError(err).Warn("Error reloading " + what + "; still using the previous one")
+				continue
+			}
+			log.Info("Received SIGHUP; reloaded " + what)
+		}
+	}()
+}
+
+// watchMOTDFile reloads the MOTD when its file changes,
+// checking every nvremoted.motdReloadInterval seconds, and on SIGHUP.
+func watchMOTDFile(srv *server.Server, file *motd.File) {
+	logger := log.WithField("file", file.Path)
+	update := func(text string) {
+		updateMOTD(srv, text)
+		logger.Info("MOTD file changed; reloaded MOTD")
+	}
+	onError := func(err error) {
+		logger.WithError(err).Warn("Error reloading MOTD; still using the previous MOTD")
+	}
+
+	if interval := viper.GetDuration("nvremoted.motdReloadInterval") * time.Second; interval > 0 {
+		go file.Poll(context.Background(), interval, update, onError)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			text, changed, err := file.Check()
+			if err != nil {
+				onError(err)
+				continue
+			}
+			if changed {
+				update(text)
+			}
+		}
+	}()
+}
+
+// updateMOTD changes the server's MOTD for new connections,
+// and broadcasts it to connected clients if nvremoted.motdBroadcast is set.
+func updateMOTD(srv *server.Server, text string) {
+	srv.SetMOTD(strings.TrimSpace(text))
+	if viper.GetBool("nvremoted.motdBroadcast") {
+		srv.BroadcastMOTD()
+	}
+}
+
+// startRemoteMOTD fetches the MOTD from url, and keeps it up to date while the server runs.
+// If it can't be fetched, the last fetched MOTD is used, or the one from motdFile if it was never fetched.
+func startRemoteMOTD(srv *server.Server, url string) error {
+	remote, err := motd.NewRemote(url, os.ExpandEnv(viper.GetString("nvremoted.motdCacheFile")))
+	if err != nil {
+		return err
+	}
+	if cached, err := remote.LoadCache(); err == nil {
+		srv.SetMOTD(cached)
+	}
+
+	ctx := context.Background()
+	logger := log.WithField("url", url)
+	if text, _, err := remote.Fetch(ctx); err != nil {
+		logger.WithError(err).Warn("Error fetching MOTD; using the last known MOTD")
 	} else {
-		log.Fatal(srv.ListenAndServe(bindAddr))
+		srv.SetMOTD(text)
+	}
+
+	interval := viper.GetDuration("nvremoted.motdRefreshInterval") * time.Second
+	if interval <= 0 {
+		return nil
+	}
+	go remote.Poll(ctx, interval, func(text string) {
+		updateMOTD(srv, text)
+		logger.Info("MOTD updated")
+	}, func(err error) {
+		logger.WithError(err).Warn("Error fetching MOTD")
+	})
+	return nil
+}
+
+// newServer creates a server configured from the server section of the configuration.
+// opts are applied afterwards, overriding the configuration.
+func newServer(log *logrus.Logger, opts ...server.Option) (*server.Server, error) {
+	allowedChannels, err := server.ParseChannelPatterns(viper.GetStringSlice("server.allowedChannels"))
+	if err != nil {
+		return nil, errors.Wrap(err, "server.allowedChannels")
+	}
+	blockedChannels, err := server.ParseChannelPatterns(viper.GetStringSlice("server.blockedChannels"))
+	if err != nil {
+		return nil, errors.Wrap(err, "server.blockedChannels")
+	}
+	slowClientPolicy, err := server.ParseSlowClientPolicy(viper.GetString("server.slowClientPolicy"))
+	if err != nil {
+		return nil, errors.Wrap(err, "server.slowClientPolicy")
+	}
+	masterPolicy, err := server.ParseMasterPolicy(viper.GetString("server.masterPolicy"))
+	if err != nil {
+		return nil, errors.Wrap(err, "server.masterPolicy")
 	}
+	relayMode, err := server.ParseRelayMode(viper.GetString("server.relayMode"))
+	if err != nil {
+		return nil, errors.Wrap(err, "server.relayMode")
+	}
+	tlsMinVersion, err := server.ParseTLSVersion(viper.GetString("tls.minVersion"))
+	if err != nil {
+		return nil, errors.Wrap(err, "tls.minVersion")
+	}
+	tlsMaxVersion, err := server.ParseTLSVersion(viper.GetString("tls.maxVersion"))
+	if err != nil {
+		return nil, errors.Wrap(err, "tls.maxVersion")
+	}
+	if tlsMinVersion != 0 && tlsMaxVersion != 0 && tlsMinVersion > tlsMaxVersion {
+		return nil, errors.New("tls.minVersion is greater than tls.maxVersion")
+	}
+	tlsCipherSuites, err := server.ParseCipherSuites(viper.GetStringSlice("tls.cipherSuites"))
+	if err != nil {
+		return nil, errors.Wrap(err, "tls.cipherSuites")
+	}
+	tokens, err := configTokens()
+	if err != nil {
+		return nil, err
+	}
+	var channelPasswordConfigs []struct {
+		Pattern  string
+		Password string
+	}
+	if err := viper.UnmarshalKey("server.channelPasswords", &channelPasswordConfigs); err != nil {
+		return nil, errors.Wrap(err, "server.channelPasswords")
+	}
+	channelPasswords := make([]server.ChannelPassword, 0, len(channelPasswordConfigs))
+	for _, cp := range channelPasswordConfigs {
+		if cp.Password == "" {
+			return nil, errors.Errorf("server.channelPasswords: no password for %q", cp.Pattern)
+		}
+		pattern, err := server.ParseChannelPattern(cp.Pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "server.channelPasswords")
+		}
+		channelPasswords = append(channelPasswords, server.ChannelPassword{Pattern: pattern, Password: cp.Password})
+	}
+	authenticator, err := configAuthenticator()
+	if err != nil {
+		return nil, err
+	}
+	cluster, err := configCluster()
+	if err != nil {
+		return nil, err
+	}
+
+	return server.NewServer(append([]server.Option{
+		server.WithLogger(server.NewLogrusLogger(log)),
+		server.WithPing(viper.GetDuration("server.timeBetweenPings")*time.Second, viper.GetInt("server.pingsUntilTimeout")),
+		server.WithWriteTimeout(viper.GetDuration("server.writeTimeout") * time.Second),
+		server.WithReverseDNS(server.ReverseDNS{
+			Disabled: !viper.GetBool("server.reverseDns"),
+			Timeout:  viper.GetDuration("server.reverseDnsTimeout") * time.Second,
+			CacheTTL: viper.GetDuration("server.reverseDnsCacheTtl") * time.Second,
+		}),
+		server.WithFlushSize(viper.GetInt("server.flushSize")),
+		server.WithFlushDelay(viper.GetDuration("server.flushDelay") * time.Millisecond),
+		server.WithQueueSize(viper.GetInt("server.queueSize")),
+		server.WithCapacity(server.Capacity{
+			MaxConnections: viper.GetInt("server.maxConnections"),
+			MaxClients:     viper.GetInt("server.maxClients"),
+			MaxChannels:    viper.GetInt("server.maxChannels"),
+		}),
+		server.WithMaxAcceptRate(viper.GetFloat64("server.maxAcceptRate")),
+		server.WithCreationLimit(server.CreationLimit{
+			PerMinute: viper.GetInt("server.channelCreationsPerMinute"),
+			PerHour:   viper.GetInt("server.channelCreationsPerHour"),
+		}),
+		server.WithCompression(viper.GetStringSlice("server.compression")...),
+		server.WithTLSVersions(tlsMinVersion, tlsMaxVersion),
+		server.WithTLSCipherSuites(tlsCipherSuites),
+		server.WithSlowClientPolicy(slowClientPolicy),
+		server.WithMasterPolicy(masterPolicy),
+		server.WithRelayMode(relayMode),
+		server.WithSessionGrace(viper.GetDuration("server.sessionGrace") * time.Second),
+		server.WithDispatchShards(viper.GetInt("server.dispatchShards")),
+		server.WithMOTD(strings.TrimSpace(localMOTD)),
+		server.WithStatsAuth(viper.GetString("server.statsPassword"), tokens...),
+		server.WithBanFile(os.ExpandEnv(viper.GetString("server.banFile"))),
+		server.WithAbuseBans(server.AbuseBans{
+			Strikes:  viper.GetInt("server.abuseStrikes"),
+			Window:   viper.GetDuration("server.abuseWindow") * time.Second,
+			Duration: viper.GetDuration("server.abuseBanDuration") * time.Second,
+		}),
+		server.WithIPLists(server.IPLists{
+			AllowFile:    os.ExpandEnv(viper.GetString("server.ipAllowlistFile")),
+			DenyFile:     os.ExpandEnv(viper.GetString("server.ipDenylistFile")),
+			DenyURLs:     viper.GetStringSlice("server.ipDenylistUrls"),
+			FeedInterval: viper.GetDuration("server.ipDenylistInterval") * time.Second,
+		}),
+		server.WithE2eOnly(viper.GetBool("server.e2eOnly")),
+		server.WithCapabilities(viper.GetBool("server.advertiseCapabilities")),
+		server.WithProtocolVersions(viper.GetIntSlice("server.protocolVersions")...),
+		server.WithAllowedChannels(allowedChannels...),
+		server.WithBlockedChannels(blockedChannels...),
+		server.WithChannelPasswords(channelPasswords...),
+		server.WithAuthenticator(authenticator),
+		server.WithWebhooks(viper.GetStringSlice("server.webhooks")...),
+		server.WithPprof(viper.GetBool("server.pprof")),
+		server.WithDashboard(viper.GetBool("server.dashboard")),
+		server.WithPrivacy(viper.GetBool("server.privacy")),
+		server.WithPrivacyKey(viper.GetString("server.privacyKey")),
+		server.WithRandomIDs(viper.GetBool("server.randomClientIds")),
+		server.WithHistory(server.StatsHistory{
+			File:      os.ExpandEnv(viper.GetString("server.historyFile")),
+			Interval:  viper.GetDuration("server.historyInterval") * time.Second,
+			Retention: viper.GetDuration("server.historyRetention") * 24 * time.Hour,
+		}),
+		server.WithStatsd(server.Statsd{
+			Addr:     viper.GetString("server.statsd"),
+			Prefix:   viper.GetString("server.statsdPrefix"),
+			Interval: viper.GetDuration("server.statsdInterval") * time.Second,
+		}),
+		server.WithCluster(cluster),
+		server.WithChannelQuota(server.ChannelQuota{
+			HourlySoft: viper.GetInt64("server.channelQuotaHourlySoft") * 1024 * 1024,
+			HourlyHard: viper.GetInt64("server.channelQuotaHourlyHard") * 1024 * 1024,
+			DailySoft:  viper.GetInt64("server.channelQuotaDailySoft") * 1024 * 1024,
+			DailyHard:  viper.GetInt64("server.channelQuotaDailyHard") * 1024 * 1024,
+		}),
+		server.WithRateLimit(server.RateLimit{
+			Rate:      viper.GetFloat64("server.rateLimit"),
+			Burst:     viper.GetInt("server.rateLimitBurst"),
+			KickAfter: viper.GetDuration("server.rateLimitKickAfter") * time.Second,
+		}),
+		server.WithMessageLimits(server.MessageLimits{
+			MaxDepth: viper.GetInt("server.maxMessageDepth"),
+			MaxKeys:  viper.GetInt("server.maxMessageKeys"),
+		}),
+		server.WithBind(server.BindPolicy{
+			FallbackAddrs: viper.GetStringSlice("server.bindFallbacks"),
+			Retries:       viper.GetInt("server.bindRetries"),
+			RetryDelay:    viper.GetDuration("server.bindRetryDelay") * time.Second,
+		}),
+	}, opts...)...)
 }
@@ -5,31 +5,31 @@
 package commands
 
 import (
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 
+	"github.com/n0ot/nvremoted/pkg/client"
+	"github.com/n0ot/nvremoted/pkg/history"
 	"github.com/n0ot/nvremoted/pkg/server"
 	"github.com/pkg/errors"
 
-	"github.com/howeyc/gopass"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var (
-	statsHost              string
-	statsPort              string
-	skipTLSVerification    bool
-	statsServerCertificate string
-	statsPassword          string
-	promptForPassword      bool
+	statsCheck    bool
+	statsMetric   string
+	statsWarn     float64
+	statsCritical float64
+	statsHistory  time.Duration
 )
 
 // statsCmd represents the stats command
@@ -38,158 +38,396 @@ var statsCmd = &cobra.Command{
 	Short: "Print stats from an NVRemoted server",
 	Long: `stats queries an NVRemoted server for running stats.
 
-If the host is omitted, the local nvremoted server will be queried.`,
+If the host is omitted, the local nvremoted server will be queried.
+
+With --check, a single stat is compared against the --warn and --crit thresholds,
+and a one line summary is printed with an exit status compatible with Nagios and Icinga plugins:
+0 (OK), 1 (WARNING), 2 (CRITICAL), or 3 (UNKNOWN).
+Metrics that can be checked are: ` + strings.Join(checkMetricNames(), ", ") + `.
+
+With --history, the stats the server recorded over that long, such as 24h, are printed instead,
+with the traffic between each sample. The server must have server.historyFile set.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		host := "127.0.0.1"
-		if len(args) > 0 {
-			host = args[0]
-			if disableTLS {
-				fmt.Fprintln(os.Stderr, "Warning: TLS is disabled. All traffic including your stats password will be sent in the clear.")
-			} else if skipTLSVerification {
-				fmt.Fprintln(os.Stderr, "Warning: skipping TLS verification is insecure.")
-			}
-		} else {
-			// Use the options from the local server's configuration.
-			if _, port, err := net.SplitHostPort(viper.GetString("server.bind")); err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: cannot determine local server port from config; using \"%s\"\n", statsPort)
-			} else {
-				statsPort = port
-			}
-			disableTLS = !viper.GetBool("tls.useTls")
-			skipTLSVerification = true
-			statsPassword = viper.GetString("server.statsPassword")
-			if !disableTLS {
-				fmt.Fprintln(os.Stderr, "Skipping TLS verification for local server query")
-			}
+		if statsHistory > 0 {
+			return printHistory(remoteHost(args))
+		}
+		if statsCheck {
+			checkStats(cmd, remoteHost(args))
+			return nil
 		}
-		return getStats(host)
+		return printStats(remoteHost(args))
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(statsCmd)
-	statsCmd.Flags().StringVarP(&statsPort, "port", "P", "6837", "port of the server to query stats for")
-	statsCmd.Flags().BoolVarP(&disableTLS, "disable-tls", "d", false, "disable connecting over TLS")
-	statsCmd.Flags().BoolVarP(&skipTLSVerification, "no-tls-verify", "n", false, "skip TLS verification\n    This is insecure, an attacker can get your password, and you should only use this for testing")
-	statsCmd.Flags().StringVarP(&statsServerCertificate, "server-certificate", "s", "", "file containing the PEM encoded certificate to use for server verification, instead of the system's certificate store")
-	statsCmd.Flags().BoolVarP(&promptForPassword, "prompt-for-password", "p", false, "prompt for the server's stats password\n    If unset, the password is the same as the local server's.")
+	addRemoteFlags(statsCmd)
+	statsCmd.Flags().BoolVar(&statsCheck, "check", false, "check a stat against thresholds, and exit with a monitoring plugin status")
+	statsCmd.Flags().StringVar(&statsMetric, "metric", "clients", "stat to check with --check")
+	statsCmd.Flags().Float64Var(&statsWarn, "warn", 0, "warning threshold for --check; the stat must not exceed this")
+	statsCmd.Flags().Float64Var(&statsCritical, "crit", 0, "critical threshold for --check; the stat must not exceed this")
+	statsCmd.Flags().DurationVar(&statsHistory, "history", 0, "print the stats recorded over this long, such as 24h")
 
 	viper.SetDefault("server.statsPassword", "")
 }
 
-func getStats(statsHost string) error {
-	if promptForPassword {
-		fmt.Printf("Password: ")
-		pass, err := gopass.GetPasswd()
-		if err != nil {
-			return err
-		}
-		statsPassword = string(pass)
+// fetchStats gets stats from the server at host.
+// If the server sends a MOTD, it is passed to onMOTD.
+func fetchStats(host string, onMOTD func(string)) (server.Stats, error) {
+	var stats server.Stats
+	if controlSocket != "" {
+		err := adminRequest(host, "stats", nil, &stats)
+		checkStatsVersion(stats)
+		return stats, err
 	}
 
-	if statsPassword == "" {
-		statsPassword = os.Getenv("NVREMOTED_STATS_PASSWORD")
+	password, err := getRemotePassword()
+	if err != nil {
+		return stats, err
 	}
 
-	if statsPassword == "" {
-		return errors.New("A stats password is required")
+	req := server.ClientStatMessage{
+		GenericClientMessage: server.GenericClientMessage{
+			Type: "stat",
+		},
+		Password: password,
 	}
 
-	var conn net.Conn
-	var err error
-	statsAddr := net.JoinHostPort(statsHost, statsPort)
-	if disableTLS {
-		conn, err = net.Dial("tcp", statsAddr)
-	} else {
-		var certPool *x509.CertPool
-		if statsServerCertificate != "" {
-			cert, err := ioutil.ReadFile(statsServerCertificate)
-			if err != nil {
-				return errors.Wrap(err, "Open server certificate")
+	err = remoteRequest(host, req, func(msgType string, raw json.RawMessage) (bool, error) {
+		switch msgType {
+		case "motd":
+			var msg server.ClientMOTDResponse
+			if err := json.Unmarshal(raw, &msg); err != nil {
+				return true, errors.Wrap(err, "Get stats response from server")
 			}
-			certPool = x509.NewCertPool()
-			certPool.AppendCertsFromPEM(cert)
+			onMOTD(msg.MOTD)
+			return false, nil
+
+		case "stats":
+			var msg server.ClientStatsResponse
+			if err := json.Unmarshal(raw, &msg); err != nil {
+				return true, errors.Wrap(err, "Get stats response from server")
+			}
+			stats = msg.Stats
+			checkStatsVersion(stats)
+			return true, nil
 		}
+		// Ignore all unknown messages
+		return false, nil
+	})
+	return stats, err
+}
 
-		conn, err = tls.Dial("tcp", statsAddr, &tls.Config{
-			InsecureSkipVerify: skipTLSVerification,
-			RootCAs:            certPool,
-		})
-	}
-	if err != nil {
-		return errors.Wrap(err, "Connect to NVRemoted server")
+// checkStatsVersion warns if stats came from a newer server than this one.
+func checkStatsVersion(stats server.Stats) {
+	if stats.Version > server.StatsVersion {
+		fmt.Fprintf(os.Stderr, "Warning: the server's stats are version %d, newer than this version of nvremoted understands (%d)\n", stats.Version, server.StatsVersion)
 	}
-	defer conn.Close()
-
-	enc := json.NewEncoder(conn)
-	dec := json.NewDecoder(conn)
-	var raw json.RawMessage
+}
 
-	err = enc.Encode(server.ClientStatMessage{
-		GenericClientMessage: server.GenericClientMessage{
-			Type: "stat",
-		},
-		Password: statsPassword,
+func printStats(statsHost string) error {
+	stats, err := fetchStats(statsHost, func(motd string) {
+		fmt.Printf("MOTD: %s\n\n", motd)
 	})
 	if err != nil {
-		return errors.Wrap(err, "Request stats")
+		return err
 	}
 
-	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	// Don't display the default port in the output.
+	friendlyAddr := statsHost
+	if remotePort != "" && remotePort != client.DefaultPort {
+		friendlyAddr = net.JoinHostPort(statsHost, remotePort)
+	}
+	fmt.Printf(`Stats for %s:
+Listening on: %s
+Uptime: %s
+Number of channels: %d (%d serving clients using end-to-end encryption),
+Max channels: %d on %s
+
+Number of connections: %d
+Number of clients: %d
+Max clients: %d on %s
+
+Max message rate: %d/s on %s
+Max byte rate: %s/s on %s
+Received: %s, sent: %s, messages relayed: %d
+%s%s
+Connects in the last minute: %d (%d reconnects), %d total (%d reconnects)
+Disconnects in the last minute: %d, %d total
+%s
+%s
+Joins rejected by the channel blocklist: %d
+Joins rejected by the channel creation limit: %d
+Joins refused for not using end-to-end encryption: %d
+Clients throttled by the rate limit: %d (%d kicked)
+Messages over the message limits: %d
+Messages dropped for slow clients: %d
+Slow clients disconnected: %d
+Sessions resumed: %d
+Rejected because the server was full: %d connections, %d joins over max clients, %d over max channels
+Connections rejected by bans: %d
+Connections rejected by the IP allowlist, denylist and deny feeds: %d
+%s
+Goroutines: %d
+Heap in use: %s
+Total allocated: %s
+Open files: %s
+%s`, friendlyAddr, strings.Join(stats.ListenAddrs, ", "), stats.Uptime,
+		stats.NumChannels, stats.NumE2eChannels,
+		stats.MaxChannels, stats.MaxChannelsTime,
+		stats.NumConnections,
+		stats.NumClients,
+		stats.MaxClients, stats.MaxClientsTime,
+		stats.MaxMessageRate, stats.MaxMessageRateTime,
+		formatBytes(uint64(stats.MaxByteRate)), stats.MaxByteRateTime,
+		formatBytes(uint64(stats.BytesReceived)), formatBytes(uint64(stats.BytesSent)), stats.MessagesRelayed,
+		formatTopChannels(stats.TopChannels),
+		formatTopMessageTypes(stats.TopMessageTypes),
+		stats.Churn.ConnectsPerMinute, stats.Churn.ReconnectsPerMinute,
+		stats.Churn.TotalConnects, stats.Churn.TotalReconnects,
+		stats.Churn.DisconnectsPerMinute, stats.Churn.TotalDisconnects,
+		formatCounts(stats.Churn.DisconnectReasons),
+		formatLatency(stats.Latency),
+		stats.BlockedJoins,
+		stats.CreationLimitedJoins,
+		stats.NonE2eJoins,
+		stats.RateLimitThrottles, stats.RateLimitKicks,
+		stats.MessageLimitViolations,
+		stats.SlowClientDrops,
+		stats.SlowClientDisconnects,
+		stats.SessionsResumed,
+		stats.FullConnections, stats.FullClientJoins, stats.FullChannelJoins,
+		stats.BannedConnections,
+		stats.DeniedConnections,
+		formatCounts(stats.DeniedBySource),
+		stats.NumGoroutines,
+		formatBytes(stats.HeapInUse),
+		formatBytes(stats.TotalAlloc),
+		formatOpenFiles(stats.OpenFiles),
+		formatCluster(stats.Cluster))
+	return nil
+}
 
-	messages := map[string]func() server.Message{
-		"motd":  func() server.Message { return &server.ClientMOTDResponse{} },
-		"error": func() server.Message { return &server.ClientErrorResponse{} },
-		"stats": func() server.Message { return &server.ClientStatsResponse{} },
+// printHistory prints the stats recorded by the server at statsHost, over the last statsHistory.
+func printHistory(statsHost string) error {
+	var samples []history.Sample
+	if err := adminRequest(statsHost, "history", server.HistoryArgs{Window: statsHistory.String()}, &samples); err != nil {
+		return err
+	}
+	if len(samples) == 0 {
+		fmt.Println("No stats have been recorded in that time.")
+		return nil
 	}
 
-	for {
-		if err := dec.Decode(&raw); err != nil {
-			if err == io.EOF {
-				return errors.New("Connection closed by remote host")
-			}
-			return errors.Wrap(err, "Get stats response from server")
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "TIME\tCLIENTS\tCONNECTIONS\tCHANNELS\tRECEIVED\tSENT\tRELAYED\t")
+	for i, sample := range samples {
+		// Traffic is shown since the previous sample; the first has nothing to compare to,
+		// and a drop means the server restarted in between.
+		traffic := "-\t-\t-"
+		if i > 0 && sample.MessagesRelayed >= samples[i-1].MessagesRelayed {
+			prev := samples[i-1]
+			traffic = fmt.Sprintf("%s\t%s\t%d",
+				formatBytes(uint64(sample.BytesReceived-prev.BytesReceived)),
+				formatBytes(uint64(sample.BytesSent-prev.BytesSent)),
+				sample.MessagesRelayed-prev.MessagesRelayed)
 		}
-		var unknownMSG server.GenericClientResponse
-		if err := json.Unmarshal(raw, &unknownMSG); err != nil {
-			return errors.Wrap(err, "Get stats response from server")
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t\n", sample.Time.Local().Format("2006-01-02 15:04:05"),
+			sample.NumClients, sample.NumConnections, sample.NumChannels, traffic)
+	}
+	return w.Flush()
+}
+
+// Exit statuses for monitoring plugins.
+const (
+	checkOK       = 0
+	checkWarning  = 1
+	checkCritical = 2
+	checkUnknown  = 3
+)
+
+var checkStatusNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// checkMetrics gets the value of each stat that can be checked.
+var checkMetrics = map[string]func(server.Stats) float64{
+	"clients":                func(s server.Stats) float64 { return float64(s.NumClients) },
+	"connections":            func(s server.Stats) float64 { return float64(s.NumConnections) },
+	"channels":               func(s server.Stats) float64 { return float64(s.NumChannels) },
+	"goroutines":             func(s server.Stats) float64 { return float64(s.NumGoroutines) },
+	"open_files":             func(s server.Stats) float64 { return float64(s.OpenFiles) },
+	"heap_in_use":            func(s server.Stats) float64 { return float64(s.HeapInUse) },
+	"connects_per_minute":    func(s server.Stats) float64 { return float64(s.Churn.ConnectsPerMinute) },
+	"disconnects_per_minute": func(s server.Stats) float64 { return float64(s.Churn.DisconnectsPerMinute) },
+	"reconnects_per_minute":  func(s server.Stats) float64 { return float64(s.Churn.ReconnectsPerMinute) },
+	"bytes_received":         func(s server.Stats) float64 { return float64(s.BytesReceived) },
+	"bytes_sent":             func(s server.Stats) float64 { return float64(s.BytesSent) },
+	"messages_relayed":       func(s server.Stats) float64 { return float64(s.MessagesRelayed) },
+}
+
+func checkMetricNames() []string {
+	names := make([]string, 0, len(checkMetrics))
+	for name := range checkMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkStats fetches stats and checks statsMetric against the thresholds, exiting with a monitoring plugin status.
+// Thresholds that weren't given on the command line aren't checked.
+func checkStats(cmd *cobra.Command, statsHost string) {
+	exit := func(status int, summary string) {
+		fmt.Printf("NVREMOTED %s - %s\n", checkStatusNames[status], summary)
+		os.Exit(status)
+	}
+
+	metric := checkMetrics[statsMetric]
+	if metric == nil {
+		exit(checkUnknown, fmt.Sprintf("unknown metric %q; must be one of %s", statsMetric, strings.Join(checkMetricNames(), ", ")))
+	}
+	checkWarn := cmd.Flags().Changed("warn")
+	checkCrit := cmd.Flags().Changed("crit")
+	if !checkWarn && !checkCrit {
+		exit(checkUnknown, "no --warn or --crit threshold given")
+	}
+
+	stats, err := fetchStats(statsHost, func(string) {})
+	if err != nil {
+		exit(checkUnknown, err.Error())
+	}
+
+	value := metric(stats)
+	status := checkOK
+	if checkCrit && value > statsCritical {
+		status = checkCritical
+	} else if checkWarn && value > statsWarn {
+		status = checkWarning
+	}
+
+	// Performance data, in the format label=value;warn;crit
+	thresholds := func(given bool, threshold float64) string {
+		if !given {
+			return ""
 		}
-		if messages[unknownMSG.Type] == nil {
-			// Ignore all unknown messages
-			continue
+		return strconv.FormatFloat(threshold, 'f', -1, 64)
+	}
+	perfData := fmt.Sprintf("%s=%s;%s;%s", statsMetric, strconv.FormatFloat(value, 'f', -1, 64),
+		thresholds(checkWarn, statsWarn), thresholds(checkCrit, statsCritical))
+	for _, name := range checkMetricNames() {
+		if name != statsMetric {
+			perfData += fmt.Sprintf(" %s=%s", name, strconv.FormatFloat(checkMetrics[name](stats), 'f', -1, 64))
 		}
+	}
 
-		msg := messages[unknownMSG.Type]()
-		if err := json.Unmarshal(raw, &msg); err != nil {
-			return errors.Wrap(err, "Get stats response from server")
+	exit(status, fmt.Sprintf("%s is %s | %s", statsMetric, strconv.FormatFloat(value, 'f', -1, 64), perfData))
+}
+
+// formatCounts lists counts by name, such as disconnect reasons, most common first.
+func formatCounts(reasons map[string]int64) string {
+	names := make([]string, 0, len(reasons))
+	for reason := range reasons {
+		names = append(names, reason)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if reasons[names[i]] != reasons[names[j]] {
+			return reasons[names[i]] > reasons[names[j]]
 		}
+		return names[i] < names[j]
+	})
 
-		switch msg := msg.(type) {
-		case *server.ClientMOTDResponse:
-			fmt.Printf("MOTD: %s\n\n", msg.MOTD)
+	var b strings.Builder
+	for _, reason := range names {
+		fmt.Fprintf(&b, "    %s: %d\n", reason, reasons[reason])
+	}
+	return b.String()
+}
 
-		case *server.ClientErrorResponse:
-			return errors.Errorf("Server returned an error: %s", msg.Error)
+// formatTopChannels lists the busiest channels' traffic, under a heading.
+func formatTopChannels(channels []server.ChannelTraffic) string {
+	if len(channels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("Busiest channels:\n")
+	for _, c := range channels {
+		fmt.Fprintf(&b, "    %s: %s received, %s sent, %d messages relayed\n",
+			c.Channel, formatBytes(uint64(c.BytesReceived)), formatBytes(uint64(c.BytesSent)), c.MessagesRelayed)
+	}
+	return b.String()
+}
 
-		case *server.ClientStatsResponse:
-			// Don't display the default port in the output.
-			friendlyAddr := statsHost
-			if statsPort != "6837" {
-				friendlyAddr = statsAddr
-			}
-			fmt.Printf(`Stats for %s:
-Uptime: %s
-Number of channels: %d (%d serving clients using end-to-end encryption),
-Max channels: %d on %s
+// formatTopMessageTypes lists the most relayed message types' traffic, under a heading.
+func formatTopMessageTypes(types []server.MessageTypeTraffic) string {
+	if len(types) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("Most relayed message types:\n")
+	for _, t := range types {
+		fmt.Fprintf(&b, "    %s: %d messages, %s\n", t.Type, t.Messages, formatBytes(uint64(t.Bytes)))
+	}
+	return b.String()
+}
 
-Number of clients: %d
-Max clients: %d on %s
-`, friendlyAddr, msg.Stats.Uptime,
-				msg.Stats.NumChannels, msg.Stats.NumE2eChannels,
-				msg.Stats.MaxChannels, msg.Stats.MaxChannelsTime,
-				msg.Stats.NumClients,
-				msg.Stats.MaxClients, msg.Stats.MaxClientsTime)
-			return nil
+// formatCluster formats the stats of the cluster the server belongs to, or nothing if it isn't clustered.
+func formatCluster(cluster *server.ClusterStats) string {
+	if cluster == nil {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "\nCluster of %d nodes: %d connections, %d clients, %d channels\n",
+		len(cluster.Nodes), cluster.NumConnections, cluster.NumClients, cluster.NumChannels)
+	for _, node := range cluster.Nodes {
+		this := ""
+		if node.Node == cluster.Node {
+			this = " (this node)"
+		}
+		if node.Draining {
+			this += " (draining)"
 		}
+		fmt.Fprintf(&b, "    %s [%s]%s: %d connections, %d clients, %d channels, last seen %s\n",
+			node.Name, node.Node, this, node.NumConnections, node.NumClients, node.NumChannels, node.LastSeen.Local().Format(time.TimeOnly))
+	}
+	if cluster.Dropped > 0 {
+		fmt.Fprintf(&b, "Messages dropped because the backplane or channels weren't keeping up: %d\n", cluster.Dropped)
+	}
+	return b.String()
+}
+
+// formatLatency formats the round trip time percentiles of clients whose latency is measured.
+func formatLatency(latency server.LatencyStats) string {
+	if latency.Clients == 0 {
+		return "Round trip times: none measured"
+	}
+	return fmt.Sprintf("Round trip times of %d clients: p50 %s, p90 %s, p99 %s, max %s",
+		latency.Clients, formatRTT(latency.P50), formatRTT(latency.P90), formatRTT(latency.P99), formatRTT(latency.Max))
+}
+
+// formatRTT formats a round trip time to the millisecond, or microsecond if it is shorter.
+func formatRTT(rtt time.Duration) string {
+	if rtt < time.Millisecond {
+		return rtt.Round(time.Microsecond).String()
+	}
+	return rtt.Round(time.Millisecond).String()
+}
+
+// formatBytes formats a number of bytes with a binary unit suffix.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatOpenFiles(n int) string {
+	if n < 0 {
+		return "unknown"
 	}
+	return fmt.Sprint(n)
 }
@@ -0,0 +1,61 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/n0ot/nvremoted/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	stopIn      time.Duration
+	stopMessage string
+	stopCancel  bool
+)
+
+// stopCmd represents the stop command
+var stopCmd = &cobra.Command{
+	Use:   "stop [host]",
+	Short: "Shut down a running NVRemoted server",
+	Long: `stop shuts down an NVRemoted server, now or after a delay given with --in.
+
+The shutdown is announced to all clients, along with --message, and again a minute before it happens.
+Until then, channels can't be joined.
+When the time comes, clients are kicked with the reason "server shutting down", and the server exits.
+A scheduled shutdown can be canceled with --cancel.
+
+If the host is omitted, the local nvremoted server will be used.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		shutdownArgs := server.ShutdownArgs{
+			Message: stopMessage,
+			Cancel:  stopCancel,
+		}
+		if stopIn > 0 {
+			shutdownArgs.Delay = stopIn.String()
+		}
+		var result server.ShutdownResult
+		if err := adminRequest(remoteHost(args), "shutdown", shutdownArgs, &result); err != nil {
+			return err
+		}
+		if stopCancel {
+			fmt.Println("Shutdown canceled.")
+		} else {
+			fmt.Printf("Shutting down at %s.\n", result.At.Local().Format(time.RFC1123))
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(stopCmd)
+	addRemoteFlags(stopCmd)
+	stopCmd.Flags().DurationVar(&stopIn, "in", 0, "how long to wait before shutting down (default now)")
+	stopCmd.Flags().StringVar(&stopMessage, "message", "", "message announced to clients along with the shutdown")
+	stopCmd.Flags().BoolVar(&stopCancel, "cancel", false, "cancel a scheduled shutdown")
+}
@@ -0,0 +1,324 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/n0ot/nvremoted/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	topInterval time.Duration
+	topScreen   bool
+	topEvents   int
+)
+
+// topCmd represents the top command
+var topCmd = &cobra.Command{
+	Use:   "top [host]",
+	Short: "Watch a running NVRemoted server's clients, channels and traffic live",
+	Long: `top watches an NVRemoted server, asking it for its stats, clients and channels every --interval.
+
+By default, top suits screen readers and logs: it lists the clients and channels once,
+then prints a line for each thing that happened since it last asked, such as a client connecting,
+joining or leaving a channel, a channel being created or closed, or connections being refused,
+and a summary of the clients, channels and traffic whenever that changes. Nothing is redrawn,
+so each line is read once, and the output can be reviewed or saved.
+
+With --screen, the terminal is instead redrawn every --interval, like top,
+with the summary, the last --events events, and tables of the clients and channels.
+
+If the host is omitted, the local nvremoted server will be watched.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if topInterval < time.Second {
+			return errors.New("--interval must be at least 1s")
+		}
+		if topEvents < 1 {
+			return errors.New("--events must be at least 1")
+		}
+		// Only ask for the password once, rather than every interval.
+		if controlSocket == "" && promptForPassword {
+			if _, err := getRemotePassword(); err != nil {
+				return err
+			}
+			promptForPassword = false
+		}
+
+		host := remoteHost(args)
+		snap, err := fetchTopSnapshot(host)
+		if err != nil {
+			return err
+		}
+		if topScreen {
+			watchTopScreen(host, snap)
+		} else {
+			watchTopStream(host, snap)
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(topCmd)
+	addRemoteFlags(topCmd)
+	topCmd.Flags().DurationVar(&topInterval, "interval", 5*time.Second, "how often to ask the server for updates")
+	topCmd.Flags().BoolVar(&topScreen, "screen", false, "redraw the terminal every interval, instead of printing what changed")
+	topCmd.Flags().IntVar(&topEvents, "events", 10, "number of recent events shown with --screen")
+}
+
+// topSnapshot is what the server reported at a moment.
+type topSnapshot struct {
+	time     time.Time
+	stats    server.Stats
+	clients  []server.ClientInfo
+	channels []server.ChannelInfo
+}
+
+// fetchTopSnapshot asks the server at host for its stats, clients and channels.
+func fetchTopSnapshot(host string) (topSnapshot, error) {
+	snap := topSnapshot{time: time.Now()}
+	if err := adminRequest(host, "stats", nil, &snap.stats); err != nil {
+		return snap, err
+	}
+	if err := adminRequest(host, "clients", nil, &snap.clients); err != nil {
+		return snap, err
+	}
+	if err := adminRequest(host, "channels", nil, &snap.channels); err != nil {
+		return snap, err
+	}
+	return snap, nil
+}
+
+// watchTopStream prints the clients and channels in snap, then what changes every topInterval, forever.
+func watchTopStream(host string, snap topSnapshot) {
+	fmt.Printf("Watching %s every %s; press Ctrl+C to stop.\n", host, topInterval)
+	fmt.Printf("%s %s\n", topTime(snap.time), formatTopSummary(nil, snap))
+	activity := topActivity(nil, snap)
+	printTopTables(os.Stdout, snap)
+
+	lastErr := ""
+	for {
+		time.Sleep(topInterval)
+		next, err := fetchTopSnapshot(host)
+		if err != nil {
+			// Only say so once, however long the server can't be reached.
+			if err.Error() != lastErr {
+				fmt.Printf("%s Couldn't get updates: %s\n", topTime(time.Now()), err)
+				lastErr = err.Error()
+			}
+			continue
+		}
+		if lastErr != "" {
+			fmt.Printf("%s Getting updates again.\n", topTime(next.time))
+			lastErr = ""
+		}
+		for _, event := range topEventsBetween(snap, next) {
+			fmt.Printf("%s %s\n", topTime(next.time), event)
+		}
+		// top's own requests are counted in the bytes the server receives and sends,
+		// so only changes in the counts and the message rate are worth a new summary.
+		if a := topActivity(&snap, next); a != activity {
+			fmt.Printf("%s %s\n", topTime(next.time), formatTopSummary(&snap, next))
+			activity = a
+		}
+		snap = next
+	}
+}
+
+// watchTopScreen redraws the terminal with snap, and the most recent events, every topInterval, forever.
+func watchTopScreen(host string, snap topSnapshot) {
+	var (
+		prev   *topSnapshot
+		events []string
+		status string
+	)
+	for {
+		// Clear the screen, and move to its top left.
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("NVRemoted top: %s, updated %s, every %s\n", host, topTime(snap.time), topInterval)
+		if status != "" {
+			fmt.Println(status)
+		}
+		fmt.Println(formatTopSummary(prev, snap))
+		fmt.Println()
+		if len(events) == 0 {
+			fmt.Println("No events yet.")
+		} else {
+			fmt.Println("Recent events, newest last:")
+			for _, event := range events {
+				fmt.Printf("    %s\n", event)
+			}
+		}
+		printTopTables(os.Stdout, snap)
+
+		time.Sleep(topInterval)
+		next, err := fetchTopSnapshot(host)
+		if err != nil {
+			status = fmt.Sprintf("Couldn't get updates at %s: %s", topTime(time.Now()), err)
+			continue
+		}
+		status = ""
+		for _, event := range topEventsBetween(snap, next) {
+			events = append(events, fmt.Sprintf("%s %s", topTime(next.time), event))
+		}
+		if len(events) > topEvents {
+			events = events[len(events)-topEvents:]
+		}
+		last := snap
+		prev, snap = &last, next
+	}
+}
+
+// topTime formats when something happened for top.
+func topTime(t time.Time) string {
+	return t.Local().Format(time.TimeOnly)
+}
+
+// formatTopSummary summarizes the clients, channels and traffic in snap.
+// Rates are only given if there is an earlier snapshot, prev, from the same run of the server to compare to.
+func formatTopSummary(prev *topSnapshot, snap topSnapshot) string {
+	s := snap.stats
+	summary := formatTopCounts(s)
+	if prev == nil || s.Uptime < prev.stats.Uptime {
+		return summary + "."
+	}
+	return summary + fmt.Sprintf("; messages relayed a second: %.1f, received: %s/s, sent: %s/s.",
+		topRate(*prev, snap, func(s server.Stats) int64 { return s.MessagesRelayed }),
+		formatBytes(uint64(topRate(*prev, snap, func(s server.Stats) int64 { return s.BytesReceived }))),
+		formatBytes(uint64(topRate(*prev, snap, func(s server.Stats) int64 { return s.BytesSent }))))
+}
+
+func formatTopCounts(s server.Stats) string {
+	return fmt.Sprintf("Connections: %d, clients: %d, channels: %d", s.NumConnections, s.NumClients, s.NumChannels)
+}
+
+// topRate is how fast the stat got by get went up a second between prev and snap.
+func topRate(prev, snap topSnapshot, get func(server.Stats) int64) float64 {
+	return float64(get(snap.stats)-get(prev.stats)) / snap.time.Sub(prev.time).Seconds()
+}
+
+// topActivity is the part of the summary of snap that watchTopStream prints a new summary for when it changes.
+func topActivity(prev *topSnapshot, snap topSnapshot) string {
+	activity := formatTopCounts(snap.stats)
+	if prev != nil && snap.stats.Uptime >= prev.stats.Uptime {
+		activity += fmt.Sprintf(" %.1f", topRate(*prev, snap, func(s server.Stats) int64 { return s.MessagesRelayed }))
+	}
+	return activity
+}
+
+// topCounters are the stats top reports increases of as events.
+var topCounters = []struct {
+	what string
+	get  func(server.Stats) int64
+}{
+	{"connections refused by bans", func(s server.Stats) int64 { return s.BannedConnections }},
+	{"connections refused by the IP allowlist, denylist and deny feeds", func(s server.Stats) int64 { return s.DeniedConnections }},
+	{"connections refused because the server was full", func(s server.Stats) int64 { return s.FullConnections }},
+	{"joins refused by the channel blocklist", func(s server.Stats) int64 { return s.BlockedJoins }},
+	{"joins refused by the channel creation limit", func(s server.Stats) int64 { return s.CreationLimitedJoins }},
+	{"clients kicked by the rate limit", func(s server.Stats) int64 { return s.RateLimitKicks }},
+	{"slow clients disconnected", func(s server.Stats) int64 { return s.SlowClientDisconnects }},
+}
+
+// topEventsBetween describes what happened between two snapshots:
+// clients connecting, joining and leaving channels, and disconnecting, channels being created and closed,
+// and increases in topCounters.
+func topEventsBetween(prev, next topSnapshot) []string {
+	var events []string
+	restarted := next.stats.Uptime < prev.stats.Uptime
+	if restarted {
+		events = append(events, "The server restarted.")
+	}
+
+	before := make(map[uint64]server.ClientInfo, len(prev.clients))
+	for _, c := range prev.clients {
+		before[c.ID] = c
+	}
+	for _, c := range next.clients {
+		old, ok := before[c.ID]
+		delete(before, c.ID)
+		if !ok || restarted {
+			events = append(events, fmt.Sprintf("Client %d connected from %s.", c.ID, c.RemoteHost))
+		}
+		if c.Channel == old.Channel && !restarted {
+			continue
+		}
+		if old.Channel != "" && !restarted {
+			events = append(events, fmt.Sprintf("Client %d left channel %s.", c.ID, old.Channel))
+		}
+		if c.Channel != "" {
+			events = append(events, fmt.Sprintf("Client %d joined channel %s as %s.", c.ID, c.Channel, c.ConnectionType))
+		}
+	}
+	// Those left in before have disconnected.
+	for _, c := range prev.clients {
+		if _, ok := before[c.ID]; ok {
+			events = append(events, fmt.Sprintf("Client %d from %s disconnected.", c.ID, c.RemoteHost))
+		}
+	}
+
+	existed := make(map[string]bool, len(prev.channels))
+	for _, ch := range prev.channels {
+		existed[ch.Name] = true
+	}
+	for _, ch := range next.channels {
+		if !existed[ch.Name] || restarted {
+			events = append(events, fmt.Sprintf("Channel %s was created.", ch.Name))
+		}
+		delete(existed, ch.Name)
+	}
+	for _, ch := range prev.channels {
+		if existed[ch.Name] {
+			events = append(events, fmt.Sprintf("Channel %s was closed.", ch.Name))
+		}
+	}
+
+	for _, counter := range topCounters {
+		n := counter.get(next.stats)
+		if !restarted {
+			n -= counter.get(prev.stats)
+		}
+		if n > 0 {
+			events = append(events, fmt.Sprintf("%d %s.", n, counter.what))
+		}
+	}
+	return events
+}
+
+// printTopTables prints the clients and channels in snap as tables, each under a heading giving how many there are.
+func printTopTables(out io.Writer, snap topSnapshot) {
+	fmt.Fprintf(out, "\nClients: %d\n", len(snap.clients))
+	if len(snap.clients) > 0 {
+		w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tCHANNEL\tTYPE\tUPTIME\tREMOTE HOST")
+		for _, c := range snap.clients {
+			channel, connectionType := c.Channel, c.ConnectionType
+			if channel == "" {
+				channel, connectionType = "-", "-"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", c.ID, channel, connectionType, formatUptime(c.Connected), c.RemoteHost)
+		}
+		w.Flush()
+	}
+
+	fmt.Fprintf(out, "\nChannels: %d\n", len(snap.channels))
+	if len(snap.channels) > 0 {
+		w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "CHANNEL\tMEMBERS\tUPTIME\tE2E\tHOUR")
+		for _, c := range snap.channels {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\n", c.Name, formatMembers(c.Members), formatUptime(c.Created), c.E2e,
+				formatBytes(uint64(c.HourBytes)))
+		}
+		w.Flush()
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+func init() {
+	viper.SetDefault("tracing.enabled", false)
+	viper.SetDefault("tracing.endpoint", "")
+	viper.SetDefault("tracing.insecure", false)
+	viper.SetDefault("tracing.sampleRatio", 1.0)
+}
+
+// newTracerProvider creates a tracer provider that exports spans over OTLP/HTTP, as configured in the tracing section,
+// or returns nil if tracing is disabled.
+// Anything not configured, such as the endpoint, can be set with the standard OTEL_EXPORTER_OTLP_* environment variables.
+func newTracerProvider() (*sdktrace.TracerProvider, error) {
+	if !viper.GetBool("tracing.enabled") {
+		return nil, nil
+	}
+	var opts []otlptracehttp.Option
+	if endpoint := viper.GetString("tracing.endpoint"); endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpoint(endpoint))
+	}
+	if viper.GetBool("tracing.insecure") {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Create OTLP exporter")
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("nvremoted"),
+		semconv.ServiceVersion(Version),
+	))
+	if err != nil {
+		return nil, errors.Wrap(err, "Create tracing resource")
+	}
+
+	// Sessions are sampled as a whole, so a sampled session's joins and messages are always traced.
+	sampler := sdktrace.ParentBased(sdktrace.TraceIDRatioBased(viper.GetFloat64("tracing.sampleRatio")))
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sampler),
+	), nil
+}
@@ -0,0 +1,207 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ProtocolVersion is the version of the NVDA Remote protocol spoken by Client.
+const ProtocolVersion = 2
+
+// eventsQueueSize is the number of events that can be received before they are read from Events.
+const eventsQueueSize = 32
+
+// ErrConnectionClosed is returned by Err when the server closed the connection.
+var ErrConnectionClosed = errors.New("Connection closed by remote host")
+
+// Event is a message received from the server.
+type Event struct {
+	// Type is the message's type, such as "channel_joined", "client_joined", or the type of a message relayed from another client.
+	Type string
+
+	// Raw holds the whole JSON encoded message.
+	Raw json.RawMessage
+}
+
+// Decode unmarshals the message into v.
+func (e Event) Decode(v interface{}) error {
+	return errors.Wrapf(json.Unmarshal(e.Raw, v), "Decode %s message", e.Type)
+}
+
+// AsError gets the error sent by the server, if this is an error message; otherwise, it returns nil.
+func (e Event) AsError() error {
+	if e.Type != "error" {
+		return nil
+	}
+	var msg struct {
+		Error string `json:"error"`
+	}
+	if err := e.Decode(&msg); err != nil {
+		return err
+	}
+	return errors.Errorf("Server returned an error: %s", msg.Error)
+}
+
+// Client is a connection to an NVDA Remote server.
+// Messages received from the server are delivered on Events, which must be read from to keep receiving them.
+type Client struct {
+	conn   net.Conn
+	events chan Event
+	done   chan struct{} // Closed by Close, so receive doesn't block on events that won't be read
+
+	sendLock sync.Mutex // Serializes sends
+	enc      *json.Encoder
+
+	errLock sync.Mutex // Protects err and closed
+	err     error
+	closed  bool
+}
+
+// Dial connects to the server at host without TLS.
+// If host has no port, the addresses from Resolve are tried in turn.
+func Dial(ctx context.Context, host string) (*Client, error) {
+	return dial(ctx, host, nil)
+}
+
+// DialTLS connects to the server at host with TLS.
+// If host has no port, the addresses from Resolve are tried in turn.
+// If config is nil, the default configuration is used, which verifies the server's certificate.
+func DialTLS(ctx context.Context, host string, config *tls.Config) (*Client, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	return dial(ctx, host, config)
+}
+
+func dial(ctx context.Context, host string, config *tls.Config) (*Client, error) {
+	addrs, err := Resolve(ctx, host)
+	if err != nil {
+		return nil, errors.Wrap(err, "Find NVRemoted server")
+	}
+	for _, addr := range addrs {
+		var conn net.Conn
+		if config == nil {
+			var d net.Dialer
+			conn, err = d.DialContext(ctx, "tcp", addr)
+		} else {
+			d := tls.Dialer{Config: config}
+			conn, err = d.DialContext(ctx, "tcp", addr)
+		}
+		if err == nil {
+			return New(conn), nil
+		}
+	}
+	return nil, errors.Wrap(err, "Connect to NVRemoted server")
+}
+
+// New creates a client that speaks the NVDA Remote protocol over an established connection.
+func New(conn net.Conn) *Client {
+	c := &Client{
+		conn:   conn,
+		events: make(chan Event, eventsQueueSize),
+		done:   make(chan struct{}),
+		enc:    json.NewEncoder(conn),
+	}
+	go c.receive()
+	return c
+}
+
+// receive delivers messages from the server to Events, until the connection ends.
+func (c *Client) receive() {
+	defer close(c.events)
+	dec := json.NewDecoder(c.conn)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if err == io.EOF {
+				c.setErr(ErrConnectionClosed)
+			} else {
+				c.setErr(errors.Wrap(err, "Receive from server"))
+			}
+			return
+		}
+		var msg struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			c.setErr(errors.Wrap(err, "Receive from server"))
+			return
+		}
+		select {
+		case c.events <- Event{Type: msg.Type, Raw: raw}:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// setErr records the error that ended the connection, unless the client was closed.
+func (c *Client) setErr(err error) {
+	c.errLock.Lock()
+	defer c.errLock.Unlock()
+	if !c.closed {
+		c.err = err
+	}
+}
+
+// Events gets the channel messages from the server are delivered on.
+// It is closed when the connection ends, after which Err reports why.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Err gets the error that ended the connection, or nil if it is still open or was closed with Close.
+// If the server closed the connection, the error is ErrConnectionClosed.
+func (c *Client) Err() error {
+	c.errLock.Lock()
+	defer c.errLock.Unlock()
+	return c.err
+}
+
+// Send sends a message to the server, which is marshaled to JSON.
+// It is safe to call Send concurrently.
+func (c *Client) Send(msg interface{}) error {
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	return errors.Wrap(c.enc.Encode(msg), "Send to server")
+}
+
+// JoinChannel asks to join a channel as connectionType, which is "master" for the controlling computer, or "slave" for the controlled one.
+// The server responds with a "channel_joined" or "error" event.
+func (c *Client) JoinChannel(channel, connectionType string) error {
+	if err := c.Send(map[string]interface{}{"type": "protocol_version", "version": ProtocolVersion}); err != nil {
+		return err
+	}
+	return c.Send(map[string]interface{}{
+		"type":            "join",
+		"channel":         channel,
+		"connection_type": connectionType,
+	})
+}
+
+// Conn gets the underlying connection, such as to set deadlines.
+func (c *Client) Conn() net.Conn {
+	return c.conn
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	c.errLock.Lock()
+	if !c.closed {
+		c.closed = true
+		c.err = nil
+		close(c.done)
+	}
+	c.errLock.Unlock()
+	return c.conn.Close()
+}
@@ -0,0 +1,58 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+// Package client implements a client for NVRemoted and other NVDA Remote servers.
+package client
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultPort is the port NVDA Remote servers listen on by default.
+const DefaultPort = "6837"
+
+// Resolve finds the addresses to try, in order, when connecting to host.
+//
+// If host includes a port, it is the only address returned.
+// Otherwise, _nvremoted._tcp SRV records are looked up for host,
+// so that servers can be moved between machines without reconfiguring clients.
+// Their targets are ordered by priority, and randomly by weight within each priority.
+// If host has no SRV records, host with DefaultPort is returned.
+func Resolve(ctx context.Context, host string) ([]string, error) {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return []string{host}, nil
+	}
+
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "nvremoted", "tcp", host)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && (dnsErr.IsNotFound || dnsErr.IsTemporary) {
+			// No SRV records; fall back to A/AAAA records.
+			return []string{net.JoinHostPort(host, DefaultPort)}, nil
+		}
+		if len(records) == 0 {
+			return nil, errors.Wrap(err, "Look up SRV records")
+		}
+		// LookupSRV returns the valid records along with an error if some were malformed.
+	}
+	if len(records) == 0 {
+		return []string{net.JoinHostPort(host, DefaultPort)}, nil
+	}
+	if len(records) == 1 && records[0].Target == "." {
+		return nil, errors.Errorf("%s does not provide an NVRemoted server", host)
+	}
+
+	// LookupSRV sorts by priority and shuffles by weight, as described in RFC 2782.
+	addrs := make([]string, 0, len(records))
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		addrs = append(addrs, net.JoinHostPort(target, strconv.Itoa(int(record.Port))))
+	}
+	return addrs, nil
+}
@@ -0,0 +1,130 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+// Package history stores periodic samples of a server's stats, so they can be viewed over time.
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// openTimeout is how long to wait for another process, such as a server handing off to its replacement, to close the store.
+const openTimeout = 5 * time.Second
+
+var samplesBucket = []byte("samples")
+
+// Sample is a snapshot of a server's stats.
+// Traffic is counted since the server started, so it goes back to 0 when the server restarts.
+type Sample struct {
+	Time            time.Time `json:"time"`
+	NumClients      int       `json:"num_clients"`
+	NumConnections  int       `json:"num_connections"`
+	NumChannels     int       `json:"num_channels"`
+	BytesReceived   int64     `json:"bytes_received"`
+	BytesSent       int64     `json:"bytes_sent"`
+	MessagesRelayed int64     `json:"messages_relayed"`
+}
+
+// Store keeps samples in a bbolt database, ordered by time.
+// The database is only open while it is being used, so that a restarting server and its replacement can share it.
+type Store struct {
+	// Path is the path of the database file.
+	Path string
+}
+
+// NewStore creates a Store for the database at path, which is created when the first sample is recorded.
+func NewStore(path string) *Store {
+	return &Store{Path: path}
+}
+
+// Record adds a sample, and removes those older than retention, if it isn't 0.
+func (s *Store) Record(sample Sample, retention time.Duration) error {
+	value, err := json.Marshal(sample)
+	if err != nil {
+		return errors.Wrap(err, "Marshal sample")
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(samplesBucket)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(timeKey(sample.Time), value); err != nil {
+			return err
+		}
+		if retention <= 0 {
+			return nil
+		}
+		cutoff := timeKey(sample.Time.Add(-retention))
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < string(cutoff); k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Since gets the samples recorded at or after since, oldest first.
+// If since is zero, all samples are returned.
+func (s *Store) Since(since time.Time) ([]Sample, error) {
+	samples := []Sample{}
+	if _, err := os.Stat(s.Path); os.IsNotExist(err) {
+		return samples, nil // Nothing has been recorded yet
+	}
+	db, err := bolt.Open(s.Path, 0600, &bolt.Options{Timeout: openTimeout, ReadOnly: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "Open stats history")
+	}
+	defer db.Close()
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(samplesBucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		k, v := c.First()
+		if !since.IsZero() {
+			k, v = c.Seek(timeKey(since))
+		}
+		for ; k != nil; k, v = c.Next() {
+			var sample Sample
+			if err := json.Unmarshal(v, &sample); err != nil {
+				return errors.Wrap(err, "Unmarshal sample")
+			}
+			samples = append(samples, sample)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Read stats history")
+	}
+	return samples, nil
+}
+
+// update opens the database and runs fn in a read-write transaction.
+func (s *Store) update(fn func(*bolt.Tx) error) error {
+	db, err := bolt.Open(s.Path, 0600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return errors.Wrap(err, "Open stats history")
+	}
+	defer db.Close()
+	if err := db.Update(fn); err != nil {
+		return errors.Wrap(err, "Write stats history")
+	}
+	return nil
+}
+
+// timeKey encodes a time as a key that sorts in time order.
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
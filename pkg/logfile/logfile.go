@@ -0,0 +1,169 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+// Package logfile writes logs to a file that is rotated when it grows too large.
+package logfile
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// backupTimeFormat is the timestamp added to the names of rotated files.
+// It sorts in time order, and contains no characters that are invalid in file names.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// File is an io.Writer that appends to a log file.
+// Once the file would grow past MaxSize, it is renamed with a timestamp, such as nvremoted-2006-01-02T15-04-05.000.log,
+// and a new file is started. Old rotated files are removed as MaxBackups and MaxAge allow.
+type File struct {
+	// Path is the path of the log file.
+	Path string
+
+	// MaxSize is the size in bytes the file may grow to before it is rotated. If 0, it is never rotated.
+	MaxSize int64
+
+	// MaxAge is how long rotated files are kept. If 0, they are kept regardless of age.
+	MaxAge time.Duration
+
+	// MaxBackups is the number of rotated files to keep. If 0, all of them are kept.
+	MaxBackups int
+
+	lock sync.Mutex // Protects the fields below, so the file can be written concurrently
+	file *os.File
+	size int64
+}
+
+// Open opens the log file at path for appending, creating it if needed.
+func Open(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*File, error) {
+	f := &File{
+		Path:       path,
+		MaxSize:    maxSize,
+		MaxAge:     maxAge,
+		MaxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write appends p to the log file, rotating it first if p would take it past MaxSize.
+// A write is never split across files.
+func (f *File) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate renames the log file with a timestamp, and starts a new one.
+func (f *File) Rotate() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.rotate()
+}
+
+// Close closes the log file.
+func (f *File) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.file.Close()
+}
+
+// open opens the log file, and gets its current size.
+func (f *File) open() error {
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Open log file")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "Open log file")
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate renames the log file and opens a new one; f.lock must be held.
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return errors.Wrap(err, "Close log file")
+	}
+	prefix, ext := f.backupName()
+	backup := filepath.Join(filepath.Dir(f.Path), prefix+time.Now().Format(backupTimeFormat)+ext)
+	if err := os.Rename(f.Path, backup); err != nil {
+		// Keep writing to the same file, rather than losing logs.
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return errors.Wrap(err, "Rotate log file")
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.removeOldBackups()
+	return nil
+}
+
+// backupName gets the parts of rotated files' base names that come before and after the timestamp.
+func (f *File) backupName() (string, string) {
+	base := filepath.Base(f.Path)
+	ext := filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + "-", ext
+}
+
+// removeOldBackups removes rotated files beyond MaxBackups, or older than MaxAge.
+// Errors are ignored, since they would have nowhere to be logged; the files are tried again at the next rotation.
+func (f *File) removeOldBackups() {
+	if f.MaxBackups <= 0 && f.MaxAge <= 0 {
+		return
+	}
+	prefix, ext := f.backupName()
+	dir := filepath.Dir(f.Path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	type backup struct {
+		path    string
+		rotated time.Time
+	}
+	var backups []backup
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		rotated, err := time.ParseInLocation(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext), time.Local)
+		if err != nil {
+			continue // Not one of ours
+		}
+		backups = append(backups, backup{filepath.Join(dir, name), rotated})
+	}
+	// Newest first
+	sort.Slice(backups, func(i, j int) bool { return backups[i].rotated.After(backups[j].rotated) })
+
+	cutoff := time.Now().Add(-f.MaxAge)
+	for i, b := range backups {
+		if (f.MaxBackups > 0 && i >= f.MaxBackups) || (f.MaxAge > 0 && b.rotated.Before(cutoff)) {
+			os.Remove(b.path)
+		}
+	}
+}
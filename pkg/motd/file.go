@@ -0,0 +1,87 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package motd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// File reads the message of the day from a local file, and notices when the file changes.
+// A missing file is an empty MOTD.
+type File struct {
+	// Path is the path of the file.
+	Path string
+
+	lock    sync.Mutex // Protects the fields below, so the file can be checked concurrently
+	modTime time.Time
+	size    int64
+	motd    string
+}
+
+// NewFile creates a File for path.
+func NewFile(path string) *File {
+	return &File{Path: path}
+}
+
+// Load reads the MOTD from the file.
+func (f *File) Load() (string, error) {
+	motd, _, err := f.Check()
+	return motd, err
+}
+
+// Check reads the MOTD from the file if it was modified since it was last read,
+// and reports whether the MOTD changed.
+// If the file can't be read, the last MOTD read is returned with the error.
+func (f *File) Check() (string, bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	info, err := os.Stat(f.Path)
+	if os.IsNotExist(err) {
+		changed := f.motd != ""
+		f.motd, f.modTime, f.size = "", time.Time{}, 0
+		return "", changed, nil
+	}
+	if err != nil {
+		return f.motd, false, errors.Wrap(err, "Check MOTD file")
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.motd, false, nil
+	}
+
+	buf, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return f.motd, false, errors.Wrap(err, "Read MOTD file")
+	}
+	changed := string(buf) != f.motd
+	f.motd, f.modTime, f.size = string(buf), info.ModTime(), info.Size()
+	return f.motd, changed, nil
+}
+
+// Poll checks the file every interval until ctx is done.
+// update is called whenever the MOTD changes, and onError whenever the file can't be read.
+func (f *File) Poll(ctx context.Context, interval time.Duration, update func(string), onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			motd, changed, err := f.Check()
+			if err != nil {
+				onError(err)
+			}
+			if changed {
+				update(motd)
+			}
+		}
+	}
+}
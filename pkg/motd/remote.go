@@ -0,0 +1,164 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+// Package motd provides sources for NVRemoted's message of the day.
+package motd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxRemoteSize is the largest MOTD that will be accepted from a remote source.
+const maxRemoteSize = 64 << 10
+
+// Remote fetches the message of the day from an HTTPS URL.
+// Conditional requests are used, so an unchanged MOTD isn't downloaded again.
+type Remote struct {
+	// URL is the HTTPS URL of the MOTD, which is served as plain text.
+	URL string
+
+	// CacheFile optionally names a file where the last fetched MOTD is kept,
+	// so that it is available after a restart, even if the URL can't be reached.
+	CacheFile string
+
+	// Client is used to make requests. If nil, a client with a 30 second timeout is used.
+	Client *http.Client
+
+	cache remoteCache
+}
+
+// remoteCache is the state of a Remote that is kept in its cache file.
+type remoteCache struct {
+	MOTD         string    `json:"motd"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+// NewRemote creates a Remote for rawURL, which must use HTTPS.
+func NewRemote(rawURL, cacheFile string) (*Remote, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse MOTD URL")
+	}
+	if u.Scheme != "https" {
+		return nil, errors.Errorf("MOTD URL must use https, not %q", u.Scheme)
+	}
+	return &Remote{
+		URL:       rawURL,
+		CacheFile: cacheFile,
+	}, nil
+}
+
+// LoadCache loads the MOTD last fetched from CacheFile.
+// The cached ETag is reused, so the next fetch won't download the MOTD again if it hasn't changed.
+func (r *Remote) LoadCache() (string, error) {
+	if r.CacheFile == "" {
+		return "", errors.New("No MOTD cache file")
+	}
+	buf, err := ioutil.ReadFile(r.CacheFile)
+	if err != nil {
+		return "", errors.Wrap(err, "Read MOTD cache")
+	}
+	var cache remoteCache
+	if err := json.Unmarshal(buf, &cache); err != nil {
+		return "", errors.Wrap(err, "Read MOTD cache")
+	}
+	r.cache = cache
+	return cache.MOTD, nil
+}
+
+// Fetch fetches the MOTD, and reports whether it changed since it was last fetched.
+func (r *Remote) Fetch(ctx context.Context) (string, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.URL, nil)
+	if err != nil {
+		return r.cache.MOTD, false, errors.Wrap(err, "Fetch MOTD")
+	}
+	if r.cache.ETag != "" {
+		req.Header.Set("If-None-Match", r.cache.ETag)
+	}
+	if r.cache.LastModified != "" {
+		req.Header.Set("If-Modified-Since", r.cache.LastModified)
+	}
+
+	client := r.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return r.cache.MOTD, false, errors.Wrap(err, "Fetch MOTD")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return r.cache.MOTD, false, nil
+	case http.StatusOK:
+	default:
+		return r.cache.MOTD, false, errors.Errorf("Fetch MOTD: %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRemoteSize+1))
+	if err != nil {
+		return r.cache.MOTD, false, errors.Wrap(err, "Fetch MOTD")
+	}
+	if len(body) > maxRemoteSize {
+		return r.cache.MOTD, false, errors.Errorf("Fetch MOTD: larger than %d bytes", maxRemoteSize)
+	}
+
+	motd := strings.TrimSpace(string(body))
+	changed := motd != r.cache.MOTD
+	r.cache = remoteCache{
+		MOTD:         motd,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Fetched:      time.Now(),
+	}
+	if err := r.saveCache(); err != nil {
+		return motd, changed, err
+	}
+	return motd, changed, nil
+}
+
+func (r *Remote) saveCache() error {
+	if r.CacheFile == "" {
+		return nil
+	}
+	buf, err := json.Marshal(r.cache)
+	if err != nil {
+		return errors.Wrap(err, "Write MOTD cache")
+	}
+	return errors.Wrap(ioutil.WriteFile(r.CacheFile, buf, 0644), "Write MOTD cache")
+}
+
+// Poll fetches the MOTD every interval until ctx is done.
+// update is called whenever the MOTD changes, and onError whenever a fetch fails.
+func (r *Remote) Poll(ctx context.Context, interval time.Duration, update func(string), onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			motd, changed, err := r.Fetch(ctx)
+			if err != nil {
+				onError(err)
+			}
+			if changed {
+				update(motd)
+			}
+		}
+	}
+}
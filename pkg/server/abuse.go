@@ -0,0 +1,115 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AbuseBans temporarily bans addresses that keep breaking the protocol, sending malformed messages, or giving wrong stats passwords,
+// such as scanners and broken bots, without anyone having to ban them by hand.
+type AbuseBans struct {
+	// Strikes is how many times an address may misbehave within Window before it is banned for Duration.
+	// If 0, addresses aren't banned for misbehaving.
+	Strikes  int
+	Window   time.Duration
+	Duration time.Duration
+}
+
+// WithAbuseBans bans addresses that misbehave abuse.Strikes times within abuse.Window, for abuse.Duration.
+func WithAbuseBans(abuse AbuseBans) Option {
+	return func(srv *Server) error {
+		if err := notNegative("abuse strikes", abuse.Strikes); err != nil {
+			return err
+		}
+		if abuse.Strikes > 0 && (abuse.Window <= 0 || abuse.Duration <= 0) {
+			return errors.New("abuse window and ban duration must be positive")
+		}
+		srv.AbuseBans = abuse
+		return nil
+	}
+}
+
+// abuseStrikes counts when each address misbehaved, within the window of the server's AbuseBans.
+type abuseStrikes struct {
+	lock      sync.Mutex // Protects addresses
+	addresses map[string][]time.Time
+}
+
+// strike records that addr misbehaved at now, and reports whether it has now struck out, given abuse.
+// Strikes older than abuse.Window don't count.
+func (s *abuseStrikes) strike(addr string, now time.Time, abuse AbuseBans) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.addresses == nil {
+		s.addresses = make(map[string][]time.Time)
+	}
+	strikes := s.addresses[addr]
+	for len(strikes) > 0 && now.Sub(strikes[0]) > abuse.Window {
+		strikes = strikes[1:]
+	}
+	strikes = append(strikes, now)
+	if len(strikes) >= abuse.Strikes {
+		delete(s.addresses, addr) // The ban takes over
+		return true
+	}
+	s.addresses[addr] = strikes
+	return false
+}
+
+// prune forgets addresses that haven't misbehaved within window.
+func (s *abuseStrikes) prune(now time.Time, window time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for addr, strikes := range s.addresses {
+		if now.Sub(strikes[len(strikes)-1]) > window {
+			delete(s.addresses, addr)
+		}
+	}
+}
+
+// strike records that addr misbehaved, and bans it for a while if it has done so too often lately.
+// what says how it misbehaved, for logs.
+func (srv *Server) strike(addr, what string) {
+	abuse := srv.AbuseBans
+	if abuse.Strikes == 0 {
+		return
+	}
+	now := time.Now()
+	if !srv.registry.abuse.strike(addr, now, abuse) {
+		return
+	}
+	log := srv.Log.WithFields(Fields{
+		"remote_addr": addr,
+		"strikes":     abuse.Strikes,
+		"window":      abuse.Window,
+		"last":        what,
+	})
+	ban := Ban{
+		Addr:    addr,
+		Reason:  "too many protocol errors or wrong passwords",
+		Created: now.Round(0),
+		Expires: now.Round(0).Add(abuse.Duration),
+	}
+	if err := srv.registry.bans.add(ban); err != nil {
+		log.WithField("error", err).Error("Error banning address for abuse")
+		return
+	}
+	log.WithField("expires", ban.Expires).Warn("Banned address for abuse")
+	srv.securityEvent(SecurityBan, addr, ban.Reason)
+}
+
+// protocolViolation records that the client broke the protocol, as an event, in the security log, and as a strike against its address.
+// Clients that didn't connect from an IP address, such as over the control socket, are never banned.
+func (c *client) protocolViolation(reason string) {
+	c.registry.emit(Event{Type: EventProtocolError, Client: c.eventClient(), Reason: reason})
+	if ip := addrIP(c.addr); ip != nil {
+		c.srv.securityEvent(SecurityProtocolViolation, ip.String(), reason)
+		c.srv.strike(ip.String(), reason)
+	}
+}
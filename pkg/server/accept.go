@@ -0,0 +1,109 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"math"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// minAcceptBackoff and maxAcceptBackoff bound how long to wait before accepting again after an error.
+	// The wait doubles with each error in a row.
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+
+	// fdExhaustedPause is how long to stop accepting connections once the server has run out of file descriptors,
+	// giving clients time to disconnect and free some up, rather than failing again straight away.
+	fdExhaustedPause = 5 * time.Second
+)
+
+// WithMaxAcceptRate limits the number of connections accepted per second, across all of the server's listeners.
+func WithMaxAcceptRate(rate float64) Option {
+	return func(srv *Server) error {
+		if err := notNegative("max accept rate", rate); err != nil {
+			return err
+		}
+		srv.MaxAcceptRate = rate
+		return nil
+	}
+}
+
+// acceptLimiter limits how quickly connections are accepted, across all of the server's listeners.
+// Its methods are safe to use concurrently.
+type acceptLimiter struct {
+	lock   sync.Mutex
+	bucket *tokenBucket
+}
+
+// wait waits until another connection may be accepted, at no more than rate per second.
+// If rate is 0, it returns immediately.
+func (l *acceptLimiter) wait(rate float64) {
+	if rate == 0 {
+		return
+	}
+	now := time.Now()
+	l.lock.Lock()
+	if l.bucket == nil {
+		// A second's worth of connections may be accepted at once,
+		// so that clients reconnecting together after a restart aren't held up for nothing.
+		l.bucket = newTokenBucket(RateLimit{Rate: rate, Burst: int(math.Ceil(rate))}, now)
+	}
+	delay := l.bucket.take(now)
+	l.lock.Unlock()
+	time.Sleep(delay)
+}
+
+// acceptLoop accepts connections from listener, passing each to handle, until listener is closed.
+// After an error, it waits before accepting again, so that an error that persists doesn't spin the loop.
+// If the server has run out of file descriptors, it pauses for longer, logging only when it stops and starts accepting again.
+// kind is what the connections are called in logs.
+func (srv *Server) acceptLoop(listener net.Listener, kind string, handle func(conn net.Conn)) {
+	var backoff time.Duration
+	exhausted := false
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			if fdsExhausted(err) {
+				if !exhausted {
+					exhausted = true
+					srv.Log.WithFields(Fields{
+						"error": err,
+						"pause": fdExhaustedPause,
+					}).Error("Out of file descriptors; pausing accepting " + kind + "s")
+				}
+				time.Sleep(fdExhaustedPause)
+				continue
+			}
+			backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+			srv.Log.WithFields(Fields{
+				"error":    err,
+				"retry_in": backoff,
+			}).Error("Error accepting " + kind)
+			time.Sleep(backoff)
+			continue
+		}
+
+		backoff = 0
+		if exhausted {
+			exhausted = false
+			srv.Log.Info("Resumed accepting " + kind + "s")
+		}
+		handle(conn)
+	}
+}
+
+// fdsExhausted checks whether err is from the process or system having run out of file descriptors.
+func fdsExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
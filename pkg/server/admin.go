@@ -0,0 +1,79 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// adminCommandFunc runs an administrative command with the given JSON encoded arguments,
+// returning a result that will be marshaled to JSON.
+type adminCommandFunc func(srv *Server, args json.RawMessage) (interface{}, error)
+
+var adminCommands = map[string]adminCommandFunc{
+	"stats":            adminStats,
+	"goroutines":       adminGoroutines,
+	"block_channel":    adminBlockChannel,
+	"unblock_channel":  adminUnblockChannel,
+	"blocked_channels": adminBlockedChannels,
+	"debug_channel":    adminDebugChannel,
+	"debug_client":     adminDebugClient,
+	"ban":              adminBan,
+	"unban":            adminUnban,
+	"bans":             adminBans,
+	"kick":             adminKick,
+	"clients":          adminClients,
+	"channels":         adminChannels,
+	"motd":             adminMOTD,
+	"broadcast":        adminBroadcast,
+	"shutdown":         adminShutdown,
+	"drain":            adminDrain,
+	"history":          adminHistory,
+	"dump":             adminDump,
+	"channel_hash":     adminChannelHash,
+}
+
+// AdminCommands lists the names of the administrative commands supported by the server.
+func AdminCommands() []string {
+	names := make([]string, 0, len(adminCommands))
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Admin runs an administrative command.
+// args holds the JSON encoded arguments for the command, and may be empty if the command takes none.
+// The result is suitable for marshaling to JSON.
+func (srv *Server) Admin(command string, args json.RawMessage) (interface{}, error) {
+	cmdFunc := adminCommands[command]
+	if cmdFunc == nil {
+		return nil, errors.Errorf("unknown admin command: %s", command)
+	}
+	return cmdFunc(srv, args)
+}
+
+// decodeAdminArgs unmarshals the arguments to an admin command into v.
+func decodeAdminArgs(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 {
+		return errors.New("missing arguments")
+	}
+	if err := json.Unmarshal(args, v); err != nil {
+		return errors.Wrap(err, "invalid arguments")
+	}
+	return nil
+}
+
+func adminStats(srv *Server, args json.RawMessage) (interface{}, error) {
+	return srv.Stats(), nil
+}
+
+func adminGoroutines(srv *Server, args json.RawMessage) (interface{}, error) {
+	return srv.GoroutineReport(), nil
+}
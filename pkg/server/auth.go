@@ -0,0 +1,162 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// authTimeout is how long an Authenticator has to decide on a client.
+const authTimeout = 15 * time.Second
+
+// AuthStage is the point at which an Authenticator is asked about a client.
+type AuthStage string
+
+// Stages at which clients are authenticated.
+const (
+	// AuthConnect is when a client connects, before anything is read from it.
+	AuthConnect AuthStage = "connect"
+
+	// AuthJoin is when a client asks to join a channel, once the server's own policies have allowed it.
+	AuthJoin AuthStage = "join"
+)
+
+// AuthRequest describes a client being authenticated.
+type AuthRequest struct {
+	Stage AuthStage
+
+	// ID is the client's ID.
+	ID uint64
+
+	// RemoteAddr is the client's IP address.
+	RemoteAddr string
+
+	// TLS is the state of the client's TLS connection, once its handshake has finished,
+	// or nil if it didn't connect with TLS.
+	TLS *tls.ConnectionState
+
+	// Join is the message the client sent to join a channel, or nil when it is connecting.
+	Join *ClientJoinMessage
+}
+
+// Annotations are labels an Authenticator attaches to a client, such as the name of the user it authenticated as.
+// They are listed by the clients admin command.
+type Annotations map[string]string
+
+// String formats the annotations as key=value pairs separated by commas, ordered by key.
+func (a Annotations) String() string {
+	pairs := make([]string, 0, len(a))
+	for k, v := range a {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// An Authenticator decides whether clients may connect and join channels.
+type Authenticator interface {
+	// Authenticate is called when a client connects, and again when it asks to join a channel.
+	// If it returns an error, the client is disconnected; the error is only sent to the client if it is an *AuthError.
+	// Otherwise, the annotations returned, if any, are added to the client's.
+	// ctx is canceled if the client takes too long to authenticate.
+	Authenticate(ctx context.Context, req AuthRequest) (Annotations, error)
+}
+
+// AuthError rejects a client, giving the reason it is sent.
+type AuthError struct {
+	Reason string
+}
+
+func (e *AuthError) Error() string {
+	return e.Reason
+}
+
+// WithAuthenticator sets the authenticator clients must satisfy to connect and join channels.
+func WithAuthenticator(auth Authenticator) Option {
+	return func(srv *Server) error {
+		srv.Authenticator = auth
+		return nil
+	}
+}
+
+// checkAuth asks the server's Authenticator about the client, and adds any annotations it returns.
+// If the client is rejected, it is sent an error and stopped.
+// join is the client's join message, or nil when it is connecting.
+func (c *client) checkAuth(stage AuthStage, join *ClientJoinMessage) bool {
+	auth := c.srv.Authenticator
+	if auth == nil {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, authTimeout)
+	defer cancel()
+
+	req := AuthRequest{
+		Stage:      stage,
+		ID:         c.id,
+		RemoteAddr: addrHost(c.addr),
+		Join:       join,
+	}
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		// The handshake usually hasn't finished when the client connects, since nothing has been read yet.
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			c.drop("Connection lost: " + err.Error())
+			return false
+		}
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+
+	annotations, err := auth.Authenticate(ctx, req)
+	if err != nil {
+		fields := Fields{
+			"id":    c.id,
+			"stage": stage,
+			"error": err,
+		}
+		var authErr *AuthError
+		if errors.As(err, &authErr) {
+			c.log.WithFields(fields).Info("Client failed authentication")
+			c.securityEvent(SecurityAuthFailure, authErr.Reason)
+			c.sendKick(KickUnauthorized, authErr.Reason)
+		} else {
+			// The authenticator itself failed, such as an auth service being down.
+			c.log.WithFields(fields).Warn("Error authenticating client")
+			c.sendKick(KickUnauthorized, "authentication failed")
+		}
+		c.stop("authentication failed")
+		return false
+	}
+	if len(annotations) > 0 {
+		c.registry.lock.Lock()
+		if c.annotations == nil {
+			c.annotations = make(Annotations, len(annotations))
+		}
+		for k, v := range annotations {
+			c.annotations[k] = v
+		}
+		c.registry.lock.Unlock()
+	}
+	return true
+}
+
+// Annotations gets a copy of the annotations the server's Authenticator attached to the client.
+func (c *client) Annotations() Annotations {
+	c.registry.lock.RLock()
+	defer c.registry.lock.RUnlock()
+	if len(c.annotations) == 0 {
+		return nil
+	}
+	annotations := make(Annotations, len(c.annotations))
+	for k, v := range c.annotations {
+		annotations[k] = v
+	}
+	return annotations
+}
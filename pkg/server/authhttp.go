@@ -0,0 +1,136 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// maxHTTPAuthResponseSize is the largest response read from an HTTP auth service.
+const maxHTTPAuthResponseSize = 64 * 1024
+
+// HTTPAuthenticator asks a web service whether clients may connect and join channels.
+//
+// For every client that connects, and again when it asks to join a channel, the service is sent a JSON POST such as
+//
+//	{"stage": "join", "id": 1, "remote_addr": "203.0.113.5", "tls": {"version": "TLS 1.3", "cipher_suite": "TLS_AES_128_GCM_SHA256"},
+//	 "channel": "...", "connection_type": "master", "auth_token": "..."}
+//
+// A 2xx response allows the client, and may annotate it with a body such as {"annotations": {"user": "alice"}}.
+// A 401 or 403 response rejects the client, with the reason in a body such as {"error": "unknown user"}.
+// Clients are also rejected if the service can't be reached, or gives any other response.
+type HTTPAuthenticator struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPAuthenticator creates an authenticator that asks the service at rawURL about each client.
+// If client is nil, http.DefaultClient is used; requests are always limited by the server's authentication timeout.
+func NewHTTPAuthenticator(rawURL string, client *http.Client) (*HTTPAuthenticator, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "auth URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, errors.Errorf("auth URL %q isn't an HTTP or HTTPS URL", rawURL)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPAuthenticator{url: rawURL, client: client}, nil
+}
+
+type httpAuthRequest struct {
+	Stage          AuthStage        `json:"stage"`
+	ID             uint64           `json:"id"`
+	RemoteAddr     string           `json:"remote_addr"`
+	TLS            *httpAuthTLSInfo `json:"tls,omitempty"`
+	Channel        string           `json:"channel,omitempty"`
+	ConnectionType string           `json:"connection_type,omitempty"`
+	AuthToken      string           `json:"auth_token,omitempty"`
+}
+
+type httpAuthTLSInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ServerName  string `json:"server_name,omitempty"`
+	// ClientCertificate is the subject of the certificate the client gave, if any.
+	ClientCertificate string `json:"client_certificate,omitempty"`
+}
+
+type httpAuthResponse struct {
+	Annotations Annotations `json:"annotations"`
+	Error       string      `json:"error"`
+}
+
+// Authenticate asks the service about the client.
+func (a *HTTPAuthenticator) Authenticate(ctx context.Context, req AuthRequest) (Annotations, error) {
+	body := httpAuthRequest{
+		Stage:      req.Stage,
+		ID:         req.ID,
+		RemoteAddr: req.RemoteAddr,
+	}
+	if req.TLS != nil {
+		body.TLS = &httpAuthTLSInfo{
+			Version:     tls.VersionName(req.TLS.Version),
+			CipherSuite: tls.CipherSuiteName(req.TLS.CipherSuite),
+			ServerName:  req.TLS.ServerName,
+		}
+		if len(req.TLS.PeerCertificates) > 0 {
+			body.TLS.ClientCertificate = req.TLS.PeerCertificates[0].Subject.String()
+		}
+	}
+	if req.Join != nil {
+		body.Channel = req.Join.Channel
+		body.ConnectionType = req.Join.ConnectionType
+		body.AuthToken = req.Join.AuthToken
+	}
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal auth request")
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, errors.Wrap(err, "Create auth request")
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(httpReq)
+	if err != nil {
+		return nil, errors.Wrap(err, "Post auth request")
+	}
+	defer resp.Body.Close()
+
+	var authResp httpAuthResponse
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPAuthResponseSize))
+	if err != nil {
+		return nil, errors.Wrap(err, "Read auth response")
+	}
+	if len(bytes.TrimSpace(respBody)) > 0 {
+		// Rejections don't need a body, so one that can't be decoded only matters when the client is allowed.
+		err = json.Unmarshal(respBody, &authResp)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		if authResp.Error == "" {
+			authResp.Error = "authentication failed"
+		}
+		return nil, &AuthError{Reason: authResp.Error}
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, errors.Errorf("Auth service responded with %s", resp.Status)
+	case err != nil:
+		return nil, errors.Wrap(err, "Decode auth response")
+	}
+	return authResp.Annotations, nil
+}
@@ -0,0 +1,69 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// authTokenFailureDelay is how long a client that gives the wrong auth token waits to be rejected, to prevent brute forcing.
+const authTokenFailureDelay = 5 * time.Second
+
+// AuthToken is a token clients can give, in the auth_token field of their join message, to join channels.
+type AuthToken struct {
+	// Name identifies who the token was given to.
+	// Clients that join with the token are annotated with it as "token".
+	Name string
+
+	// Token is the token, or its bcrypt hash from HashPassword.
+	Token string
+}
+
+// StaticTokenAuthenticator only lets clients that give one of its tokens join channels.
+// Any client may connect.
+type StaticTokenAuthenticator struct {
+	tokens []AuthToken
+}
+
+// NewStaticTokenAuthenticator creates an authenticator that accepts any of tokens, which must have unique names.
+func NewStaticTokenAuthenticator(tokens ...AuthToken) (*StaticTokenAuthenticator, error) {
+	names := make(map[string]bool, len(tokens))
+	for _, t := range tokens {
+		if t.Name == "" {
+			return nil, errors.New("auth token has no name")
+		}
+		if t.Token == "" {
+			return nil, errors.Errorf("auth token %q has no token", t.Name)
+		}
+		if names[t.Name] {
+			return nil, errors.Errorf("auth token %q is given more than once", t.Name)
+		}
+		names[t.Name] = true
+	}
+	return &StaticTokenAuthenticator{tokens: tokens}, nil
+}
+
+// Authenticate checks the auth token given by a client joining a channel.
+func (a *StaticTokenAuthenticator) Authenticate(ctx context.Context, req AuthRequest) (Annotations, error) {
+	if req.Stage != AuthJoin {
+		return nil, nil
+	}
+	if req.Join.AuthToken == "" {
+		return nil, &AuthError{Reason: "auth token required: this server requires an auth_token in the join message"}
+	}
+	for _, t := range a.tokens {
+		if checkPassword(t.Token, req.Join.AuthToken) {
+			return Annotations{"token": t.Name}, nil
+		}
+	}
+	select {
+	case <-time.After(authTokenFailureDelay):
+	case <-ctx.Done():
+	}
+	return nil, &AuthError{Reason: "wrong auth token"}
+}
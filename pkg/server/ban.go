@@ -0,0 +1,267 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A Ban prevents connections from an address, or a network in CIDR notation.
+type Ban struct {
+	Addr    string    `json:"addr"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	// Expires is when the ban is lifted, or the zero time if it is permanent.
+	Expires time.Time `json:"expires"`
+	// Rejected is the number of connections the ban has rejected since the server started.
+	Rejected int64 `json:"rejected"`
+
+	network *net.IPNet
+}
+
+// expired reports whether the ban has been lifted by now.
+func (b *Ban) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+// parseBanAddr parses an IP address, or a network in CIDR notation, into the network it bans.
+func parseBanAddr(addr string) (*net.IPNet, error) {
+	if strings.Contains(addr, "/") {
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid network")
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, errors.Errorf("invalid IP address: %s", addr)
+	}
+	bits := 8 * len(ip)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// banList holds the banned addresses, persisting them to a file if it has one.
+type banList struct {
+	lock     sync.Mutex // Protects everything below
+	bans     []*Ban
+	file     string
+	rejected int64 // Number of connections rejected by any ban
+}
+
+// load loads bans from file, which will also be saved to when bans change.
+// A missing file is treated as an empty ban list.
+func (bl *banList) load(file string) error {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	bl.file = file
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Read ban file")
+	}
+	var bans []*Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return errors.Wrap(err, "Parse ban file")
+	}
+	now := time.Now()
+	for _, b := range bans {
+		if b.expired(now) {
+			continue
+		}
+		if b.network, err = parseBanAddr(b.Addr); err != nil {
+			return errors.Wrap(err, "Parse ban file")
+		}
+		b.Rejected = 0
+		bl.bans = append(bl.bans, b)
+	}
+	return nil
+}
+
+// save saves the bans to the ban file, if there is one.
+// The lock must be held.
+func (bl *banList) save() error {
+	if bl.file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(bl.bans, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Save bans")
+	}
+	// Write to a temporary file first, so that a crash can't leave a truncated ban file.
+	tmp := bl.file + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(bl.file), 0o755); err != nil {
+		return errors.Wrap(err, "Save bans")
+	}
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		return errors.Wrap(err, "Save bans")
+	}
+	return errors.Wrap(os.Rename(tmp, bl.file), "Save bans")
+}
+
+// purge removes expired bans.
+// The lock must be held.
+func (bl *banList) purge(now time.Time) {
+	bans := bl.bans[:0]
+	for _, b := range bl.bans {
+		if !b.expired(now) {
+			bans = append(bans, b)
+		}
+	}
+	bl.bans = bans
+}
+
+// banned reports whether connections from ip are banned, counting the rejection if so.
+func (bl *banList) banned(ip net.IP) bool {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	now := time.Now()
+	for _, b := range bl.bans {
+		if !b.expired(now) && b.network.Contains(ip) {
+			b.Rejected++
+			bl.rejected++
+			return true
+		}
+	}
+	return false
+}
+
+// add bans an address, replacing any existing ban of the same address.
+func (bl *banList) add(ban Ban) error {
+	network, err := parseBanAddr(ban.Addr)
+	if err != nil {
+		return err
+	}
+	ban.network = network
+
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	bl.purge(ban.Created)
+	for i, b := range bl.bans {
+		if b.Addr == ban.Addr {
+			ban.Rejected = b.Rejected
+			bl.bans[i] = &ban
+			return bl.save()
+		}
+	}
+	bl.bans = append(bl.bans, &ban)
+	return bl.save()
+}
+
+// remove lifts the ban on an address, returning false if it wasn't banned.
+func (bl *banList) remove(addr string) (bool, error) {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	bl.purge(time.Now())
+	for i, b := range bl.bans {
+		if b.Addr == addr {
+			bl.bans = append(bl.bans[:i], bl.bans[i+1:]...)
+			return true, bl.save()
+		}
+	}
+	return false, nil
+}
+
+// list lists the bans in effect.
+func (bl *banList) list() []Ban {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	bl.purge(time.Now())
+	list := make([]Ban, 0, len(bl.bans))
+	for _, b := range bl.bans {
+		list = append(list, *b)
+	}
+	return list
+}
+
+// numRejected gets the number of connections rejected by bans.
+func (bl *banList) numRejected() int64 {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	return bl.rejected
+}
+
+// BanArgs holds the arguments to the ban admin command.
+type BanArgs struct {
+	// Addr is an IP address, or a network in CIDR notation.
+	Addr   string `json:"addr"`
+	Reason string `json:"reason,omitempty"`
+	// Duration is how long the ban lasts, parsable by time.ParseDuration.
+	// If empty, the ban is permanent.
+	Duration string `json:"duration,omitempty"`
+}
+
+// UnbanArgs holds the arguments to the unban admin command.
+type UnbanArgs struct {
+	Addr string `json:"addr"`
+}
+
+func adminBan(srv *Server, args json.RawMessage) (interface{}, error) {
+	var banArgs BanArgs
+	if err := decodeAdminArgs(args, &banArgs); err != nil {
+		return nil, err
+	}
+	ban := Ban{
+		Addr:    banArgs.Addr,
+		Reason:  banArgs.Reason,
+		Created: time.Now().Round(0),
+	}
+	if banArgs.Duration != "" {
+		duration, err := time.ParseDuration(banArgs.Duration)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid duration")
+		}
+		if duration <= 0 {
+			return nil, errors.New("duration must be positive")
+		}
+		ban.Expires = ban.Created.Add(duration)
+	}
+	if err := srv.registry.bans.add(ban); err != nil {
+		return nil, err
+	}
+	srv.Log.WithFields(Fields{
+		"addr":    ban.Addr,
+		"reason":  ban.Reason,
+		"expires": ban.Expires,
+	}).Info("Address banned")
+	srv.securityEvent(SecurityBan, ban.Addr, ban.Reason)
+	return srv.registry.bans.list(), nil
+}
+
+func adminUnban(srv *Server, args json.RawMessage) (interface{}, error) {
+	var unbanArgs UnbanArgs
+	if err := decodeAdminArgs(args, &unbanArgs); err != nil {
+		return nil, err
+	}
+	removed, err := srv.registry.bans.remove(unbanArgs.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if !removed {
+		return nil, errors.Errorf("%s is not banned", unbanArgs.Addr)
+	}
+	srv.Log.WithField("addr", unbanArgs.Addr).Info("Address unbanned")
+	srv.securityEvent(SecurityUnban, unbanArgs.Addr, "")
+	return srv.registry.bans.list(), nil
+}
+
+func adminBans(srv *Server, args json.RawMessage) (interface{}, error) {
+	return srv.registry.bans.list(), nil
+}
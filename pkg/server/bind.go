@@ -0,0 +1,79 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BindPolicy controls what the server does when it can't bind the address it was asked to listen on,
+// such as when a previous instance still holds the port during a restart.
+type BindPolicy struct {
+	// FallbackAddrs are tried, in order, if the preferred address can't be bound.
+	// They are only used by ListenAndServe and ListenAndServeTLS, which listen on a single address.
+	FallbackAddrs []string
+
+	// Retries is the number of times to try all of the addresses again, if none of them could be bound.
+	Retries int
+
+	// RetryDelay is how long to wait before each retry.
+	RetryDelay time.Duration
+}
+
+// listen binds addr, or one of the fallback addresses, retrying as srv.Bind allows until ctx is canceled.
+// If a listener for addr was inherited from a previous server, it is used instead.
+func (srv *Server) listen(ctx context.Context, addr string, fallbacks []string) (net.Listener, error) {
+	if listener := srv.handoff.inherit(addr); listener != nil {
+		srv.handoff.addBound(addr, listener)
+		return listener, nil
+	}
+
+	addrs := append([]string{addr}, fallbacks...)
+	var err error
+	for attempt := 0; attempt <= srv.Bind.Retries; attempt++ {
+		if attempt > 0 {
+			srv.Log.WithFields(Fields{
+				"attempt": attempt,
+				"delay":   srv.Bind.RetryDelay,
+			}).Warn("No address could be bound; retrying")
+			select {
+			case <-time.After(srv.Bind.RetryDelay):
+			case <-ctx.Done():
+				return nil, errors.Wrap(ctx.Err(), "Listen")
+			}
+		}
+
+		for _, bindAddr := range addrs {
+			var listener net.Listener
+			listener, err = net.Listen("tcp", bindAddr)
+			if err == nil {
+				if bindAddr != addr {
+					srv.Log.WithFields(Fields{
+						"addr":      bindAddr,
+						"preferred": addr,
+					}).Warn("Bound a fallback address")
+				}
+				srv.handoff.addBound(addr, listener)
+				return listener, nil
+			}
+			srv.Log.WithFields(Fields{
+				"addr":  bindAddr,
+				"error": err,
+			}).Warn("Error binding address")
+		}
+	}
+	return nil, errors.Wrap(err, "Listen")
+}
+
+// Addrs gets the addresses the server is listening on.
+func (srv *Server) Addrs() []string {
+	srv.registry.lock.RLock()
+	defer srv.registry.lock.RUnlock()
+	return append([]string(nil), srv.registry.listenAddrs...)
+}
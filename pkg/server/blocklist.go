@@ -0,0 +1,130 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// channelBlocklist holds patterns of channel names that may not be joined.
+// Unlike AllowedChannels, it can be changed while the server is running.
+type channelBlocklist struct {
+	lock     sync.RWMutex // Protects everything below
+	patterns []*blockedChannel
+	rejected int64 // Number of joins rejected by any pattern
+}
+
+// blockedChannel is a blocked pattern, and the number of joins it has rejected.
+type blockedChannel struct {
+	pattern  ChannelPattern
+	rejected int64
+}
+
+// BlockedChannel describes a pattern on the channel blocklist.
+type BlockedChannel struct {
+	Pattern  string `json:"pattern"`
+	Rejected int64  `json:"rejected"`
+}
+
+// blocks reports whether joining the named channel is blocked, counting the rejection if so.
+func (bl *channelBlocklist) blocks(name string) bool {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	for _, blocked := range bl.patterns {
+		if blocked.pattern.Match(name) {
+			blocked.rejected++
+			bl.rejected++
+			return true
+		}
+	}
+	return false
+}
+
+// add adds a pattern to the blocklist, returning false if it was already there.
+func (bl *channelBlocklist) add(pattern ChannelPattern) bool {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	for _, blocked := range bl.patterns {
+		if blocked.pattern.String() == pattern.String() {
+			return false
+		}
+	}
+	bl.patterns = append(bl.patterns, &blockedChannel{pattern: pattern})
+	return true
+}
+
+// remove removes a pattern from the blocklist, returning false if it wasn't there.
+func (bl *channelBlocklist) remove(pattern string) bool {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	for i, blocked := range bl.patterns {
+		if blocked.pattern.String() == pattern {
+			bl.patterns = append(bl.patterns[:i], bl.patterns[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// list lists the patterns on the blocklist.
+func (bl *channelBlocklist) list() []BlockedChannel {
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+	list := make([]BlockedChannel, 0, len(bl.patterns))
+	for _, blocked := range bl.patterns {
+		list = append(list, BlockedChannel{
+			Pattern:  blocked.pattern.String(),
+			Rejected: blocked.rejected,
+		})
+	}
+	return list
+}
+
+// numRejected gets the number of joins rejected by the blocklist.
+func (bl *channelBlocklist) numRejected() int64 {
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+	return bl.rejected
+}
+
+// ChannelPatternArgs holds the arguments to admin commands that take a channel pattern.
+type ChannelPatternArgs struct {
+	Pattern string `json:"pattern"`
+}
+
+func adminBlockChannel(srv *Server, args json.RawMessage) (interface{}, error) {
+	var patternArgs ChannelPatternArgs
+	if err := decodeAdminArgs(args, &patternArgs); err != nil {
+		return nil, err
+	}
+	pattern, err := ParseChannelPattern(patternArgs.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	if !srv.registry.blocklist.add(pattern) {
+		return nil, errors.Errorf("%s is already blocked", pattern)
+	}
+	srv.Log.WithField("pattern", pattern.String()).Info("Channel pattern blocked")
+	return srv.registry.blocklist.list(), nil
+}
+
+func adminUnblockChannel(srv *Server, args json.RawMessage) (interface{}, error) {
+	var patternArgs ChannelPatternArgs
+	if err := decodeAdminArgs(args, &patternArgs); err != nil {
+		return nil, err
+	}
+	if !srv.registry.blocklist.remove(patternArgs.Pattern) {
+		return nil, errors.Errorf("%s is not blocked", patternArgs.Pattern)
+	}
+	srv.Log.WithField("pattern", patternArgs.Pattern).Info("Channel pattern unblocked")
+	return srv.registry.blocklist.list(), nil
+}
+
+func adminBlockedChannels(srv *Server, args json.RawMessage) (interface{}, error) {
+	return srv.registry.blocklist.list(), nil
+}
@@ -0,0 +1,122 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// broadcastEvent queues an event for every connected client, whether or not it has joined a channel,
+// and returns the number of clients it was queued for.
+// Clients whose queue is full miss the event, rather than holding up the broadcast.
+func (srv *Server) broadcastEvent(msg Message) int {
+	reg := &srv.registry
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	n := 0
+	for _, c := range reg.connected {
+		if c.admin.Load() {
+			continue
+		}
+		select {
+		case c.events <- msg:
+			n++
+		default:
+		}
+	}
+	return n
+}
+
+// BroadcastMOTD sends the current message of the day to every connected client,
+// such as after changing it, and returns the number of clients it was sent to.
+// Clients show a MOTD they haven't seen before.
+func (srv *Server) BroadcastMOTD() int {
+	n := srv.broadcastEvent(ClientMOTDResponse{
+		Type: "motd",
+		MOTD: srv.getMOTD(),
+	})
+	srv.Log.WithField("clients", n).Info("Broadcast MOTD")
+	return n
+}
+
+// Broadcast shows an announcement to every connected client, such as a warning that the server is restarting,
+// and returns the number of clients it was sent to.
+// It is sent as a MOTD that clients must display, even if they've seen it before.
+// This method is safe to use while the server is running.
+func (srv *Server) Broadcast(message string) int {
+	n := srv.broadcastEvent(ClientMOTDResponse{
+		Type:         "motd",
+		MOTD:         message,
+		ForceDisplay: true,
+	})
+	srv.Log.WithFields(Fields{
+		"message": message,
+		"clients": n,
+	}).Info("Broadcast announcement")
+	return n
+}
+
+// handleClientMOTDEvent sends a MOTD broadcast to the client.
+func handleClientMOTDEvent(c *client, msg Message) {
+	c.send(msg)
+}
+
+// MOTDArgs holds the arguments to the motd admin command.
+type MOTDArgs struct {
+	// MOTD replaces the message of the day, if given.
+	MOTD *string `json:"motd,omitempty"`
+
+	// Broadcast sends the message of the day to all connected clients.
+	Broadcast bool `json:"broadcast,omitempty"`
+}
+
+// MOTDResult holds the result of the motd admin command.
+type MOTDResult struct {
+	MOTD string `json:"motd"`
+
+	// Broadcast is the number of clients the MOTD was broadcast to.
+	Broadcast int `json:"broadcast"`
+}
+
+func adminMOTD(srv *Server, args json.RawMessage) (interface{}, error) {
+	var motdArgs MOTDArgs
+	if len(args) > 0 {
+		if err := decodeAdminArgs(args, &motdArgs); err != nil {
+			return nil, err
+		}
+	}
+	if motdArgs.MOTD != nil {
+		srv.SetMOTD(*motdArgs.MOTD)
+		srv.Log.WithField("motd", *motdArgs.MOTD).Info("MOTD changed by an administrator")
+	}
+	result := MOTDResult{MOTD: srv.getMOTD()}
+	if motdArgs.Broadcast {
+		result.Broadcast = srv.BroadcastMOTD()
+	}
+	return result, nil
+}
+
+// BroadcastArgs holds the arguments to the broadcast admin command.
+type BroadcastArgs struct {
+	Message string `json:"message"`
+}
+
+// BroadcastResult holds the number of clients an announcement was sent to.
+type BroadcastResult struct {
+	Clients int `json:"clients"`
+}
+
+func adminBroadcast(srv *Server, args json.RawMessage) (interface{}, error) {
+	var broadcastArgs BroadcastArgs
+	if err := decodeAdminArgs(args, &broadcastArgs); err != nil {
+		return nil, err
+	}
+	if broadcastArgs.Message == "" {
+		return nil, errors.New("no message specified")
+	}
+	return BroadcastResult{Clients: srv.Broadcast(broadcastArgs.Message)}, nil
+}
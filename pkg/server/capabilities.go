@@ -0,0 +1,127 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+// Optional features the server may advertise in its capabilities.
+const (
+	// FeatureUnicast is sending a channel message to one member, by giving its ID in the message's "to" field.
+	FeatureUnicast = "unicast"
+
+	// FeatureResume is resuming a session from a new connection, after the old one was lost.
+	FeatureResume = "resume"
+
+	// FeatureCompression is compressing the connection, after a compression message.
+	FeatureCompression = "compression"
+
+	// FeatureCodec is switching to an encoding other than JSON, after a codec message.
+	FeatureCodec = "codec"
+)
+
+// ClientCapabilitiesMessage is received when a client asks for the server's capabilities.
+type ClientCapabilitiesMessage struct {
+	GenericClientMessage
+}
+
+// Name gets this ClientCapabilitiesMessage's name.
+func (ClientCapabilitiesMessage) Name() string {
+	return "capabilities"
+}
+
+// ClientCapabilitiesResponse tells a client what the server supports, and the limits it enforces,
+// so that clients and tools can adapt without trial and error.
+// It is sent when a client connects, unless the server's HideCapabilities is set, and whenever a client asks for it.
+type ClientCapabilitiesResponse struct {
+	Type string `json:"type"`
+
+	// ProtocolVersions are the versions of the protocol clients may give in a protocol_version message.
+	ProtocolVersions []int `json:"protocol_versions"`
+
+	// Features are the optional features the server supports, such as FeatureUnicast.
+	Features []string `json:"features"`
+
+	// Compression lists the algorithms that may be given in a compression message, in the server's order of preference,
+	// and Codecs the encodings that may be given in a codec message.
+	Compression []string `json:"compression,omitempty"`
+	Codecs      []string `json:"codecs,omitempty"`
+
+	Limits CapabilityLimits `json:"limits"`
+}
+
+// Name gets this ClientCapabilitiesResponse's name.
+func (ClientCapabilitiesResponse) Name() string {
+	return "capabilities"
+}
+
+// CapabilityLimits are the limits the server enforces on clients.
+// Durations are in seconds, and 0 means there is no limit.
+type CapabilityLimits struct {
+	// PingInterval is how often clients are pinged,
+	// and IdleTimeout how long a client may go without sending anything before it is disconnected.
+	PingInterval float64 `json:"ping_interval"`
+	IdleTimeout  float64 `json:"idle_timeout"`
+
+	// SessionGrace is how long a client whose connection was lost may take to resume its session.
+	SessionGrace float64 `json:"session_grace"`
+
+	// RateLimit is the number of messages per second a client may send on average, and RateLimitBurst how many at once.
+	RateLimit      float64 `json:"rate_limit"`
+	RateLimitBurst int     `json:"rate_limit_burst,omitempty"`
+
+	// MaxMessageDepth and MaxMessageKeys bound the channel messages clients may send.
+	MaxMessageDepth int `json:"max_message_depth"`
+	MaxMessageKeys  int `json:"max_message_keys"`
+
+	// E2eOnly is set if only end-to-end encrypted channels may be joined.
+	E2eOnly bool `json:"e2e_only"`
+}
+
+// WithCapabilities decides whether clients are sent the server's capabilities when they connect.
+// Clients that can't handle messages they don't know may need them hidden; they can still be asked for.
+func WithCapabilities(advertise bool) Option {
+	return func(srv *Server) error {
+		srv.HideCapabilities = !advertise
+		return nil
+	}
+}
+
+// capabilities describes what the server supports.
+func (srv *Server) capabilities() ClientCapabilitiesResponse {
+	caps := ClientCapabilitiesResponse{
+		Type:             "capabilities",
+		ProtocolVersions: srv.protocolVersions(),
+		Features:         []string{FeatureUnicast},
+		Compression:      srv.Compression,
+		Limits: CapabilityLimits{
+			PingInterval:    srv.TimeBetweenPings.Seconds(),
+			IdleTimeout:     srv.idleTimeout().Seconds(),
+			SessionGrace:    srv.SessionGrace.Seconds(),
+			RateLimit:       srv.RateLimit.Rate,
+			MaxMessageDepth: srv.MessageLimits.MaxDepth,
+			MaxMessageKeys:  srv.MessageLimits.MaxKeys,
+			E2eOnly:         srv.E2eOnly,
+		},
+	}
+	if srv.RateLimit.Rate > 0 {
+		caps.Limits.RateLimitBurst = max(1, srv.RateLimit.Burst)
+	}
+	if srv.SessionGrace > 0 {
+		caps.Features = append(caps.Features, FeatureResume)
+	}
+	if len(srv.Compression) > 0 {
+		caps.Features = append(caps.Features, FeatureCompression)
+	}
+	if len(srv.Codecs) > 0 {
+		caps.Features = append(caps.Features, FeatureCodec)
+		caps.Codecs = []string{jsonCodec{}.Name()}
+		for _, codec := range srv.Codecs {
+			caps.Codecs = append(caps.Codecs, codec.Name())
+		}
+	}
+	return caps
+}
+
+func handleClientCapabilities(c *client, msg Message) {
+	c.send(c.srv.capabilities())
+}
@@ -0,0 +1,69 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"sync/atomic"
+)
+
+// Capacity limits how much the server takes on at once, so that a burst of clients can't exhaust a small server's memory.
+// Connections and joins over a limit are rejected with ErrServerFull.
+// A limit of 0 isn't enforced.
+type Capacity struct {
+	// MaxConnections is the number of connections that may be open at once, whether or not their clients have joined a channel.
+	MaxConnections int
+
+	// MaxClients is the number of clients that may be in channels at once.
+	MaxClients int
+
+	// MaxChannels is the number of channels that may exist at once.
+	MaxChannels int
+}
+
+// WithCapacity sets the limits on how many connections, clients in channels, and channels the server takes on at once.
+func WithCapacity(capacity Capacity) Option {
+	return func(srv *Server) error {
+		if err := notNegative("max connections", capacity.MaxConnections); err != nil {
+			return err
+		}
+		if err := notNegative("max clients", capacity.MaxClients); err != nil {
+			return err
+		}
+		if err := notNegative("max channels", capacity.MaxChannels); err != nil {
+			return err
+		}
+		srv.Capacity = capacity
+		return nil
+	}
+}
+
+// capacityRejections counts what was turned away for being over the server's Capacity.
+type capacityRejections struct {
+	connections atomic.Int64
+	clients     atomic.Int64
+	channels    atomic.Int64
+}
+
+// reserveConnection counts a connection that is being accepted, and gets its client's ID, unless there are already maxConnections.
+// If maxConnections is 0, connections aren't limited.
+func (reg *registry) reserveConnection(maxConnections int) (id uint64, ok bool) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if maxConnections > 0 && reg.numConnections >= maxConnections {
+		reg.capacityRejections.connections.Add(1)
+		return 0, false
+	}
+	reg.numConnections++
+	return reg.newClientID(), true
+}
+
+// releaseConnection uncounts a connection reserved by reserveConnection that was closed before being served,
+// and frees its ID.
+func (reg *registry) releaseConnection(id uint64) {
+	reg.lock.Lock()
+	reg.numConnections--
+	delete(reg.reservedIDs, id)
+	reg.lock.Unlock()
+}
@@ -0,0 +1,123 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CertificateReloader serves a TLS certificate loaded from files, and can reload it when the files change,
+// such as when a certificate is renewed.
+// Connections that are already established keep working; new connections get the reloaded certificate.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+
+	lock     sync.RWMutex // Protects everything below
+	cert     *tls.Certificate
+	modTimes [2]time.Time // Modification times of certFile and keyFile when cert was loaded
+}
+
+// NewCertificateReloader loads a certificate and its private key from PEM encoded files.
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	cr := &CertificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// GetCertificate gets the current certificate.
+// It can be used as the GetCertificate function of a tls.Config.
+func (cr *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	return cr.cert, nil
+}
+
+// GetClientCertificate gets the current certificate, to present to servers that ask for one.
+// It can be used as the GetClientCertificate function of a tls.Config.
+func (cr *CertificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	return cr.cert, nil
+}
+
+// TLSConfig creates a TLS configuration that serves the current certificate.
+func (cr *CertificateReloader) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: cr.GetCertificate}
+}
+
+// Reload loads the certificate from its files again.
+// If loading fails, the previous certificate is kept.
+func (cr *CertificateReloader) Reload() error {
+	modTimes, err := cr.statFiles()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "Load X.509 key pair")
+	}
+
+	cr.lock.Lock()
+	cr.cert = &cert
+	cr.modTimes = modTimes
+	cr.lock.Unlock()
+	return nil
+}
+
+// statFiles gets the modification times of the certificate and key files.
+func (cr *CertificateReloader) statFiles() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, file := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTimes, errors.Wrap(err, "Check certificate")
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// Poll checks whether the certificate or key file has changed every interval, until ctx is done,
+// reloading the certificate and calling reloaded when it has.
+// Errors checking or reloading the files are passed to onError.
+func (cr *CertificateReloader) Poll(ctx context.Context, interval time.Duration, reloaded func(), onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			modTimes, err := cr.statFiles()
+			if err != nil {
+				onError(err)
+				continue
+			}
+			cr.lock.RLock()
+			changed := modTimes != cr.modTimes
+			cr.lock.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := cr.Reload(); err != nil {
+				onError(err)
+				continue
+			}
+			reloaded()
+		}
+	}
+}
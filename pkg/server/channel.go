@@ -5,86 +5,170 @@
 package server
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type channel struct {
 	name    string
 	members []channelMember
 
-	// messages receives messages to be broadcast over the channel.
-	messages chan channelMessage
-	// joins receives members to add to the channel
-	joins chan joinChannelRequest
-	// parts receives member IDs to remove from the channel
-	// If there are no more members, and no pending joins, the channel will be destroyed.
-	parts chan leaveChannelRequest
+	created time.Time
+
+	// shard runs this channel's joins, parts, and messages, in the order they are sent to it.
+	shard *dispatchShard
 
-	pendingJoinsLock sync.Mutex // Protects pendingJoins
-	// pendingJoins is the number of clients who have fetched this channel from the registry, but have not yet joined
+	// pendingJoins is the number of clients who have fetched this channel from its shard, but have not yet joined.
+	// It is protected by the shard's lock.
 	pendingJoins int
+
+	traffic trafficCounters
+	// quotaCounted is how much of traffic.bytesSent has been added to the channel's quota usage.
+	// It is protected by the shard's lock, and only changed by runTimers.
+	quotaCounted int64
+
+	// remote holds the members connected to other nodes of the cluster, by ID,
+	// and seen the Seq of the last membership change applied from each node.
+	// Until the channel's creator has finished asking the cluster who is in it, syncing is set,
+	// and deltas holds the joins and leaves applied meanwhile, to apply again after member lists sent before them.
+	// shared is set if the channel is counted by another node in the cluster's stats.
+	// These are only used by the shard's goroutine.
+	remote  map[uint64]remoteMember
+	seen    map[string]uint64
+	syncing bool
+	deltas  []clusterMessage
+	shared  bool
+
+	// destroyed is set once the channel has been removed from its shard. It is protected by the shard's lock.
+	destroyed bool
+
+	// debugUntil is the time in Unix nanoseconds until which activity on this channel is logged in detail.
+	debugUntil atomic.Int64
+	// lastMessage is when the last message was relayed, for debug logging.
+	lastMessage time.Time
+	reg         *registry
+	log         Logger
 }
 
 type channelMember struct {
 	id             uint64
 	connectionType string
-	events         chan<- Message
+	channel        string // Name of the channel, set when joining
+	events         chan Message
+	client         *client
 }
 
 type joinChannelRequest struct {
+	ctx    context.Context // Carries the join's span
 	member channelMember
 	resp   chan interface{} // response could either be a list of existing members or an error
 }
 
 // joinChannel adds a member to the named channel, creating it if it doesn't already exist.
-func joinChannel(name string, member channelMember, reg *registry) (*channel, []channelMember, error) {
+func joinChannel(ctx context.Context, name string, member channelMember, reg *registry) (*channel, []channelMember, error) {
+	member.channel = name
 	reg.lock.Lock()
+	if maxClients := reg.capacity.MaxClients; maxClients > 0 && len(reg.clients) >= maxClients {
+		reg.lock.Unlock()
+		reg.capacityRejections.clients.Add(1)
+		return nil, nil, ErrServerFull
+	}
 	reg.clients[member.id] = member
 	if len(reg.clients) > reg.maxClients {
 		reg.maxClients = len(reg.clients)
 		reg.maxClientsTime = time.Now()
 	}
+	reg.lock.Unlock()
 
-	c, ok := reg.channels[name]
+	shard := reg.dispatcher.shard(name)
+	shard.lock.Lock()
+	c, ok := shard.channels[name]
 	if !ok {
+		reg.lock.Lock()
+		if maxChannels := reg.capacity.MaxChannels; maxChannels > 0 && reg.numChannels >= maxChannels {
+			delete(reg.clients, member.id)
+			reg.lock.Unlock()
+			shard.lock.Unlock()
+			reg.capacityRejections.channels.Add(1)
+			return nil, nil, ErrServerFull
+		}
+		if ip := addrIP(member.client.addr); ip != nil {
+			if err := reg.creations.take(ip.String(), time.Now()); err != nil {
+				delete(reg.clients, member.id)
+				reg.lock.Unlock()
+				shard.lock.Unlock()
+				return nil, nil, err
+			}
+		}
 		c = &channel{
-			name:     name,
-			members:  []channelMember{},
-			messages: make(chan channelMessage),
-			joins:    make(chan joinChannelRequest),
-			parts:    make(chan leaveChannelRequest),
+			name:    name,
+			members: []channelMember{},
+			shard:   shard,
+			created: time.Now(),
+			reg:     reg,
+			log:     reg.log,
+			syncing: reg.cluster != nil,
 		}
-		reg.channels[name] = c
-		go c.start(reg)
+		shard.channels[name] = c
 
+		if until, ok := reg.debugChannels[name]; ok {
+			c.debugUntil.Store(until.UnixNano())
+		}
+		reg.numChannels++
 		if c.isE2e() {
 			reg.numE2eChannels++
 		}
-		if len(reg.channels) > reg.maxChannels {
-			reg.maxChannels = len(reg.channels)
+		if reg.numChannels > reg.maxChannels {
+			reg.maxChannels = reg.numChannels
 			reg.maxChannelsTime = time.Now()
 		}
+		reg.lock.Unlock()
+		reg.log.WithFields(Fields{
+			"channel":        name,
+			"id":             member.id,
+			"correlation_id": member.client.correlationID,
+		}).Info("Channel created")
+		reg.emit(Event{Type: EventChannelCreated, Channel: name})
+		trace.SpanFromContext(ctx).AddEvent("channel created")
 	}
 
-	// We don't want to join the channel while the registry is locked, because slow channel goroutines will bog it down for everyone.
+	// We don't want to join the channel while the shard is locked, because a busy shard would bog down lookups for all of its channels.
 	// But we do need to note that there is a join pending, so that if the channel becomes empty before this member joins,
-	// it doesn't spin down and remove itself from the registry.
-	c.pendingJoinsLock.Lock()
+	// it doesn't remove itself from the shard.
 	c.pendingJoins++
-	c.pendingJoinsLock.Unlock()
-	reg.lock.Unlock()
-	// Join the channel, now that the registry is unlocked
+	shard.lock.Unlock()
+	// The channel can't be destroyed until this join has been handled, so OnChannelCreated is always called before OnChannelDestroyed.
+	if !ok {
+		subscribed := reg.cluster.watch(name)
+		reg.hooks.channelCreated(name)
+		reg.cluster.syncMembers(ctx, c, subscribed)
+	}
+	// Join the channel, now that the shard is unlocked
 	req := joinChannelRequest{
+		ctx:    ctx,
 		member: member,
-		resp:   make(chan interface{}),
+		resp:   make(chan interface{}, 1),
+	}
+	if !member.client.dispatch(channelOp{channel: c, join: &req}) {
+		return nil, nil, ErrShuttingDown
+	}
+	resp, ok := awaitShard(shard, req.resp)
+	if !ok {
+		return nil, nil, ErrShuttingDown
 	}
-	c.joins <- req
 
-	switch result := (<-req.resp).(type) {
+	switch result := resp.(type) {
 	case error:
+		// The member never joined, but is in the registry, where it would be pinged after disconnecting.
+		// Leaving also destroys the channel, if it was only created for this join.
+		c.leave(member.id)
 		return c, nil, result
 	case []channelMember:
 		return c, result, nil
@@ -99,86 +183,203 @@ type leaveChannelRequest struct {
 }
 
 // leave removes a member from the channel, destroying the channel if it is empty.
+// The shard may be blocked delivering to the member, so unless it never joined, its events must be drained meanwhile,
+// such as with drainWhile.
 func (c *channel) leave(id uint64) {
 	req := leaveChannelRequest{
 		id:   id,
-		resp: make(chan struct{}),
-	}
-	c.parts <- req
-	<-req.resp
-}
-
-func (c *channel) start(reg *registry) {
-	for {
-		select {
-		case req := <-c.joins:
-			var exists bool
-			for _, member := range c.members {
-				if req.member.id == member.id {
-					exists = true
-					break // Already in the channel
-				}
-			}
+		resp: make(chan struct{}, 1),
+	}
+	if c.shard.send(channelOp{channel: c, part: &req}) {
+		awaitShard(c.shard, req.resp)
+	}
+}
 
-			if !exists {
-				// Send current members to the joiner
-				// and notify existing members.
-				req.resp <- c.members
-				c.broadcast(joinedChannelMSG(req.member))
-				c.members = append(c.members, req.member)
-			} else {
-				req.resp <- errors.New("already a member")
-			}
-			c.pendingJoinsLock.Lock()
-			c.pendingJoins--
-			c.pendingJoinsLock.Unlock()
-
-		case req := <-c.parts:
-			for i, member := range c.members {
-				if req.id == member.id {
-					c.members = append(c.members[:i], c.members[i+1:]...)
-					c.broadcast(leftChannelMSG(member))
-				}
-			}
-			// Tell the requester the removal is complete.
-			// This does not mean a member was actually removed, if the specified ID wasn't already in the channel.
-			req.resp <- struct{}{}
-
-			reg.lock.Lock()
-			delete(reg.clients, req.id)
-			// Destroy the channel if there are no more members and no more pending joins
-			c.pendingJoinsLock.Lock()
-			if len(c.members) == 0 && c.pendingJoins == 0 {
-				delete(reg.channels, c.name)
-				if c.isE2e() {
-					reg.numE2eChannels--
-				}
-				c.pendingJoinsLock.Unlock()
-				reg.lock.Unlock()
-				return
-			}
-			c.pendingJoinsLock.Unlock()
-			reg.lock.Unlock()
+// relay sends a message from the client, which must be a member, to every member of the channel except its origin.
+// It must be called from the client's handleClient. Messages sent once the server has shut down are dropped.
+func (c *channel) relay(cl *client, msg channelMessage) {
+	cl.dispatch(channelOp{channel: c, msg: &msg})
+}
 
-		case msg := <-c.messages:
-			for _, member := range c.members {
-				if msg.origin != member.id {
-					member.events <- msg
-				}
-			}
+func (c *channel) handleJoin(req joinChannelRequest) {
+	trace.SpanFromContext(req.ctx).AddEvent("dispatched")
+	var exists bool
+	for _, member := range c.members {
+		if req.member.id == member.id {
+			exists = true
+			break // Already in the channel
+		}
+	}
 
+	if exists {
+		req.resp <- ErrAlreadyInChannel
+	} else if err := c.enforceMasterPolicy(req.member); err != nil {
+		req.resp <- err
+	} else {
+		// Send current members to the joiner
+		// and notify existing members.
+		req.resp <- c.withRemote(c.members)
+		c.broadcast(joinedChannelMSG(req.member))
+		c.members = append(c.members, req.member)
+		c.reg.emit(Event{Type: EventClientJoined, Client: req.member.client.eventClient(), Channel: c.name, ConnectionType: req.member.connectionType})
+		c.reg.cluster.forward(clusterMessage{
+			Type:    clusterJoin,
+			Channel: c.name,
+			Members: []clusterMember{{ID: req.member.id, ConnectionType: req.member.connectionType}},
+		})
+		c.log.WithFields(Fields{
+			"channel":         c.name,
+			"id":              req.member.id,
+			"correlation_id":  req.member.client.correlationID,
+			"connection_type": req.member.connectionType,
+			"members":         len(c.members),
+		}).Info("Client joined channel")
+	}
+	c.shard.lock.Lock()
+	c.pendingJoins--
+	c.shard.lock.Unlock()
+}
+
+func (c *channel) handlePart(req leaveChannelRequest) {
+	// correlationID identifies the connection of the client that left, in case it was the last.
+	var correlationID string
+	for i, member := range c.members {
+		if req.id == member.id {
+			c.members = append(c.members[:i], c.members[i+1:]...)
+			c.broadcast(leftChannelMSG(member))
+			c.reg.emit(Event{Type: EventClientLeft, Client: member.client.eventClient(), Channel: c.name})
+			c.reg.cluster.forward(clusterMessage{
+				Type:    clusterLeave,
+				Channel: c.name,
+				Members: []clusterMember{{ID: member.id, ConnectionType: member.connectionType}},
+			})
+			c.log.WithFields(Fields{
+				"channel":        c.name,
+				"id":             member.id,
+				"correlation_id": member.client.correlationID,
+				"members":        len(c.members),
+			}).Info("Client left channel")
+			correlationID = member.client.correlationID
+		}
+	}
+
+	c.reg.lock.Lock()
+	delete(c.reg.clients, req.id)
+	c.reg.lock.Unlock()
+
+	// Destroy the channel if there are no more members and no more pending joins
+	c.shard.lock.Lock()
+	destroyed := len(c.members) == 0 && c.pendingJoins == 0
+	if destroyed {
+		c.destroyed = true
+		delete(c.shard.channels, c.name)
+		c.reg.lock.Lock()
+		c.reg.numChannels--
+		if c.isE2e() {
+			c.reg.numE2eChannels--
+		}
+		c.reg.lock.Unlock()
+		c.log.WithFields(Fields{
+			"channel":        c.name,
+			"correlation_id": correlationID,
+		}).Info("Channel destroyed")
+		c.reg.emit(Event{Type: EventChannelDestroyed, Channel: c.name})
+		if c.shared {
+			c.reg.cluster.sharedChannels.Add(-1)
+		}
+	}
+	c.shard.lock.Unlock()
+	if destroyed {
+		c.reg.cluster.unwatch(c.name)
+		c.reg.hooks.channelDestroyed(c.name)
+	}
+
+	// Tell the requester the removal is complete.
+	// This does not mean a member was actually removed, if the specified ID wasn't already in the channel.
+	req.resp <- struct{}{}
+}
+
+func (c *channel) handleMessage(msg channelMessage) {
+	start := time.Now()
+	msg.span.AddEvent("dispatched")
+	c.countRelayed(msg)
+	var origin channelMember
+	for _, member := range c.members {
+		if msg.origin == member.id {
+			origin = member
+			break
+		}
+	}
+	recipients := 0
+	if msg.to != nil {
+		// Targeted messages go to their member regardless of the relay mode.
+		for _, member := range c.members {
+			if *msg.to == member.id && msg.origin != member.id {
+				c.deliver(member, msg)
+				recipients++
+				break
+			}
+		}
+		if recipients == 0 && c.relayRemote(msg, origin.connectionType) {
+			recipients++
+		}
+		if recipients == 0 && origin.events != nil {
+			c.deliver(origin, channelErrorMSG(fmt.Sprintf("no member with ID %d in channel", *msg.to)))
+		}
+	} else {
+		for _, member := range c.members {
+			if msg.origin != member.id && c.reg.relayMode.relaysTo(origin.connectionType, member) {
+				c.deliver(member, msg)
+				recipients++
+			}
 		}
+		c.relayRemote(msg, origin.connectionType)
+	}
+	msg.span.SetAttributes(attribute.Int("nvremoted.message.recipients", recipients))
+	msg.span.End()
+	if c.debugging() {
+		c.logMessage(msg, start, recipients)
 	}
 }
 
 func (c *channel) broadcast(msg Message) {
 	for _, member := range c.members {
-		member.events <- msg
+		c.deliver(member, msg)
 	}
 }
 
+// debugging reports whether activity on this channel should be logged in detail.
+func (c *channel) debugging() bool {
+	return c.debugUntil.Load() > time.Now().UnixNano()
+}
+
+// logMessage logs the metadata of a message relayed over the channel, without its contents.
+// relayStart is when the channel began delivering the message to its members.
+func (c *channel) logMessage(msg channelMessage, relayStart time.Time, recipients int) {
+	msgType, _ := msg.msg["type"].(string)
+	fields := Fields{
+		"channel":      c.name,
+		"origin":       msg.origin,
+		"message_type": msgType,
+		"size":         msg.size,
+		"recipients":   recipients,
+		"queue_time":   relayStart.Sub(msg.received),
+		"relay_time":   time.Since(relayStart),
+	}
+	if !c.lastMessage.IsZero() {
+		fields["since_last"] = relayStart.Sub(c.lastMessage)
+	}
+	c.lastMessage = relayStart
+	c.log.WithFields(fields).Info("Channel debug: message relayed")
+}
+
 func (c *channel) isE2e() bool {
-	return strings.HasPrefix(c.name, "E2E_") && len(c.name) == 68
+	return isE2eChannel(c.name)
+}
+
+// isE2eChannel reports whether a channel's name is the form used by clients with end-to-end encryption.
+func isE2eChannel(name string) bool {
+	return strings.HasPrefix(name, "E2E_") && len(name) == 68
 }
 
 type joinedChannelMSG channelMember
@@ -194,10 +395,22 @@ func (leftChannelMSG) Name() string {
 }
 
 type channelMessage struct {
-	origin uint64
-	msg    map[string]interface{}
+	origin    uint64
+	msg       map[string]interface{}
+	size      int        // Size of the message as received, in bytes
+	received  time.Time  // When the message was read from its origin
+	span      trace.Span // Covers the message's relay, from when it was read
+	to        *uint64    // If set, the ID of the only member the message is for
+	overLimit error      // If set, why the message is over the server's MessageLimits; msg is then nil
 }
 
 func (channelMessage) Name() string {
 	return "channel_message"
 }
+
+// channelErrorMSG tells a member that a message it sent to the channel couldn't be relayed.
+type channelErrorMSG string
+
+func (channelErrorMSG) Name() string {
+	return "channel_error"
+}
@@ -0,0 +1,82 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxChannelDebugDuration limits how long a channel can be debug logged for with one command,
+// so that a forgotten debug session doesn't keep logging indefinitely.
+const maxChannelDebugDuration = 24 * time.Hour
+
+// ChannelDebugArgs holds the arguments to the debug_channel admin command.
+type ChannelDebugArgs struct {
+	Channel string `json:"channel"`
+	// Duration is how long to log the channel for, parsable by time.ParseDuration.
+	// A duration of 0 stops debug logging.
+	Duration string `json:"duration"`
+}
+
+// ChannelDebugResult is the result of the debug_channel admin command.
+type ChannelDebugResult struct {
+	Channel string `json:"channel"`
+	// Until is when debug logging will stop, or the zero time if it was stopped.
+	Until time.Time `json:"until"`
+}
+
+// adminDebugChannel logs the metadata of activity on a channel (message types, sizes and timings, and resumed sessions)
+// for a limited time; joins and parts are always logged. Message contents are never logged.
+func adminDebugChannel(srv *Server, args json.RawMessage) (interface{}, error) {
+	var debugArgs ChannelDebugArgs
+	if err := decodeAdminArgs(args, &debugArgs); err != nil {
+		return nil, err
+	}
+	if debugArgs.Channel == "" {
+		return nil, errors.New("no channel specified")
+	}
+	duration, err := time.ParseDuration(debugArgs.Duration)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid duration")
+	}
+	if duration < 0 || duration > maxChannelDebugDuration {
+		return nil, errors.Errorf("duration must be between 0 and %s", maxChannelDebugDuration)
+	}
+
+	result := ChannelDebugResult{Channel: debugArgs.Channel}
+	reg := &srv.registry
+	reg.lock.Lock()
+	// Forget channels whose debugging has expired, so the map doesn't grow indefinitely.
+	for name, until := range reg.debugChannels {
+		if time.Now().After(until) {
+			delete(reg.debugChannels, name)
+		}
+	}
+	if duration == 0 {
+		delete(reg.debugChannels, debugArgs.Channel)
+	} else {
+		result.Until = time.Now().Add(duration).Round(0) // Strip the monotonic clock reading, which is noise in logs
+		reg.debugChannels[debugArgs.Channel] = result.Until
+	}
+	reg.lock.Unlock()
+	// The channel is looked up after unlocking the registry, since shards lock the registry while holding their own lock.
+	// A channel created in between already got its debug time from debugChannels.
+	if c, ok := reg.dispatcher.channel(debugArgs.Channel); ok {
+		c.debugUntil.Store(result.Until.UnixNano())
+	}
+
+	if duration == 0 {
+		srv.Log.WithField("channel", debugArgs.Channel).Info("Channel debug logging stopped")
+	} else {
+		srv.Log.WithFields(Fields{
+			"channel": debugArgs.Channel,
+			"until":   result.Until,
+		}).Info("Channel debug logging started")
+	}
+	return result, nil
+}
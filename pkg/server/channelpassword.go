@@ -0,0 +1,49 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/subtle"
+	"time"
+)
+
+// A ChannelPassword requires clients joining channels matching Pattern to provide Password as the join message's key_password.
+type ChannelPassword struct {
+	Pattern  ChannelPattern
+	Password string
+}
+
+// channelPassword gets the password required to join a channel, or "" if none is required.
+// If several patterns match the channel, the first one's password is used.
+func (srv *Server) channelPassword(channel string) string {
+	for _, cp := range srv.ChannelPasswords {
+		if cp.Pattern.Match(channel) {
+			return cp.Password
+		}
+	}
+	return ""
+}
+
+// checkChannelPassword checks the password a client gave to join a channel.
+// If it is missing or doesn't match, the client is sent an error and stopped.
+func (c *client) checkChannelPassword(channel, password string) bool {
+	required := c.srv.channelPassword(channel)
+	if required == "" {
+		return true
+	}
+	if password == "" {
+		c.sendKick(KickUnauthorized, "channel password required: this channel requires a key_password in the join message")
+		c.stop("channel password required")
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(required)) != 1 {
+		c.securityEvent(SecurityAuthFailure, "wrong channel password")
+		time.Sleep(5 * time.Second) // Prevent brute forcing
+		c.sendKick(KickUnauthorized, "wrong channel password")
+		c.stop("wrong channel password")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+	"time"
+)
+
+// reconnectWindow is how soon a client must connect from the same address after a disconnect to count as reconnecting.
+const reconnectWindow = time.Minute
+
+// churnSeconds is the number of seconds over which per minute churn rates are counted.
+const churnSeconds = 60
+
+// churn tracks clients connecting and disconnecting.
+// It is protected by the registry lock.
+type churn struct {
+	// Rings of counts for each of the last churnSeconds seconds; pos is the current second.
+	connects    [churnSeconds]int
+	disconnects [churnSeconds]int
+	reconnects  [churnSeconds]int
+	pos         int
+
+	totalConnects    int64
+	totalDisconnects int64
+	totalReconnects  int64
+
+	// disconnectReasons counts disconnects by the general reason, without details such as network errors.
+	disconnectReasons map[string]int64
+	// lastDisconnect maps addresses to the time a client from that address last disconnected.
+	lastDisconnect map[string]time.Time
+}
+
+// recordConnect records that a client connected from addr.
+func (reg *registry) recordConnect(c *client, addr string) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	// The connection was counted, and its ID reserved, by reserveConnection when it was accepted.
+	reg.connected[c.id] = c
+	delete(reg.reservedIDs, c.id)
+	ch := &reg.churn
+	ch.connects[ch.pos]++
+	ch.totalConnects++
+	if last, ok := ch.lastDisconnect[addr]; ok && time.Since(last) < reconnectWindow {
+		ch.reconnects[ch.pos]++
+		ch.totalReconnects++
+	}
+}
+
+// recordDisconnect records that a client from addr disconnected for reason.
+func (reg *registry) recordDisconnect(addr, reason string) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	reg.numConnections--
+	ch := &reg.churn
+	ch.disconnects[ch.pos]++
+	ch.totalDisconnects++
+	if ch.disconnectReasons == nil {
+		ch.disconnectReasons = make(map[string]int64)
+	}
+	ch.disconnectReasons[generalReason(reason)]++
+	if ch.lastDisconnect == nil {
+		ch.lastDisconnect = make(map[string]time.Time)
+	}
+	ch.lastDisconnect[addr] = time.Now()
+}
+
+// advanceChurn starts counting churn for the next second, and forgets disconnects too old to be reconnected to.
+// It should be called once per second.
+func (reg *registry) advanceChurn() {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	ch := &reg.churn
+	ch.pos = (ch.pos + 1) % churnSeconds
+	ch.connects[ch.pos] = 0
+	ch.disconnects[ch.pos] = 0
+	ch.reconnects[ch.pos] = 0
+	for addr, last := range ch.lastDisconnect {
+		if time.Since(last) >= reconnectWindow {
+			delete(ch.lastDisconnect, addr)
+		}
+	}
+}
+
+// ChurnStats contains counts of clients connecting and disconnecting.
+// Per minute counts cover the last 60 seconds.
+type ChurnStats struct {
+	ConnectsPerMinute    int              `json:"connects_per_minute"`
+	DisconnectsPerMinute int              `json:"disconnects_per_minute"`
+	ReconnectsPerMinute  int              `json:"reconnects_per_minute"`
+	TotalConnects        int64            `json:"total_connects"`
+	TotalDisconnects     int64            `json:"total_disconnects"`
+	TotalReconnects      int64            `json:"total_reconnects"`
+	DisconnectReasons    map[string]int64 `json:"disconnect_reasons"`
+}
+
+// stats gets churn stats. The registry must be locked for reading.
+func (ch *churn) stats() ChurnStats {
+	stats := ChurnStats{
+		TotalConnects:     ch.totalConnects,
+		TotalDisconnects:  ch.totalDisconnects,
+		TotalReconnects:   ch.totalReconnects,
+		DisconnectReasons: make(map[string]int64, len(ch.disconnectReasons)),
+	}
+	for i := 0; i < churnSeconds; i++ {
+		stats.ConnectsPerMinute += ch.connects[i]
+		stats.DisconnectsPerMinute += ch.disconnects[i]
+		stats.ReconnectsPerMinute += ch.reconnects[i]
+	}
+	for reason, count := range ch.disconnectReasons {
+		stats.DisconnectReasons[reason] = count
+	}
+	return stats
+}
+
+// generalReason strips details, such as the underlying error, from a disconnect reason,
+// so that reasons can be counted without every distinct error getting its own count.
+func generalReason(reason string) string {
+	if i := strings.Index(reason, ":"); i >= 0 {
+		return reason[:i]
+	}
+	return reason
+}
@@ -5,78 +5,204 @@
 package server
 
 import (
-	"encoding/json"
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// defaultQueueSize is the number of events that can be queued for a client if the server doesn't specify a size.
+// Events that are queued together are coalesced into a single write.
+const defaultQueueSize = 32
+
+// defaultFlushSize is the size of a client's output buffer if the server doesn't specify one.
+const defaultFlushSize = 4096
+
+// correlationIDSize is the number of random bytes in a connection's correlation ID.
+const correlationIDSize = 8
+
 // client represents a client on the server.
 type client struct {
 	id         uint64
+	addr       net.Addr // address of the client, which may have been given by a trusted proxy
+	remoteHost string
+	connected  time.Time
 	conn       net.Conn
 	events     chan Message  // passes internal messages to a client
 	recv       chan Message  // passes messages to a client from the network
 	readNext   chan struct{} // Used by handleClient to ask readFromClient to read the next message
 	channel    *channel      // active channel
+	session    *session      // session in the active channel, if sessions can be resumed
 	registry   *registry
-	encoder    *json.Encoder
-	stopMTX    sync.RWMutex // Protects stopped and stopReason
-	stopped    bool
-	stopReason string
-	log        *logrus.Logger
+	srv        *Server
+	out        *bufio.Writer // buffers output to conn; only used by handleClient
+	// codec encodes messages to and from the client. It is only changed by handleClient,
+	// while readFromClient waits for it to finish handling the message asking for the change.
+	codec Codec
+	// protocol is the version of the protocol the client negotiated, or the default if it didn't.
+	protocol *protocol
+	// compression is the algorithm the client's connection is compressed with, if any.
+	// Like codec, it is only changed by handleClient, while readFromClient waits.
+	compression string
+	// compressor compresses output once the connection is compressed; out then writes to it.
+	compressor *compressor
+	// flushDelay is how long buffered output may wait for more output before being flushed.
+	flushDelay time.Duration
+	// writeTimeout is how long a single write may block before the peer is considered gone.
+	writeTimeout time.Duration
+	stopMTX      sync.RWMutex // Protects stopped, stopReason, and dropped
+	stopped      bool
+	stopReason   string
+	// dropped is set if the client was stopped because its connection was lost, so its session may be resumed.
+	dropped bool
+	// slow is set once the client is being disconnected by the slow client policy, or displaced by a new master,
+	// after which nothing more is queued for it.
+	slow atomic.Bool
+	// admin is set once the client has made an admin request, so it isn't kicked by its own command.
+	admin atomic.Bool
+	// limitViolations counts the messages the client sent over the server's MessageLimits.
+	limitViolations atomic.Int64
+	// debugUntil is when the client stops being debug logged, in nanoseconds since the Unix epoch.
+	debugUntil atomic.Int64
+	// pingSent is when the client was sent a ping it hasn't answered, if it speaks a version of the protocol that answers them.
+	// It is only used by handleClient.
+	pingSent time.Time
+	// rtt summarizes the client's round trip times, measured from its pings.
+	rtt rttStats
+	// lastActive is when the client last sent a message, in nanoseconds since the Unix epoch,
+	// so that clients that aren't idle needn't be pinged.
+	lastActive atomic.Int64
+	// annotations are attached by the server's Authenticator, and protected by the registry lock.
+	annotations Annotations
+	// ctx carries the client's session span, which spans for its joins and messages are children of.
+	ctx  context.Context
+	span trace.Span
+	// correlationID identifies the connection in every log line about it, including those logged by its channel,
+	// so that a session can be followed across goroutines, and across its ID being handed over by a resumed session.
+	correlationID string
+	// log logs with the client's correlation ID.
+	log Logger
 }
 
 // serveClient handles events sent and received by a client.
-func (srv *Server) serveClient(conn net.Conn, id uint64, remoteHost string) {
+// done is closed once the client has disconnected.
+func (srv *Server) serveClient(conn net.Conn, id uint64, addr net.Addr, remoteHost string, done chan<- struct{}) {
+	queueSize := srv.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	correlationID := newCorrelationID()
 	c := &client{
-		id:       id,
-		conn:     conn,
-		events:   make(chan Message, 1),
-		recv:     make(chan Message),
-		readNext: make(chan struct{}),
-		registry: &srv.registry,
-		encoder:  json.NewEncoder(conn),
-		log:      srv.Log,
+		id:         id,
+		addr:       addr,
+		remoteHost: remoteHost,
+		connected:  time.Now(),
+		conn:       conn,
+		events:     make(chan Message, queueSize),
+		recv:       make(chan Message),
+		readNext:   make(chan struct{}),
+		registry:   &srv.registry,
+		srv:        srv,
+		codec:      jsonCodec{},
+		protocol:   protocols[defaultProtocolVersion],
+
+		flushDelay:   srv.FlushDelay,
+		writeTimeout: srv.WriteTimeout,
+
+		correlationID: correlationID,
+		log:           srv.Log.WithField("correlation_id", correlationID),
 	}
+	flushSize := srv.FlushSize
+	if flushSize <= 0 {
+		flushSize = defaultFlushSize
+	}
+	c.out = bufio.NewWriterSize(deadlineWriter{conn: conn, timeout: srv.WriteTimeout, count: c.countSent}, flushSize)
+
+	c.startSession()
+	c.debugUntil.Store(c.registry.debugUntilFor(addr))
+
+	remoteAddr := addrHost(addr)
+	c.registry.recordConnect(c, remoteAddr)
 
 	// Only when both readFromClient and handleClient are finished will conn be closed.
 	finished := make(chan struct{}, 2)
 
-	srv.Log.WithFields(logrus.Fields{
+	c.log.WithFields(Fields{
 		"id":          id,
 		"remote_host": remoteHost,
 	}).Info("Client connected")
+	c.registry.emit(Event{Type: EventClientConnected, Client: c.eventClient()})
 
 	go srv.readFromClient(c, finished)
 	go srv.handleClient(c, finished)
 	go func() {
+		defer close(done)
 		// Wait for both readFromClient and handleClient to finish
 		<-finished
 		<-finished
 
 		// The active channel and server registry may still be sending events to the client after requesting removal.
 		// The events channel needs to be closed and drained to prevent these goroutines from hanging.
-		if c.channel != nil {
-			c.channel.leave(c.id)
+		if c.channel != nil && !c.holdSession() {
+			// The channel's shard may be blocked delivering to this client, and can't get to the leave request
+			// until there's room in the client's queue, so keep draining it while leaving.
+			c.drainWhile(func() {
+				c.channel.leave(c.id)
+			})
 		}
 
+		// Admin commands may queue events for connected clients, so the client is removed before its events are closed.
+		// Its ID may have been taken over by a client that resumed its session.
+		c.registry.lock.Lock()
+		if c.registry.connected[c.id] == c {
+			delete(c.registry.connected, c.id)
+		}
+		c.registry.lock.Unlock()
 		close(c.events)
 		for range c.events {
 		}
 
 		conn.Close()
-		srv.Log.WithFields(logrus.Fields{
-			"id":          id,
+		c.registry.recordDisconnect(remoteAddr, c.stopReason)
+		c.log.WithFields(Fields{
+			"id":          c.id,
 			"remote_host": remoteHost,
 			"reason":      c.stopReason,
 		}).Info("Client disconnected")
+		c.registry.emit(Event{Type: EventClientDisconnected, Client: c.eventClient(), Reason: c.stopReason})
+		c.endSession(c.stopReason)
+		srv.Hooks.clientDisconnected(c, c.stopReason)
 	}()
 }
 
+// newCorrelationID makes a random ID for a connection, which, unlike client IDs,
+// won't be repeated across restarts or the nodes of a cluster.
+func newCorrelationID() string {
+	buf := make([]byte, correlationIDSize)
+	// This only fails if the system's random source is broken; a predictable ID still correlates logs.
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// idleTimeout is how long a client may go without sending anything before it is timed out, or 0 if it never is.
+// If PingsUntilTimeout is not 0, but no pings are to be sent, idle clients time out after a minute.
+func (srv *Server) idleTimeout() time.Duration {
+	switch {
+	case srv.PingsUntilTimeout == 0:
+		return 0
+	case srv.TimeBetweenPings == 0:
+		return time.Minute
+	}
+	return srv.TimeBetweenPings * time.Duration(srv.PingsUntilTimeout)
+}
+
 // readFromClient reads data from the client socket, marshals it, and sends the resulting clientMessage to the client's events channel to be handled.
 func (srv *Server) readFromClient(c *client, finished chan<- struct{}) {
 	defer func() {
@@ -85,28 +211,94 @@ func (srv *Server) readFromClient(c *client, finished chan<- struct{}) {
 	}()
 
 	// readDeadline is the total amount of time that may pass before a client is timed out, if nothing is received.
-	// If PingsUntilTimeout is 0, the client will never time out.
-	readDeadline := srv.TimeBetweenPings * time.Duration(srv.PingsUntilTimeout)
+	readDeadline := srv.idleTimeout()
 	if readDeadline == 0 {
-		// If PingsUntilTimeout is not 0, but no pings are to be sent,
-		// idle clients will time out after a minute.
-		// If PingsUntilTimeout is 0, clients will not time out, but it is still necessary to unblock at least once per minute,
+		// Clients will not time out, but it is still necessary to unblock at least once per minute,
 		// to allow this function to return when handleClient stops.
 		readDeadline = time.Minute
 	}
-	dec := json.NewDecoder(c.conn)
+	codec := c.codec
+	// src is what messages are decoded from: the connection, or its decompressed stream.
+	var src io.Reader = c.conn
+	dec := codec.NewDecoder(src)
+	var compression string
+	var decompress *decompressor
+	defer func() {
+		if decompress != nil {
+			decompress.Close()
+		}
+	}()
+
+	var limiter *tokenBucket
+	if srv.RateLimit.Rate > 0 {
+		limiter = newTokenBucket(srv.RateLimit, time.Now())
+	}
+	var throttledSince time.Time // When the client started being throttled, if it is
 
 	for !c.isStopped() {
 		c.conn.SetReadDeadline(time.Now().Add(readDeadline))
-		msg, err := unmarshalClientMessage(c.id, dec)
+		if c.isStopped() {
+			// Stopped before the deadline above was set, which would have overwritten the one set by stop.
+			return
+		}
+		raw, err := dec.Decode()
+		var msg Message
+		if err == nil {
+			msg, err = unmarshalClientMessage(c.id, codec, raw, srv.messageTypes(), srv.MessageLimits)
+		}
 		// handleClient could have finished while the above read was blocking.
 		if err == nil {
+			// Answering a ping doesn't make a client active, or clients answering them would only be pinged every other time.
+			if _, ok := msg.(*ClientPongMessage); !ok {
+				c.lastActive.Store(time.Now().UnixNano())
+			}
+			c.registry.countTraffic(int64(len(raw)))
+			if c.debugging() {
+				c.logMessage("received", msg, len(raw))
+			}
+			if limiter != nil {
+				now := time.Now()
+				wait := limiter.take(now)
+				if wait == 0 {
+					throttledSince = time.Time{}
+				} else if throttledSince.IsZero() {
+					throttledSince = now
+					c.registry.rateLimitThrottles.Add(1)
+					c.log.WithField("id", c.id).Info("Throttling client for exceeding the rate limit")
+				} else if srv.RateLimit.KickAfter > 0 && now.Sub(throttledSince) > srv.RateLimit.KickAfter {
+					c.registry.rateLimitKicks.Add(1)
+					c.log.WithFields(Fields{
+						"id":        c.id,
+						"throttled": now.Sub(throttledSince),
+					}).Warn("Kicking client for exceeding the rate limit")
+					c.registry.emit(Event{Type: EventClientKicked, Client: c.eventClient(), Reason: "rate limit exceeded"})
+					c.kickFromReader(kickMessage{code: KickRateLimit, reason: "rate limit exceeded"})
+					return
+				}
+				time.Sleep(wait)
+			}
+			if channelMSG, ok := msg.(*channelMessage); ok {
+				c.startRelay(channelMSG)
+			}
 			c.recv <- msg
 			// Sending the unmarshaled message to handleClient might cause the client to be kicked.
 			// But there would be no wayfor this goroutine to know that until the next read operation unblocks.
 			// By waiting for handleClient to signal that it has finished processing the message,
 			// we are able to see if the client was stopped before trying to read from the socket again.
 			<-c.readNext
+			if c.compression != compression {
+				// The client's connection is compressed from here on, including anything it has sent since.
+				compression = c.compression
+				conn := &connReader{c: c, retryDeadline: readDeadline}
+				decompress = newDecompressor(compression, io.MultiReader(dec.Buffered(), conn), conn)
+				src = decompress
+				dec = codec.NewDecoder(src)
+			}
+			if c.codec != codec {
+				// The client switched codecs, so anything it has sent since is in the new encoding.
+				codec = c.codec
+				dec = codec.NewDecoder(io.MultiReader(dec.Buffered(), src))
+			}
 			continue
 		}
 
@@ -118,22 +310,36 @@ func (srv *Server) readFromClient(c *client, finished chan<- struct{}) {
 			if srv.PingsUntilTimeout == 0 {
 				// No timeout enforcement.
 				// Decoder breaks if it returns an error; reinitialize.
-				dec = json.NewDecoder(c.conn)
+				dec = codec.NewDecoder(src)
 				continue
 			}
-			c.stop("Client timed out")
+			if c.isStopped() {
+				// The deadline was set by stop, not by the client going quiet.
+				return
+			}
+			c.kickFromReader(kickMessage{
+				code:       KickTimeout,
+				reason:     "timed out: nothing was received from the client for too long",
+				stopReason: "Client timed out",
+				drop:       true,
+			})
+			return
+		}
+		if _, ok := err.(malformedMessageError); ok {
+			c.kickFromReader(kickMessage{code: KickProtocolError, reason: "malformed message", stopReason: "client sent a malformed request"})
 			return
 		}
-		if _, ok := err.(*json.UnmarshalTypeError); ok {
-			c.sendError("malformed message")
-			c.stop("client sent a malformed request")
+		if _, ok := err.(*net.OpError); ok {
+			// The connection was reset or otherwise broken beneath us;
+			// the client did not leave on its own.
+			c.drop("Connection lost: " + err.Error())
 			return
 		}
-		srv.Log.WithFields(logrus.Fields{
+		c.log.WithFields(Fields{
 			"id":    c.id,
 			"error": err,
 		}).Warn("Error unmarshaling message from client")
-		c.stop("Receive error")
+		c.kickFromReader(kickMessage{code: KickProtocolError, reason: "malformed message", stopReason: "Receive error"})
 		return
 	}
 }
@@ -144,56 +350,152 @@ func (srv *Server) handleClient(c *client, finished chan<- struct{}) {
 		finished <- struct{}{}
 	}()
 
-	// Send the MOTD when the client connects
-	if srv.MOTD != "" {
+	srv.Hooks.clientConnected(c)
+
+	if !c.checkAuth(AuthConnect, nil) {
+		c.flush()
+		// Discard anything read before the client was stopped, so readFromClient can finish.
+		for range c.recv {
+			c.readNext <- struct{}{}
+		}
+		return
+	}
+
+	// Send the capabilities and MOTD when the client connects
+	if !srv.HideCapabilities {
+		c.send(srv.capabilities())
+	}
+	if motd := srv.getMOTD(); motd != "" {
 		c.send(ClientMOTDResponse{
 			Type: "motd",
-			MOTD: srv.MOTD,
+			MOTD: motd,
 		})
 	}
+	c.flush()
+
+	// Buffered output is flushed when the buffer fills, or once flushDelay passes, whichever comes first.
+	// flushCH is nil when no flush is pending.
+	var flushCH <-chan time.Time
+	scheduleFlush := func() {
+		if !c.hasOutput() || flushCH != nil {
+			return
+		}
+		if c.flushDelay <= 0 || c.isStopped() {
+			// Errors sent to stopped clients need to go out before the connection is closed.
+			c.flush()
+			return
+		}
+		flushCH = time.After(c.flushDelay)
+	}
 
 	for {
 		select {
 		case msg, ok := <-c.recv:
 			if !ok {
+				c.flush()
 				return // The client was stopped.
 			}
 
-			if handlerFunc := clientMessageHandlers[msg.Name()]; handlerFunc == nil {
-				c.log.WithFields(logrus.Fields{
-					"id":           c.id,
-					"message_name": msg.Name(),
-				}).Warn("No handler found for client message")
-				c.sendInternalError()
-				c.stop("internal error")
+			if kick, ok := msg.(kickMessage); ok {
+				// From readFromClient, which has stopped reading.
+				c.handleEvent(kick)
 			} else {
-				handlerFunc(c, msg)
+				c.handleMessage(msg)
 			}
+			c.coalesceEvents()
+			scheduleFlush()
 			// Tell readFromClient to read the next message
 			c.readNext <- struct{}{}
 
 		case msg := <-c.events:
-			if handlerFunc := clientEventHandlers[msg.Name()]; handlerFunc == nil {
-				c.log.WithFields(logrus.Fields{
-					"id":           c.id,
-					"message_name": msg.Name(),
-				}).Warn("No handler found for client event")
-				c.sendInternalError()
-				c.stop("internal error")
-			} else {
-				handlerFunc(c, msg)
-			}
+			c.handleEvent(msg)
+			c.coalesceEvents()
+			scheduleFlush()
+
+		case <-flushCH:
+			flushCH = nil
+			c.flush()
+		}
+	}
+}
+
+// handleMessage handles a message received from the client.
+func (c *client) handleMessage(msg Message) {
+	if handlerFunc := c.srv.messageTypes()[msg.Name()].handler; handlerFunc == nil {
+		c.log.WithFields(Fields{
+			"id":           c.id,
+			"message_name": msg.Name(),
+		}).Warn("No handler found for client message")
+		c.sendKick(KickInternalError, "internal error")
+		c.stop("internal error")
+	} else {
+		handlerFunc(c, msg)
+	}
+}
+
+// handleEvent handles an event sent to the client from within the server.
+func (c *client) handleEvent(msg Message) {
+	if handlerFunc := clientEventHandlers[msg.Name()]; handlerFunc == nil {
+		c.log.WithFields(Fields{
+			"id":           c.id,
+			"message_name": msg.Name(),
+		}).Warn("No handler found for client event")
+		c.sendKick(KickInternalError, "internal error")
+		c.stop("internal error")
+	} else {
+		handlerFunc(c, msg)
+	}
+}
+
+// coalesceEvents handles any events that are already queued for the client,
+// so that their output can be sent with a single write when flushed.
+func (c *client) coalesceEvents() {
+	for i := 0; i < cap(c.events); i++ {
+		select {
+		case msg := <-c.events:
+			c.handleEvent(msg)
+		default:
+			return
 		}
 	}
 }
 
 // stop stops a client with the specified reason
+// Only the first reason is kept, since later ones are usually side effects of the first.
 // This method is safe to use concurrently.
 func (c *client) stop(reason string) {
 	c.stopMTX.Lock()
+	defer c.stopMTX.Unlock()
+	if c.stopped {
+		return
+	}
+	c.stopped = true
+	c.stopReason = reason
+
+	// Unblock readFromClient, so the client is reaped now rather than when its read deadline expires.
+	c.conn.SetReadDeadline(time.Now())
+}
+
+// drop stops a client whose connection was lost, rather than one that left or was disconnected by the server.
+// This method is safe to use concurrently.
+func (c *client) drop(reason string) {
+	c.stopMTX.Lock()
+	defer c.stopMTX.Unlock()
+	if c.stopped {
+		return
+	}
 	c.stopped = true
 	c.stopReason = reason
-	c.stopMTX.Unlock()
+	c.dropped = true
+	c.conn.SetReadDeadline(time.Now())
+}
+
+// wasDropped checks to see if a client was stopped by drop.
+// This method is safe to use concurrently.
+func (c *client) wasDropped() bool {
+	c.stopMTX.RLock()
+	defer c.stopMTX.RUnlock()
+	return c.dropped
 }
 
 // isStopped checks to see if a client is stopped.
@@ -206,14 +508,75 @@ func (c *client) isStopped() bool {
 	return stopped
 }
 
+// send buffers a response to be written to the client.
 func (c *client) send(resp Message) {
-	if err := c.encoder.Encode(resp); err != nil {
-		c.log.WithFields(logrus.Fields{
+	if c.isStopped() {
+		return // Nothing more will be read by the client.
+	}
+	buf, err := c.codec.Marshal(resp)
+	if err != nil {
+		c.log.WithFields(Fields{
 			"id":    c.id,
 			"error": err,
 		}).Warn("Error while marshaling response to client")
 		c.stop("Send error")
+		return
+	}
+	if c.debugging() {
+		c.logMessage("sent", resp, len(buf))
+	}
+	c.write(buf)
+}
+
+// kickFromReader has handleClient kick the client, from readFromClient, which must then stop reading.
+// handleClient owns the client's output, so the kick is handed to it along with the messages read,
+// and goes out after the responses to them, through the same buffer.
+func (c *client) kickFromReader(kick kickMessage) {
+	c.recv <- kick
+	<-c.readNext
+}
+
+// write buffers raw bytes to be written to the client.
+// If the buffer fills, it is written out immediately.
+func (c *client) write(buf []byte) {
+	if c.isStopped() {
+		return
+	}
+	if _, err := c.out.Write(buf); err != nil {
+		c.handleWriteError(err)
+	}
+}
+
+// hasOutput reports whether there is output waiting to be flushed.
+func (c *client) hasOutput() bool {
+	return c.out.Buffered() > 0 || c.compressor != nil && c.compressor.hasOutput()
+}
+
+// flush writes all buffered output to the client.
+// Output buffered before the client was stopped is still written, so errors reach the client before it is disconnected.
+func (c *client) flush() {
+	if err := c.out.Flush(); err != nil {
+		c.handleWriteError(err)
+		return
+	}
+	if c.compressor != nil {
+		// Everything compressed so far needs to be flushed too, or the client can't decompress it yet.
+		out := deadlineWriter{conn: c.conn, timeout: c.writeTimeout, count: c.countSent}
+		if _, err := c.compressor.write(out, nil, true); err != nil {
+			c.handleWriteError(err)
+		}
+	}
+}
+
+// handleWriteError stops a client whose connection could not be written to.
+// A write that times out or fails means the peer has stopped acknowledging data,
+// which is distinguished from the client leaving on its own in the disconnect reason.
+func (c *client) handleWriteError(err error) {
+	if terr, ok := err.(net.Error); ok && terr.Timeout() {
+		c.drop("Connection lost: write timed out")
+		return
 	}
+	c.drop("Connection lost: " + err.Error())
 }
 
 func (c *client) sendError(reason string) {
@@ -227,42 +590,71 @@ func (c *client) sendInternalError() {
 	c.sendError("internal error")
 }
 
-func unmarshalClientMessage(id uint64, dec *json.Decoder) (Message, error) {
-	// The raw JSON needs to be stored, because it will be unmarshalled twice,
-	// first to a GenericClientMessage to get its type, then to the more specific Message type.
-	// All returned messages will implement clientMessage, except for those of type message.ChannelMessage.
-	var raw json.RawMessage
-	if err := dec.Decode(&raw); err != nil {
-		return nil, err
+// deadlineWriter sets a write deadline on a connection before every write, if timeout is not 0.
+// The number of bytes written is passed to count.
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+	count   func(n int)
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	if w.timeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
 	}
+	n, err := w.conn.Write(p)
+	w.count(n)
+	return n, err
+}
 
+// unmarshalClientMessage unmarshals a message read from a client.
+// If it can't be unmarshaled, a malformedMessageError is returned.
+// Channel messages over limits aren't unmarshaled any further than their type;
+// handleClientChannelMessage rejects them.
+func unmarshalClientMessage(id uint64, codec Codec, raw []byte, types map[string]messageType, limits MessageLimits) (Message, error) {
+	// The raw message is unmarshalled twice,
+	// first to a GenericClientMessage to get its type, then to the more specific Message type.
+	// All returned messages will implement clientMessage, except for those of type message.ChannelMessage.
 	var genericMSG GenericClientMessage
-	if err := json.Unmarshal(raw, &genericMSG); err != nil {
-		return nil, err
+	if err := codec.Unmarshal(raw, &genericMSG); err != nil {
+		return nil, malformedMessageError{err}
 	}
 
 	// If genericMSG.Type corresponds to a known clientMessage,
 	// msgFunc will return a new empty message of that type into which the JSON will be unmarshalled.
-	msgFunc := clientMessages[genericMSG.Type]
+	msgFunc := types[genericMSG.Type].factory
 	var msg Message
 	var err error
 	if msgFunc == nil {
 		// There is no clientMessage with the specified type.
 		// Because the NVDA Remote protocol allows arbitrary messages to be sent on channels,
-		// the JSON needs to be marshalled into a map.
-		m := make(map[string]interface{})
-		err = json.Unmarshal(raw, &m)
-		msg = &channelMessage{
-			origin: id,
-			msg:    m,
+		// the message needs to be unmarshalled into a map.
+		channelMSG := &channelMessage{
+			origin:   id,
+			size:     len(raw),
+			received: time.Now(),
+		}
+		msg = channelMSG
+		if _, ok := codec.(jsonCodec); ok {
+			channelMSG.overLimit = limits.checkJSON(raw)
+		}
+		if channelMSG.overLimit == nil {
+			m := make(map[string]interface{})
+			err = codec.Unmarshal(raw, &m)
+			if err == nil {
+				channelMSG.overLimit = limits.check(m)
+			}
+			if channelMSG.overLimit == nil {
+				channelMSG.msg = m
+			}
 		}
 	} else {
 		msg = msgFunc()
-		err = json.Unmarshal(raw, &msg)
+		err = codec.Unmarshal(raw, msg)
 	}
 
 	if err != nil {
-		return nil, err
+		return nil, malformedMessageError{err}
 	}
 
 	return msg, nil
@@ -0,0 +1,173 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxClientDebugDuration limits how long clients can be debug logged for with one command,
+// so that a forgotten debug session doesn't keep logging indefinitely.
+const maxClientDebugDuration = 24 * time.Hour
+
+// ClientDebugArgs holds the arguments to the debug_client admin command.
+// Either ID or Addr must be given: the ID of a connected client,
+// or an IP address or network, in CIDR notation, whose clients are debugged,
+// including those that connect from it while it is being debugged.
+type ClientDebugArgs struct {
+	ID   *uint64 `json:"id,omitempty"`
+	Addr string  `json:"addr,omitempty"`
+	// Duration is how long to log the clients for, such as "10m".
+	// A duration of 0 stops debug logging.
+	Duration string `json:"duration"`
+}
+
+// ClientDebugResult is the result of the debug_client admin command.
+type ClientDebugResult struct {
+	// Clients lists the IDs of the connected clients that debug logging was started or stopped for.
+	Clients []uint64 `json:"clients"`
+	// Until is when debug logging will stop, or the zero time if it was stopped.
+	Until time.Time `json:"until"`
+}
+
+// debugNetwork is an address whose clients are debug logged until a time.
+type debugNetwork struct {
+	network *net.IPNet
+	until   time.Time
+}
+
+// adminDebugClient logs the metadata of every message a client sends and is sent (their types, sizes and timings)
+// for a limited time, whatever the server's log level. Message contents are never logged.
+func adminDebugClient(srv *Server, args json.RawMessage) (interface{}, error) {
+	var debugArgs ClientDebugArgs
+	if err := decodeAdminArgs(args, &debugArgs); err != nil {
+		return nil, err
+	}
+	if (debugArgs.ID == nil) == (debugArgs.Addr == "") {
+		return nil, errors.New("either a client ID or an address must be given")
+	}
+	var network *net.IPNet
+	if debugArgs.Addr != "" {
+		var err error
+		if network, err = parseBanAddr(debugArgs.Addr); err != nil {
+			return nil, err
+		}
+	}
+	duration, err := time.ParseDuration(debugArgs.Duration)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid duration")
+	}
+	if duration < 0 || duration > maxClientDebugDuration {
+		return nil, errors.Errorf("duration must be between 0 and %s", maxClientDebugDuration)
+	}
+
+	result := ClientDebugResult{Clients: []uint64{}}
+	var until int64
+	if duration > 0 {
+		result.Until = time.Now().Add(duration).Round(0) // Strip the monotonic clock reading, which is noise in logs
+		until = result.Until.UnixNano()
+	}
+	reg := &srv.registry
+	reg.lock.Lock()
+	// Forget addresses whose debugging has expired, so the map doesn't grow indefinitely.
+	for addr, debug := range reg.debugNetworks {
+		if time.Now().After(debug.until) {
+			delete(reg.debugNetworks, addr)
+		}
+	}
+	if network != nil {
+		if duration == 0 {
+			delete(reg.debugNetworks, network.String())
+		} else {
+			reg.debugNetworks[network.String()] = debugNetwork{network: network, until: result.Until}
+		}
+	}
+	for id, c := range reg.connected {
+		if c.admin.Load() || debugArgs.ID != nil && id != *debugArgs.ID {
+			continue
+		}
+		if network != nil {
+			if ip := addrIP(c.addr); ip == nil || !network.Contains(ip) {
+				continue
+			}
+		}
+		c.debugUntil.Store(until)
+		result.Clients = append(result.Clients, id)
+		if duration == 0 {
+			c.log.WithField("id", id).Info("Client debug logging stopped")
+		} else {
+			c.log.WithFields(Fields{
+				"id":    id,
+				"until": result.Until,
+			}).Info("Client debug logging started")
+		}
+	}
+	reg.lock.Unlock()
+	sort.Slice(result.Clients, func(i, j int) bool { return result.Clients[i] < result.Clients[j] })
+
+	if debugArgs.ID != nil && len(result.Clients) == 0 {
+		return nil, errors.Errorf("no client with ID %d is connected", *debugArgs.ID)
+	}
+	if network != nil {
+		if duration == 0 {
+			srv.Log.WithField("addr", network.String()).Info("Client debug logging stopped for address")
+		} else {
+			srv.Log.WithFields(Fields{
+				"addr":  network.String(),
+				"until": result.Until,
+			}).Info("Client debug logging started for address")
+		}
+	}
+	return result, nil
+}
+
+// debugUntilFor gets the time until which a client connecting from addr should be debug logged,
+// in nanoseconds since the Unix epoch, or 0 if it shouldn't be.
+func (reg *registry) debugUntilFor(addr net.Addr) int64 {
+	ip := addrIP(addr)
+	if ip == nil {
+		return 0
+	}
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	var until time.Time
+	for _, debug := range reg.debugNetworks {
+		if debug.network.Contains(ip) && debug.until.After(until) {
+			until = debug.until
+		}
+	}
+	if until.IsZero() {
+		return 0
+	}
+	return until.UnixNano()
+}
+
+// debugging reports whether the client's messages should be logged in detail.
+func (c *client) debugging() bool {
+	return c.debugUntil.Load() > time.Now().UnixNano()
+}
+
+// logMessage logs the metadata of a message the client sent or was sent, without its contents.
+// direction is "received" or "sent".
+func (c *client) logMessage(direction string, msg Message, size int) {
+	fields := Fields{
+		"id":           c.id,
+		"message_name": msg.Name(),
+		"size":         size,
+	}
+	switch msg := msg.(type) {
+	case *channelMessage:
+		fields["message_type"], _ = msg.msg["type"].(string)
+	case ClientResponse:
+		// Channel messages are relayed to the client as responses.
+		fields["message_type"], _ = msg["type"].(string)
+	}
+	c.log.WithFields(fields).Info("Client debug: message " + direction)
+}
@@ -0,0 +1,58 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	mathrand "math/rand/v2"
+)
+
+// maxRandomID bounds random client IDs, which stay below 2^53 so they survive being parsed as JSON numbers.
+const maxRandomID = 1 << 53
+
+// WithRandomIDs gives clients random IDs, rather than numbering them in the order they connect,
+// so that IDs don't give away how many clients have connected, or when, and can't be guessed.
+// IDs are checked against those in use on this server; in a cluster, they are all but certainly unique across its nodes.
+// Sequential IDs are the default, for clients and tools that expect them.
+func WithRandomIDs(randomIDs bool) Option {
+	return func(srv *Server) error {
+		srv.RandomIDs = randomIDs
+		return nil
+	}
+}
+
+// newClientID gets the ID of a client that is connecting.
+// It must be called with reg.lock held. A random ID is reserved until the client is recorded as connected by recordConnect,
+// or releaseConnection is called.
+func (reg *registry) newClientID() uint64 {
+	if !reg.randomIDs {
+		return reg.nextID.Add(1) - 1
+	}
+	for {
+		id := randomID()
+		if _, ok := reg.connected[id]; ok {
+			continue
+		}
+		if _, ok := reg.clients[id]; ok {
+			continue
+		}
+		if _, ok := reg.reservedIDs[id]; ok {
+			continue
+		}
+		reg.reservedIDs[id] = struct{}{}
+		return id
+	}
+}
+
+// randomID gets a random ID below maxRandomID.
+func randomID() uint64 {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		// The system's random source is broken; IDs are still unique, if easier to predict.
+		return mathrand.Uint64N(maxRandomID)
+	}
+	return binary.BigEndian.Uint64(buf[:]) % maxRandomID
+}
@@ -4,10 +4,17 @@
 
 package server
 
-import "time"
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
 
-var clientMessages map[string]func() Message
-var clientMessageHandlers map[string]clientMessageHandlerFunc
 var clientEventHandlers map[string]clientEventHandlerFunc
 
 type clientMessageHandlerFunc func(*client, Message)
@@ -78,6 +85,9 @@ type ClientChannelJoinedResponse struct {
 	Clients []ClientMemberResponse `json:"clients"`
 	Channel string                 `json:"channel"`
 	Origin  uint64                 `json:"origin"`
+	// Session is the token used to resume the client's place in the channel if its connection is lost.
+	// It is only sent if the server allows sessions to be resumed.
+	Session string `json:"session,omitempty"`
 }
 
 // Name gets this ClientChannelJoinedResponse's name.
@@ -130,52 +140,33 @@ func (ClientMOTDResponse) Name() string {
 	return "motd"
 }
 
-func init() {
-	clientMessages = make(map[string]func() Message)
-	clientMessageHandlers = make(map[string]clientMessageHandlerFunc)
-	clientEventHandlers = make(map[string]clientEventHandlerFunc)
-
-	clientMessages["join"] = func() Message {
-		return &ClientJoinMessage{}
-	}
-	clientMessageHandlers["join"] = handleClientJoin
-
-	clientMessages["protocol_version"] = func() Message {
-		return &ClientProtocolVersionMessage{}
-	}
-	clientMessageHandlers["protocol_version"] = handleClientProtocolVersion
-
-	clientMessageHandlers["channel_message"] = handleClientChannelMessage
-
-	clientMessages["stat"] = func() Message {
-		return &ClientStatMessage{}
+// builtinMessageTypes gets the types of message every server handles.
+func builtinMessageTypes() map[string]messageType {
+	return map[string]messageType{
+		"join":             {func() Message { return &ClientJoinMessage{} }, handleClientJoin},
+		"protocol_version": {func() Message { return &ClientProtocolVersionMessage{} }, handleClientProtocolVersion},
+		"channel_message":  {nil, handleClientChannelMessage},
+		"resume":           {func() Message { return &ClientResumeMessage{} }, handleClientResume},
+		"stat":             {func() Message { return &ClientStatMessage{} }, handleClientStatMessage},
+		"server_ping":      {func() Message { return &ClientServerPingMessage{} }, handleClientServerPingMessage},
+		"admin":            {func() Message { return &ClientAdminMessage{} }, handleClientAdminMessage},
+		"codec":            {func() Message { return &ClientCodecMessage{} }, handleClientCodec},
+		"compression":      {func() Message { return &ClientCompressionMessage{} }, handleClientCompression},
+		"capabilities":     {func() Message { return &ClientCapabilitiesMessage{} }, handleClientCapabilities},
+		"whoami":           {func() Message { return &ClientWhoamiMessage{} }, handleClientWhoami},
+		"pong":             {func() Message { return &ClientPongMessage{} }, handleClientPong},
 	}
-	clientMessageHandlers["stat"] = handleClientStatMessage
+}
 
+func init() {
+	clientEventHandlers = make(map[string]clientEventHandlerFunc)
 	clientEventHandlers["channel_message"] = handleClientChannelEvent
 	clientEventHandlers["joined_channel"] = handleClientJoinEvent
 	clientEventHandlers["left_channel"] = handleClientLeaveEvent
-}
-
-// ClientProtocolVersionMessage contains the protocol version sent by a client.
-type ClientProtocolVersionMessage struct {
-	GenericClientMessage
-	Version int `json:"version"`
-}
-
-// Name gets this ClientProtocolVersionMessage's name.
-func (ClientProtocolVersionMessage) Name() string {
-	return "protocol_version"
-}
-
-func handleClientProtocolVersion(c *client, msg Message) {
-	protvMSG := msg.(*ClientProtocolVersionMessage)
-	// Only version 2 is supported for now;
-	// allow clients to continue without providing a version, but kick those who provide a version that isn't 2.
-	if protvMSG.Version != 2 {
-		c.sendError("version unsupported")
-		c.stop("protocol version unsupported")
-	}
+	clientEventHandlers["ping"] = handleClientPingEvent
+	clientEventHandlers["channel_error"] = handleClientChannelErrorEvent
+	clientEventHandlers["kick"] = handleClientKickEvent
+	clientEventHandlers["motd"] = handleClientMOTDEvent
 }
 
 // ClientJoinMessage is received when a client wishes to join a channel.
@@ -183,6 +174,10 @@ type ClientJoinMessage struct {
 	GenericClientMessage
 	Channel        string `json:"channel"`
 	ConnectionType string `json:"connection_type"`
+	// KeyPassword is required to join channels protected by the server's ChannelPasswords.
+	KeyPassword string `json:"key_password,omitempty"`
+	// AuthToken is given to the server's Authenticator, such as a StaticTokenAuthenticator.
+	AuthToken string `json:"auth_token,omitempty"`
 }
 
 // Name gets this ClientJoinMessage's name.
@@ -193,43 +188,172 @@ func (ClientJoinMessage) Name() string {
 func handleClientJoin(c *client, msg Message) {
 	joinMSG := msg.(*ClientJoinMessage)
 	if joinMSG.Channel == "" {
-		c.sendError("no channel specified")
+		c.sendKick(KickProtocolError, "no channel specified")
 		c.stop("protocol error")
 		return
 	}
 	if joinMSG.ConnectionType == "" {
-		c.sendError("no connection_type specified")
+		c.sendKick(KickProtocolError, "no connection_type specified")
 		c.stop("protocol error")
 		return
 	}
 	if c.channel != nil {
-		c.sendError("already in a channel")
+		c.sendKick(KickProtocolError, ErrAlreadyInChannel.Error())
 		c.stop("protocol error")
 		return
 	}
+	if c.srv.shutdown.draining.Load() {
+		c.sendKick(KickShutdown, ErrShuttingDown.Error())
+		c.stop("server shutting down")
+		return
+	}
+	if c.srv.drain.active.Load() {
+		if _, ok := c.registry.dispatcher.channel(joinMSG.Channel); !ok {
+			c.sendKick(KickDraining, "server draining: channels can't be created here; reconnect to another server")
+			c.stop("server draining")
+			return
+		}
+	}
+	if c.srv.E2eOnly && !isE2eChannel(joinMSG.Channel) {
+		c.registry.nonE2eJoins.Add(1)
+		c.sendKick(KickRefused, "end-to-end encryption required: this server only allows end-to-end encrypted channels; please upgrade NVDA Remote")
+		c.stop("channel not end-to-end encrypted")
+		return
+	}
+	if allowed := c.srv.AllowedChannels; len(allowed) > 0 && !matchAnyPattern(allowed, joinMSG.Channel) {
+		c.sendKick(KickRefused, "channel not allowed: this server only allows channels matching its configured patterns")
+		c.stop("channel not allowed")
+		return
+	}
+	if c.registry.blocklist.blocks(joinMSG.Channel) {
+		c.sendKick(KickRefused, "channel blocked: this channel has been blocked by the server's operator")
+		c.stop("channel blocked")
+		return
+	}
+	if reason, exceeded := c.registry.quotas.exceeded(joinMSG.Channel, time.Now()); exceeded {
+		c.sendKick(KickQuota, reason)
+		c.stop("channel quota exceeded")
+		return
+	}
+	if !c.checkChannelPassword(joinMSG.Channel, joinMSG.KeyPassword) {
+		return
+	}
+	if !c.checkAuth(AuthJoin, joinMSG) {
+		return
+	}
+	if err := c.srv.Hooks.join(c, joinMSG.Channel, joinMSG.ConnectionType); err != nil {
+		c.sendKick(KickRefused, err.Error())
+		c.stop("join refused")
+		return
+	}
 
 	member := channelMember{
 		id:             c.id,
 		connectionType: joinMSG.ConnectionType,
 		events:         c.events,
+		client:         c,
 	}
 
-	if ch, members, err := joinChannel(joinMSG.Channel, member, c.registry); err != nil {
-		c.sendError(err.Error())
-		c.stop("protocol error")
+	ctx, span := c.registry.tracer.Start(c.ctx, spanJoin, trace.WithAttributes(
+		attribute.String("nvremoted.connection_type", joinMSG.ConnectionType),
+		attribute.Bool("nvremoted.channel.e2e", isE2eChannel(joinMSG.Channel)),
+	))
+	defer span.End()
+	if ch, members, err := joinChannel(ctx, joinMSG.Channel, member, c.registry); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		if errors.Is(err, ErrChannelHasMaster) {
+			c.sendKick(KickRefused, err.Error())
+			c.stop("channel already has a master")
+		} else if errors.Is(err, ErrServerFull) {
+			c.sendKick(KickServerFull, err.Error())
+			c.stop("server full")
+		} else if errors.Is(err, ErrCreationLimit) {
+			c.sendKick(KickRateLimit, err.Error())
+			c.stop("channel creation limit")
+		} else if errors.Is(err, ErrShuttingDown) {
+			c.sendKick(KickShutdown, err.Error())
+			c.stop("server shutting down")
+		} else {
+			c.sendKick(KickProtocolError, err.Error())
+			c.stop("protocol error")
+		}
 	} else {
-		memberResponses := []ClientMemberResponse{}
-		for _, member := range members {
-			memberResponses = append(memberResponses, clientMemberResponseFromChannelMember(member))
+		span.SetAttributes(attribute.Int("nvremoted.channel.members", len(members)))
+		c.joined(ch, members)
+	}
+}
+
+// joined tells the client it is in a channel with members, and starts its session if sessions can be resumed.
+func (c *client) joined(ch *channel, members []channelMember) {
+	c.channel = ch
+	resp := ClientChannelJoinedResponse{
+		Type:    "channel_joined",
+		Clients: []ClientMemberResponse{},
+		Channel: ch.name,
+		Origin:  c.id,
+	}
+	for _, member := range members {
+		resp.Clients = append(resp.Clients, clientMemberResponseFromChannelMember(member))
+	}
+	if c.srv.SessionGrace > 0 {
+		sess, err := c.registry.sessions.open(c)
+		if err != nil {
+			c.log.WithFields(Fields{
+				"id":    c.id,
+				"error": err,
+			}).Warn("Error starting session")
+		} else {
+			c.session = sess
+			resp.Session = sess.token
 		}
-		c.send(ClientChannelJoinedResponse{
-			Type:    "channel_joined",
-			Clients: memberResponses,
-			Channel: joinMSG.Channel,
-			Origin:  c.id,
-		})
-		c.channel = ch
 	}
+	c.send(resp)
+}
+
+// ClientResumeMessage is sent by a client that lost its connection, to take its place in its channel back.
+type ClientResumeMessage struct {
+	GenericClientMessage
+	Session string `json:"session"`
+}
+
+// Name gets this ClientResumeMessage's name.
+func (ClientResumeMessage) Name() string {
+	return "resume"
+}
+
+// handleClientResume resumes a session, answering with channel_joined as if the client had joined its channel,
+// but with the ID it had before and a new session token.
+// If the session can't be resumed, the client stays connected, so it can join its channel again.
+func handleClientResume(c *client, msg Message) {
+	resumeMSG := msg.(*ClientResumeMessage)
+	if resumeMSG.Session == "" {
+		c.sendKick(KickProtocolError, "no session specified")
+		c.stop("protocol error")
+		return
+	}
+	if c.channel != nil {
+		c.sendKick(KickProtocolError, ErrAlreadyInChannel.Error())
+		c.stop("protocol error")
+		return
+	}
+	if c.srv.shutdown.draining.Load() {
+		c.sendKick(KickShutdown, ErrShuttingDown.Error())
+		c.stop("server shutting down")
+		return
+	}
+
+	sess := c.registry.sessions.claim(resumeMSG.Session)
+	if sess == nil {
+		c.sendError("session expired: join the channel again")
+		return
+	}
+	sess.resume <- c
+	members := <-sess.done
+	if members == nil {
+		c.sendError("session expired: join the channel again")
+		return
+	}
+	c.joined(sess.client.channel, members)
 }
 
 // ClientStatMessage is sent by clients requesting server stats.
@@ -247,38 +371,190 @@ func handleClientStatMessage(c *client, msg Message) {
 	statReq := msg.(*ClientStatMessage)
 
 	if c.channel != nil {
-		c.sendError("no stats while in channel")
+		c.sendKick(KickProtocolError, "no stats while in channel")
 		c.stop("protocol error")
 		return
 	}
-	if statReq.Password == "" {
-		c.sendError("no password")
-		c.stop("no stats password provided")
-		return
-	}
-	if c.registry.statsPassword != statReq.Password {
-		time.Sleep(5 * time.Second) // Prevent broot forcing
-		c.sendError("wrong password")
-		c.stop("wrong stats password")
+	if token := c.authenticate(statReq.Password); token == nil || !c.authorize(token, token.allows(ScopeStats)) {
 		return
 	}
 
 	c.send(ClientStatsResponse{
 		Type:  "stats",
-		Stats: c.registry.Stats(),
+		Stats: c.srv.Stats(),
 	})
 	c.stop("stats request completed")
 }
 
+// ClientServerPingMessage is sent by clients measuring their round trip time to the server.
+// Unlike other messages without a known type, it isn't relayed to the client's channel.
+type ClientServerPingMessage struct {
+	GenericClientMessage
+	Seq int64 `json:"seq"`
+}
+
+// Name gets this ClientServerPingMessage's name.
+func (ClientServerPingMessage) Name() string {
+	return "server_ping"
+}
+
+// ClientServerPongResponse answers a ClientServerPingMessage with the same sequence number.
+type ClientServerPongResponse struct {
+	Type string `json:"type"`
+	Seq  int64  `json:"seq"`
+}
+
+// Name gets this ClientServerPongResponse's name.
+func (ClientServerPongResponse) Name() string {
+	return "server_pong"
+}
+
+// handleClientServerPingMessage answers a ping right away, rather than waiting for the flush delay,
+// so that the round trip time measured doesn't include it.
+func handleClientServerPingMessage(c *client, msg Message) {
+	pingReq := msg.(*ClientServerPingMessage)
+	c.send(ClientServerPongResponse{
+		Type: "server_pong",
+		Seq:  pingReq.Seq,
+	})
+	c.flush()
+}
+
+// authenticate gets the token for a password, which may be the server's stats password.
+// If it doesn't match any, or the client's address is locked out for guessing, the client is sent an error and stopped.
+func (c *client) authenticate(password string) *Token {
+	if password == "" {
+		c.sendKick(KickUnauthorized, "no password")
+		c.stop("no stats password provided")
+		return nil
+	}
+	token, err := c.srv.authenticate(addrHost(c.addr), password)
+	if err != nil {
+		c.sendKick(KickUnauthorized, err.Error())
+		c.stop("wrong stats password")
+		return nil
+	}
+	return token
+}
+
+// authorize stops the client with an error, unless allowed, which is whether its token allows the request.
+func (c *client) authorize(token *Token, allowed bool) bool {
+	if !allowed {
+		c.log.WithFields(Fields{
+			"id":    c.id,
+			"token": token.Name,
+		}).Warn("Token not allowed to make request")
+		c.sendKick(KickUnauthorized, "not allowed: this token's scopes don't allow that request")
+		c.stop("token not allowed")
+		return false
+	}
+	return true
+}
+
+// ClientAdminMessage is sent by clients requesting an administrative command be run.
+// Admin messages are authenticated with the stats password, or a token whose scopes allow the command.
+type ClientAdminMessage struct {
+	GenericClientMessage
+	Password string          `json:"password"`
+	Command  string          `json:"command"`
+	Args     json.RawMessage `json:"args,omitempty"`
+}
+
+// Name gets this ClientAdminMessage's name.
+func (ClientAdminMessage) Name() string {
+	return "admin"
+}
+
+// ClientAdminResponse contains the result of an administrative command.
+type ClientAdminResponse struct {
+	Type    string      `json:"type"`
+	Command string      `json:"command"`
+	Result  interface{} `json:"result"`
+}
+
+// Name gets this ClientAdminResponse's name.
+func (ClientAdminResponse) Name() string {
+	return "admin_result"
+}
+
+func handleClientAdminMessage(c *client, msg Message) {
+	adminReq := msg.(*ClientAdminMessage)
+
+	if c.channel != nil {
+		c.sendKick(KickProtocolError, "no admin commands while in channel")
+		c.stop("protocol error")
+		return
+	}
+	token := c.authenticate(adminReq.Password)
+	if token == nil || !c.authorize(token, token.allowsCommand(adminReq.Command)) {
+		return
+	}
+
+	c.log.WithFields(Fields{
+		"id":      c.id,
+		"command": adminReq.Command,
+		"token":   token.Name,
+	}).Info("Running admin command")
+	c.admin.Store(true)
+	result, err := c.srv.Admin(adminReq.Command, adminReq.Args)
+	if err != nil {
+		c.sendKick(KickRequestFailed, err.Error())
+		c.stop("admin command failed")
+		return
+	}
+	c.send(ClientAdminResponse{
+		Type:    "admin_result",
+		Command: adminReq.Command,
+		Result:  result,
+	})
+	c.stop("admin request completed")
+}
+
 func handleClientChannelMessage(c *client, msg Message) {
 	channelMSG := msg.(*channelMessage)
+	if channelMSG.overLimit != nil {
+		channelMSG.span.SetStatus(codes.Error, channelMSG.overLimit.Error())
+		channelMSG.span.End()
+		c.limitViolations.Add(1)
+		c.registry.messageLimitViolations.Add(1)
+		c.log.WithFields(Fields{
+			"id":    c.id,
+			"error": channelMSG.overLimit,
+		}).Info("Client sent a message over the message limits")
+		c.sendError(channelMSG.overLimit.Error())
+		return
+	}
 	if c.channel == nil {
-		c.sendError("not in a channel")
+		channelMSG.span.SetStatus(codes.Error, ErrNotInChannel.Error())
+		channelMSG.span.End()
+		c.sendKick(KickProtocolError, ErrNotInChannel.Error())
 		c.stop("protocol error")
 		return
 	}
 
-	c.channel.messages <- *channelMSG
+	if to, ok := channelMSG.msg["to"]; ok {
+		id, ok := parseMemberID(to)
+		if !ok {
+			channelMSG.span.SetStatus(codes.Error, "invalid to")
+			channelMSG.span.End()
+			c.sendKick(KickProtocolError, "invalid to: must be the ID of a member of the channel")
+			c.stop("protocol error")
+			return
+		}
+		channelMSG.to = &id
+	}
+
+	channelMSG.span.AddEvent("handled")
+	c.channel.relay(c, *channelMSG)
+}
+
+// parseMemberID parses a member ID from a JSON number.
+func parseMemberID(v interface{}) (uint64, bool) {
+	f, ok := v.(float64)
+	if !ok || f < 0 || f != math.Trunc(f) || f > 1<<53 {
+		return 0, false
+	}
+	return uint64(f), true
 }
 
 func handleClientChannelEvent(c *client, msg Message) {
@@ -307,3 +583,42 @@ func handleClientLeaveEvent(c *client, msg Message) {
 		Client: clientMemberResponseFromChannelMember(member),
 	})
 }
+
+// handleClientKickEvent tells the client why it is being disconnected, and disconnects it.
+func handleClientKickEvent(c *client, msg Message) {
+	kick := msg.(kickMessage)
+	c.sendKick(kick.code, kick.reason)
+	stopReason := kick.reason
+	if kick.stopReason != "" {
+		stopReason = kick.stopReason
+	}
+	if kick.drop {
+		c.drop(stopReason)
+	} else {
+		c.stop(stopReason)
+	}
+}
+
+// handleClientChannelErrorEvent tells the client that a message it sent couldn't be relayed.
+// Unlike other errors, the client stays connected.
+func handleClientChannelErrorEvent(c *client, msg Message) {
+	c.sendError(string(msg.(channelErrorMSG)))
+}
+
+// handleClientPingEvent pings the client with a newline, or a ping message if its version of the protocol answers them.
+// Besides keeping the connection active, this forces a write to idle clients,
+// so that peers who have gone away without closing the connection are noticed.
+func handleClientPingEvent(c *client, msg Message) {
+	if !c.protocol.timedPings {
+		c.write([]byte("\n"))
+		return
+	}
+	// A ping still unanswered is forgotten, so its pong won't be counted.
+	c.pingSent = time.Now()
+	c.send(ClientPingResponse{
+		Type:      "ping",
+		Timestamp: c.pingSent.UnixNano(),
+	})
+	// Like a server_pong, the ping isn't held back by the flush delay, which would be counted in the round trip time.
+	c.flush()
+}
@@ -0,0 +1,1171 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// defaultClusterHeartbeat is how often nodes tell each other they are still there, if the server's Cluster doesn't say.
+	defaultClusterHeartbeat = 5 * time.Second
+
+	// clusterMissedHeartbeats is how many heartbeats a node may miss before the others take it to be gone.
+	clusterMissedHeartbeats = 3
+
+	// clusterQueueSize is the number of messages that can wait to be published to the backplane,
+	// or for a shard to relay them from the backplane, before more are dropped.
+	// Membership changes are never dropped.
+	clusterQueueSize = 1024
+
+	// clusterTimeout is how long publishing a message, or subscribing to a topic, may take.
+	clusterTimeout = 5 * time.Second
+
+	// memberSyncTimeout is how long a join creating a channel waits for the other nodes to say who is in it.
+	memberSyncTimeout = 500 * time.Millisecond
+)
+
+// Backplane carries messages between the nodes of a cluster, such as Redis pub/sub or NATS.
+// Its methods must be safe to use concurrently.
+type Backplane interface {
+	// Publish sends payload to every node subscribed to topic, including this one.
+	Publish(ctx context.Context, topic string, payload []byte) error
+
+	// Subscribe calls handler with each message published to topic, until unsubscribe is called.
+	// Handlers must be called one at a time, with the messages of each publisher in the order they were published.
+	Subscribe(ctx context.Context, topic string, handler BackplaneHandler) (unsubscribe func(ctx context.Context) error, err error)
+
+	// MemberSync sends request to every node subscribed to topic, and gathers their replies,
+	// until want have come or ctx is done, when it returns those that came.
+	// A node creating a channel uses it to ask the others who is in the channel, before telling the client creating it.
+	MemberSync(ctx context.Context, topic string, request []byte, want int) ([][]byte, error)
+
+	// Close disconnects from the backplane.
+	Close() error
+}
+
+// NewBackplane creates a Backplane over Redis or NATS, depending on url's scheme.
+// Redis URLs start with redis:// or rediss://, and NATS URLs with nats:// or tls://.
+// If tlsConfig isn't nil, the backplane is connected to over TLS with it, whatever the scheme, such as one from ClusterTLSConfig.
+func NewBackplane(url string, tlsConfig *tls.Config) (Backplane, error) {
+	switch {
+	case strings.HasPrefix(url, "redis://"), strings.HasPrefix(url, "rediss://"):
+		return NewRedisBackplane(url, tlsConfig)
+	case strings.HasPrefix(url, "nats://"), strings.HasPrefix(url, "tls://"):
+		return NewNATSBackplane(url, tlsConfig), nil
+	default:
+		return nil, errors.New("backplane URL must start with redis://, rediss://, nats://, or tls://")
+	}
+}
+
+// ClusterTLSConfig creates a TLS configuration for connecting to a cluster's backplane with mutual TLS,
+// so that nothing relayed between nodes crosses the network in plaintext.
+// The backplane's certificate must be signed by a certificate authority in caFile,
+// and the node presents the certificate from certs, which the backplane should require to be signed by the cluster's CA too.
+// The node's certificate can be rotated by reloading certs; new connections present the new one.
+func ClusterTLSConfig(caFile string, certs *CertificateReloader) (*tls.Config, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Read cluster CA")
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, errors.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{
+		RootCAs:              roots,
+		GetClientCertificate: certs.GetClientCertificate,
+		MinVersion:           tls.VersionTLS12,
+	}, nil
+}
+
+// A BackplaneHandler handles a message published to a topic the node is subscribed to.
+// If the message is a request sent by MemberSync, reply answers it; otherwise, reply is nil.
+type BackplaneHandler func(payload []byte, reply func(payload []byte) error)
+
+// Cluster configures sharing channels with other servers, called nodes, over a Backplane.
+// Clients on different nodes who join the same channel see each other join and leave, and their messages are relayed between them,
+// so that the service can run on more than one machine, and be restarted one node at a time.
+// Every node should be configured alike, particularly their relay modes and master policies.
+//
+// Each channel is owned by one node, chosen by consistent hashing of its name over the nodes in the cluster.
+// Nodes send joins, leaves and messages to the owner, which keeps the channel's members, and passes them on,
+// in the order it received them, to the nodes with members in the channel.
+// When a node joins or leaves the cluster, only the channels it owned, or takes over, change owner.
+type Cluster struct {
+	// Backplane carries messages between nodes. If nil, the server isn't clustered.
+	Backplane Backplane
+
+	// Node names this server in the cluster's stats. If empty, the host name is used.
+	Node string
+
+	// Prefix is prepended to the backplane's topics, such as "nvremoted.", so that several clusters can share one.
+	Prefix string
+
+	// Heartbeat is how often this node tells the others it is still there, and shares its stats with them.
+	// A node that misses three heartbeats is taken to be gone, along with its clients.
+	// If 0, heartbeats are sent every 5 seconds.
+	Heartbeat time.Duration
+}
+
+// WithCluster makes the server a node of a cluster, sharing its channels with the other nodes.
+func WithCluster(cluster Cluster) Option {
+	return func(srv *Server) error {
+		if err := notNegative("cluster heartbeat", cluster.Heartbeat); err != nil {
+			return err
+		}
+		srv.Cluster = cluster
+		return nil
+	}
+}
+
+// ClusterStats summarizes the nodes of the cluster the server belongs to.
+type ClusterStats struct {
+	// Node is the ID of this node.
+	Node string `json:"node"`
+
+	// Nodes lists every node that has been heard from, including this one.
+	Nodes []ClusterNodeStats `json:"nodes"`
+
+	// Totals across the cluster.
+	// A channel with members on several nodes is only counted once.
+	NumConnections int `json:"num_connections"`
+	NumClients     int `json:"num_clients"`
+	NumChannels    int `json:"num_channels"`
+
+	// Dropped is the number of messages this node couldn't publish or relay, because the backplane or its channels weren't keeping up.
+	Dropped int64 `json:"dropped"`
+}
+
+// ClusterNodeStats summarizes one node of a cluster, as of its last heartbeat.
+type ClusterNodeStats struct {
+	// Node identifies this run of the node, and Name the node.
+	Node string `json:"node"`
+	Name string `json:"name"`
+
+	NumConnections int `json:"num_connections"`
+	NumClients     int `json:"num_clients"`
+	// NumChannels counts the node's channels, except those counted by another node.
+	NumChannels int `json:"num_channels"`
+
+	// Draining is set if the node is draining, so doesn't own channels.
+	Draining bool `json:"draining,omitempty"`
+
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Types of clusterMessage.
+const (
+	clusterJoin      = "join"      // Members joined the channel
+	clusterLeave     = "leave"     // Members left the channel
+	clusterMembers   = "members"   // All of From's members of the channel, or all of its members if From is empty, replacing those known before
+	clusterSync      = "sync"      // Asks the channel's owner who is in it, with MemberSync
+	clusterRelay     = "message"   // A message relayed over the channel
+	clusterHeartbeat = "heartbeat" // The node is still there, with its stats
+	clusterBye       = "bye"       // The node is shutting down, along with its clients
+)
+
+// keptClusterMessages are the types of clusterMessage that are published however many messages are waiting,
+// since nodes that missed them would be wrong about who is in a channel, or which nodes are in the cluster.
+var keptClusterMessages = map[string]bool{
+	clusterJoin:    true,
+	clusterLeave:   true,
+	clusterMembers: true,
+	clusterBye:     true,
+}
+
+// clusterMessage is sent between the nodes of a cluster.
+type clusterMessage struct {
+	Type    string `json:"type"`
+	Node    string `json:"node"`
+	Channel string `json:"channel,omitempty"`
+
+	// Seq is the number of messages the node had sent when it sent this one.
+	// Member lists sent in answer to a sync can arrive after joins and leaves the owner sent later,
+	// so only membership changes newer than the last applied from the owner are applied.
+	Seq uint64 `json:"seq,omitempty"`
+
+	// Owner is set on changes and messages sent to the channel's owner, to be passed on,
+	// and From is the node they came from, which the owner keeps when passing them on.
+	Owner string `json:"owner,omitempty"`
+	From  string `json:"from,omitempty"`
+
+	Members []clusterMember `json:"members,omitempty"`
+
+	// The message relayed, the ID and connection type of the member who sent it,
+	// and the ID of the only member it is for, if it was sent to one.
+	Message    map[string]interface{} `json:"message,omitempty"`
+	Origin     uint64                 `json:"origin,omitempty"`
+	OriginType string                 `json:"origin_type,omitempty"`
+	To         *uint64                `json:"to,omitempty"`
+
+	Stats *ClusterNodeStats `json:"stats,omitempty"`
+}
+
+// clusterMember is a member of a channel, as sent between nodes, with the node its client is connected to.
+type clusterMember struct {
+	ID             uint64 `json:"id"`
+	ConnectionType string `json:"connection_type"`
+	Node           string `json:"node,omitempty"`
+}
+
+// remoteMember is a member of a channel whose client is connected to another node.
+type remoteMember struct {
+	node           string
+	connectionType string
+}
+
+// clusterOutgoing is a message waiting to be published.
+type clusterOutgoing struct {
+	topic   string
+	payload []byte
+	reply   func(payload []byte) error // If set, the message answers a sync, and is sent with it rather than published to topic
+	sent    chan struct{}              // If set, closed once the message has been published, or failed to be
+}
+
+// clusterNode is the server's part in a cluster.
+type clusterNode struct {
+	backplane Backplane
+	id        string // Identifies this run of the server
+	name      string
+	prefix    string
+	heartbeat time.Duration
+	reg       *registry
+	log       Logger
+
+	// out holds messages waiting to be published, in order, and queued is signalled when messages are added.
+	// Messages other than membership changes are dropped while clusterQueueSize are waiting.
+	outLock sync.Mutex
+	out     []clusterOutgoing
+	queued  chan struct{}
+	// wake tells the publisher that the topics wanted have changed.
+	wake chan struct{}
+	// done is closed when the node leaves the cluster, and stopped once the publisher has stopped.
+	done    chan struct{}
+	stopped chan struct{}
+
+	// sharedChannels is the number of this node's channels that are counted by another node instead,
+	// because a node with a lower ID also has members in them.
+	sharedChannels atomic.Int64
+
+	// dropped counts messages that weren't published, or relayed to this node's channels, because too many were waiting.
+	dropped atomic.Int64
+
+	// seq is the number of messages sent by this node.
+	seq atomic.Uint64
+
+	// draining is set while the server is draining, so that the other nodes own its channels.
+	draining atomic.Bool
+
+	// owned holds the members of the channels this node owns, by channel name and member ID.
+	// Changes to them are queued to be published while ownLock is held, so they are published in the order they were made.
+	ownLock sync.Mutex
+	owned   map[string]map[uint64]clusterMember
+
+	lock    sync.Mutex                   // Protects everything below
+	wanted  map[string]int               // Topics to be subscribed to, with the number of channels that want each
+	waiters map[string][]chan struct{}   // Closed once the publisher has subscribed to their topics
+	peers   map[string]*ClusterNodeStats // The other nodes, by ID
+	ring    hashRing                     // This node and its peers, to choose channels' owners
+}
+
+// newClusterNode joins the server's registry to a cluster, and starts publishing and sending heartbeats.
+// Client IDs begin with the node's ID, which is chosen at random for each run, so that they are all but certainly unique across the cluster.
+func newClusterNode(cluster Cluster, reg *registry) *clusterNode {
+	// IDs stay below 2^53, so they survive being parsed as JSON numbers.
+	nodeID := rand.Uint64N(1<<20-1) + 1
+	reg.nextID.Store(nodeID << 32)
+
+	name := cluster.Node
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	heartbeat := cluster.Heartbeat
+	if heartbeat == 0 {
+		heartbeat = defaultClusterHeartbeat
+	}
+	cn := &clusterNode{
+		backplane: cluster.Backplane,
+		id:        fmt.Sprintf("%05x", nodeID),
+		name:      name,
+		prefix:    cluster.Prefix,
+		heartbeat: heartbeat,
+		reg:       reg,
+		log:       reg.log,
+		queued:    make(chan struct{}, 1),
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		wanted:    make(map[string]int),
+		waiters:   make(map[string][]chan struct{}),
+		peers:     make(map[string]*ClusterNodeStats),
+		owned:     make(map[string]map[uint64]clusterMember),
+	}
+	cn.ring = newHashRing([]string{cn.id})
+	cn.wanted[cn.nodesTopic()] = 1
+	cn.wanted[cn.nodeTopic(cn.id)] = 1
+	cn.log.WithFields(Fields{
+		"node":      cn.id,
+		"name":      cn.name,
+		"heartbeat": cn.heartbeat,
+	}).Info("Joining cluster")
+	go cn.run()
+	go cn.beat()
+	return cn
+}
+
+// nodesTopic is the topic nodes send their heartbeats to.
+func (cn *clusterNode) nodesTopic() string {
+	return cn.prefix + "nodes"
+}
+
+// nodeTopic is the topic for changes and messages sent to the node with the given ID, as the owner of their channels.
+func (cn *clusterNode) nodeTopic(node string) string {
+	return cn.prefix + "node." + node
+}
+
+// channelTopic is the topic for the named channel.
+// The name is encoded, since backplanes such as NATS don't allow every character in their topics.
+func (cn *clusterNode) channelTopic(name string) string {
+	return cn.prefix + "channel." + base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+// watch subscribes to the named channel, which was just created.
+// The returned channel is closed once the subscription has been made.
+func (cn *clusterNode) watch(name string) <-chan struct{} {
+	if cn == nil {
+		return nil
+	}
+	topic := cn.channelTopic(name)
+	subscribed := make(chan struct{})
+	cn.lock.Lock()
+	cn.wanted[topic]++
+	cn.waiters[topic] = append(cn.waiters[topic], subscribed)
+	cn.lock.Unlock()
+	select {
+	case cn.wake <- struct{}{}:
+	default:
+	}
+	return subscribed
+}
+
+// syncMembers asks the channel's owner who is in the channel, which this node has just created,
+// so that the client creating it is told about them when it joins.
+// It gives up after memberSyncTimeout, leaving the channel to learn of them as they come and go.
+func (cn *clusterNode) syncMembers(ctx context.Context, c *channel, subscribed <-chan struct{}) {
+	if cn == nil {
+		return
+	}
+	defer func() {
+		c.shard.sendRemote(channelOp{channel: c, synced: true})
+	}()
+	owner := cn.owner(c.name)
+	if owner == cn.id {
+		cn.ownLock.Lock()
+		msg := clusterMessage{Type: clusterMembers, Node: cn.id, Channel: c.name, Seq: cn.seq.Load(), Members: cn.ownedMembers(c.name)}
+		cn.ownLock.Unlock()
+		c.shard.sendRemote(channelOp{channel: c, remote: &msg})
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, memberSyncTimeout)
+	defer cancel()
+	// Until the channel's topic is subscribed to, joins and leaves sent after the owner answers would be missed.
+	select {
+	case <-subscribed:
+	case <-ctx.Done():
+		return
+	}
+
+	request, err := json.Marshal(clusterMessage{Type: clusterSync, Node: cn.id, Channel: c.name})
+	if err != nil {
+		return
+	}
+	replies, err := cn.backplane.MemberSync(ctx, cn.nodeTopic(owner), request, 1)
+	if err != nil {
+		cn.log.WithFields(Fields{
+			"channel": c.name,
+			"error":   err,
+		}).Warn("Error asking a channel's owner who is in it")
+	}
+	for _, payload := range replies {
+		var msg clusterMessage
+		if err := json.Unmarshal(payload, &msg); err != nil || msg.Type != clusterMembers {
+			continue
+		}
+		c.shard.sendRemote(channelOp{channel: c, remote: &msg})
+	}
+}
+
+// unwatch unsubscribes from the named channel, which was destroyed, unless it has been created again since.
+func (cn *clusterNode) unwatch(name string) {
+	if cn == nil {
+		return
+	}
+	topic := cn.channelTopic(name)
+	cn.lock.Lock()
+	if cn.wanted[topic]--; cn.wanted[topic] <= 0 {
+		delete(cn.wanted, topic)
+	}
+	cn.lock.Unlock()
+	select {
+	case cn.wake <- struct{}{}:
+	default:
+	}
+}
+
+// publish queues msg to be published, from this node.
+// Messages to channels go to the channel's topic, and others to the nodes topic.
+// If too many messages are waiting, msg is dropped, unless it changes a channel's members.
+func (cn *clusterNode) publish(msg clusterMessage) {
+	if cn == nil {
+		return
+	}
+	cn.enqueue(msg, clusterOutgoing{})
+}
+
+// answer queues msg to be sent with reply, in answer to a sync.
+func (cn *clusterNode) answer(reply func(payload []byte) error, msg clusterMessage) {
+	cn.enqueue(msg, clusterOutgoing{reply: reply})
+}
+
+// enqueue queues msg to be sent as out says, to the topic publish would use if out doesn't give one,
+// returning the Seq given to it.
+func (cn *clusterNode) enqueue(msg clusterMessage, out clusterOutgoing) uint64 {
+	msg.Node = cn.id
+	msg.Seq = cn.seq.Add(1)
+	if out.topic == "" {
+		out.topic = cn.nodesTopic()
+		if msg.Channel != "" {
+			out.topic = cn.channelTopic(msg.Channel)
+		}
+	}
+	var err error
+	out.payload, err = json.Marshal(msg)
+	if err != nil {
+		cn.log.WithFields(Fields{
+			"type":  msg.Type,
+			"error": err,
+		}).Error("Error encoding cluster message")
+		return msg.Seq
+	}
+	cn.outLock.Lock()
+	if len(cn.out) >= clusterQueueSize && !keptClusterMessages[msg.Type] {
+		cn.outLock.Unlock()
+		cn.dropped.Add(1)
+		if out.sent != nil {
+			close(out.sent)
+		}
+		return msg.Seq
+	}
+	cn.out = append(cn.out, out)
+	cn.outLock.Unlock()
+	select {
+	case cn.queued <- struct{}{}:
+	default:
+	}
+	return msg.Seq
+}
+
+// nextOutgoing takes the first message waiting to be published, if there is one.
+func (cn *clusterNode) nextOutgoing() (clusterOutgoing, bool) {
+	cn.outLock.Lock()
+	defer cn.outLock.Unlock()
+	if len(cn.out) == 0 {
+		return clusterOutgoing{}, false
+	}
+	msg := cn.out[0]
+	cn.out[0] = clusterOutgoing{}
+	cn.out = cn.out[1:]
+	if len(cn.out) == 0 {
+		cn.out = nil
+	}
+	return msg, true
+}
+
+// deliver queues a message from the cluster for this node's channel, without holding up the backplane,
+// counting it as dropped if the channel's shard isn't keeping up.
+func (cn *clusterNode) deliver(c *channel, msg *clusterMessage) {
+	if !c.shard.sendRemote(channelOp{channel: c, remote: msg}) {
+		cn.dropped.Add(1)
+	}
+}
+
+// owner gets the ID of the node that owns the named channel.
+func (cn *clusterNode) owner(name string) string {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	return cn.ring.owner(name)
+}
+
+// forward sends a change or message from this node's members of a channel to the channel's owner, to be passed on.
+func (cn *clusterNode) forward(msg clusterMessage) {
+	if cn == nil {
+		return
+	}
+	msg.From = cn.id
+	owner := cn.owner(msg.Channel)
+	if owner == cn.id {
+		cn.own(msg)
+		return
+	}
+	msg.Owner = owner
+	cn.enqueue(msg, clusterOutgoing{topic: cn.nodeTopic(owner)})
+}
+
+// own applies a change or message from msg.From to a channel this node owns,
+// and passes it on to the nodes with members in the channel.
+func (cn *clusterNode) own(msg clusterMessage) {
+	msg.Owner = ""
+	for i := range msg.Members {
+		msg.Members[i].Node = msg.From
+	}
+	cn.ownLock.Lock()
+	members := cn.owned[msg.Channel]
+	if members == nil {
+		members = make(map[uint64]clusterMember)
+	}
+	switch msg.Type {
+	case clusterJoin:
+		for _, member := range msg.Members {
+			members[member.ID] = member
+		}
+	case clusterLeave:
+		for _, member := range msg.Members {
+			delete(members, member.ID)
+		}
+	case clusterMembers:
+		for id, member := range members {
+			if member.Node == msg.From {
+				delete(members, id)
+			}
+		}
+		for _, member := range msg.Members {
+			members[member.ID] = member
+		}
+	}
+	if len(members) == 0 {
+		delete(cn.owned, msg.Channel)
+	} else {
+		cn.owned[msg.Channel] = members
+	}
+	msg.Seq = cn.enqueue(msg, clusterOutgoing{})
+	cn.ownLock.Unlock()
+
+	// Nodes ignore what they publish themselves, so this node's channel is given what came from the others directly.
+	if msg.From == cn.id {
+		return
+	}
+	msg.Node = cn.id
+	if c, ok := cn.reg.dispatcher.channel(msg.Channel); ok {
+		cn.deliver(c, &msg)
+	}
+}
+
+// ownedMembers lists the members of the named channel, which this node owns. ownLock must be held.
+func (cn *clusterNode) ownedMembers(name string) []clusterMember {
+	members := make([]clusterMember, 0, len(cn.owned[name]))
+	for _, member := range cn.owned[name] {
+		members = append(members, member)
+	}
+	return members
+}
+
+// run publishes queued messages in order, and keeps the node subscribed to the topics it wants, until the node leaves the cluster.
+func (cn *clusterNode) run() {
+	defer close(cn.stopped)
+	subscribed := make(map[string]func(ctx context.Context) error)
+	failing := false // Errors are only logged when publishing starts failing, so a backplane that is down doesn't flood the log.
+	for {
+		msg, ok := cn.nextOutgoing()
+		if !ok {
+			select {
+			case <-cn.queued:
+				continue
+			case <-cn.wake:
+			case <-cn.done:
+				return
+			}
+		}
+		select {
+		case <-cn.done:
+			return // Even if more is waiting, since the node has said goodbye.
+		default:
+		}
+
+		err := cn.subscribe(subscribed)
+		if err == nil && msg.reply != nil {
+			err = msg.reply(msg.payload)
+		} else if err == nil && msg.topic != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), clusterTimeout)
+			err = cn.backplane.Publish(ctx, msg.topic, msg.payload)
+			cancel()
+		}
+		if msg.sent != nil {
+			close(msg.sent)
+		}
+		if err != nil && !failing {
+			cn.log.WithField("error", err).Error("Error using cluster backplane")
+		} else if err == nil && failing {
+			cn.log.Info("Cluster backplane recovered")
+		}
+		failing = err != nil
+	}
+}
+
+// subscribe subscribes to the topics wanted, and unsubscribes from those no longer wanted.
+// subscribed maps the topics already subscribed to their unsubscribe functions.
+func (cn *clusterNode) subscribe(subscribed map[string]func(ctx context.Context) error) error {
+	defer cn.notifyWaiters(subscribed)
+	cn.lock.Lock()
+	var add, remove []string
+	for topic := range cn.wanted {
+		if _, ok := subscribed[topic]; !ok {
+			add = append(add, topic)
+		}
+	}
+	for topic := range subscribed {
+		if _, ok := cn.wanted[topic]; !ok {
+			remove = append(remove, topic)
+		}
+	}
+	cn.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), clusterTimeout)
+	defer cancel()
+	for _, topic := range remove {
+		unsubscribe := subscribed[topic]
+		delete(subscribed, topic)
+		if err := unsubscribe(ctx); err != nil {
+			return err
+		}
+	}
+	for _, topic := range add {
+		unsubscribe, err := cn.backplane.Subscribe(ctx, topic, cn.receive)
+		if err != nil {
+			return err
+		}
+		subscribed[topic] = unsubscribe
+	}
+	return nil
+}
+
+// notifyWaiters closes the waiters for topics that have been subscribed to, or are no longer wanted.
+func (cn *clusterNode) notifyWaiters(subscribed map[string]func(ctx context.Context) error) {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	for topic, waiters := range cn.waiters {
+		_, done := subscribed[topic]
+		if _, ok := cn.wanted[topic]; !ok {
+			done = true
+		}
+		if !done {
+			continue
+		}
+		for _, waiter := range waiters {
+			close(waiter)
+		}
+		delete(cn.waiters, topic)
+	}
+}
+
+// receive handles a message from another node.
+// reply is set if the message is a sync sent with MemberSync.
+func (cn *clusterNode) receive(payload []byte, reply func(payload []byte) error) {
+	var msg clusterMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		cn.log.WithField("error", err).Warn("Received invalid cluster message")
+		return
+	}
+	if msg.Node == cn.id {
+		return
+	}
+	switch msg.Type {
+	case clusterHeartbeat:
+		cn.heard(msg.Node, msg.Stats)
+	case clusterBye:
+		cn.gone(msg.Node)
+	case clusterSync:
+		if reply == nil {
+			return
+		}
+		cn.ownLock.Lock()
+		cn.answer(reply, clusterMessage{Type: clusterMembers, Channel: msg.Channel, Members: cn.ownedMembers(msg.Channel)})
+		cn.ownLock.Unlock()
+	default:
+		if msg.Owner != "" {
+			// Sent to this node's topic, to be passed on as the channel's owner.
+			if msg.Owner == cn.id {
+				cn.own(msg)
+			}
+			return
+		}
+		if c, ok := cn.reg.dispatcher.channel(msg.Channel); ok {
+			cn.deliver(c, &msg)
+		}
+	}
+}
+
+// heard notes a heartbeat from the node with the given ID.
+// If the node is new, or had been taken to be gone, the channels are rebalanced to include it.
+func (cn *clusterNode) heard(node string, stats *ClusterNodeStats) {
+	if stats == nil {
+		stats = &ClusterNodeStats{}
+	}
+	stats.Node = node
+	stats.LastSeen = time.Now()
+	cn.lock.Lock()
+	previous, known := cn.peers[node]
+	cn.peers[node] = stats
+	changed := !known || previous.Draining != stats.Draining
+	if changed {
+		cn.ring = cn.newRingLocked()
+	}
+	cn.lock.Unlock()
+	if !changed {
+		return
+	}
+
+	fields := Fields{
+		"node": node,
+		"name": stats.Name,
+	}
+	switch {
+	case !known:
+		cn.log.WithFields(fields).Info("Node joined the cluster")
+	case stats.Draining:
+		cn.log.WithFields(fields).Info("Node draining")
+	default:
+		cn.log.WithFields(fields).Info("Node stopped draining")
+	}
+	cn.rebalance()
+}
+
+// gone removes the node with the given ID from the cluster, along with its members of every channel,
+// and rebalances the channels it owned.
+func (cn *clusterNode) gone(node string) {
+	cn.lock.Lock()
+	stats, known := cn.peers[node]
+	delete(cn.peers, node)
+	cn.ring = cn.newRingLocked()
+	cn.lock.Unlock()
+	if !known {
+		return
+	}
+
+	cn.log.WithFields(Fields{
+		"node": node,
+		"name": stats.Name,
+	}).Info("Node left the cluster")
+	cn.ownLock.Lock()
+	for name, members := range cn.owned {
+		removed := false
+		for id, member := range members {
+			if member.Node == node {
+				delete(members, id)
+				removed = true
+			}
+		}
+		if !removed {
+			continue
+		}
+		if len(members) == 0 {
+			delete(cn.owned, name)
+		}
+		cn.enqueue(clusterMessage{Type: clusterMembers, Channel: name, From: node}, clusterOutgoing{})
+	}
+	cn.ownLock.Unlock()
+	// The node may have owned the channel, in which case no one else will say its members have gone.
+	cn.forEachChannel(func(c *channel) {
+		c.shard.sendRemote(channelOp{channel: c, remote: &clusterMessage{Type: clusterBye, From: node, Channel: c.name}})
+	})
+	cn.rebalance()
+}
+
+// newRingLocked creates a hashRing over this node and its peers, leaving out those that are draining,
+// unless every node is. cn.lock must be held.
+func (cn *clusterNode) newRingLocked() hashRing {
+	var nodes, draining []string
+	if cn.draining.Load() {
+		draining = append(draining, cn.id)
+	} else {
+		nodes = append(nodes, cn.id)
+	}
+	for node, peer := range cn.peers {
+		if peer.Draining {
+			draining = append(draining, node)
+		} else {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		nodes = draining
+	}
+	return newHashRing(nodes)
+}
+
+// setDraining sets whether this node is draining, handing its channels over to the other nodes if it is,
+// and tells them straight away.
+func (cn *clusterNode) setDraining(draining bool) {
+	if cn == nil {
+		return
+	}
+	cn.draining.Store(draining)
+	cn.lock.Lock()
+	cn.ring = cn.newRingLocked()
+	cn.lock.Unlock()
+	cn.rebalance()
+	stats := cn.reg.clusterNodeStats()
+	cn.publish(clusterMessage{Type: clusterHeartbeat, Stats: &stats})
+}
+
+// numOwned counts the channels this node owns.
+func (cn *clusterNode) numOwned() int {
+	if cn == nil {
+		return 0
+	}
+	cn.ownLock.Lock()
+	defer cn.ownLock.Unlock()
+	return len(cn.owned)
+}
+
+// rebalance hands channels over to their owners, after a node has joined or left the cluster.
+// This node forgets the channels it no longer owns, and tells the other nodes who is in those it still does,
+// in case they had taken it to be gone.
+// Then it tells the owner of each of its channels, which may be new, who is in the channel here.
+func (cn *clusterNode) rebalance() {
+	cn.ownLock.Lock()
+	for name := range cn.owned {
+		if cn.owner(name) != cn.id {
+			delete(cn.owned, name)
+			continue
+		}
+		cn.enqueue(clusterMessage{Type: clusterMembers, Channel: name, Members: cn.ownedMembers(name)}, clusterOutgoing{})
+	}
+	cn.ownLock.Unlock()
+	cn.forEachChannel(func(c *channel) {
+		c.shard.sendRemote(channelOp{channel: c, remote: &clusterMessage{Type: clusterSync, Channel: c.name}})
+	})
+}
+
+// forEachChannel calls f with each of this node's channels.
+// The shards aren't locked while f runs.
+func (cn *clusterNode) forEachChannel(f func(c *channel)) {
+	var channels []*channel
+	for _, shard := range cn.reg.dispatcher.shards {
+		shard.lock.Lock()
+		for _, c := range shard.channels {
+			channels = append(channels, c)
+		}
+		shard.lock.Unlock()
+	}
+	for _, c := range channels {
+		f(c)
+	}
+}
+
+// beat sends a heartbeat every cn.heartbeat, and removes nodes that have missed too many of theirs, until the node leaves the cluster.
+func (cn *clusterNode) beat() {
+	ticker := time.NewTicker(cn.heartbeat)
+	defer ticker.Stop()
+	for {
+		stats := cn.reg.clusterNodeStats()
+		cn.publish(clusterMessage{Type: clusterHeartbeat, Stats: &stats})
+
+		select {
+		case now := <-ticker.C:
+			var expired []string
+			cn.lock.Lock()
+			for node, peer := range cn.peers {
+				if now.Sub(peer.LastSeen) > clusterMissedHeartbeats*cn.heartbeat {
+					expired = append(expired, node)
+				}
+			}
+			cn.lock.Unlock()
+			for _, node := range expired {
+				cn.gone(node)
+			}
+		case <-cn.done:
+			return
+		}
+	}
+}
+
+// leave tells the other nodes this one is shutting down, once everything queued before has been published, and disconnects from the backplane.
+// The server's clients should have disconnected first, so that the other nodes see them leave their channels.
+func (cn *clusterNode) leave() {
+	if cn == nil {
+		return
+	}
+	sent := make(chan struct{})
+	cn.enqueue(clusterMessage{Type: clusterBye}, clusterOutgoing{sent: sent})
+	select {
+	case <-sent:
+	case <-time.After(clusterTimeout):
+	}
+	close(cn.done)
+	<-cn.stopped
+	if err := cn.backplane.Close(); err != nil {
+		cn.log.WithField("error", err).Warn("Error closing cluster backplane")
+	}
+	cn.log.Info("Left cluster")
+}
+
+// stats gets the cluster's stats, given this node's own.
+func (cn *clusterNode) stats(self ClusterNodeStats) *ClusterStats {
+	stats := &ClusterStats{
+		Node:    cn.id,
+		Nodes:   []ClusterNodeStats{self},
+		Dropped: cn.dropped.Load(),
+	}
+	cn.lock.Lock()
+	for _, peer := range cn.peers {
+		stats.Nodes = append(stats.Nodes, *peer)
+	}
+	cn.lock.Unlock()
+	sort.Slice(stats.Nodes, func(i, j int) bool {
+		if stats.Nodes[i].Name != stats.Nodes[j].Name {
+			return stats.Nodes[i].Name < stats.Nodes[j].Name
+		}
+		return stats.Nodes[i].Node < stats.Nodes[j].Node
+	})
+	for _, node := range stats.Nodes {
+		stats.NumConnections += node.NumConnections
+		stats.NumClients += node.NumClients
+		stats.NumChannels += node.NumChannels
+	}
+	return stats
+}
+
+// clusterNodeStats gets this node's stats, to share with the rest of the cluster.
+func (reg *registry) clusterNodeStats() ClusterNodeStats {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	return reg.clusterNodeStatsLocked()
+}
+
+// clusterNodeStatsLocked gets this node's stats. The registry must be locked for reading.
+func (reg *registry) clusterNodeStatsLocked() ClusterNodeStats {
+	return ClusterNodeStats{
+		Node:           reg.cluster.id,
+		Name:           reg.cluster.name,
+		NumConnections: reg.numConnections,
+		NumClients:     len(reg.clients),
+		NumChannels:    reg.numChannels - int(reg.cluster.sharedChannels.Load()),
+		Draining:       reg.cluster.draining.Load(),
+		LastSeen:       time.Now(),
+	}
+}
+
+// handleRemote applies a message from the channel's owner, or from this node about another, to the channel.
+func (c *channel) handleRemote(msg clusterMessage) {
+	if c.destroyed {
+		return
+	}
+	switch msg.Type {
+	case clusterJoin, clusterLeave:
+		if c.stale(msg) {
+			return
+		}
+		c.seen[msg.Node] = msg.Seq
+		c.applyMembership(msg)
+		if c.syncing {
+			c.deltas = append(c.deltas, msg)
+		}
+	case clusterMembers:
+		switch {
+		case !c.stale(msg):
+			c.seen[msg.Node] = msg.Seq
+			c.applyMembership(msg)
+		case c.syncing:
+			// The members were listed in answer to a sync, and changes the owner made afterwards came first.
+			c.applyMembership(msg)
+			for _, delta := range c.deltas {
+				if delta.Node == msg.Node && delta.Seq > msg.Seq {
+					c.applyMembership(delta)
+				}
+			}
+		}
+	case clusterBye:
+		// From this node, because the other is gone.
+		delete(c.seen, msg.From)
+		c.applyMembership(msg)
+	case clusterSync:
+		// From this node, because the channel's owner may have changed.
+		members := make([]clusterMember, 0, len(c.members))
+		for _, member := range c.members {
+			members = append(members, clusterMember{ID: member.id, ConnectionType: member.connectionType})
+		}
+		c.reg.cluster.forward(clusterMessage{Type: clusterMembers, Channel: c.name, Members: members})
+	case clusterRelay:
+		if msg.From != c.reg.cluster.id {
+			c.handleRemoteMessage(msg)
+		}
+	}
+	c.countShared()
+}
+
+// stale reports whether a membership change from the channel's owner is no newer than the last one applied from it.
+func (c *channel) stale(msg clusterMessage) bool {
+	if c.seen == nil {
+		c.seen = make(map[string]uint64)
+	}
+	return msg.Seq <= c.seen[msg.Node]
+}
+
+// applyMembership applies a join, leave or list of members, or the departure of msg.From.
+func (c *channel) applyMembership(msg clusterMessage) {
+	switch msg.Type {
+	case clusterJoin:
+		for _, member := range msg.Members {
+			c.addRemote(member)
+		}
+	case clusterLeave:
+		for _, member := range msg.Members {
+			c.removeRemote(member.ID)
+		}
+	case clusterMembers, clusterBye:
+		present := make(map[uint64]bool, len(msg.Members))
+		for _, member := range msg.Members {
+			present[member.ID] = true
+		}
+		for id, member := range c.remote {
+			if (msg.From == "" || member.node == msg.From) && !present[id] {
+				c.removeRemote(id)
+			}
+		}
+		for _, member := range msg.Members {
+			c.addRemote(member)
+		}
+	}
+}
+
+// addRemote adds a member connected to another node, telling the channel's members it joined.
+// Members connected to this node are already in the channel, so are ignored.
+func (c *channel) addRemote(member clusterMember) {
+	if member.Node == c.reg.cluster.id {
+		return
+	}
+	if _, ok := c.remote[member.ID]; ok {
+		return
+	}
+	if c.remote == nil {
+		c.remote = make(map[uint64]remoteMember)
+	}
+	c.remote[member.ID] = remoteMember{node: member.Node, connectionType: member.ConnectionType}
+	c.broadcast(joinedChannelMSG(channelMember{id: member.ID, connectionType: member.ConnectionType, channel: c.name}))
+}
+
+// removeRemote removes a member connected to another node, telling the channel's members it left.
+func (c *channel) removeRemote(id uint64) {
+	member, ok := c.remote[id]
+	if !ok {
+		return
+	}
+	delete(c.remote, id)
+	c.broadcast(leftChannelMSG(channelMember{id: id, connectionType: member.connectionType, channel: c.name}))
+}
+
+// handleRemoteMessage relays a message sent by a member connected to another node.
+func (c *channel) handleRemoteMessage(msg clusterMessage) {
+	relayed := channelMessage{
+		origin:   msg.Origin,
+		msg:      msg.Message,
+		received: time.Now(),
+		span:     trace.SpanFromContext(context.Background()),
+	}
+	for _, member := range c.members {
+		if msg.To != nil && *msg.To != member.id {
+			continue
+		}
+		if msg.To != nil || c.reg.relayMode.relaysTo(msg.OriginType, member) {
+			c.deliver(member, relayed)
+		}
+	}
+}
+
+// relayRemote sends a message to the channel's members connected to other nodes, if it has any,
+// and reports whether it went to any of them.
+// If to is set, the message is only sent if it is for one of them.
+func (c *channel) relayRemote(msg channelMessage, originType string) bool {
+	if len(c.remote) == 0 {
+		return false
+	}
+	if msg.to != nil {
+		if _, ok := c.remote[*msg.to]; !ok {
+			return false
+		}
+	}
+	c.reg.cluster.forward(clusterMessage{
+		Type:       clusterRelay,
+		Channel:    c.name,
+		Message:    msg.msg,
+		Origin:     msg.origin,
+		OriginType: originType,
+		To:         msg.to,
+	})
+	return true
+}
+
+// withRemote gets members, followed by the channel's members connected to other nodes, in the order they joined.
+// Remote members have no client, and are only for telling a joining client who is in the channel.
+func (c *channel) withRemote(members []channelMember) []channelMember {
+	if len(c.remote) == 0 {
+		return members
+	}
+	all := make([]channelMember, 0, len(members)+len(c.remote))
+	all = append(all, members...)
+	start := len(all)
+	for id, member := range c.remote {
+		all = append(all, channelMember{id: id, connectionType: member.connectionType, channel: c.name})
+	}
+	sort.Slice(all[start:], func(i, j int) bool { return all[start+i].id < all[start+j].id })
+	return all
+}
+
+// hasRemoteMaster reports whether a master connected to another node is in the channel.
+func (c *channel) hasRemoteMaster() bool {
+	for _, member := range c.remote {
+		if member.connectionType == connectionTypeMaster {
+			return true
+		}
+	}
+	return false
+}
+
+// countShared updates whether the channel is counted by another node in the cluster's stats,
+// which it is if a node with a lower ID also has members in it.
+func (c *channel) countShared() {
+	shared := false
+	for _, member := range c.remote {
+		if member.node < c.reg.cluster.id {
+			shared = true
+			break
+		}
+	}
+	if shared == c.shared {
+		return
+	}
+	c.shared = shared
+	if shared {
+		c.reg.cluster.sharedChannels.Add(1)
+	} else {
+		c.reg.cluster.sharedChannels.Add(-1)
+	}
+}
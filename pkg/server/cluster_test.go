@@ -0,0 +1,74 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestClusterQueueKeepsMembership fills the queue of messages waiting to be published,
+// and checks that relayed messages are dropped from then on, but membership changes are still published, in order.
+func TestClusterQueueKeepsMembership(t *testing.T) {
+	cn := &clusterNode{id: "00001", queued: make(chan struct{}, 1)}
+	for i := 0; i < clusterQueueSize; i++ {
+		cn.publish(clusterMessage{Type: clusterRelay, Channel: "busy"})
+	}
+	cn.publish(clusterMessage{Type: clusterRelay, Channel: "busy"})
+	cn.publish(clusterMessage{Type: clusterJoin, Channel: "busy", Members: []clusterMember{{ID: 1, ConnectionType: "slave"}}})
+	cn.publish(clusterMessage{Type: clusterHeartbeat})
+	cn.publish(clusterMessage{Type: clusterLeave, Channel: "busy", Members: []clusterMember{{ID: 1, ConnectionType: "slave"}}})
+
+	if dropped := cn.dropped.Load(); dropped != 2 {
+		t.Errorf("dropped %d messages, want 2", dropped)
+	}
+	var types []string
+	for {
+		out, ok := cn.nextOutgoing()
+		if !ok {
+			break
+		}
+		var msg clusterMessage
+		if err := json.Unmarshal(out.payload, &msg); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, msg.Type)
+	}
+	if len(types) != clusterQueueSize+2 {
+		t.Fatalf("%d messages queued, want %d", len(types), clusterQueueSize+2)
+	}
+	if last := types[clusterQueueSize:]; last[0] != clusterJoin || last[1] != clusterLeave {
+		t.Errorf("membership changes queued as %v, want [join leave]", last)
+	}
+}
+
+// TestRemoteOpsDontBlock queues more operations from the cluster than a shard holds, with the shard not running,
+// as the backplane's handler would while the shard is stuck delivering to a slow client.
+func TestRemoteOpsDontBlock(t *testing.T) {
+	shard := &dispatchShard{
+		channels:    make(map[string]*channel),
+		work:        make(chan channelOp, dispatchQueueSize),
+		remoteReady: make(chan struct{}, 1),
+	}
+	c := &channel{name: "busy", shard: shard}
+	dropped := 0
+	for i := 0; i < 2*clusterQueueSize; i++ {
+		if !shard.sendRemote(channelOp{channel: c, remote: &clusterMessage{Type: clusterRelay, Channel: c.name}}) {
+			dropped++
+		}
+	}
+	if !shard.sendRemote(channelOp{channel: c, remote: &clusterMessage{Type: clusterMembers, Channel: c.name}}) {
+		t.Error("membership change dropped")
+	}
+	if !shard.sendRemote(channelOp{channel: c, synced: true}) {
+		t.Error("end of sync dropped")
+	}
+	if dropped != clusterQueueSize {
+		t.Errorf("dropped %d relayed messages, want %d", dropped, clusterQueueSize)
+	}
+	if ops := shard.takeRemote(); len(ops) != clusterQueueSize+2 {
+		t.Errorf("%d operations queued, want %d", len(ops), clusterQueueSize+2)
+	}
+}
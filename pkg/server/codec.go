@@ -0,0 +1,160 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// A Codec is a wire encoding for the messages exchanged with clients.
+// Clients start out speaking JSON, and may switch to any of the server's Codecs by sending a codec message.
+//
+// Messages are unmarshaled into the same types as with encoding/json,
+// including channel messages, which are unmarshaled into a map[string]interface{} whose numbers must be float64s,
+// so a codec must honor the types' json struct tags, and decode numbers in maps as float64s.
+type Codec interface {
+	// Name identifies the codec in codec messages, such as "msgpack".
+	Name() string
+
+	// NewDecoder creates a decoder reading messages from a client's connection.
+	NewDecoder(r io.Reader) Decoder
+
+	// Marshal encodes a message to be sent to a client, including any framing the encoding needs.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes a message read by one of the codec's decoders into v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// A Decoder reads the messages a client sends, one at a time.
+type Decoder interface {
+	// Decode reads the next message, returning it whole, to be unmarshaled by its codec.
+	Decode() ([]byte, error)
+
+	// Buffered returns what has been read from the connection, but not yet decoded,
+	// so that it can be decoded by another codec if the client switches.
+	Buffered() io.Reader
+}
+
+// jsonCodec is the encoding NVDA Remote clients speak: a JSON object per line.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) NewDecoder(r io.Reader) Decoder {
+	return jsonDecoder{json.NewDecoder(r)}
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type jsonDecoder struct {
+	dec *json.Decoder
+}
+
+func (d jsonDecoder) Decode() ([]byte, error) {
+	var raw json.RawMessage
+	err := d.dec.Decode(&raw)
+	return raw, err
+}
+
+func (d jsonDecoder) Buffered() io.Reader {
+	// The newline ending the last message is still buffered, and isn't part of the next.
+	buf, _ := io.ReadAll(d.dec.Buffered())
+	return bytes.NewReader(bytes.TrimLeft(buf, " \t\r\n"))
+}
+
+// malformedMessageError is returned when a message could be read, but not unmarshaled.
+type malformedMessageError struct {
+	error
+}
+
+// WithCodecs adds encodings clients may switch to from JSON.
+func WithCodecs(codecs ...Codec) Option {
+	return func(srv *Server) error {
+		for _, codec := range codecs {
+			if codec == nil {
+				return errors.New("no codec given")
+			}
+			if srv.codec(codec.Name()) != nil {
+				return errors.Errorf("codec %q is given more than once", codec.Name())
+			}
+			srv.Codecs = append(srv.Codecs, codec)
+		}
+		return nil
+	}
+}
+
+// codec gets the codec named name, or nil if the server has none by that name.
+func (srv *Server) codec(name string) Codec {
+	if name == (jsonCodec{}).Name() {
+		return jsonCodec{}
+	}
+	for _, codec := range srv.Codecs {
+		if codec.Name() == name {
+			return codec
+		}
+	}
+	return nil
+}
+
+// ClientCodecMessage is received when a client wishes to switch to another encoding.
+// It must be sent before the client joins a channel.
+type ClientCodecMessage struct {
+	GenericClientMessage
+	Codec string `json:"codec"`
+}
+
+// Name gets this ClientCodecMessage's name.
+func (ClientCodecMessage) Name() string {
+	return "codec"
+}
+
+// ClientCodecResponse confirms a switch of encoding.
+// It is the last message sent with the old encoding, and everything the client sends after its codec message
+// must use the new one.
+type ClientCodecResponse struct {
+	Type  string `json:"type"`
+	Codec string `json:"codec"`
+}
+
+// Name gets this ClientCodecResponse's name.
+func (ClientCodecResponse) Name() string {
+	return "codec"
+}
+
+func handleClientCodec(c *client, msg Message) {
+	codecMSG := msg.(*ClientCodecMessage)
+	if c.channel != nil {
+		c.sendError("codec can't be changed once in a channel")
+		return
+	}
+	codec := c.srv.codec(codecMSG.Codec)
+	if codec == nil {
+		c.sendError("unknown codec: " + codecMSG.Codec)
+		return
+	}
+	c.send(ClientCodecResponse{
+		Type:  "codec",
+		Codec: codec.Name(),
+	})
+	// readFromClient waits for this handler to return before it reads the next message, which it will decode with codec.
+	c.codec = codec
+}
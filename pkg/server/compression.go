@@ -0,0 +1,294 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// zstdWindowSize is the largest window a client's zstd stream may use, which bounds the memory its decoder needs.
+// It is the size the zstd format recommends every decoder support, and the one zstd encoders use by default.
+const zstdWindowSize = 8 << 20
+
+// zstdEncoderWindowSize is the window used to compress output to clients.
+// Relayed messages are small, so a larger window would mostly cost memory for every client.
+const zstdEncoderWindowSize = 256 << 10
+
+// flushWriter is a compressing writer, whose output can be flushed so that everything written so far can be decompressed.
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// compression is an algorithm connections can be compressed with.
+type compression struct {
+	newWriter func(w io.Writer) (flushWriter, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// compressions are the algorithms the server can offer clients, by the names they are negotiated with.
+var compressions = map[string]compression{
+	"gzip": {
+		newWriter: func(w io.Writer) (flushWriter, error) {
+			// Relayed messages are small and need to go out right away, so speed matters more than ratio.
+			return gzip.NewWriterLevel(w, gzip.BestSpeed)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	"zstd": {
+		newWriter: func(w io.Writer) (flushWriter, error) {
+			return zstd.NewWriter(w,
+				zstd.WithEncoderConcurrency(1),
+				zstd.WithEncoderLevel(zstd.SpeedFastest),
+				zstd.WithWindowSize(zstdEncoderWindowSize))
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			dec, err := zstd.NewReader(r,
+				zstd.WithDecoderConcurrency(1),
+				zstd.WithDecoderMaxWindow(zstdWindowSize))
+			if err != nil {
+				return nil, err
+			}
+			return dec.IOReadCloser(), nil
+		},
+	},
+}
+
+// WithCompression offers clients stream compression with algorithms, in order of preference.
+// The supported algorithms are "zstd" and "gzip".
+func WithCompression(algorithms ...string) Option {
+	return func(srv *Server) error {
+		for i, algorithm := range algorithms {
+			if _, ok := compressions[algorithm]; !ok {
+				return errors.Errorf("unknown compression %q; must be zstd or gzip", algorithm)
+			}
+			for _, prev := range algorithms[:i] {
+				if prev == algorithm {
+					return errors.Errorf("compression %q is given more than once", algorithm)
+				}
+			}
+		}
+		srv.Compression = algorithms
+		return nil
+	}
+}
+
+// ClientCompressionMessage is received when a client advertises the compression algorithms it supports.
+type ClientCompressionMessage struct {
+	GenericClientMessage
+	Algorithms []string `json:"algorithms"`
+}
+
+// Name gets this ClientCompressionMessage's name.
+func (ClientCompressionMessage) Name() string {
+	return "compression"
+}
+
+// ClientCompressionResponse tells a client which algorithm its connection is compressed with, or "none".
+// It is the last message sent uncompressed, and everything the client sends after its compression message
+// must be compressed.
+type ClientCompressionResponse struct {
+	Type      string `json:"type"`
+	Algorithm string `json:"algorithm"`
+}
+
+// Name gets this ClientCompressionResponse's name.
+func (ClientCompressionResponse) Name() string {
+	return "compression"
+}
+
+func handleClientCompression(c *client, msg Message) {
+	compressionMSG := msg.(*ClientCompressionMessage)
+	if c.compression != "" {
+		c.sendError("compression has already been negotiated")
+		return
+	}
+	// The server's preference wins over the order the client lists its algorithms in.
+	var algorithm string
+	for _, offered := range c.srv.Compression {
+		for _, supported := range compressionMSG.Algorithms {
+			if offered == supported {
+				algorithm = offered
+				break
+			}
+		}
+		if algorithm != "" {
+			break
+		}
+	}
+	if algorithm == "" {
+		c.send(ClientCompressionResponse{
+			Type:      "compression",
+			Algorithm: "none",
+		})
+		return
+	}
+
+	z := &compressor{}
+	w, err := compressions[algorithm].newWriter(&z.buf)
+	if err != nil {
+		c.log.WithFields(Fields{
+			"id":          c.id,
+			"compression": algorithm,
+			"error":       err,
+		}).Warn("Error creating compressor")
+		c.sendInternalError()
+		return
+	}
+	z.w = w
+	c.send(ClientCompressionResponse{
+		Type:      "compression",
+		Algorithm: algorithm,
+	})
+	// The response goes out uncompressed; everything after it is compressed.
+	c.flush()
+	c.compressor = z
+	c.out.Reset(compressedWriter{z: z, w: deadlineWriter{conn: c.conn, timeout: c.writeTimeout, count: c.countSent}})
+	// readFromClient waits for this handler to return before it reads the next message, which it will decompress.
+	c.compression = algorithm
+	c.log.WithFields(Fields{
+		"id":          c.id,
+		"compression": algorithm,
+	}).Debug("Compressing client's connection")
+}
+
+// compressor compresses a client's output. Like the rest of the client's output, it is only used by handleClient.
+type compressor struct {
+	w flushWriter
+	// buf holds w's output, so it can be written to whichever writer it is compressing for.
+	buf bytes.Buffer
+	// unflushed is set when w may be holding output back until it is flushed.
+	unflushed bool
+}
+
+// write compresses p, flushing the compressed stream if flush is set, and writes whatever output is ready to dst.
+// It returns the number of compressed bytes written.
+func (z *compressor) write(dst io.Writer, p []byte, flush bool) (int, error) {
+	if _, err := z.w.Write(p); err != nil {
+		return 0, err
+	}
+	if len(p) > 0 {
+		z.unflushed = true
+	}
+	if flush && z.unflushed {
+		if err := z.w.Flush(); err != nil {
+			return 0, err
+		}
+		z.unflushed = false
+	}
+	if z.buf.Len() == 0 {
+		return 0, nil
+	}
+	n, err := dst.Write(z.buf.Bytes())
+	z.buf.Reset()
+	return n, err
+}
+
+// hasOutput reports whether the compressor is holding back output until it is flushed.
+func (z *compressor) hasOutput() bool {
+	return z.unflushed
+}
+
+// compressedWriter compresses what is written to it into w.
+// A client's output buffer writes to one once its connection is compressed.
+type compressedWriter struct {
+	z *compressor
+	w io.Writer
+}
+
+func (cw compressedWriter) Write(p []byte) (int, error) {
+	if _, err := cw.z.write(cw.w, p, false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// decompressor reads a client's compressed stream from its connection.
+type decompressor struct {
+	conn      *connReader
+	src       io.Reader
+	newReader func(r io.Reader) (io.ReadCloser, error)
+	r         io.ReadCloser
+}
+
+// newDecompressor decompresses src, which reads what was buffered by the client's decoder, then conn.
+func newDecompressor(algorithm string, src io.Reader, conn *connReader) *decompressor {
+	return &decompressor{
+		conn:      conn,
+		src:       src,
+		newReader: compressions[algorithm].newReader,
+	}
+}
+
+func (d *decompressor) Read(p []byte) (int, error) {
+	if d.r == nil {
+		// Created on the first read, since a gzip reader reads the stream's header straight away.
+		r, err := d.newReader(d.src)
+		if err != nil {
+			return 0, d.wrapError(err)
+		}
+		d.r = r
+	}
+	n, err := d.r.Read(p)
+	return n, d.wrapError(err)
+}
+
+// Close releases the decompressor's resources.
+func (d *decompressor) Close() error {
+	if d.r == nil {
+		return nil
+	}
+	return d.r.Close()
+}
+
+// wrapError reports errors reading the connection as they are,
+// since readFromClient decides how to stop the client by them, and anything else as a malformed message.
+func (d *decompressor) wrapError(err error) error {
+	switch {
+	case err == nil || err == io.EOF:
+		return err
+	case d.conn.err != nil:
+		// A decompressor reports a connection closed partway through its stream as an unexpected EOF,
+		// but clients don't need to end the stream before disconnecting.
+		return d.conn.err
+	}
+	return malformedMessageError{errors.Wrap(err, "Decompress")}
+}
+
+// connReader reads a client's connection beneath a decompressor, which can't carry on after an error.
+// Reads that time out are retried if idle clients aren't timed out;
+// otherwise, the error that ended the connection is kept.
+type connReader struct {
+	c *client
+	// retryDeadline is how long to wait for each retried read.
+	retryDeadline time.Duration
+	err           error
+}
+
+func (r *connReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.c.conn.Read(p)
+		if terr, ok := err.(net.Error); ok && terr.Timeout() && n == 0 && r.c.srv.PingsUntilTimeout == 0 {
+			r.c.conn.SetReadDeadline(time.Now().Add(r.retryDeadline))
+			if !r.c.isStopped() {
+				// Stopped clients have their deadline set to now, which the above would have overwritten.
+				continue
+			}
+		}
+		if err != nil {
+			r.err = err
+		}
+		return n, err
+	}
+}
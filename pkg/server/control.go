@@ -0,0 +1,101 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ControlRequest runs an admin command over the control socket.
+// Requests are sent as lines of JSON, and each is answered with a ControlResponse.
+type ControlRequest struct {
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+// ControlResponse holds the result of a ControlRequest, or the error it failed with.
+type ControlResponse struct {
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// ListenAndServeControl listens on a unix domain socket at path, which runs admin commands for local administration.
+// No password is needed; access is controlled by the socket's permissions, which are set to perm.
+// If a socket is left over at path from a server that is no longer running, it is replaced.
+// If a control socket for path was inherited from a previous server, it is used as is.
+// It returns when the listener is closed.
+func (srv *Server) ListenAndServeControl(path string, perm os.FileMode) error {
+	listener := srv.handoff.inherit(path)
+	if listener == nil {
+		var err error
+		if listener, err = listenControl(path, perm); err != nil {
+			return err
+		}
+	}
+	srv.handoff.addBound(path, listener)
+	defer listener.Close()
+
+	srv.startOnce.Do(srv.start)
+	srv.shutdown.addListener(listener)
+	srv.Log.WithFields(Fields{
+		"path": path,
+		"perm": perm,
+	}).Info("Listening on control socket")
+	srv.acceptLoop(listener, "control connection", func(conn net.Conn) {
+		go srv.serveControl(conn)
+	})
+	return nil
+}
+
+// listenControl binds a control socket at path, replacing a stale one, and sets its permissions to perm.
+func listenControl(path string, perm os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.Errorf("Control socket %s is in use by another server", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, errors.Wrap(err, "Remove stale control socket")
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Listen on control socket")
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		listener.Close()
+		return nil, errors.Wrap(err, "Set control socket permissions")
+	}
+	return listener, nil
+}
+
+// serveControl runs admin commands from a control connection until it is closed.
+func (srv *Server) serveControl(conn net.Conn) {
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		var req ControlRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		srv.Log.WithField("command", req.Command).Info("Running admin command from control socket")
+		var resp ControlResponse
+		result, err := srv.Admin(req.Command, req.Args)
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Result = result
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CreationLimit limits how many channels each IP address may create,
+// so that one address can't spray channels to guess keys, or exhaust the server by creating them.
+// Joining a channel that already exists is never limited.
+// Minutes and hours start on the minute and on the hour. A limit of 0 isn't enforced.
+type CreationLimit struct {
+	PerMinute int
+	PerHour   int
+}
+
+// WithCreationLimit limits how many channels each IP address may create per minute and per hour.
+func WithCreationLimit(limit CreationLimit) Option {
+	return func(srv *Server) error {
+		if err := notNegative("channel creations per minute", limit.PerMinute); err != nil {
+			return err
+		}
+		if err := notNegative("channel creations per hour", limit.PerHour); err != nil {
+			return err
+		}
+		srv.CreationLimit = limit
+		return nil
+	}
+}
+
+// creationLimitError explains which CreationLimit a join hit.
+// It is ErrCreationLimit, as far as errors.Is is concerned.
+type creationLimitError struct {
+	reason string
+}
+
+func (e creationLimitError) Error() string {
+	return e.reason
+}
+
+func (e creationLimitError) Is(target error) bool {
+	return target == ErrCreationLimit
+}
+
+// countWindow counts what happened in the current minute or hour.
+type countWindow struct {
+	start time.Time
+	count int
+}
+
+// advance starts a new window if the period containing now is different from the window's.
+func (w *countWindow) advance(now time.Time, period time.Duration) {
+	if start := now.Truncate(period); !w.start.Equal(start) {
+		*w = countWindow{start: start}
+	}
+}
+
+// addressCreations counts the channels an address created in the current minute and hour.
+type addressCreations struct {
+	minute countWindow
+	hour   countWindow
+}
+
+// creationLimiter enforces the server's CreationLimit.
+type creationLimiter struct {
+	limit CreationLimit
+
+	lock      sync.Mutex // Protects addresses
+	addresses map[string]*addressCreations
+
+	rejected atomic.Int64 // Number of joins rejected for creating too many channels
+}
+
+// take counts a channel about to be created by addr at now,
+// unless addr has already created as many as the limit allows, in which case the returned error explains the limit.
+func (l *creationLimiter) take(addr string, now time.Time) error {
+	if l.limit.PerMinute == 0 && l.limit.PerHour == 0 {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.addresses == nil {
+		l.addresses = make(map[string]*addressCreations)
+	}
+	creations := l.addresses[addr]
+	if creations == nil {
+		creations = &addressCreations{}
+		l.addresses[addr] = creations
+	}
+
+	for _, window := range []struct {
+		name   string
+		period time.Duration
+		limit  int
+		window *countWindow
+	}{
+		{"minute", time.Minute, l.limit.PerMinute, &creations.minute},
+		{"hour", time.Hour, l.limit.PerHour, &creations.hour},
+	} {
+		window.window.advance(now, window.period)
+		if window.limit > 0 && window.window.count >= window.limit {
+			l.rejected.Add(1)
+			wait := window.window.start.Add(window.period).Sub(now).Round(time.Second)
+			return creationLimitError{fmt.Sprintf("%s: your address may create %d channels per %s; try again in %s",
+				ErrCreationLimit, window.limit, window.name, wait)}
+		}
+	}
+	creations.minute.count++
+	creations.hour.count++
+	return nil
+}
+
+// prune forgets addresses that haven't created a channel this hour.
+func (l *creationLimiter) prune(now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	hour := now.Truncate(time.Hour)
+	for addr, creations := range l.addresses {
+		if !creations.hour.start.Equal(hour) {
+			delete(l.addresses, addr)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// maxAdminArgsSize is the largest request body the admin API accepts as a command's arguments.
+const maxAdminArgsSize = 64 << 10
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// WithDashboard serves the admin dashboard and API on the health listener.
+func WithDashboard(dashboard bool) Option {
+	return func(srv *Server) error {
+		srv.Dashboard = dashboard
+		return nil
+	}
+}
+
+// AdminAPIResponse is the body of every response from the admin API.
+// Result holds what the admin command returned, or Error why it failed.
+type AdminAPIResponse struct {
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// dashboardHandler serves the admin dashboard under /admin/, the admin API under /admin/api/, and the event stream at /admin/events.
+// Both need the stats password, or a token, given with HTTP basic authentication; the user name is ignored.
+//
+// The API runs the admin command named by the rest of the path, such as POST /admin/api/kick,
+// with the JSON request body as its arguments, if it has any, and responds with an AdminAPIResponse.
+// Requests must be POSTs with a JSON content type, so that other sites can't make a browser that has logged in run commands.
+// Tokens may only run the commands their scopes allow.
+//
+// Events, such as clients connecting and joining channels, are streamed as server-sent events from /admin/events,
+// to tokens with ScopeList.
+func (srv *Server) dashboardHandler() http.Handler {
+	static, _ := fs.Sub(dashboardFiles, "dashboard")
+	files := http.StripPrefix("/admin/", http.FileServer(http.FS(static)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="nvremoted"`)
+			http.Error(w, "no password", http.StatusUnauthorized)
+			return
+		}
+		remoteAddr, _, _ := net.SplitHostPort(r.RemoteAddr)
+		token, err := srv.authenticate(remoteAddr, password)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="nvremoted"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		if r.URL.Path == "/admin/events" {
+			srv.serveEvents(w, r, token)
+			return
+		}
+		if command, ok := strings.CutPrefix(r.URL.Path, "/admin/api/"); ok {
+			srv.serveAdminAPI(w, r, command, token)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// serveAdminAPI runs an admin command for the admin API, as allowed by token.
+func (srv *Server) serveAdminAPI(w http.ResponseWriter, r *http.Request, command string, token *Token) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAdminAPI(w, http.StatusMethodNotAllowed, AdminAPIResponse{Error: "admin commands must be POSTed"})
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeAdminAPI(w, http.StatusUnsupportedMediaType, AdminAPIResponse{Error: "the content type must be application/json"})
+		return
+	}
+	if adminCommands[command] == nil {
+		writeAdminAPI(w, http.StatusNotFound, AdminAPIResponse{Error: "unknown admin command: " + command})
+		return
+	}
+	if !token.allowsCommand(command) {
+		writeAdminAPI(w, http.StatusForbidden, AdminAPIResponse{Error: "not allowed: this token's scopes don't allow that request"})
+		return
+	}
+
+	args, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminArgsSize))
+	if err != nil {
+		writeAdminAPI(w, http.StatusRequestEntityTooLarge, AdminAPIResponse{Error: err.Error()})
+		return
+	}
+	srv.Log.WithFields(Fields{
+		"remote_addr": r.RemoteAddr,
+		"command":     command,
+		"token":       token.Name,
+	}).Info("Running admin command")
+	result, err := srv.Admin(command, args)
+	if err != nil {
+		writeAdminAPI(w, http.StatusBadRequest, AdminAPIResponse{Error: err.Error()})
+		return
+	}
+	writeAdminAPI(w, http.StatusOK, AdminAPIResponse{Result: result})
+}
+
+func writeAdminAPI(w http.ResponseWriter, code int, resp AdminAPIResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
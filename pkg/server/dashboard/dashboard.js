@@ -0,0 +1,266 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+// The dashboard polls the admin API, and whenever the event stream says something changed,
+// and rebuilds its tables in place, keeping focus where it was,
+// so that screen reader users aren't thrown around by updates. Updates can be paused.
+
+"use strict";
+
+const refreshInterval = 5000;
+const maxSamples = 60;
+
+let paused = false;
+let samples = [];
+
+// api runs an admin command, returning its result, or throwing an Error saying why it failed.
+async function api(command, args) {
+	const resp = await fetch("api/" + command, {
+		method: "POST",
+		headers: {"Content-Type": "application/json"},
+		credentials: "same-origin",
+		body: args === undefined ? "" : JSON.stringify(args),
+	});
+	let body;
+	try {
+		body = await resp.json();
+	} catch (e) {
+		throw new Error(resp.status + " " + resp.statusText);
+	}
+	if (!resp.ok) {
+		throw new Error(body.error || resp.statusText);
+	}
+	return body.result;
+}
+
+function announce(message) {
+	document.getElementById("status").textContent = message;
+}
+
+function formatBytes(n) {
+	const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+	let i = 0;
+	while (n >= 1024 && i < units.length - 1) {
+		n /= 1024;
+		i++;
+	}
+	return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+}
+
+// formatDuration formats a Go time.Duration, which is in nanoseconds.
+function formatDuration(ns) {
+	if (ns < 1e9) {
+		return Math.round(ns / 1e6) + " ms";
+	}
+	let s = Math.floor(ns / 1e9);
+	const parts = [];
+	for (const [unit, size] of [["d", 86400], ["h", 3600], ["m", 60]]) {
+		if (s >= size) {
+			parts.push(Math.floor(s / size) + unit);
+			s %= size;
+		}
+	}
+	parts.push(s + "s");
+	return parts.join(" ");
+}
+
+function formatTime(iso) {
+	return new Date(iso).toLocaleString();
+}
+
+function cell(row, text) {
+	const td = document.createElement("td");
+	td.textContent = text;
+	row.appendChild(td);
+	return td;
+}
+
+// replaceRows replaces the rows of tbody, putting focus back on the control with the same data-key, if it still exists.
+function replaceRows(tbody, rows) {
+	const focused = tbody.contains(document.activeElement) ? document.activeElement.dataset.key : undefined;
+	tbody.replaceChildren(...rows);
+	if (focused !== undefined) {
+		const again = tbody.querySelector("[data-key=\"" + CSS.escape(focused) + "\"]");
+		if (again) {
+			again.focus();
+		}
+	}
+}
+
+function showStats(stats) {
+	const values = {
+		uptime: formatDuration(stats.uptime),
+		num_connections: stats.num_connections,
+		num_clients: stats.num_clients + " (most " + stats.max_clients + ")",
+		num_channels: stats.num_channels + " (" + stats.num_e2e_channels + " end-to-end encrypted)",
+		bytes_received: formatBytes(stats.bytes_received),
+		bytes_sent: formatBytes(stats.bytes_sent),
+		messages_relayed: stats.messages_relayed,
+	};
+	for (const dd of document.querySelectorAll("[data-stat]")) {
+		dd.textContent = values[dd.dataset.stat];
+	}
+
+	const now = Date.now();
+	const last = samples[samples.length - 1];
+	if (last) {
+		const seconds = (now - last.time) / 1000;
+		samples.push({
+			time: now,
+			received: stats.bytes_received,
+			sent: stats.bytes_sent,
+			receivedRate: Math.max(0, (stats.bytes_received - last.received) / seconds),
+			sentRate: Math.max(0, (stats.bytes_sent - last.sent) / seconds),
+		});
+	} else {
+		samples.push({time: now, received: stats.bytes_received, sent: stats.bytes_sent});
+	}
+	if (samples.length > maxSamples) {
+		samples = samples.slice(samples.length - maxSamples);
+	}
+	showTraffic();
+}
+
+function showTraffic() {
+	const rated = samples.filter((s) => s.receivedRate !== undefined);
+	if (rated.length === 0) {
+		return;
+	}
+	const peak = Math.max(1, ...rated.map((s) => Math.max(s.receivedRate, s.sentRate)));
+	const points = (key) => rated.map((s, i) => {
+		const x = rated.length === 1 ? 600 : i * 600 / (rated.length - 1);
+		const y = 160 - s[key] / peak * 150;
+		return x.toFixed(1) + "," + y.toFixed(1);
+	}).join(" ");
+	document.getElementById("traffic-received").setAttribute("points", points("receivedRate"));
+	document.getElementById("traffic-sent").setAttribute("points", points("sentRate"));
+
+	const latest = rated[rated.length - 1];
+	const minutes = Math.round((latest.time - rated[0].time) / 60000);
+	document.getElementById("traffic-summary").textContent =
+		"Traffic over the last " + (minutes < 1 ? "minute" : minutes + " minutes") +
+		": now receiving " + formatBytes(latest.receivedRate) + "/s and sending " + formatBytes(latest.sentRate) + "/s" +
+		"; peak " + formatBytes(peak) + "/s.";
+
+	const rows = rated.slice().reverse().map((s) => {
+		const tr = document.createElement("tr");
+		cell(tr, new Date(s.time).toLocaleTimeString());
+		cell(tr, formatBytes(s.receivedRate) + "/s");
+		cell(tr, formatBytes(s.sentRate) + "/s");
+		return tr;
+	});
+	replaceRows(document.getElementById("traffic-table"), rows);
+}
+
+function showClients(clients) {
+	document.getElementById("clients-caption").textContent = "Connected clients: " + clients.length;
+	const rows = clients.map((c) => {
+		const tr = document.createElement("tr");
+		cell(tr, c.id);
+		cell(tr, c.remote_host);
+		cell(tr, c.channel || "none");
+		cell(tr, c.connection_type || "");
+		cell(tr, formatTime(c.connected));
+		cell(tr, c.avg_rtt ? formatDuration(c.avg_rtt) : "");
+		const kick = document.createElement("button");
+		kick.type = "button";
+		kick.textContent = "Kick";
+		kick.dataset.key = "kick-" + c.id;
+		kick.setAttribute("aria-label", "Kick client " + c.id + " from " + c.remote_host);
+		kick.addEventListener("click", () => kickClient(c));
+		cell(tr, "").appendChild(kick);
+		return tr;
+	});
+	replaceRows(document.getElementById("clients"), rows);
+}
+
+function showChannels(channels) {
+	document.getElementById("channels-caption").textContent = "Active channels: " + channels.length;
+	const rows = channels.map((ch) => {
+		const tr = document.createElement("tr");
+		cell(tr, ch.name);
+		cell(tr, Object.entries(ch.members).map(([type, n]) => n + " " + type).join(", "));
+		cell(tr, ch.e2e ? "yes" : "no");
+		cell(tr, formatTime(ch.created));
+		cell(tr, formatBytes(ch.hour_bytes));
+		return tr;
+	});
+	replaceRows(document.getElementById("channels"), rows);
+}
+
+async function kickClient(c) {
+	if (!confirm("Kick client " + c.id + " from " + c.remote_host + "?")) {
+		return;
+	}
+	try {
+		const result = await api("kick", {id: c.id, reason: "kicked from the dashboard"});
+		announce(result.kicked.length ? "Kicked client " + c.id + "." : "Client " + c.id + " had already left.");
+		refresh();
+	} catch (e) {
+		announce("Couldn't kick client " + c.id + ": " + e.message);
+	}
+}
+
+async function refresh() {
+	const [stats, clients, channels] = await Promise.allSettled([api("stats"), api("clients"), api("channels")]);
+	if (stats.status === "rejected") {
+		announce("Couldn't get stats: " + stats.reason.message);
+		return;
+	}
+	showStats(stats.value);
+	if (clients.status === "fulfilled") {
+		showClients(clients.value);
+	} else {
+		document.getElementById("clients-caption").textContent = "Couldn't list clients: " + clients.reason.message;
+	}
+	if (channels.status === "fulfilled") {
+		showChannels(channels.value);
+	} else {
+		document.getElementById("channels-caption").textContent = "Couldn't list channels: " + channels.reason.message;
+	}
+	document.getElementById("updated").textContent = "Updated " + new Date().toLocaleTimeString();
+}
+
+document.getElementById("pause").addEventListener("click", (event) => {
+	paused = !paused;
+	event.target.setAttribute("aria-pressed", String(paused));
+	announce(paused ? "Updates paused." : "Updates resumed.");
+	if (!paused) {
+		refresh();
+	}
+});
+
+document.getElementById("broadcast").addEventListener("submit", async (event) => {
+	event.preventDefault();
+	const message = document.getElementById("broadcast-message");
+	try {
+		const result = await api("broadcast", {message: message.value});
+		announce("Broadcast sent to " + result.clients + " clients.");
+		message.value = "";
+	} catch (e) {
+		announce("Couldn't send the broadcast: " + e.message);
+	}
+});
+
+// Refresh soon after clients and channels change, rather than waiting for the next poll.
+// Events come in bursts, such as a client connecting and joining a channel, so they are gathered for a moment first.
+if (window.EventSource) {
+	let pending;
+	new EventSource("events").addEventListener("message", () => {
+		if (paused || pending) {
+			return;
+		}
+		pending = setTimeout(() => {
+			pending = undefined;
+			refresh();
+		}, 1000);
+	});
+}
+
+refresh();
+setInterval(() => {
+	if (!paused) {
+		refresh();
+	}
+}, refreshInterval);
@@ -0,0 +1,161 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GoroutineReport summarizes the goroutines running in the server's process.
+type GoroutineReport struct {
+	Time        time.Time        `json:"time"`
+	Total       int              `json:"total"`
+	Connections int              `json:"connections"`
+	Channels    int              `json:"channels"`
+	ByFunction  []GoroutineCount `json:"by_function"`
+
+	// Warnings describes anything that looks like a leak.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// GoroutineCount is the number of goroutines started from a function.
+type GoroutineCount struct {
+	Function string `json:"function"`
+	Count    int    `json:"count"`
+}
+
+// Entry points of goroutines the server starts per client and per dispatch shard.
+// Each connected client runs one of each of the client functions.
+const (
+	readFromClientFunc = "(*Server).readFromClient"
+	handleClientFunc   = "(*Server).handleClient"
+	serveClientFunc    = "(*Server).serveClient.func"
+	dispatchShardFunc  = "(*dispatchShard).run"
+)
+
+// goroutineHistory remembers the last report, so growth between reports can be flagged.
+type goroutineHistory struct {
+	lock sync.Mutex
+	last *GoroutineReport
+}
+
+// GoroutineReport groups the running goroutines by the function that started them,
+// and checks the counts against the number of clients and channels for signs of leaks.
+func (srv *Server) GoroutineReport() GoroutineReport {
+	counts := countGoroutinesByFunction()
+
+	srv.registry.lock.RLock()
+	report := GoroutineReport{
+		Time:        time.Now(),
+		Connections: srv.registry.numConnections,
+		Channels:    srv.registry.numChannels,
+	}
+	srv.registry.lock.RUnlock()
+
+	perFunc := func(name string) int {
+		n := 0
+		for function, count := range counts {
+			if strings.Contains(function, name) {
+				n += count
+			}
+		}
+		return n
+	}
+
+	for function, count := range counts {
+		report.Total += count
+		report.ByFunction = append(report.ByFunction, GoroutineCount{
+			Function: function,
+			Count:    count,
+		})
+	}
+	sort.Slice(report.ByFunction, func(i, j int) bool {
+		if report.ByFunction[i].Count != report.ByFunction[j].Count {
+			return report.ByFunction[i].Count > report.ByFunction[j].Count
+		}
+		return report.ByFunction[i].Function < report.ByFunction[j].Function
+	})
+
+	readers := perFunc(readFromClientFunc)
+	handlers := perFunc(handleClientFunc)
+	waiters := perFunc(serveClientFunc)
+	shards := perFunc(dispatchShardFunc)
+	if readers != handlers {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("%d readFromClient goroutines, but %d handleClient goroutines; clients may be stuck while being torn down", readers, handlers))
+	}
+	if waiters > report.Connections {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("%d clients waiting to be torn down, but only %d connections", waiters, report.Connections))
+	}
+	if numShards := len(srv.registry.dispatcher.shards); shards != numShards {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("%d dispatch goroutines, but %d dispatch shards; channels on a missing shard will hang", shards, numShards))
+	}
+
+	srv.goroutineHistory.lock.Lock()
+	if last := srv.goroutineHistory.last; last != nil && report.Total > last.Total && report.Connections <= last.Connections && report.Channels <= last.Channels {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("goroutines grew from %d to %d since %s, while connections went from %d to %d and channels from %d to %d",
+			last.Total, report.Total, last.Time.Format(time.RFC3339), last.Connections, report.Connections, last.Channels, report.Channels))
+	}
+	srv.goroutineHistory.last = &report
+	srv.goroutineHistory.lock.Unlock()
+
+	return report
+}
+
+// countGoroutinesByFunction counts all goroutines by the function they were started with.
+func countGoroutinesByFunction() map[string]int {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+
+	// Each goroutine's trace is separated by a blank line, and consists of a header,
+	// followed by a function line and a location line for each frame, innermost first.
+	// The last frame may be followed by a "created by" line and its location.
+	counts := make(map[string]int)
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	scanner.Buffer(make([]byte, 0, 64<<10), len(buf)+1)
+	var entry string
+	inTrace := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if inTrace {
+				counts[entry]++
+			}
+			entry, inTrace = "", false
+		case strings.HasPrefix(line, "goroutine "):
+			inTrace = true
+		case strings.HasPrefix(line, "\t"), strings.HasPrefix(line, "created by "), strings.HasPrefix(line, "..."):
+			// Locations, and the creator of the goroutine, which isn't interesting here.
+		default:
+			entry = trimFunctionArgs(line)
+		}
+	}
+	if inTrace {
+		counts[entry]++
+	}
+	return counts
+}
+
+// trimFunctionArgs removes the argument list from a function line in a stack trace.
+func trimFunctionArgs(line string) string {
+	if i := strings.LastIndex(line, "("); i > 0 && strings.HasSuffix(line, ")") {
+		return line[:i]
+	}
+	return line
+}
@@ -0,0 +1,196 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// defaultDispatchShards is the number of dispatch shards used if the server doesn't set DispatchShards.
+const defaultDispatchShards = 64
+
+// dispatchQueueSize is the number of operations that can wait for each shard.
+const dispatchQueueSize = 64
+
+// dispatcher runs channels on a fixed pool of goroutines, rather than one goroutine per channel.
+// Each channel belongs to the shard chosen by hashing its name.
+// A shard handles the joins, parts, and messages of all of its channels one at a time, in the order they were sent,
+// so each channel sees its operations in order, just as if it had its own goroutine.
+type dispatcher struct {
+	shards []*dispatchShard
+}
+
+// dispatchShard owns the channels whose names hash to it.
+type dispatchShard struct {
+	lock     sync.Mutex // Protects channels, and the pendingJoins of each channel
+	channels map[string]*channel
+
+	// work receives operations for this shard's channels.
+	work chan channelOp
+	// stop is closed when the server shuts down, which stops the shard.
+	stop <-chan struct{}
+
+	// remote holds operations from the cluster, which are queued here rather than sent to work,
+	// so that a busy shard never holds up the backplane. They are handled before operations sent to work after them.
+	// remoteReady is signalled when operations are added.
+	remoteLock  sync.Mutex
+	remote      []channelOp
+	remoteReady chan struct{}
+}
+
+// channelOp is an operation for a channel, run by its shard's goroutine.
+// Exactly one of join, part, attach, msg, and remote is set.
+type channelOp struct {
+	channel *channel
+	join    *joinChannelRequest
+	part    *leaveChannelRequest
+	attach  *attachChannelRequest
+	msg     *channelMessage
+	remote  *clusterMessage // From another node of the cluster
+	synced  bool            // The channel's creator has finished asking the cluster who is in it
+}
+
+// newDispatcher creates a dispatcher with n shards, and starts their goroutines, which run until stop is closed.
+// If n is 0 or less, defaultDispatchShards is used.
+func newDispatcher(n int, stop <-chan struct{}) *dispatcher {
+	if n <= 0 {
+		n = defaultDispatchShards
+	}
+	d := &dispatcher{shards: make([]*dispatchShard, n)}
+	for i := range d.shards {
+		shard := &dispatchShard{
+			channels:    make(map[string]*channel),
+			work:        make(chan channelOp, dispatchQueueSize),
+			stop:        stop,
+			remoteReady: make(chan struct{}, 1),
+		}
+		d.shards[i] = shard
+		go shard.run()
+	}
+	return d
+}
+
+// shard gets the shard that owns the named channel.
+func (d *dispatcher) shard(name string) *dispatchShard {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return d.shards[h.Sum32()%uint32(len(d.shards))]
+}
+
+// channel gets the named channel, if it exists.
+func (d *dispatcher) channel(name string) (*channel, bool) {
+	shard := d.shard(name)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	c, ok := shard.channels[name]
+	return c, ok
+}
+
+// send queues an operation for the shard, and reports whether it was queued, which it isn't once the server has shut down.
+func (shard *dispatchShard) send(op channelOp) bool {
+	select {
+	case shard.work <- op:
+		return true
+	case <-shard.stop:
+		return false
+	}
+}
+
+// sendRemote queues an operation from the cluster for the shard, without blocking,
+// and reports whether it was queued. Relayed messages are dropped while clusterQueueSize operations are waiting,
+// but membership changes never are, since the channel would be wrong about who is in it until it next synced.
+func (shard *dispatchShard) sendRemote(op channelOp) bool {
+	shard.remoteLock.Lock()
+	if len(shard.remote) >= clusterQueueSize && op.remote != nil && op.remote.Type == clusterRelay {
+		shard.remoteLock.Unlock()
+		return false
+	}
+	shard.remote = append(shard.remote, op)
+	shard.remoteLock.Unlock()
+	select {
+	case shard.remoteReady <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// takeRemote takes the operations from the cluster waiting to be handled.
+func (shard *dispatchShard) takeRemote() []channelOp {
+	shard.remoteLock.Lock()
+	defer shard.remoteLock.Unlock()
+	ops := shard.remote
+	shard.remote = nil
+	return ops
+}
+
+// awaitShard waits for the response to an operation queued for shard,
+// and reports whether there was one, which there isn't if the server shut down first.
+func awaitShard[T any](shard *dispatchShard, resp <-chan T) (T, bool) {
+	select {
+	case v := <-resp:
+		return v, true
+	case <-shard.stop:
+		var zero T
+		return zero, false
+	}
+}
+
+// dispatch hands an operation to its channel's shard for the client, from handleClient,
+// and reports whether it was queued, which it isn't once the server has shut down.
+// The shard may itself be blocked delivering to this client, whose queue only empties as handleClient handles it,
+// so the client's events are handled while waiting for room in the shard's queue, rather than deadlocking the shard.
+func (c *client) dispatch(op channelOp) bool {
+	shard := op.channel.shard
+	for {
+		select {
+		case shard.work <- op:
+			return true
+		case msg := <-c.events:
+			c.handleEvent(msg)
+		case <-shard.stop:
+			return false
+		}
+	}
+}
+
+// run handles operations for the shard's channels, one at a time, until the server shuts down.
+func (shard *dispatchShard) run() {
+	for {
+		select {
+		case op := <-shard.work:
+			// Operations from the cluster queued before this one, such as the members found by a join's sync, come first.
+			for _, remote := range shard.takeRemote() {
+				remote.handle()
+			}
+			op.handle()
+		case <-shard.remoteReady:
+			for _, remote := range shard.takeRemote() {
+				remote.handle()
+			}
+		case <-shard.stop:
+			return
+		}
+	}
+}
+
+// handle runs the operation on its channel, from the shard's goroutine.
+func (op channelOp) handle() {
+	switch {
+	case op.join != nil:
+		op.channel.handleJoin(*op.join)
+	case op.part != nil:
+		op.channel.handlePart(*op.part)
+	case op.attach != nil:
+		op.channel.handleAttach(*op.attach)
+	case op.msg != nil:
+		op.channel.handleMessage(*op.msg)
+	case op.remote != nil:
+		op.channel.handleRemote(*op.remote)
+	case op.synced:
+		op.channel.syncing = false
+		op.channel.deltas = nil
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	nvclient "github.com/n0ot/nvremoted/pkg/client"
+)
+
+// newTestServer starts a server with opts on a local port, and returns its address.
+// The server is shut down when the test finishes.
+func newTestServer(t *testing.T, opts ...Option) string {
+	t.Helper()
+	opts = append([]Option{WithLogger(NewSlogLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))}, opts...)
+	srv, err := NewServer(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		srv.ServeContext(ctx, listener)
+		close(served)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-served
+	})
+	return listener.Addr().String()
+}
+
+// joinTestChannel connects a client to the server at addr, and waits for it to join channel.
+func joinTestChannel(t *testing.T, addr, channel, connectionType string, timeout time.Duration) *nvclient.Client {
+	t.Helper()
+	c, err := nvclient.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.JoinChannel(channel, connectionType); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.After(timeout)
+	for {
+		select {
+		case event, ok := <-c.Events():
+			if !ok {
+				t.Fatalf("connection closed while joining %s: %v", channel, c.Err())
+			}
+			if err := event.AsError(); err != nil {
+				t.Fatal(err)
+			}
+			if event.Type == "channel_joined" {
+				return c
+			}
+		case <-deadline:
+			t.Fatalf("timed out joining %s", channel)
+		}
+	}
+}
+
+// TestChattyMembersDontStallShard has two members of a channel on a single shard both send as fast as they can,
+// while reading what the other sends. Each member's handleClient blocks handing its messages to the shard,
+// while the shard blocks delivering to the other member's full queue, so neither may wait on the shard
+// without handling its own events. Relaying must keep going, in order, and other channels on the shard must stay usable.
+func TestChattyMembersDontStallShard(t *testing.T) {
+	const messages = 30000
+	addr := newTestServer(t, WithDispatchShards(1), WithQueueSize(4))
+	members := []*nvclient.Client{
+		joinTestChannel(t, addr, "chatty", "master", 5*time.Second),
+		joinTestChannel(t, addr, "chatty", "slave", 5*time.Second),
+	}
+
+	type result struct {
+		received int
+		err      string
+	}
+	results := make(chan result, len(members))
+	var progress atomic.Int64 // Messages received by either member
+	for _, m := range members {
+		go func(m *nvclient.Client) {
+			for seq := 1; seq <= messages; seq++ {
+				if err := m.Send(map[string]interface{}{"type": "chatter", "seq": seq}); err != nil {
+					return
+				}
+			}
+		}(m)
+		go func(m *nvclient.Client) {
+			var res result
+			for event := range m.Events() {
+				if event.Type != "chatter" {
+					continue
+				}
+				var msg struct {
+					Seq int `json:"seq"`
+				}
+				if err := event.Decode(&msg); err != nil {
+					res.err = err.Error()
+					break
+				}
+				if msg.Seq != res.received+1 {
+					res.err = "messages relayed out of order"
+					break
+				}
+				res.received++
+				progress.Add(1)
+				if res.received == messages {
+					break
+				}
+			}
+			results <- res
+		}(m)
+	}
+
+	// Joining another channel on the same shard must not wait for the chatter to finish.
+	time.Sleep(100 * time.Millisecond)
+	joinTestChannel(t, addr, "quiet", "master", 5*time.Second)
+
+	// Relaying is slow under the race detector, so only a lack of progress counts as stalling.
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	var last int64
+	for done := 0; done < len(members); {
+		select {
+		case res := <-results:
+			if res.err != "" {
+				t.Fatal(res.err)
+			}
+			if res.received != messages {
+				t.Fatalf("received %d of %d messages", res.received, messages)
+			}
+			done++
+		case <-ticker.C:
+			n := progress.Load()
+			if n == last {
+				t.Fatalf("relaying stalled after %d messages", n)
+			}
+			last = n
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultDrainRate is how many clients a second are moved off a draining server, if the drain doesn't say.
+	defaultDrainRate = 5
+
+	// drainKickReason is sent to clients moved off a draining server.
+	drainKickReason = "server draining: reconnect to continue on another server"
+
+	// drainPoll is how often a drain that isn't moving clients checks whether the server has emptied.
+	drainPoll = time.Second
+)
+
+// drainState tracks draining the server of its channels.
+type drainState struct {
+	lock    sync.Mutex // Protects everything below, except the atomics
+	since   time.Time  // When the drain started, or zero if the server isn't draining
+	cancel  chan struct{}
+	migrate bool
+	rate    float64
+
+	// active is set while draining, so that channels can't be created.
+	active atomic.Bool
+	// migrated counts the clients moved off the server since the drain started.
+	migrated atomic.Int64
+}
+
+// Drain stops the server from creating channels, so that it can be taken down for maintenance without disrupting anyone.
+// Clients may still join the channels it has, and the readiness endpoint fails, so that load balancers stop sending it clients.
+// If the server is a node of a cluster, it hands the channels it owns over to the other nodes,
+// and if migrate is set, moves its clients to them, by kicking rate of them a second with KickDraining,
+// so that they reconnect, through a load balancer, to another node, and rejoin their channels there.
+// Otherwise, the drain waits for the channels to empty.
+// If rate is 0, 5 clients a second are moved.
+func (srv *Server) Drain(migrate bool, rate float64) error {
+	if migrate && srv.registry.cluster == nil {
+		return errors.New("clients can only be moved to other nodes of a cluster")
+	}
+	if err := notNegative("drain rate", rate); err != nil {
+		return err
+	}
+	if rate == 0 {
+		rate = defaultDrainRate
+	}
+	d := &srv.drain
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.since.IsZero() {
+		return errors.Errorf("already draining since %s", d.since.Format(time.RFC1123))
+	}
+	d.since = time.Now().Round(0)
+	d.cancel = make(chan struct{})
+	d.migrate = migrate
+	d.rate = rate
+	d.migrated.Store(0)
+	d.active.Store(true)
+	srv.registry.cluster.setDraining(true)
+
+	srv.Log.WithFields(Fields{
+		"migrate": migrate,
+		"rate":    rate,
+	}).Warn("Draining")
+	go srv.runDrain(migrate, rate, d.cancel)
+	return nil
+}
+
+// CancelDrain lets the server create channels again, and reports whether it was draining.
+func (srv *Server) CancelDrain() bool {
+	d := &srv.drain
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.since.IsZero() {
+		return false
+	}
+	close(d.cancel)
+	d.since = time.Time{}
+	d.active.Store(false)
+	srv.registry.cluster.setDraining(false)
+	srv.Log.Warn("Drain canceled")
+	return true
+}
+
+// runDrain moves clients off the server, if migrate is set, until it is empty or the drain is canceled.
+func (srv *Server) runDrain(migrate bool, rate float64, cancel <-chan struct{}) {
+	interval := drainPoll
+	if migrate {
+		interval = time.Duration(float64(time.Second) / rate)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	kicked := make(map[uint64]bool) // Kicked clients stay in the registry until they have disconnected.
+	for {
+		select {
+		case <-cancel:
+			return
+		case <-ticker.C:
+		}
+
+		reg := &srv.registry
+		var next *client
+		reg.lock.RLock()
+		left := len(reg.clients)
+		for id, member := range reg.clients {
+			if !kicked[id] && member.client != nil {
+				next = member.client
+				kicked[id] = true
+				break
+			}
+		}
+		reg.lock.RUnlock()
+		if left == 0 {
+			srv.Log.Warn("Drained")
+			return
+		}
+		if migrate && next != nil {
+			next.kick(KickDraining, drainKickReason)
+			srv.drain.migrated.Add(1)
+		}
+	}
+}
+
+// DrainStatus reports the progress of draining the server.
+type DrainStatus struct {
+	// Draining is set if the server is draining, since Since.
+	Draining bool      `json:"draining"`
+	Since    time.Time `json:"since"`
+
+	// Migrate is set if clients are being moved to other nodes, at Rate a second,
+	// and Migrated is how many have been.
+	Migrate  bool    `json:"migrate"`
+	Rate     float64 `json:"rate,omitempty"`
+	Migrated int64   `json:"migrated"`
+
+	// The clients and channels left on the server, and the channels it still owns, if it is a node of a cluster.
+	NumClients    int `json:"num_clients"`
+	NumChannels   int `json:"num_channels"`
+	OwnedChannels int `json:"owned_channels"`
+}
+
+// DrainStatus reports the progress of draining the server.
+func (srv *Server) DrainStatus() DrainStatus {
+	d := &srv.drain
+	d.lock.Lock()
+	status := DrainStatus{
+		Draining: !d.since.IsZero(),
+		Since:    d.since,
+		Migrate:  d.migrate,
+		Migrated: d.migrated.Load(),
+	}
+	if status.Migrate {
+		status.Rate = d.rate
+	}
+	d.lock.Unlock()
+
+	reg := &srv.registry
+	reg.lock.RLock()
+	status.NumClients = len(reg.clients)
+	status.NumChannels = reg.numChannels
+	reg.lock.RUnlock()
+	status.OwnedChannels = reg.cluster.numOwned()
+	return status
+}
+
+// DrainArgs holds the arguments to the drain admin command.
+type DrainArgs struct {
+	// Migrate moves the server's clients to other nodes of its cluster, at Rate a second.
+	Migrate bool    `json:"migrate,omitempty"`
+	Rate    float64 `json:"rate,omitempty"`
+
+	// Cancel lets the server create channels again, instead of draining it.
+	Cancel bool `json:"cancel,omitempty"`
+
+	// Status only reports the progress of the drain.
+	Status bool `json:"status,omitempty"`
+}
+
+func adminDrain(srv *Server, args json.RawMessage) (interface{}, error) {
+	var drainArgs DrainArgs
+	if err := decodeAdminArgs(args, &drainArgs); err != nil {
+		return nil, err
+	}
+	switch {
+	case drainArgs.Status:
+	case drainArgs.Cancel:
+		if !srv.CancelDrain() {
+			return nil, errors.New("the server isn't draining")
+		}
+	default:
+		if err := srv.Drain(drainArgs.Migrate, drainArgs.Rate); err != nil {
+			return nil, err
+		}
+	}
+	return srv.DrainStatus(), nil
+}
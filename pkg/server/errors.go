@@ -0,0 +1,37 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Errors returned by the server's channel and registry operations.
+// Their messages are what clients are sent, so they can be compared with errors.Is,
+// or with the error in a ClientErrorResponse.
+var (
+	// ErrAlreadyInChannel is returned when a client that is already in a channel asks to join or resume one.
+	ErrAlreadyInChannel = errors.New("already in a channel")
+
+	// ErrNotInChannel is returned when a client sends a channel message before joining a channel.
+	ErrNotInChannel = errors.New("not in a channel")
+
+	// ErrChannelHasMaster is returned when joining a channel as a second master is rejected by the MasterReject policy.
+	ErrChannelHasMaster = errors.New("channel already has a master: another computer is already controlling this channel")
+
+	// ErrServerFull is returned when a join is rejected because the server is at its Capacity.
+	ErrServerFull = errors.New("server full: please try again later")
+
+	// ErrCreationLimit is returned when a join would create a channel,
+	// but the client's address has already created as many as the server's CreationLimit allows.
+	// The error returned says which limit was hit, and when the client may try again.
+	ErrCreationLimit = errors.New("too many new channels")
+
+	// ErrShuttingDown is returned when a channel can't be joined because the server is shutting down.
+	ErrShuttingDown = errors.New("server shutting down: channels can't be joined until it restarts")
+
+	// ErrBadPassword is returned when a stats password or token is wrong.
+	ErrBadPassword = errors.New("wrong password")
+)
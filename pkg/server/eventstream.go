@@ -0,0 +1,160 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// eventStreamQueueSize is the number of events that can wait to be sent to each event stream.
+	// A stream whose queue fills up is ended, rather than silently missing events.
+	eventStreamQueueSize = 256
+
+	// eventStreamKeepalive is how often a comment is sent on an idle event stream,
+	// so that proxies don't time it out, and watchers that have gone away are noticed.
+	eventStreamKeepalive = 30 * time.Second
+)
+
+// eventStreams fans events out to everyone watching the admin event stream.
+type eventStreams struct {
+	lock        sync.Mutex // Protects subscribers
+	subscribers map[chan Event]struct{}
+	count       atomic.Int32 // Number of subscribers, so emit can skip the lock when there are none
+}
+
+// watched reports whether anyone is subscribed.
+func (s *eventStreams) watched() bool {
+	return s.count.Load() > 0
+}
+
+// subscribe returns a channel that is sent every event from now on,
+// until unsubscribe is called, or the subscriber falls too far behind, when it is closed.
+func (s *eventStreams) subscribe() chan Event {
+	events := make(chan Event, eventStreamQueueSize)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.subscribers == nil {
+		s.subscribers = make(map[chan Event]struct{})
+	}
+	s.subscribers[events] = struct{}{}
+	s.count.Add(1)
+	return events
+}
+
+// unsubscribe stops sending events to a subscriber, and closes its channel, if that hasn't already happened.
+func (s *eventStreams) unsubscribe(events chan Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.remove(events)
+}
+
+// remove must be called with s.lock held.
+func (s *eventStreams) remove(events chan Event) {
+	if _, ok := s.subscribers[events]; ok {
+		delete(s.subscribers, events)
+		s.count.Add(-1)
+		close(events)
+	}
+}
+
+// publish sends an event to every subscriber, without blocking.
+// Subscribers whose queues are full are removed.
+func (s *eventStreams) publish(e Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for events := range s.subscribers {
+		select {
+		case events <- e:
+		default:
+			s.remove(events)
+		}
+	}
+}
+
+// serveEvents streams events to an admin as server-sent events, until they disconnect.
+// Each event is sent as a data line holding the JSON encoded Event.
+// If the types query parameter is given, only events of those types, separated by commas, are sent.
+// If the watcher can't keep up, an overflow event is sent, and the stream ends;
+// they should reconnect, and list the clients and channels to catch up.
+func (srv *Server) serveEvents(w http.ResponseWriter, r *http.Request, token *Token) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "the event stream must be requested with GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if !token.allows(ScopeList) {
+		http.Error(w, "not allowed: this token's scopes don't allow that request", http.StatusForbidden)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+	var types map[string]bool
+	if list := r.URL.Query().Get("types"); list != "" {
+		types = make(map[string]bool)
+		for _, t := range strings.Split(list, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+
+	reg := &srv.registry
+	events := reg.eventStreams.subscribe()
+	defer reg.eventStreams.unsubscribe(events)
+	log := srv.Log.WithFields(Fields{
+		"remote_addr": r.RemoteAddr,
+		"token":       token.Name,
+	})
+	log.Info("Streaming events")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	// Tell EventSource how long to wait before reconnecting, and get the headers to the watcher now.
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Info("Stopped streaming events")
+			return
+
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case e, ok := <-events:
+			if !ok {
+				log.Warn("Event stream fell behind; ending it")
+				fmt.Fprint(w, "event: overflow\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+			if types != nil && !types[e.Type] {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/pkg/errors"
+)
+
+// messageType is a type of message clients can send, and how it is handled.
+type messageType struct {
+	// factory creates an empty message for the JSON to be unmarshaled into.
+	// It is nil for channel messages, which are any message without a type of its own.
+	factory func() Message
+	handler clientMessageHandlerFunc
+}
+
+// Client is a connected client, as seen by a MessageHandler.
+type Client interface {
+	ID() uint64
+	RemoteHost() string
+
+	// Channel gets the name of the channel the client is in, or "" if it hasn't joined one.
+	Channel() string
+
+	// Send queues a response to be written to the client.
+	Send(resp Message)
+
+	// SendError sends the client an error, without disconnecting it.
+	SendError(reason string)
+
+	// Stop disconnects the client, giving reason in the log.
+	Stop(reason string)
+
+	// Annotations gets the annotations the server's Authenticator attached to the client.
+	Annotations() Annotations
+
+	// ProtocolVersion gets the version of the protocol the client negotiated, or 2 if it didn't.
+	ProtocolVersion() int
+}
+
+// A MessageHandler handles a message received from a client.
+// Messages from a client are handled one at a time, and the next isn't read until the handler returns.
+type MessageHandler func(c Client, msg Message)
+
+// Handle registers a type of message clients can send, replacing any handler already registered for it,
+// including the server's own.
+// factory creates an empty message for each received message to be unmarshaled into,
+// whose Name must be typ.
+// Messages of a registered type are no longer relayed to the sender's channel.
+// Handle must be called before the server starts serving.
+func (srv *Server) Handle(typ string, factory func() Message, handler MessageHandler) error {
+	if typ == "" || typ == "channel_message" {
+		return errors.Errorf("can't handle messages of type %q", typ)
+	}
+	if factory == nil || handler == nil {
+		return errors.Errorf("no factory or handler for messages of type %q", typ)
+	}
+	if name := factory().Name(); name != typ {
+		return errors.Errorf("messages created for type %q are named %q", typ, name)
+	}
+	srv.messageTypes()[typ] = messageType{
+		factory: factory,
+		handler: func(c *client, msg Message) { handler(c, msg) },
+	}
+	return nil
+}
+
+// WithHandler registers a type of message clients can send, as Handle does.
+func WithHandler(typ string, factory func() Message, handler MessageHandler) Option {
+	return func(srv *Server) error {
+		return srv.Handle(typ, factory, handler)
+	}
+}
+
+// A Middleware wraps the handling of every message clients send, including those the server handles itself,
+// and channel messages, whose Name is "channel_message".
+// It may act before or after calling next, or not call it to drop the message.
+// next must be called with the Client the middleware was given.
+type Middleware func(next MessageHandler) MessageHandler
+
+// Use adds middleware, which wraps the handlers of every type of message.
+// The first middleware added sees each message first.
+// Use must be called before the server starts serving.
+func (srv *Server) Use(middleware ...Middleware) {
+	srv.middleware = append(srv.middleware, middleware...)
+}
+
+// WithMiddleware adds middleware, as Use does.
+func WithMiddleware(middleware ...Middleware) Option {
+	return func(srv *Server) error {
+		srv.Use(middleware...)
+		return nil
+	}
+}
+
+// applyMiddleware wraps the handler of every type of message with the server's middleware.
+// It is called once, when the server starts.
+func (srv *Server) applyMiddleware() {
+	if len(srv.middleware) == 0 {
+		return
+	}
+	types := srv.messageTypes()
+	for typ, mt := range types {
+		handler := mt.handler
+		next := MessageHandler(func(c Client, msg Message) { handler(c.(*client), msg) })
+		for i := len(srv.middleware) - 1; i >= 0; i-- {
+			next = srv.middleware[i](next)
+		}
+		mt.handler = func(c *client, msg Message) { next(c, msg) }
+		types[typ] = mt
+	}
+}
+
+// messageTypes gets the types of message the server handles, by type.
+// Until Handle is called, these are the built in types.
+func (srv *Server) messageTypes() map[string]messageType {
+	srv.messageTypesOnce.Do(func() {
+		srv.messageTypesByName = builtinMessageTypes()
+	})
+	return srv.messageTypesByName
+}
+
+// ID gets the client's ID, which is its ID in its channel.
+func (c *client) ID() uint64 {
+	return c.id
+}
+
+// RemoteHost gets the host name of the client, or its address if it has none.
+func (c *client) RemoteHost() string {
+	return c.remoteHost
+}
+
+// Channel gets the name of the client's channel, or "" if it isn't in one.
+func (c *client) Channel() string {
+	if c.channel == nil {
+		return ""
+	}
+	return c.channel.name
+}
+
+// Send queues a response to be written to the client.
+func (c *client) Send(resp Message) {
+	c.send(resp)
+}
+
+// SendError sends the client an error, without disconnecting it.
+func (c *client) SendError(reason string) {
+	c.sendError(reason)
+}
+
+// Stop disconnects the client.
+func (c *client) Stop(reason string) {
+	c.stop(reason)
+}
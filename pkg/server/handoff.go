@@ -0,0 +1,176 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// handoffKickReason is sent to clients still connected when a handoff's drain times out.
+const handoffKickReason = "server restarting"
+
+// boundListener is a listener, and the address or control socket path it was bound for.
+type boundListener struct {
+	addr     string
+	listener net.Listener
+}
+
+// handoffState tracks the server's listeners, so they can be handed off to a replacement server.
+type handoffState struct {
+	lock sync.Mutex // Protects everything below
+
+	// bound lists the listeners the server has bound or inherited.
+	bound []boundListener
+
+	// inherited maps addresses to listeners inherited from a previous server, which haven't been used yet.
+	inherited map[string]net.Listener
+
+	// drained is created when a handoff starts, and closed once the server's connections have drained.
+	drained chan struct{}
+}
+
+// addBound records a listener that can be handed off.
+func (h *handoffState) addBound(addr string, listener net.Listener) {
+	h.lock.Lock()
+	h.bound = append(h.bound, boundListener{addr: addr, listener: listener})
+	h.lock.Unlock()
+}
+
+// inherit takes the listener inherited for addr, if there is one.
+func (h *handoffState) inherit(addr string) net.Listener {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	listener := h.inherited[addr]
+	delete(h.inherited, addr)
+	return listener
+}
+
+// wait waits for connections to drain, if a handoff has started.
+func (h *handoffState) wait() {
+	h.lock.Lock()
+	drained := h.drained
+	h.lock.Unlock()
+	if drained != nil {
+		<-drained
+	}
+}
+
+// ListenerFiles gets duplicates of the server's listening sockets, including its control socket,
+// and the addresses they were bound for, to pass to a replacement server's InheritListeners.
+// The caller should close the files once they have been passed on.
+func (srv *Server) ListenerFiles() ([]*os.File, []string, error) {
+	h := &srv.handoff
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var files []*os.File
+	var addrs []string
+	for _, bound := range h.bound {
+		var file *os.File
+		var err error
+		switch listener := bound.listener.(type) {
+		case *net.TCPListener:
+			file, err = listener.File()
+		case *net.UnixListener:
+			file, err = listener.File()
+		default:
+			err = errors.Errorf("Listener for %s can't be handed off", bound.addr)
+		}
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, nil, errors.Wrap(err, "Get listener file")
+		}
+		files = append(files, file)
+		addrs = append(addrs, bound.addr)
+	}
+	return files, addrs, nil
+}
+
+// InheritListeners adopts listening sockets passed on by a previous server from ListenerFiles.
+// When the server is asked to listen on one of their addresses, it uses the inherited listener instead of binding it again,
+// so no connections are refused while the previous server hands off.
+func (srv *Server) InheritListeners(files []*os.File, addrs []string) error {
+	if len(files) != len(addrs) {
+		return errors.Errorf("Inherited %d listeners, but %d addresses", len(files), len(addrs))
+	}
+	h := &srv.handoff
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.inherited == nil {
+		h.inherited = make(map[string]net.Listener)
+	}
+	for i, file := range files {
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return errors.Wrapf(err, "Inherit listener for %s", addrs[i])
+		}
+		h.inherited[addrs[i]] = listener
+	}
+	return nil
+}
+
+// Handoff stops accepting connections, once a replacement server has inherited the listeners,
+// and waits for the existing connections to end, for up to timeout, before kicking those that remain.
+// Connections already queued on the listeners are accepted by the replacement.
+// Clients are kept apart from those who connect to the replacement until they reconnect,
+// so members of a channel may not hear each other until the drain ends.
+// When it is done, ListenAndServe and the other serving methods return.
+func (srv *Server) Handoff(timeout time.Duration) {
+	h := &srv.handoff
+	h.lock.Lock()
+	if h.drained != nil {
+		h.lock.Unlock()
+		return
+	}
+	h.drained = make(chan struct{})
+	bound := h.bound
+	h.lock.Unlock()
+	defer close(h.drained)
+
+	srv.Log.WithField("timeout", timeout).Warn("Handing off listeners; draining connections")
+	for _, b := range bound {
+		if listener, ok := b.listener.(*net.UnixListener); ok {
+			listener.SetUnlinkOnClose(false) // The replacement serves the socket now.
+		}
+		b.listener.Close()
+	}
+
+	if !srv.waitForConnections(timeout) {
+		srv.Log.Warn("Connections still open after the drain timeout; kicking them")
+		reg := &srv.registry
+		reg.lock.RLock()
+		for _, c := range reg.connected {
+			c.kick(KickShutdown, handoffKickReason)
+		}
+		reg.lock.RUnlock()
+		srv.waitForConnections(shutdownDrainTimeout)
+	}
+	srv.Log.Warn("Handoff complete")
+}
+
+// waitForConnections waits for up to timeout for all connections to end, and reports whether they did.
+func (srv *Server) waitForConnections(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		srv.registry.lock.RLock()
+		remaining := srv.registry.numConnections
+		srv.registry.lock.RUnlock()
+		if remaining == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HealthStatus is reported by the health and readiness endpoints.
+type HealthStatus struct {
+	// Status is "ok", or why the server isn't ready: "not listening", "shutting down", "draining", or "restarting".
+	Status         string   `json:"status"`
+	ListenAddrs    []string `json:"listen_addrs"`
+	NumGoroutines  int      `json:"num_goroutines"`
+	NumConnections int      `json:"num_connections"`
+	NumClients     int      `json:"num_clients"`
+	NumChannels    int      `json:"num_channels"`
+}
+
+// Health reports whether the server is ready to accept clients, along with its size.
+func (srv *Server) Health() HealthStatus {
+	reg := &srv.registry
+	reg.lock.RLock()
+	health := HealthStatus{
+		Status:         "ok",
+		ListenAddrs:    append([]string(nil), reg.listenAddrs...),
+		NumGoroutines:  runtime.NumGoroutine(),
+		NumConnections: reg.numConnections,
+		NumClients:     len(reg.clients),
+		NumChannels:    reg.numChannels,
+	}
+	reg.lock.RUnlock()
+
+	srv.handoff.lock.Lock()
+	handingOff := srv.handoff.drained != nil
+	srv.handoff.lock.Unlock()
+	switch {
+	case handingOff:
+		health.Status = "restarting"
+	case srv.shutdown.draining.Load() || srv.shutdown.closing.Load():
+		health.Status = "shutting down"
+	case srv.drain.active.Load():
+		health.Status = "draining"
+	case len(health.ListenAddrs) == 0:
+		health.Status = "not listening"
+	}
+	return health
+}
+
+// HealthHandler serves /healthz, which answers as long as the server is running,
+// and /readyz, which fails with 503 Service Unavailable unless the server is listening for clients and isn't shutting down.
+// Both respond with a HealthStatus.
+// If srv.Pprof is set, profiles are also served under /debug/pprof/,
+// and if srv.Dashboard is set, the admin dashboard and API under /admin/.
+func (srv *Server) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	if srv.Pprof {
+		mux.Handle("/debug/pprof/", srv.pprofHandler())
+	}
+	if srv.Dashboard {
+		mux.Handle("/admin/", srv.dashboardHandler())
+	}
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, srv.Health())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		health := srv.Health()
+		code := http.StatusOK
+		if health.Status != "ok" {
+			code = http.StatusServiceUnavailable
+		}
+		writeHealth(w, code, health)
+	})
+	return mux
+}
+
+func writeHealth(w http.ResponseWriter, code int, health HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(health)
+}
+
+// ListenAndServeHealth serves the health and readiness endpoints over HTTP on addr,
+// so that load balancers and orchestrators can probe the server without speaking the NVDA Remote protocol.
+// It returns when the server shuts down.
+func (srv *Server) ListenAndServeHealth(addr string) error {
+	listener, err := srv.listen(context.Background(), addr, nil)
+	if err != nil {
+		return err
+	}
+	srv.startOnce.Do(srv.start)
+	srv.shutdown.addListener(listener)
+	srv.Log.WithFields(Fields{
+		"addr": listener.Addr().String(),
+	}).Info("Serving health checks")
+
+	httpServer := &http.Server{
+		Handler:           srv.HealthHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err := httpServer.Serve(listener); !errors.Is(err, net.ErrClosed) {
+		return errors.Wrap(err, "Serve health checks")
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/n0ot/nvremoted/pkg/history"
+	"github.com/pkg/errors"
+)
+
+// defaultHistoryInterval is how often stats are recorded if the server doesn't set an interval.
+const defaultHistoryInterval = 5 * time.Minute
+
+// StatsHistory configures recording the server's stats over time.
+type StatsHistory struct {
+	// File is the database the stats are recorded in. If empty, stats aren't recorded.
+	File string
+
+	// Interval is how often stats are recorded. If 0, they are recorded every 5 minutes.
+	Interval time.Duration
+
+	// Retention is how long recorded stats are kept. If 0, they are kept forever.
+	Retention time.Duration
+}
+
+// recordHistory records the server's stats every srv.History.Interval, until the server shuts down.
+func (srv *Server) recordHistory() {
+	stop := srv.shutdown.done()
+	interval := srv.History.Interval
+	if interval <= 0 {
+		interval = defaultHistoryInterval
+	}
+	store := history.NewStore(srv.History.File)
+	log := srv.Log.WithField("file", srv.History.File)
+	log.WithField("interval", interval).Info("Recording stats history")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-stop:
+			return
+		}
+		reg := &srv.registry
+		reg.lock.RLock()
+		sample := history.Sample{
+			Time:            now,
+			NumClients:      len(reg.clients),
+			NumConnections:  reg.numConnections,
+			NumChannels:     reg.numChannels,
+			BytesReceived:   reg.traffic.bytesReceived.Load(),
+			BytesSent:       reg.traffic.bytesSent.Load(),
+			MessagesRelayed: reg.traffic.messagesRelayed.Load(),
+		}
+		reg.lock.RUnlock()
+		if err := store.Record(sample, srv.History.Retention); err != nil {
+			log.WithFields(Fields{
+				"error": err,
+			}).Error("Error recording stats history")
+		}
+	}
+}
+
+// HistoryArgs holds the arguments to the history admin command.
+type HistoryArgs struct {
+	// Window is how far back to get stats from, parsable by time.ParseDuration.
+	// If empty, all recorded stats are returned.
+	Window string `json:"window,omitempty"`
+}
+
+func adminHistory(srv *Server, args json.RawMessage) (interface{}, error) {
+	if srv.History.File == "" {
+		return nil, errors.New("stats history isn't enabled")
+	}
+	var historyArgs HistoryArgs
+	if len(args) > 0 {
+		if err := decodeAdminArgs(args, &historyArgs); err != nil {
+			return nil, err
+		}
+	}
+	var since time.Time
+	if historyArgs.Window != "" {
+		window, err := time.ParseDuration(historyArgs.Window)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid window")
+		}
+		since = time.Now().Add(-window)
+	}
+	return history.NewStore(srv.History.File).Since(since)
+}
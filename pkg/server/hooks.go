@@ -0,0 +1,67 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+// Hooks are called as clients connect, join channels, and disconnect, and as channels come and go,
+// so embedders can implement their own policies, such as billing or moderation.
+// Any hook may be nil.
+// Hooks are called synchronously, so they should return quickly;
+// a slow OnChannelCreated or OnChannelDestroyed holds up relaying messages over other channels.
+type Hooks struct {
+	// OnClientConnected is called when a client connects, before anything is read from it.
+	OnClientConnected func(c Client)
+
+	// OnClientDisconnected is called once a client has disconnected, and left its channel.
+	OnClientDisconnected func(c Client, reason string)
+
+	// OnChannelCreated is called when a client joins a channel that didn't exist, before it joins.
+	OnChannelCreated func(channel string)
+
+	// OnChannelDestroyed is called when the last member of a channel leaves.
+	OnChannelDestroyed func(channel string)
+
+	// OnJoin is called when a client asks to join a channel, once the server's own policies have allowed it.
+	// If it returns an error, the join is refused, and the client is sent the error and disconnected.
+	OnJoin func(c Client, channel, connectionType string) error
+}
+
+// WithHooks sets the server's hooks.
+func WithHooks(hooks Hooks) Option {
+	return func(srv *Server) error {
+		srv.Hooks = hooks
+		return nil
+	}
+}
+
+func (h *Hooks) clientConnected(c *client) {
+	if h.OnClientConnected != nil {
+		h.OnClientConnected(c)
+	}
+}
+
+func (h *Hooks) clientDisconnected(c *client, reason string) {
+	if h.OnClientDisconnected != nil {
+		h.OnClientDisconnected(c, reason)
+	}
+}
+
+func (h *Hooks) channelCreated(name string) {
+	if h.OnChannelCreated != nil {
+		h.OnChannelCreated(name)
+	}
+}
+
+func (h *Hooks) channelDestroyed(name string) {
+	if h.OnChannelDestroyed != nil {
+		h.OnChannelDestroyed(name)
+	}
+}
+
+func (h *Hooks) join(c *client, channel, connectionType string) error {
+	if h.OnJoin != nil {
+		return h.OnJoin(c, channel, connectionType)
+	}
+	return nil
+}
@@ -0,0 +1,488 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ipListPollInterval is how often the IP list files are checked for changes.
+	ipListPollInterval = 5 * time.Second
+
+	// defaultIPFeedInterval is how often deny feeds are fetched if IPLists doesn't set an interval.
+	defaultIPFeedInterval = time.Hour
+
+	// ipFeedTimeout limits how long fetching a deny feed may take.
+	ipFeedTimeout = 30 * time.Second
+
+	// maxIPFeedSize is the largest deny feed that will be accepted.
+	maxIPFeedSize = 16 << 20
+)
+
+// IPLists names files of IP addresses and networks that may, or may not, connect to the server,
+// and feeds of addresses that may not, such as lists of known abusive ranges.
+// Each line of a file or feed holds an IP address, or a network in CIDR notation.
+// Blank lines, and anything after a # or ;, are ignored.
+// The files are reloaded when they change, so ranges can be blocked without restarting.
+type IPLists struct {
+	// AllowFile lists the only addresses that may connect.
+	// If empty, any address that isn't denied may connect.
+	AllowFile string
+
+	// DenyFile lists addresses that may not connect, even if AllowFile allows them.
+	DenyFile string
+
+	// DenyURLs are HTTPS URLs of feeds listing more addresses that may not connect.
+	// They are fetched when the server starts, then every FeedInterval, or every hour if it is 0.
+	// A feed that can't be fetched keeps the addresses it last listed.
+	DenyURLs     []string
+	FeedInterval time.Duration
+}
+
+// WithIPLists only lets addresses allowed by lists.AllowFile, and not denied by lists.DenyFile or any of lists.DenyURLs, connect.
+// The files are read straight away, so that a missing or invalid file is caught before the server starts,
+// but the feeds aren't fetched until it starts.
+func WithIPLists(lists IPLists) Option {
+	return func(srv *Server) error {
+		for _, rawURL := range lists.DenyURLs {
+			u, err := url.Parse(rawURL)
+			if err != nil {
+				return errors.Wrap(err, "invalid deny feed URL")
+			}
+			if u.Scheme != "https" {
+				return errors.Errorf("deny feed URL must use https, not %q", u.Scheme)
+			}
+		}
+		if err := notNegative("deny feed interval", lists.FeedInterval); err != nil {
+			return err
+		}
+		srv.IPLists = lists
+		filter, err := newIPFilter(lists)
+		if err != nil {
+			return err
+		}
+		srv.ipFilter = filter
+		return nil
+	}
+}
+
+// ipList holds the networks listed in a file.
+type ipList struct {
+	file     string
+	modTime  time.Time
+	networks int // The number of networks listed
+	ranges   ipRanges
+}
+
+// loadIPList reads the networks listed in file.
+func loadIPList(file string) (*ipList, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "Read IP list")
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "Read IP list")
+	}
+	networks, err := parseIPList(f, file)
+	if err != nil {
+		return nil, err
+	}
+	return &ipList{file: file, modTime: info.ModTime(), networks: len(networks), ranges: newIPRanges(networks)}, nil
+}
+
+// parseIPList parses the networks listed one per line by r, which name describes in errors.
+func parseIPList(r io.Reader, name string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry, _, _ := strings.Cut(scanner.Text(), "#")
+		entry, _, _ = strings.Cut(entry, ";")
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		network, err := parseBanAddr(entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s, line %d", name, line)
+		}
+		networks = append(networks, network)
+	}
+	return networks, errors.Wrapf(scanner.Err(), "Read %s", name)
+}
+
+// ipRanges holds a set of networks as sorted, non-overlapping ranges of addresses,
+// so that looking up an address takes a binary search, however many networks a list or feed has.
+type ipRanges []ipRange
+
+// ipRange is the addresses from first to last, inclusive.
+type ipRange struct {
+	first, last netip.Addr
+}
+
+// newIPRanges gets the ranges covered by networks, merging those that overlap or adjoin.
+// IPv4 networks written as IPv6 addresses are taken as IPv4, as net.IPNet's Contains takes them.
+func newIPRanges(networks []*net.IPNet) ipRanges {
+	ranges := make(ipRanges, 0, len(networks))
+	for _, network := range networks {
+		addr, ok := netip.AddrFromSlice(network.IP)
+		if !ok {
+			continue
+		}
+		ones, _ := network.Mask.Size()
+		if addr.Is4In6() {
+			addr, ones = addr.Unmap(), max(ones-96, 0)
+		}
+		prefix, err := addr.Prefix(ones)
+		if err != nil {
+			continue
+		}
+		ranges = append(ranges, ipRange{first: prefix.Addr(), last: lastAddr(prefix)})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].first.Less(ranges[j].first) })
+
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 {
+			prev := &merged[n-1]
+			if r.first.Compare(prev.last) <= 0 || r.first == prev.last.Next() {
+				if prev.last.Less(r.last) {
+					prev.last = r.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// lastAddr gets the last address in prefix, which must be masked.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(b)*8; bit++ {
+		b[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// contains reports whether ip is in any of the ranges.
+func (r ipRanges) contains(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	// The range ip is in, if any, is the last to start at or before it.
+	i := sort.Search(len(r), func(i int) bool { return addr.Less(r[i].first) })
+	return i > 0 && addr.Compare(r[i-1].last) <= 0
+}
+
+// changed reports whether the list's file has been modified since it was loaded, and when it was.
+func (l *ipList) changed() (bool, time.Time, error) {
+	info, err := os.Stat(l.file)
+	if err != nil {
+		return false, time.Time{}, errors.Wrap(err, "Check IP list")
+	}
+	return !info.ModTime().Equal(l.modTime), info.ModTime(), nil
+}
+
+// ipFeed holds the networks listed by a deny feed.
+type ipFeed struct {
+	url    string
+	ranges ipRanges // Protected by the ipFilter's lock
+
+	// etag and lastModified are from the last successful fetch, so an unchanged feed isn't downloaded again.
+	etag, lastModified string
+
+	rejected atomic.Int64 // Number of connections rejected by the feed
+}
+
+// fetch fetches the feed, returning its networks, and whether they may have changed since the last fetch.
+func (feed *ipFeed) fetch(ctx context.Context, client *http.Client) ([]*net.IPNet, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feed.url, nil)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "Fetch deny feed")
+	}
+	if feed.etag != "" {
+		req.Header.Set("If-None-Match", feed.etag)
+	}
+	if feed.lastModified != "" {
+		req.Header.Set("If-Modified-Since", feed.lastModified)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "Fetch deny feed")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, false, nil
+	case http.StatusOK:
+	default:
+		return nil, false, errors.Errorf("Fetch deny feed: %s", resp.Status)
+	}
+
+	body := &io.LimitedReader{R: resp.Body, N: maxIPFeedSize + 1}
+	networks, err := parseIPList(body, feed.url)
+	if body.N <= 0 {
+		return nil, false, errors.Errorf("Fetch deny feed: larger than %d bytes", maxIPFeedSize)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	feed.etag = resp.Header.Get("ETag")
+	feed.lastModified = resp.Header.Get("Last-Modified")
+	return networks, true, nil
+}
+
+// ipFilter decides which addresses may connect, by an allowlist, a denylist and deny feeds.
+// Its methods are safe to use concurrently.
+type ipFilter struct {
+	lists IPLists
+	feeds []*ipFeed
+
+	lock   sync.RWMutex // Protects everything below, and the feeds' networks
+	loaded bool         // false if the lists have never loaded, in which case no address is allowed
+	allow  *ipList      // nil if every address not denied is allowed
+	deny   *ipList
+
+	// Number of connections rejected by the allowlist and denylist
+	allowRejected atomic.Int64
+	denyRejected  atomic.Int64
+}
+
+// newIPFilter creates an ipFilter from the files in lists, with feeds that are empty until fetched.
+// If a file can't be loaded, the error is returned along with a filter that allows no addresses until reload succeeds.
+func newIPFilter(lists IPLists) (*ipFilter, error) {
+	filter := &ipFilter{lists: lists}
+	for _, u := range lists.DenyURLs {
+		filter.feeds = append(filter.feeds, &ipFeed{url: u})
+	}
+	allow, deny, err := loadIPLists(lists)
+	if err != nil {
+		return filter, err
+	}
+	filter.loaded, filter.allow, filter.deny = true, allow, deny
+	return filter, nil
+}
+
+// loadIPLists loads the files in lists, giving nil for those that aren't set.
+func loadIPLists(lists IPLists) (allow, deny *ipList, err error) {
+	if lists.AllowFile != "" {
+		if allow, err = loadIPList(lists.AllowFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	if lists.DenyFile != "" {
+		if deny, err = loadIPList(lists.DenyFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	return allow, deny, nil
+}
+
+// allowed reports whether connections from ip may be served, counting the rejection against the list that denied it if not.
+func (f *ipFilter) allowed(ip net.IP) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if !f.loaded || f.allow != nil && !f.allow.ranges.contains(ip) {
+		f.allowRejected.Add(1)
+		return false
+	}
+	if f.deny != nil && f.deny.ranges.contains(ip) {
+		f.denyRejected.Add(1)
+		return false
+	}
+	for _, feed := range f.feeds {
+		if feed.ranges.contains(ip) {
+			feed.rejected.Add(1)
+			return false
+		}
+	}
+	return true
+}
+
+// reload reloads the lists whose files have changed, passing each one reloaded to reloaded, and each error to onError.
+// A list that can't be reloaded stays as it was, so that a mistake in a file never lets everyone in, or locks everyone out.
+func (f *ipFilter) reload(reloaded func(list *ipList), onError func(err error)) {
+	f.lock.RLock()
+	loaded := f.loaded
+	f.lock.RUnlock()
+	if !loaded {
+		allow, deny, err := loadIPLists(f.lists)
+		if err != nil {
+			onError(err)
+			return
+		}
+		f.lock.Lock()
+		f.loaded, f.allow, f.deny = true, allow, deny
+		f.lock.Unlock()
+		for _, list := range []*ipList{allow, deny} {
+			if list != nil {
+				reloaded(list)
+			}
+		}
+		return
+	}
+
+	for _, current := range []**ipList{&f.allow, &f.deny} {
+		f.lock.RLock()
+		list := *current
+		f.lock.RUnlock()
+		if list == nil {
+			continue
+		}
+		changed, modTime, err := list.changed()
+		if err != nil {
+			onError(err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		next, err := loadIPList(list.file)
+		if err != nil {
+			onError(err)
+			// Keep the previous networks, but don't complain again until the file is edited.
+			kept := *list
+			kept.modTime = modTime
+			next = &kept
+		}
+		f.lock.Lock()
+		*current = next
+		f.lock.Unlock()
+		if err == nil {
+			reloaded(next)
+		}
+	}
+}
+
+// fetchFeeds fetches the deny feeds, passing each one that changed to fetched, and each error to onError.
+func (f *ipFilter) fetchFeeds(ctx context.Context, client *http.Client, fetched func(url string, networks int), onError func(url string, err error)) {
+	for _, feed := range f.feeds {
+		networks, changed, err := feed.fetch(ctx, client)
+		if err != nil {
+			onError(feed.url, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		// The feed's ranges are built before taking the lock, so that a large feed doesn't hold up connections.
+		ranges := newIPRanges(networks)
+		f.lock.Lock()
+		feed.ranges = ranges
+		f.lock.Unlock()
+		fetched(feed.url, len(networks))
+	}
+}
+
+// numRejected gets the number of connections rejected by the lists and feeds.
+func (f *ipFilter) numRejected() int64 {
+	var rejected int64
+	for _, n := range f.rejectedBySource() {
+		rejected += n
+	}
+	return rejected
+}
+
+// rejectedBySource gets the number of connections rejected by each of the allowlist, the denylist, and the feeds, by URL.
+func (f *ipFilter) rejectedBySource() map[string]int64 {
+	if f == nil {
+		return nil
+	}
+	rejected := map[string]int64{
+		"allowlist": f.allowRejected.Load(),
+		"denylist":  f.denyRejected.Load(),
+	}
+	for _, feed := range f.feeds {
+		rejected[feed.url] = feed.rejected.Load()
+	}
+	return rejected
+}
+
+// watchIPLists reloads the IP lists whenever their files change, until the server shuts down.
+func (srv *Server) watchIPLists(filter *ipFilter) {
+	stop := srv.shutdown.done()
+	ticker := time.NewTicker(ipListPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		filter.reload(func(list *ipList) {
+			srv.Log.WithFields(Fields{
+				"file":     list.file,
+				"networks": list.networks,
+			}).Info("Reloaded IP list")
+		}, func(err error) {
+			srv.Log.WithField("error", err).Warn("Error reloading IP list; still using the previous list")
+		})
+	}
+}
+
+// fetchIPFeeds fetches the deny feeds straight away, then every srv.IPLists.FeedInterval, until the server shuts down.
+func (srv *Server) fetchIPFeeds(filter *ipFilter) {
+	// Fetches in progress are cancelled by the shutdown too.
+	stop := srv.shutdown.done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	interval := srv.IPLists.FeedInterval
+	if interval <= 0 {
+		interval = defaultIPFeedInterval
+	}
+	client := &http.Client{Timeout: ipFeedTimeout}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		filter.fetchFeeds(ctx, client, func(url string, networks int) {
+			srv.Log.WithFields(Fields{
+				"url":      url,
+				"networks": networks,
+			}).Info("Fetched deny feed")
+		}, func(url string, err error) {
+			srv.Log.WithFields(Fields{
+				"url":   url,
+				"error": err,
+			}).Warn("Error fetching deny feed; still using what it last listed")
+		})
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"math/rand/v2"
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestIPRangesMatchNetworks checks that looking addresses up in ipRanges gives the same answers as checking each network in turn.
+func TestIPRangesMatchNetworks(t *testing.T) {
+	list := `
+		10.0.0.0/8
+		10.1.0.0/16 # Inside the last
+		192.0.2.0/25
+		192.0.2.128/25 ; Adjoins the last
+		198.51.100.7
+		255.255.255.0/24
+		2001:db8::/32
+		2001:db8:1::/48
+		::ffff:203.0.113.0/120
+		ffff::/16
+	`
+	networks, err := parseIPList(strings.NewReader(list), "test list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Random networks, mostly in a few small ranges, so that they overlap.
+	rnd := rand.New(rand.NewPCG(1, 2))
+	for i := 0; i < 500; i++ {
+		mask := net.CIDRMask(24+rnd.IntN(9), 32)
+		ip := net.IPv4(100, 64, byte(rnd.IntN(4)), byte(rnd.IntN(256))).To4()
+		networks = append(networks, &net.IPNet{IP: ip.Mask(mask), Mask: mask})
+	}
+	ranges := newIPRanges(networks)
+
+	addrs := []string{
+		"9.255.255.255", "10.0.0.0", "10.1.2.3", "10.255.255.255", "11.0.0.0",
+		"192.0.1.255", "192.0.2.0", "192.0.2.127", "192.0.2.128", "192.0.2.255", "192.0.3.0",
+		"198.51.100.6", "198.51.100.7", "198.51.100.8",
+		"255.255.254.255", "255.255.255.255",
+		"2001:db7:ffff:ffff:ffff:ffff:ffff:ffff", "2001:db8::", "2001:db8:1::1", "2001:db9::",
+		"203.0.113.5", "::ffff:203.0.113.5", "::1", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff",
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		ips = append(ips, net.ParseIP(addr))
+	}
+	for i := 0; i < 5000; i++ {
+		ips = append(ips, net.IPv4(100, 64, byte(rnd.IntN(5)), byte(rnd.IntN(256))))
+	}
+
+	for _, ip := range ips {
+		want := false
+		for _, network := range networks {
+			if network.Contains(ip) {
+				want = true
+				break
+			}
+		}
+		if got := ranges.contains(ip); got != want {
+			t.Errorf("contains(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	if len(ranges) >= len(networks) {
+		t.Errorf("%d networks gave %d ranges; overlapping networks weren't merged", len(networks), len(ranges))
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultKickReason is sent to clients kicked by an administrator who didn't give a reason.
+const defaultKickReason = "kicked by an administrator"
+
+// KickCode is a machine-readable reason the server disconnected a client, sent in a kick response.
+type KickCode string
+
+// Reasons the server disconnects clients.
+const (
+	// KickTimeout is for clients that sent nothing for too long.
+	KickTimeout KickCode = "timeout"
+
+	// KickProtocolError is for clients that sent something the server couldn't make sense of, or didn't expect.
+	KickProtocolError KickCode = "protocol_error"
+
+	// KickBanned is for connections from banned addresses.
+	KickBanned KickCode = "banned"
+
+	// KickShutdown is for clients connected when the server shuts down or restarts, or that try to join a channel while it is.
+	KickShutdown KickCode = "shutdown"
+
+	// KickDraining is for clients moved off a draining server, or that try to create a channel on it.
+	// They can reconnect to another server of its cluster.
+	KickDraining KickCode = "draining"
+
+	// KickQuota is for members of channels that used up their bandwidth quota.
+	KickQuota KickCode = "quota"
+
+	// KickServerFull is for connections and joins turned away because the server is at its capacity.
+	KickServerFull KickCode = "server_full"
+
+	// KickRateLimit is for clients that sent messages faster than the rate limit for too long,
+	// and joins that would create a channel over the creation limit.
+	KickRateLimit KickCode = "rate_limit"
+
+	// KickUnauthorized is for clients that failed authentication, or gave a wrong password.
+	KickUnauthorized KickCode = "unauthorized"
+
+	// KickRefused is for clients whose join the server's policies refused, such as a blocked channel.
+	KickRefused KickCode = "refused"
+
+	// KickDisplaced is for masters displaced by a new master joining their channel.
+	KickDisplaced KickCode = "displaced"
+
+	// KickSlow is for clients that didn't keep up with their channel.
+	KickSlow KickCode = "too_slow"
+
+	// KickAdmin is for clients kicked by an administrator.
+	KickAdmin KickCode = "kicked"
+
+	// KickRequestFailed is for stats and admin requests that failed.
+	KickRequestFailed KickCode = "request_failed"
+
+	// KickInternalError is for clients the server failed to serve.
+	KickInternalError KickCode = "internal_error"
+)
+
+// ClientKickResponse tells a client why it is being disconnected, just before the server closes its connection.
+type ClientKickResponse struct {
+	Type   string   `json:"type"`
+	Code   KickCode `json:"code"`
+	Reason string   `json:"reason"`
+}
+
+// Name gets this ClientKickResponse's name.
+func (ClientKickResponse) Name() string {
+	return "kick"
+}
+
+// kickResponses gets the responses telling a client speaking this version of the protocol why it is being disconnected.
+func (p *protocol) kickResponses(code KickCode, reason string) []Message {
+	kick := ClientKickResponse{
+		Type:   "kick",
+		Code:   code,
+		Reason: reason,
+	}
+	if p.kickOnly {
+		return []Message{kick}
+	}
+	return []Message{ClientErrorResponse{Type: "error", Error: reason}, kick}
+}
+
+// sendKick tells the client why it is being disconnected; the caller then stops it.
+func (c *client) sendKick(code KickCode, reason string) {
+	if code == KickProtocolError {
+		c.protocolViolation(reason)
+	}
+	for _, resp := range c.protocol.kickResponses(code, reason) {
+		c.send(resp)
+	}
+}
+
+// KickArgs holds the arguments to the kick admin command.
+// Exactly one of ID and Addr must be given.
+type KickArgs struct {
+	ID *uint64 `json:"id,omitempty"`
+	// Addr is an IP address, or a network in CIDR notation; all clients connected from it are kicked.
+	Addr   string `json:"addr,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// KickResult lists the IDs of the clients kicked by the kick admin command.
+type KickResult struct {
+	Kicked []uint64 `json:"kicked"`
+}
+
+// kick disconnects the client with an error explaining why, discarding anything still queued for it.
+// It doesn't block; if the queue refills before the kick can be queued, the client is disconnected without being told why.
+// The client must not have been torn down yet, which holding the registry lock while it's in connected ensures.
+// In privacy mode, addresses in the reason aren't recorded in the client's span.
+func (c *client) kick(code KickCode, reason string) {
+	spanReason := reason
+	if c.registry.privacy {
+		spanReason = redactIPs(reason)
+	}
+	c.span.AddEvent("kicked", trace.WithAttributes(
+		attribute.String("nvremoted.kick.code", string(code)),
+		attribute.String("nvremoted.kick.reason", spanReason),
+	))
+	for len(c.events) > 0 {
+		select {
+		case <-c.events:
+		default:
+		}
+	}
+	select {
+	case c.events <- kickMessage{code: code, reason: reason}:
+	default:
+		c.stop(reason)
+		c.conn.Close() // Unblock any write in progress, rather than waiting for it to time out
+	}
+}
+
+func adminKick(srv *Server, args json.RawMessage) (interface{}, error) {
+	var kickArgs KickArgs
+	if err := decodeAdminArgs(args, &kickArgs); err != nil {
+		return nil, err
+	}
+	if (kickArgs.ID == nil) == (kickArgs.Addr == "") {
+		return nil, errors.New("either a client ID or an address must be given")
+	}
+	var network *net.IPNet
+	if kickArgs.Addr != "" {
+		var err error
+		if network, err = parseBanAddr(kickArgs.Addr); err != nil {
+			return nil, err
+		}
+	}
+	reason := kickArgs.Reason
+	if reason == "" {
+		reason = defaultKickReason
+	}
+
+	result := KickResult{Kicked: []uint64{}}
+	reg := &srv.registry
+	reg.lock.RLock()
+	for id, c := range reg.connected {
+		if c.admin.Load() || kickArgs.ID != nil && id != *kickArgs.ID {
+			continue
+		}
+		if network != nil {
+			if ip := addrIP(c.addr); ip == nil || !network.Contains(ip) {
+				continue
+			}
+		}
+		c.kick(KickAdmin, reason)
+		result.Kicked = append(result.Kicked, id)
+		c.log.WithFields(Fields{
+			"id":     id,
+			"reason": reason,
+		}).Info("Client kicked by an administrator")
+		reg.emit(Event{Type: EventClientKicked, Client: c.eventClient(), Reason: reason})
+	}
+	reg.lock.RUnlock()
+	sort.Slice(result.Kicked, func(i, j int) bool { return result.Kicked[i] < result.Kicked[j] })
+
+	if len(result.Kicked) == 0 {
+		if kickArgs.ID != nil {
+			return nil, errors.Errorf("no client with ID %d is connected", *kickArgs.ID)
+		}
+		return nil, errors.Errorf("no clients are connected from %s", kickArgs.Addr)
+	}
+	return result, nil
+}
@@ -0,0 +1,142 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stallingConn is a connection from a client that records what is written to it,
+// and holds up the first write that ends part way through a line until released.
+type stallingConn struct {
+	net.Conn
+	lock    sync.Mutex
+	written []byte
+	stalled chan struct{} // Closed once a write has stalled
+	release chan struct{}
+}
+
+func (c *stallingConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	c.written = append(c.written, b...)
+	stall := len(b) > 0 && b[len(b)-1] != '\n'
+	select {
+	case <-c.stalled:
+		stall = false
+	default:
+		if stall {
+			close(c.stalled)
+		}
+	}
+	c.lock.Unlock()
+	if stall {
+		<-c.release
+	}
+	return len(b), nil
+}
+
+func (c *stallingConn) output() []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return bytes.Clone(c.written)
+}
+
+func (c *stallingConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 6837}
+}
+func (c *stallingConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 40000}
+}
+
+// waitForOutput waits for the server to write want to conn.
+func waitForOutput(t *testing.T, conn *stallingConn, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(string(conn.output()), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never sent", want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestKickWaitsForWholeLines kicks a client for a malformed message while a write to it has stopped part way through a line,
+// and checks that the kick doesn't land in the middle of that line.
+func TestKickWaitsForWholeLines(t *testing.T) {
+	srv, err := NewServer(WithLogger(NewSlogLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		srv.ServeContext(ctx, listener)
+		close(served)
+	}()
+	defer func() {
+		cancel()
+		<-served
+	}()
+
+	serverEnd, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+	conn := &stallingConn{Conn: serverEnd, stalled: make(chan struct{}), release: make(chan struct{})}
+	disconnected := make(chan struct{})
+	go func() {
+		srv.ServeConn(conn)
+		close(disconnected)
+	}()
+	io.WriteString(clientEnd, `{"type": "protocol_version", "version": 2}`+"\n"+`{"type": "join", "channel": "large", "connection_type": "slave"}`+"\n")
+	waitForOutput(t, conn, `"channel_joined"`)
+	sender := joinTestChannel(t, listener.Addr().String(), "large", "master", 5*time.Second)
+	waitForOutput(t, conn, `"client_joined"`)
+
+	// Messages too large for the output buffer to hold two of are split across flushes.
+	text := strings.Repeat("x", 3000)
+	for i := 0; i < 20; i++ {
+		if err := sender.Send(map[string]interface{}{"type": "speak", "text": text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-conn.stalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no write ended part way through a line")
+	}
+	go io.WriteString(clientEnd, "{malformed\n")
+	time.Sleep(100 * time.Millisecond)
+	close(conn.release)
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client wasn't kicked")
+	}
+
+	var last map[string]interface{}
+	for _, line := range bytes.SplitAfter(conn.output(), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(line, &last); err != nil {
+			t.Fatalf("received a corrupt line of %d bytes: %v", len(line), err)
+		}
+	}
+	if last["type"] != "kick" || last["code"] != string(KickProtocolError) {
+		t.Errorf("last message was %v, want a protocol error kick", last)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ClientPingResponse pings a client speaking a version of the protocol that answers pings,
+// so that the server can measure its round trip time.
+// The client answers with a pong message giving the same timestamp.
+type ClientPingResponse struct {
+	Type string `json:"type"`
+	// Timestamp is when the ping was sent, in nanoseconds since the Unix epoch.
+	// Clients shouldn't interpret it; it only needs to be echoed back.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// Name gets this ClientPingResponse's name.
+func (ClientPingResponse) Name() string {
+	return "ping"
+}
+
+// ClientPongMessage is received when a client answers a ping.
+type ClientPongMessage struct {
+	GenericClientMessage
+	Timestamp int64 `json:"timestamp"`
+}
+
+// Name gets this ClientPongMessage's name.
+func (ClientPongMessage) Name() string {
+	return "pong"
+}
+
+// handleClientPong measures the round trip time of the client's last ping.
+// Pongs for older pings, and timestamps the server never sent, are ignored,
+// so that a client can't make its latency look other than it is.
+func handleClientPong(c *client, msg Message) {
+	pong := msg.(*ClientPongMessage)
+	if c.pingSent.IsZero() || pong.Timestamp != c.pingSent.UnixNano() {
+		return
+	}
+	c.rtt.record(time.Since(c.pingSent))
+	c.pingSent = time.Time{}
+}
+
+// rttStats summarizes the round trip times measured for a client.
+// Its methods are safe to use concurrently.
+type rttStats struct {
+	count atomic.Int64
+	total atomic.Int64
+	max   atomic.Int64
+}
+
+// record adds a round trip time.
+func (s *rttStats) record(rtt time.Duration) {
+	s.count.Add(1)
+	s.total.Add(int64(rtt))
+	for {
+		prev := s.max.Load()
+		if int64(rtt) <= prev || s.max.CompareAndSwap(prev, int64(rtt)) {
+			return
+		}
+	}
+}
+
+// avg gets the average round trip time, or 0 if none have been measured.
+func (s *rttStats) avg() time.Duration {
+	count := s.count.Load()
+	if count == 0 {
+		return 0
+	}
+	return time.Duration(s.total.Load() / count)
+}
+
+// LatencyStats summarizes the round trip times of connected clients whose latency is measured,
+// which are those speaking a version of the protocol that answers pings.
+// Percentiles are of the clients' average round trip times.
+type LatencyStats struct {
+	Clients int           `json:"clients"`
+	P50     time.Duration `json:"p50"`
+	P90     time.Duration `json:"p90"`
+	P99     time.Duration `json:"p99"`
+	Max     time.Duration `json:"max"`
+}
+
+// latencyStats gets latency stats. The registry must be locked for reading.
+func (reg *registry) latencyStats() LatencyStats {
+	var avgs []time.Duration
+	var stats LatencyStats
+	for _, c := range reg.connected {
+		if avg := c.rtt.avg(); avg > 0 {
+			avgs = append(avgs, avg)
+			stats.Max = max(stats.Max, time.Duration(c.rtt.max.Load()))
+		}
+	}
+	if len(avgs) == 0 {
+		return stats
+	}
+	sort.Slice(avgs, func(i, j int) bool { return avgs[i] < avgs[j] })
+	percentile := func(p int) time.Duration {
+		// Nearest rank, so that every percentile is an average some client actually has.
+		return avgs[(p*len(avgs)+99)/100-1]
+	}
+	stats.Clients = len(avgs)
+	stats.P50 = percentile(50)
+	stats.P90 = percentile(90)
+	stats.P99 = percentile(99)
+	return stats
+}
@@ -0,0 +1,141 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// ClientInfo describes a connected client, for the clients admin command.
+type ClientInfo struct {
+	ID         uint64    `json:"id"`
+	RemoteHost string    `json:"remote_host"`
+	Connected  time.Time `json:"connected"`
+	// CorrelationID identifies the client's connection in the server's logs.
+	CorrelationID string `json:"correlation_id"`
+	// LastActive is when the client last sent a message, or zero if it hasn't sent any.
+	LastActive time.Time `json:"last_active,omitempty"`
+
+	// Channel and ConnectionType are empty if the client hasn't joined a channel.
+	Channel        string `json:"channel,omitempty"`
+	ConnectionType string `json:"connection_type,omitempty"`
+
+	// Annotations were attached by the server's Authenticator.
+	Annotations Annotations `json:"annotations,omitempty"`
+
+	// LimitViolations is the number of messages the client sent over the server's message limits.
+	LimitViolations int64 `json:"limit_violations,omitempty"`
+
+	// AvgRTT and MaxRTT are the client's average and highest round trip times,
+	// if it speaks a version of the protocol that answers pings, and has answered any.
+	AvgRTT time.Duration `json:"avg_rtt,omitempty"`
+	MaxRTT time.Duration `json:"max_rtt,omitempty"`
+}
+
+// ChannelInfo describes an active channel, for the channels admin command.
+type ChannelInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	E2e     bool      `json:"e2e"`
+
+	// Members counts the channel's members by connection type, such as "master" or "slave".
+	Members map[string]int `json:"members"`
+
+	// HourBytes and DayBytes are the bytes sent to the channel's members this hour and today, counted against its quota.
+	HourBytes int64 `json:"hour_bytes"`
+	DayBytes  int64 `json:"day_bytes"`
+}
+
+// Clients lists the connected clients, ordered by ID.
+// Connections making admin requests, including the one asking, aren't listed.
+func (srv *Server) Clients() []ClientInfo {
+	reg := &srv.registry
+	reg.lock.RLock()
+	clients := make([]ClientInfo, 0, len(reg.connected))
+	for id, c := range reg.connected {
+		if c.admin.Load() {
+			continue
+		}
+		info := ClientInfo{
+			ID:         id,
+			RemoteHost: c.remoteHost,
+			Connected:  c.connected.Round(0),
+
+			CorrelationID: c.correlationID,
+
+			LimitViolations: c.limitViolations.Load(),
+
+			AvgRTT: c.rtt.avg(),
+			MaxRTT: time.Duration(c.rtt.max.Load()),
+		}
+		if lastActive := c.lastActive.Load(); lastActive != 0 {
+			info.LastActive = time.Unix(0, lastActive)
+		}
+		if len(c.annotations) > 0 {
+			info.Annotations = make(Annotations, len(c.annotations))
+			for k, v := range c.annotations {
+				info.Annotations[k] = v
+			}
+		}
+		if member, ok := reg.clients[id]; ok {
+			info.Channel = member.channel
+			info.ConnectionType = member.connectionType
+		}
+		clients = append(clients, info)
+	}
+	reg.lock.RUnlock()
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients
+}
+
+// Channels lists the active channels, ordered by name.
+func (srv *Server) Channels() []ChannelInfo {
+	// Shards lock the registry while holding their own lock, so the channels are gathered before locking the registry.
+	channels := []ChannelInfo{}
+	byName := make(map[string]*ChannelInfo)
+	for _, shard := range srv.registry.dispatcher.shards {
+		shard.lock.Lock()
+		for name, c := range shard.channels {
+			channels = append(channels, ChannelInfo{
+				Name:    name,
+				Created: c.created.Round(0),
+				E2e:     c.isE2e(),
+				Members: make(map[string]int),
+				// Bytes sent since quota usage was last counted; the rest is added below.
+				HourBytes: c.traffic.bytesSent.Load() - c.quotaCounted,
+			})
+		}
+		shard.lock.Unlock()
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	now := time.Now()
+	for i := range channels {
+		byName[channels[i].Name] = &channels[i]
+		pending := channels[i].HourBytes
+		hour, day := srv.registry.quotas.current(channels[i].Name, now)
+		channels[i].HourBytes, channels[i].DayBytes = hour+pending, day+pending
+	}
+
+	reg := &srv.registry
+	reg.lock.RLock()
+	for _, member := range reg.clients {
+		if info := byName[member.channel]; info != nil {
+			info.Members[member.connectionType]++
+		}
+	}
+	reg.lock.RUnlock()
+	return channels
+}
+
+func adminClients(srv *Server, args json.RawMessage) (interface{}, error) {
+	return srv.Clients(), nil
+}
+
+func adminChannels(srv *Server, args json.RawMessage) (interface{}, error) {
+	return srv.Channels(), nil
+}
@@ -0,0 +1,139 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// lockoutFreeFailures is the number of wrong stats passwords an address may give before it is locked out.
+	lockoutFreeFailures = 3
+
+	// lockoutBaseDelay is how long an address is locked out after its first failure past lockoutFreeFailures.
+	// Each further failure doubles it, up to lockoutMaxDelay.
+	lockoutBaseDelay = 5 * time.Second
+	lockoutMaxDelay  = time.Hour
+
+	// lockoutBanFailures is the number of wrong stats passwords after which an address is banned for lockoutBanDuration.
+	lockoutBanFailures = 10
+	lockoutBanDuration = 24 * time.Hour
+
+	// lockoutForget is how long after its last failure an address's failures are forgotten.
+	lockoutForget = 24 * time.Hour
+)
+
+// passwordLockout counts wrong stats passwords from each address, and locks out those that keep guessing,
+// without holding up the goroutines of the clients that guessed.
+type passwordLockout struct {
+	lock      sync.Mutex // Protects addresses
+	addresses map[string]*lockoutEntry
+}
+
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// lockedOut gets how much longer addr is locked out for, or 0 if it isn't.
+func (l *passwordLockout) lockedOut(addr string, now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entry := l.addresses[addr]
+	if entry == nil || !now.Before(entry.lockedUntil) {
+		return 0
+	}
+	return entry.lockedUntil.Sub(now)
+}
+
+// fail records a wrong password from addr, and reports whether addr should now be banned.
+func (l *passwordLockout) fail(addr string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.addresses == nil {
+		l.addresses = make(map[string]*lockoutEntry)
+	}
+	entry := l.addresses[addr]
+	if entry == nil {
+		entry = &lockoutEntry{}
+		l.addresses[addr] = entry
+	}
+	entry.failures++
+	entry.lastFailure = now
+	if entry.failures > lockoutFreeFailures {
+		delay := lockoutBaseDelay
+		for i := lockoutFreeFailures + 1; i < entry.failures && delay < lockoutMaxDelay; i++ {
+			delay *= 2
+		}
+		if delay > lockoutMaxDelay {
+			delay = lockoutMaxDelay
+		}
+		entry.lockedUntil = now.Add(delay)
+	}
+	if entry.failures >= lockoutBanFailures {
+		delete(l.addresses, addr) // The ban takes over
+		return true
+	}
+	return false
+}
+
+// succeed forgets addr's failures, after it gave the right password.
+func (l *passwordLockout) succeed(addr string) {
+	l.lock.Lock()
+	delete(l.addresses, addr)
+	l.lock.Unlock()
+}
+
+// prune forgets addresses that haven't failed in a while.
+func (l *passwordLockout) prune(now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for addr, entry := range l.addresses {
+		if now.Sub(entry.lastFailure) > lockoutForget {
+			delete(l.addresses, addr)
+		}
+	}
+}
+
+// authenticate finds the token for a password given by addr, which may be the stats password,
+// locking out and eventually banning addresses that keep guessing.
+// If the password can't be accepted, the returned error says why, and is suitable for sending to the client.
+func (srv *Server) authenticate(addr, password string) (*Token, error) {
+	reg := &srv.registry
+	now := time.Now()
+	if wait := reg.lockout.lockedOut(addr, now); wait > 0 {
+		srv.securityEvent(SecurityAuthFailure, addr, "locked out for too many wrong stats passwords")
+		return nil, errors.Errorf("too many wrong passwords; try again in %s", wait.Round(time.Second))
+	}
+	if token := srv.findToken(password); token != nil {
+		reg.lockout.succeed(addr)
+		return token, nil
+	}
+
+	log := srv.Log.WithField("remote_addr", addr)
+	srv.securityEvent(SecurityAuthFailure, addr, "wrong stats password")
+	if reg.lockout.fail(addr, now) {
+		ban := Ban{
+			Addr:    addr,
+			Reason:  "too many wrong stats passwords",
+			Created: now.Round(0),
+			Expires: now.Round(0).Add(lockoutBanDuration),
+		}
+		if err := reg.bans.add(ban); err != nil {
+			log.WithField("error", err).Error("Error banning address for too many wrong stats passwords")
+		} else {
+			log.Warn("Banned address for too many wrong stats passwords")
+			srv.securityEvent(SecurityBan, addr, ban.Reason)
+		}
+	} else {
+		log.Info("Wrong stats password")
+		srv.strike(addr, "wrong stats password")
+	}
+	return nil, ErrBadPassword
+}
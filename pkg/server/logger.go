@@ -0,0 +1,84 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"log/slog"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fields are the structured data logged with a message, such as the ID of the client it is about.
+type Fields map[string]interface{}
+
+// Logger is what the server logs to.
+// NewLogrusLogger and NewSlogLogger adapt the common logging packages; embedders can implement it for any other.
+type Logger interface {
+	// WithField and WithFields return a logger that logs the given fields with every message, as well as its own.
+	WithField(key string, value interface{}) Logger
+	WithFields(fields Fields) Logger
+
+	Debug(msg string)
+	Info(msg string)
+	Warn(msg string)
+	Error(msg string)
+}
+
+// logrusLogger logs to logrus.
+type logrusLogger struct {
+	log logrus.FieldLogger
+}
+
+// NewLogrusLogger adapts a logrus logger, such as a *logrus.Logger or *logrus.Entry, to be used by the server.
+func NewLogrusLogger(log logrus.FieldLogger) Logger {
+	return logrusLogger{log: log}
+}
+
+func (l logrusLogger) WithField(key string, value interface{}) Logger {
+	return logrusLogger{log: l.log.WithField(key, value)}
+}
+
+func (l logrusLogger) WithFields(fields Fields) Logger {
+	return logrusLogger{log: l.log.WithFields(logrus.Fields(fields))}
+}
+
+func (l logrusLogger) Debug(msg string) { l.log.Debug(msg) }
+func (l logrusLogger) Info(msg string)  { l.log.Info(msg) }
+func (l logrusLogger) Warn(msg string)  { l.log.Warn(msg) }
+func (l logrusLogger) Error(msg string) { l.log.Error(msg) }
+
+// slogLogger logs to log/slog.
+type slogLogger struct {
+	log *slog.Logger
+}
+
+// NewSlogLogger adapts a log/slog logger to be used by the server.
+func NewSlogLogger(log *slog.Logger) Logger {
+	return slogLogger{log: log}
+}
+
+func (l slogLogger) WithField(key string, value interface{}) Logger {
+	return slogLogger{log: l.log.With(key, value)}
+}
+
+func (l slogLogger) WithFields(fields Fields) Logger {
+	// Sorted, so the fields are in the same order every time.
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	args := make([]interface{}, 0, len(keys))
+	for _, k := range keys {
+		args = append(args, k, fields[k])
+	}
+	return slogLogger{log: l.log.With(args...)}
+}
+
+func (l slogLogger) Debug(msg string) { l.log.Debug(msg) }
+func (l slogLogger) Info(msg string)  { l.log.Info(msg) }
+func (l slogLogger) Warn(msg string)  { l.log.Warn(msg) }
+func (l slogLogger) Error(msg string) { l.log.Error(msg) }
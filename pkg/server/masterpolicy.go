@@ -0,0 +1,77 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/pkg/errors"
+)
+
+// connectionTypeMaster is the connection_type of the controlling computer in a channel.
+const connectionTypeMaster = "master"
+
+// A MasterPolicy decides what happens when a master joins a channel that already has one.
+// NVDA Remote expects a single controlling computer per channel.
+type MasterPolicy string
+
+const (
+	// MasterAllow lets any number of masters join a channel.
+	MasterAllow MasterPolicy = "allow"
+
+	// MasterReject refuses to let a second master join.
+	MasterReject MasterPolicy = "reject"
+
+	// MasterDisplace lets the new master join, and kicks the old one.
+	MasterDisplace MasterPolicy = "displace"
+)
+
+// ParseMasterPolicy parses the name of a master policy.
+// An empty name is MasterAllow.
+func ParseMasterPolicy(name string) (MasterPolicy, error) {
+	switch policy := MasterPolicy(name); policy {
+	case "":
+		return MasterAllow, nil
+	case MasterAllow, MasterReject, MasterDisplace:
+		return policy, nil
+	}
+	return "", errors.Errorf("unknown master policy %q; must be allow, reject, or displace", name)
+}
+
+// enforceMasterPolicy applies the server's master policy to a member joining the channel.
+// It returns ErrChannelHasMaster if the member may not join.
+// It must only be called from the channel's shard.
+func (c *channel) enforceMasterPolicy(joiner channelMember) error {
+	if joiner.connectionType != connectionTypeMaster {
+		return nil
+	}
+	policy := joiner.client.srv.MasterPolicy
+	if policy == "" || policy == MasterAllow {
+		return nil
+	}
+	// Masters connected to other nodes of the cluster can't be displaced from here.
+	if policy == MasterReject && c.hasRemoteMaster() {
+		return ErrChannelHasMaster
+	}
+
+	for _, member := range c.members {
+		if member.connectionType != connectionTypeMaster || member.client.slow.Load() {
+			continue
+		}
+		if policy == MasterReject {
+			return ErrChannelHasMaster
+		}
+		if !member.client.slow.CompareAndSwap(false, true) {
+			continue
+		}
+
+		c.log.WithFields(Fields{
+			"id":      member.id,
+			"new_id":  joiner.id,
+			"channel": c.name,
+		}).Info("Displacing channel master")
+		c.reg.emit(Event{Type: EventClientKicked, Client: member.client.eventClient(), Channel: c.name, Reason: "displaced by a new master"})
+		member.client.kick(KickDisplaced, "displaced by a new master: another computer has taken control of this channel")
+	}
+	return nil
+}
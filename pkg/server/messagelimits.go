@@ -0,0 +1,111 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+// MessageLimits bound the structure of the messages clients send to their channels,
+// so that a malicious client can't make the server spend a lot of time decoding and re-encoding them.
+// Messages over the limits aren't relayed, and the client that sent them is sent an error.
+type MessageLimits struct {
+	// MaxDepth is how deeply objects and arrays may be nested in a message.
+	// If 0, nesting isn't limited.
+	MaxDepth int
+
+	// MaxKeys is the number of keys a message may have, including those of nested objects.
+	// If 0, keys aren't limited.
+	MaxKeys int
+}
+
+// messageLimitError rejects a message that is over the server's MessageLimits.
+type messageLimitError string
+
+func (e messageLimitError) Error() string {
+	return string(e)
+}
+
+const (
+	errMessageTooDeep     messageLimitError = "message is nested too deeply"
+	errMessageTooManyKeys messageLimitError = "message has too many keys"
+)
+
+// checkJSON checks a JSON message against the limits without decoding it,
+// so that messages over them never cost a decode.
+// The message doesn't need to be valid JSON; if it isn't, decoding it will fail anyway.
+func (limits MessageLimits) checkJSON(raw []byte) error {
+	if limits.MaxDepth <= 0 && limits.MaxKeys <= 0 {
+		return nil
+	}
+	depth, keys := 0, 0
+	inString, escaped := false, false
+	for _, b := range raw {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case b == '\\':
+				escaped = true
+			case b == '"':
+				inString = false
+			}
+			continue
+		}
+		switch b {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+			if limits.MaxDepth > 0 && depth > limits.MaxDepth {
+				return errMessageTooDeep
+			}
+		case '}', ']':
+			depth--
+		case ':':
+			// Outside of strings, colons only separate keys from their values.
+			keys++
+			if limits.MaxKeys > 0 && keys > limits.MaxKeys {
+				return errMessageTooManyKeys
+			}
+		}
+	}
+	return nil
+}
+
+// check checks a decoded message against the limits, for codecs whose encoding can't be scanned like JSON.
+func (limits MessageLimits) check(msg map[string]interface{}) error {
+	if limits.MaxDepth <= 0 && limits.MaxKeys <= 0 {
+		return nil
+	}
+	keys := 0
+	var walk func(v interface{}, depth int) error
+	walk = func(v interface{}, depth int) error {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			depth++
+			keys += len(v)
+			if limits.MaxKeys > 0 && keys > limits.MaxKeys {
+				return errMessageTooManyKeys
+			}
+			if limits.MaxDepth > 0 && depth > limits.MaxDepth {
+				return errMessageTooDeep
+			}
+			for _, child := range v {
+				if err := walk(child, depth); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			depth++
+			if limits.MaxDepth > 0 && depth > limits.MaxDepth {
+				return errMessageTooDeep
+			}
+			for _, child := range v {
+				if err := walk(child, depth); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(msg, 0)
+}
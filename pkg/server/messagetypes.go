@@ -0,0 +1,108 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// numTopMessageTypes is the number of most relayed message types reported in stats.
+	numTopMessageTypes = 10
+
+	// otherMessageType counts the messages whose types aren't counted separately.
+	otherMessageType = "(other)"
+
+	// noMessageType counts the messages that have no type.
+	noMessageType = "(none)"
+)
+
+// countedMessageTypes are the types of channel message NVDA Remote sends, which are counted separately.
+// Clients choose the types of the messages they send, so any others are counted together as otherMessageType,
+// so that they can't make the counters grow without bound, or push NVDA Remote's out.
+var countedMessageTypes = map[string]bool{
+	"key":                true,
+	"speak":              true,
+	"cancel":             true,
+	"pause_speech":       true,
+	"tone":               true,
+	"wave":               true,
+	"send_SAS":           true,
+	"index":              true,
+	"display":            true,
+	"braille_input":      true,
+	"set_braille_info":   true,
+	"set_display_size":   true,
+	"set_clipboard_text": true,
+}
+
+// MessageTypeTraffic is the number and size of the channel messages of one type relayed since the server started,
+// such as "speak", "braille" or "key".
+type MessageTypeTraffic struct {
+	Type     string `json:"type"`
+	Messages int64  `json:"messages"`
+	// Bytes is the size of the messages as they were received, before being relayed to each member.
+	Bytes int64 `json:"bytes"`
+}
+
+// messageTypeCount counts the messages of one type.
+type messageTypeCount struct {
+	messages atomic.Int64
+	bytes    atomic.Int64
+}
+
+// messageTypeCounters count relayed channel messages by their type.
+// They are safe to update concurrently.
+type messageTypeCounters struct {
+	counts sync.Map // Maps types to *messageTypeCount
+}
+
+// count counts a relayed message of msgType, which was size bytes.
+func (m *messageTypeCounters) count(msgType string, size int) {
+	counter := m.counter(msgType)
+	counter.messages.Add(1)
+	counter.bytes.Add(int64(size))
+}
+
+// counter gets the counter for msgType, adding it the first time the type is seen.
+func (m *messageTypeCounters) counter(msgType string) *messageTypeCount {
+	switch {
+	case msgType == "":
+		msgType = noMessageType
+	case !countedMessageTypes[msgType]:
+		msgType = otherMessageType
+	}
+	if counter, ok := m.counts.Load(msgType); ok {
+		return counter.(*messageTypeCount)
+	}
+	counter, _ := m.counts.LoadOrStore(msgType, &messageTypeCount{})
+	return counter.(*messageTypeCount)
+}
+
+// top gets the traffic of the n message types that have been relayed the most.
+func (m *messageTypeCounters) top(n int) []MessageTypeTraffic {
+	var top []MessageTypeTraffic
+	m.counts.Range(func(key, value interface{}) bool {
+		counter := value.(*messageTypeCount)
+		top = append(top, MessageTypeTraffic{
+			Type:     key.(string),
+			Messages: counter.messages.Load(),
+			Bytes:    counter.bytes.Load(),
+		})
+		return true
+	})
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Messages != top[j].Messages {
+			return top[i].Messages > top[j].Messages
+		}
+		return top[i].Type < top[j].Type
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
@@ -0,0 +1,169 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// natsPending is how many messages may wait to be handled before NATS starts dropping them.
+const natsPending = 4096
+
+// NATSBackplane is a Backplane over NATS core pub/sub.
+// It connects when first used, and keeps trying to reconnect and resubscribe if the connection is lost.
+type NATSBackplane struct {
+	url       string
+	tlsConfig *tls.Config
+
+	connectOnce sync.Once
+	conn        *nats.Conn
+	connectErr  error
+
+	// Every subscription delivers into msgs, so that messages are handled one at a time, in the order they came.
+	msgs chan *nats.Msg
+	done chan struct{}
+
+	lock     sync.Mutex // Protects handlers
+	handlers map[string]BackplaneHandler
+}
+
+// NewNATSBackplane creates a Backplane over the NATS servers at url, such as "nats://localhost:4222".
+// url may list several servers, separated by commas.
+// If tlsConfig isn't nil, NATS is connected to over TLS with it, even if url's scheme is nats://.
+func NewNATSBackplane(url string, tlsConfig *tls.Config) *NATSBackplane {
+	return &NATSBackplane{
+		url:       url,
+		tlsConfig: tlsConfig,
+		msgs:      make(chan *nats.Msg, natsPending),
+		done:      make(chan struct{}),
+		handlers:  make(map[string]BackplaneHandler),
+	}
+}
+
+// connect connects to NATS the first time it is called, returning the connection.
+func (b *NATSBackplane) connect() (*nats.Conn, error) {
+	b.connectOnce.Do(func() {
+		opts := []nats.Option{
+			nats.Name("nvremoted"),
+			nats.RetryOnFailedConnect(true),
+			nats.MaxReconnects(-1),
+		}
+		if b.tlsConfig != nil {
+			opts = append(opts, nats.Secure(b.tlsConfig))
+		}
+		b.conn, b.connectErr = nats.Connect(b.url, opts...)
+		if b.connectErr != nil {
+			b.connectErr = errors.Wrap(b.connectErr, "Connect to NATS")
+			return
+		}
+		go b.receive()
+	})
+	return b.conn, b.connectErr
+}
+
+// Publish publishes payload to topic.
+func (b *NATSBackplane) Publish(ctx context.Context, topic string, payload []byte) error {
+	conn, err := b.connect()
+	if err != nil {
+		return err
+	}
+	return conn.Publish(topic, payload)
+}
+
+// Subscribe subscribes to topic, calling handler with each message published to it.
+func (b *NATSBackplane) Subscribe(ctx context.Context, topic string, handler BackplaneHandler) (func(ctx context.Context) error, error) {
+	conn, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+	b.lock.Lock()
+	b.handlers[topic] = handler
+	b.lock.Unlock()
+	sub, err := conn.ChanSubscribe(topic, b.msgs)
+	if err != nil {
+		b.lock.Lock()
+		delete(b.handlers, topic)
+		b.lock.Unlock()
+		return nil, err
+	}
+	return func(ctx context.Context) error {
+		b.lock.Lock()
+		delete(b.handlers, topic)
+		b.lock.Unlock()
+		return sub.Unsubscribe()
+	}, nil
+}
+
+// MemberSync publishes request to topic, with a reply subject to gather the replies from.
+func (b *NATSBackplane) MemberSync(ctx context.Context, topic string, request []byte, want int) ([][]byte, error) {
+	conn, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+	inbox := conn.NewRespInbox()
+	// The subscription reaches the server before the request, which is sent after it on the same connection.
+	sub, err := conn.SubscribeSync(inbox)
+	if err != nil {
+		return nil, errors.Wrap(err, "Subscribe to replies")
+	}
+	defer sub.Unsubscribe()
+	if err := conn.PublishRequest(topic, inbox, request); err != nil {
+		return nil, err
+	}
+
+	var replies [][]byte
+	for len(replies) < want {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			return replies, err
+		}
+		replies = append(replies, msg.Data)
+	}
+	return replies, nil
+}
+
+// Close closes the connection to NATS.
+func (b *NATSBackplane) Close() error {
+	// Once closed, the backplane mustn't connect if used again.
+	b.connectOnce.Do(func() {
+		b.connectErr = errors.New("NATS backplane closed")
+	})
+	if b.conn != nil {
+		b.conn.Close()
+		close(b.done)
+	}
+	return nil
+}
+
+// receive passes messages to the handlers of their topics, until the backplane is closed.
+func (b *NATSBackplane) receive() {
+	for {
+		var msg *nats.Msg
+		select {
+		case msg = <-b.msgs:
+		case <-b.done:
+			return
+		}
+		b.lock.Lock()
+		handler := b.handlers[msg.Subject]
+		b.lock.Unlock()
+		if handler == nil {
+			continue
+		}
+		var reply func(payload []byte) error
+		if msg.Reply != "" {
+			reply = msg.Respond
+		}
+		handler(msg.Data, reply)
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// An Option configures a Server created by NewServer.
+// Options check their arguments, so a misconfigured server fails to be created rather than misbehaving once it runs.
+type Option func(srv *Server) error
+
+// NewServer creates a server configured by opts, which are applied in order.
+// Without options, the server uses the defaults documented on each of Server's fields,
+// and logs to logrus's standard logger.
+func NewServer(opts ...Option) (*Server, error) {
+	srv := &Server{Log: NewLogrusLogger(logrus.StandardLogger())}
+	for _, opt := range opts {
+		if err := opt(srv); err != nil {
+			return nil, err
+		}
+	}
+	if srv.TLSMinVersion != 0 && srv.TLSMaxVersion != 0 && srv.TLSMinVersion > srv.TLSMaxVersion {
+		return nil, errors.New("minimum TLS version is greater than the maximum")
+	}
+	if srv.Privacy && srv.SecurityLog != nil {
+		return nil, errors.New("the security log can't be used in privacy mode, as it logs clients' addresses")
+	}
+	return srv, nil
+}
+
+// notNegative returns an error naming what if n is negative.
+func notNegative[T int | int64 | float64 | time.Duration](what string, n T) error {
+	if n < 0 {
+		return errors.Errorf("%s can't be negative", what)
+	}
+	return nil
+}
+
+// WithLogger sets the logger the server logs to.
+func WithLogger(log Logger) Option {
+	return func(srv *Server) error {
+		if log == nil {
+			return errors.New("no logger given")
+		}
+		srv.Log = log
+		return nil
+	}
+}
+
+// WithPing pings clients every timeBetweenPings, and disconnects those who haven't sent anything for untilTimeout pings.
+// If timeBetweenPings is 0, clients aren't pinged, and if untilTimeout is 0, they aren't timed out.
+func WithPing(timeBetweenPings time.Duration, untilTimeout int) Option {
+	return func(srv *Server) error {
+		if err := notNegative("time between pings", timeBetweenPings); err != nil {
+			return err
+		}
+		if err := notNegative("pings until timeout", untilTimeout); err != nil {
+			return err
+		}
+		srv.TimeBetweenPings = timeBetweenPings
+		srv.PingsUntilTimeout = untilTimeout
+		return nil
+	}
+}
+
+// WithWriteTimeout sets how long a write to a client may block before its connection is considered lost.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(srv *Server) error {
+		if err := notNegative("write timeout", timeout); err != nil {
+			return err
+		}
+		srv.WriteTimeout = timeout
+		return nil
+	}
+}
+
+// WithFlushSize sets the size in bytes of each client's output buffer.
+func WithFlushSize(size int) Option {
+	return func(srv *Server) error {
+		if err := notNegative("flush size", size); err != nil {
+			return err
+		}
+		srv.FlushSize = size
+		return nil
+	}
+}
+
+// WithFlushDelay sets how long output may wait in a client's buffer for more output.
+func WithFlushDelay(delay time.Duration) Option {
+	return func(srv *Server) error {
+		if err := notNegative("flush delay", delay); err != nil {
+			return err
+		}
+		srv.FlushDelay = delay
+		return nil
+	}
+}
+
+// WithQueueSize sets the number of messages that can be queued for each client.
+func WithQueueSize(size int) Option {
+	return func(srv *Server) error {
+		if err := notNegative("queue size", size); err != nil {
+			return err
+		}
+		srv.QueueSize = size
+		return nil
+	}
+}
+
+// WithSlowClientPolicy sets what happens when a client's queue is full.
+func WithSlowClientPolicy(policy SlowClientPolicy) Option {
+	return func(srv *Server) error {
+		policy, err := ParseSlowClientPolicy(string(policy))
+		srv.SlowClientPolicy = policy
+		return err
+	}
+}
+
+// WithMasterPolicy sets what happens when a master joins a channel that already has one.
+func WithMasterPolicy(policy MasterPolicy) Option {
+	return func(srv *Server) error {
+		policy, err := ParseMasterPolicy(string(policy))
+		srv.MasterPolicy = policy
+		return err
+	}
+}
+
+// WithRelayMode sets which members of a channel receive each message.
+func WithRelayMode(mode RelayMode) Option {
+	return func(srv *Server) error {
+		mode, err := ParseRelayMode(string(mode))
+		srv.RelayMode = mode
+		return err
+	}
+}
+
+// WithSessionGrace lets clients that lost their connection resume their session within grace.
+func WithSessionGrace(grace time.Duration) Option {
+	return func(srv *Server) error {
+		if err := notNegative("session grace", grace); err != nil {
+			return err
+		}
+		srv.SessionGrace = grace
+		return nil
+	}
+}
+
+// WithDispatchShards sets the number of goroutines that relay messages over channels.
+func WithDispatchShards(n int) Option {
+	return func(srv *Server) error {
+		if err := notNegative("number of dispatch shards", n); err != nil {
+			return err
+		}
+		srv.DispatchShards = n
+		return nil
+	}
+}
+
+// WithRateLimit limits the rate at which each client may send messages.
+func WithRateLimit(limit RateLimit) Option {
+	return func(srv *Server) error {
+		if err := notNegative("rate limit", limit.Rate); err != nil {
+			return err
+		}
+		if err := notNegative("rate limit burst", limit.Burst); err != nil {
+			return err
+		}
+		if err := notNegative("rate limit kick after", limit.KickAfter); err != nil {
+			return err
+		}
+		srv.RateLimit = limit
+		return nil
+	}
+}
+
+// WithMessageLimits bounds the nesting and number of keys of the messages clients send to their channels.
+func WithMessageLimits(limits MessageLimits) Option {
+	return func(srv *Server) error {
+		if err := notNegative("message depth limit", limits.MaxDepth); err != nil {
+			return err
+		}
+		if err := notNegative("message key limit", limits.MaxKeys); err != nil {
+			return err
+		}
+		srv.MessageLimits = limits
+		return nil
+	}
+}
+
+// WithChannelQuota limits the bandwidth each channel may use per hour and per day.
+func WithChannelQuota(quota ChannelQuota) Option {
+	return func(srv *Server) error {
+		for _, limit := range []int64{quota.HourlySoft, quota.HourlyHard, quota.DailySoft, quota.DailyHard} {
+			if err := notNegative("channel quota", limit); err != nil {
+				return err
+			}
+		}
+		srv.ChannelQuota = quota
+		return nil
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used by listeners with TLS.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(srv *Server) error {
+		if config == nil {
+			return errors.New("no TLS configuration given")
+		}
+		srv.TLSConfig = config
+		return nil
+	}
+}
+
+// WithTLSVersions limits the TLS versions clients may use, such as tls.VersionTLS12.
+// A version of 0 leaves that end of the range to the TLS configuration.
+func WithTLSVersions(min, max uint16) Option {
+	return func(srv *Server) error {
+		for _, version := range []uint16{min, max} {
+			if version != 0 && (version < tls.VersionTLS10 || version > tls.VersionTLS13) {
+				return errors.Errorf("unknown TLS version 0x%04x", version)
+			}
+		}
+		srv.TLSMinVersion = min
+		srv.TLSMaxVersion = max
+		return nil
+	}
+}
+
+// WithTLSCipherSuites restricts the cipher suites used with TLS 1.2 and earlier, such as those from ParseCipherSuites.
+func WithTLSCipherSuites(suites []uint16) Option {
+	return func(srv *Server) error {
+		srv.TLSCipherSuites = suites
+		return nil
+	}
+}
+
+// WithMOTD sets the message of the day sent to clients when they connect.
+func WithMOTD(motd string) Option {
+	return func(srv *Server) error {
+		srv.MOTD = motd
+		return nil
+	}
+}
+
+// WithStatsAuth sets the stats password, which allows every stats and admin request,
+// and the tokens that allow only some of them.
+// The password may be a bcrypt hash, from HashPassword, and may be empty to only allow tokens.
+func WithStatsAuth(password string, tokens ...Token) Option {
+	return func(srv *Server) error {
+		for _, token := range tokens {
+			if err := token.Validate(); err != nil {
+				return err
+			}
+		}
+		srv.StatsPassword = password
+		srv.Tokens = tokens
+		return nil
+	}
+}
+
+// WithAllowedChannels restricts the channels clients may join to those matching at least one pattern.
+func WithAllowedChannels(patterns ...ChannelPattern) Option {
+	return func(srv *Server) error {
+		srv.AllowedChannels = patterns
+		return nil
+	}
+}
+
+// WithE2eOnly refuses joins to channels that aren't used with end-to-end encryption.
+func WithE2eOnly(e2eOnly bool) Option {
+	return func(srv *Server) error {
+		srv.E2eOnly = e2eOnly
+		return nil
+	}
+}
+
+// WithBlockedChannels sets the patterns of channels clients may not join when the server starts.
+func WithBlockedChannels(patterns ...ChannelPattern) Option {
+	return func(srv *Server) error {
+		srv.BlockedChannels = patterns
+		return nil
+	}
+}
+
+// WithBanFile saves banned addresses to file, and loads them from it when the server starts.
+func WithBanFile(file string) Option {
+	return func(srv *Server) error {
+		srv.BanFile = file
+		return nil
+	}
+}
+
+// WithChannelPasswords requires a password to join channels matching the passwords' patterns.
+func WithChannelPasswords(passwords ...ChannelPassword) Option {
+	return func(srv *Server) error {
+		for _, cp := range passwords {
+			if cp.Password == "" {
+				return errors.Errorf("no password for channel pattern %q", cp.Pattern.String())
+			}
+		}
+		srv.ChannelPasswords = passwords
+		return nil
+	}
+}
+
+// WithWebhooks sends every Event to each of the URLs as a JSON POST.
+func WithWebhooks(urls ...string) Option {
+	return func(srv *Server) error {
+		for _, rawURL := range urls {
+			u, err := url.Parse(rawURL)
+			if err != nil {
+				return errors.Wrap(err, "webhook")
+			}
+			if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+				return errors.Errorf("webhook %q isn't an HTTP or HTTPS URL", rawURL)
+			}
+		}
+		srv.Webhooks = urls
+		return nil
+	}
+}
+
+// WithPprof serves net/http/pprof profiles on the health listener.
+func WithPprof(pprof bool) Option {
+	return func(srv *Server) error {
+		srv.Pprof = pprof
+		return nil
+	}
+}
+
+// WithStatsd pushes metrics to a statsd server.
+func WithStatsd(statsd Statsd) Option {
+	return func(srv *Server) error {
+		if err := notNegative("statsd interval", statsd.Interval); err != nil {
+			return err
+		}
+		srv.Statsd = statsd
+		return nil
+	}
+}
+
+// WithHistory records the server's stats over time.
+func WithHistory(history StatsHistory) Option {
+	return func(srv *Server) error {
+		if err := notNegative("history interval", history.Interval); err != nil {
+			return err
+		}
+		if err := notNegative("history retention", history.Retention); err != nil {
+			return err
+		}
+		srv.History = history
+		return nil
+	}
+}
+
+// WithTracerProvider sets the provider of the tracer for OpenTelemetry spans.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(srv *Server) error {
+		srv.TracerProvider = provider
+		return nil
+	}
+}
+
+// WithBind sets what happens when the server's address can't be bound.
+func WithBind(bind BindPolicy) Option {
+	return func(srv *Server) error {
+		if err := notNegative("bind retries", bind.Retries); err != nil {
+			return err
+		}
+		if err := notNegative("bind retry delay", bind.RetryDelay); err != nil {
+			return err
+		}
+		srv.Bind = bind
+		return nil
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/subtle"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashPassword hashes a stats password with bcrypt, so that the hash can be used as the server's StatsPassword
+// without the password itself being stored in its configuration.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", errors.Wrap(err, "Hash password")
+	}
+	return string(hash), nil
+}
+
+// IsPasswordHash reports whether a stats password is a bcrypt hash, rather than the password itself.
+func IsPasswordHash(s string) bool {
+	_, err := bcrypt.Cost([]byte(s))
+	return err == nil
+}
+
+// checkPassword checks a given password against a stored one, which may be a bcrypt hash, in constant time.
+// Nothing matches an empty password.
+func checkPassword(stored, given string) bool {
+	if stored == "" || given == "" {
+		return false
+	}
+	if IsPasswordHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(given)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(given)) == 1
+}
@@ -0,0 +1,71 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A ChannelPattern matches channel names.
+type ChannelPattern struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// ParseChannelPattern parses a pattern matching channel names.
+// Patterns are globs, where * matches any number of characters and ? matches one character,
+// unless they are prefixed with "re:", in which case the rest is a regular expression.
+// Either way, the pattern must match the entire channel name.
+func ParseChannelPattern(pattern string) (ChannelPattern, error) {
+	var expr string
+	if strings.HasPrefix(pattern, "re:") {
+		expr = strings.TrimPrefix(pattern, "re:")
+	} else {
+		expr = regexp.QuoteMeta(pattern)
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\?`, ".")
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return ChannelPattern{}, errors.Wrapf(err, "Parse channel pattern %q", pattern)
+	}
+	return ChannelPattern{pattern: pattern, re: re}, nil
+}
+
+// ParseChannelPatterns parses a list of patterns with ParseChannelPattern.
+func ParseChannelPatterns(patterns []string) ([]ChannelPattern, error) {
+	parsed := make([]ChannelPattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		p, err := ParseChannelPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+// Match reports whether name matches the pattern.
+func (p ChannelPattern) Match(name string) bool {
+	return p.re != nil && p.re.MatchString(name)
+}
+
+// String gets the pattern as it was given to ParseChannelPattern.
+func (p ChannelPattern) String() string {
+	return p.pattern
+}
+
+// matchAnyPattern reports whether name matches any of patterns.
+func matchAnyPattern(patterns []ChannelPattern, name string) bool {
+	for _, p := range patterns {
+		if p.Match(name) {
+			return true
+		}
+	}
+	return false
+}
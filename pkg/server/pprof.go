@@ -0,0 +1,47 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// pprofHandler serves the net/http/pprof profiles under /debug/pprof/,
+// to requests that give the stats password, or a token with ScopeAdmin, with HTTP basic authentication; the user name is ignored.
+func (srv *Server) pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="nvremoted"`)
+			http.Error(w, "no password", http.StatusUnauthorized)
+			return
+		}
+		remoteAddr, _, _ := net.SplitHostPort(r.RemoteAddr)
+		token, err := srv.authenticate(remoteAddr, password)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="nvremoted"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !token.allows(ScopeAdmin) {
+			http.Error(w, "not allowed: this token's scopes don't allow profiling", http.StatusForbidden)
+			return
+		}
+		srv.Log.WithFields(Fields{
+			"path":  r.URL.Path,
+			"token": token.Name,
+		}).Info("Serving profile")
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,169 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// WithPrivacy keeps clients' IP addresses and host names, and the names of channels, out of the server's logs, stats,
+// webhook and admin events, and traces. Channels are identified by ChannelHash instead,
+// so that activity on one channel can still be followed, and the channel found by asking the server for its hash.
+// Hashes are keyed with a secret chosen when the server starts, so they can't be worked back to names by guessing,
+// and can only be linked to each other within a single run of the server, unless WithPrivacyKey sets the key.
+// Admin commands that act on particular clients, such as listing or kicking them, still see their addresses.
+// The security log exists to record addresses, so it can't be used with privacy mode.
+func WithPrivacy(privacy bool) Option {
+	return func(srv *Server) error {
+		srv.Privacy = privacy
+		return nil
+	}
+}
+
+// WithPrivacyKey sets the secret channel hashes are keyed with, so that a channel has the same hash after the server restarts,
+// such as to follow it across restarts in the logs. The key must be kept as secret as the channels' names;
+// anyone who has it can work out hashes from names they guess.
+func WithPrivacyKey(key string) Option {
+	return func(srv *Server) error {
+		srv.PrivacyKey = key
+		return nil
+	}
+}
+
+// channelHasher identifies channels without giving their names away.
+type channelHasher struct {
+	key []byte
+}
+
+// newChannelHasher creates a channelHasher keyed with key, or with a random key if key is empty.
+func newChannelHasher(key string) channelHasher {
+	if key != "" {
+		return channelHasher{key: []byte(key)}
+	}
+	random := make([]byte, sha256.Size)
+	rand.Read(random)
+	return channelHasher{key: random}
+}
+
+// hash gets the first 16 hex digits of the HMAC-SHA256 of the channel's name.
+func (h channelHasher) hash(name string) string {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// ChannelHash identifies the named channel in logs, stats, events and state dumps, without giving its name away.
+// It can only be worked out by this server, or by others run with the same PrivacyKey.
+// The server must have started.
+func (srv *Server) ChannelHash(name string) string {
+	return srv.registry.channelHasher.hash(name)
+}
+
+// ChannelHashArgs holds the arguments to the channel_hash admin command.
+type ChannelHashArgs struct {
+	Channel string `json:"channel"`
+}
+
+// ChannelHashResult is the result of the channel_hash admin command.
+type ChannelHashResult struct {
+	Hash string `json:"hash"`
+}
+
+func adminChannelHash(srv *Server, args json.RawMessage) (interface{}, error) {
+	var hashArgs ChannelHashArgs
+	if err := decodeAdminArgs(args, &hashArgs); err != nil {
+		return nil, err
+	}
+	return ChannelHashResult{Hash: srv.ChannelHash(hashArgs.Channel)}, nil
+}
+
+// privateFields are the log fields that hold clients' addresses or host names, and are left out in privacy mode.
+var privateFields = map[string]bool{
+	"addr":        true,
+	"client_addr": true,
+	"remote_addr": true,
+	"remote_host": true,
+}
+
+// privateLogger logs to another logger, leaving clients' addresses and host names out, and hashing channel names.
+type privateLogger struct {
+	log    Logger
+	hasher channelHasher
+}
+
+// newPrivateLogger wraps log for privacy mode, hashing channel names with hasher, unless it already is.
+func newPrivateLogger(log Logger, hasher channelHasher) Logger {
+	if _, ok := log.(privateLogger); ok {
+		return log
+	}
+	return privateLogger{log: log, hasher: hasher}
+}
+
+func (l privateLogger) WithField(key string, value interface{}) Logger {
+	value, ok := l.hasher.privateField(key, value)
+	if !ok {
+		return l
+	}
+	return privateLogger{log: l.log.WithField(key, value), hasher: l.hasher}
+}
+
+func (l privateLogger) WithFields(fields Fields) Logger {
+	private := make(Fields, len(fields))
+	for key, value := range fields {
+		if value, ok := l.hasher.privateField(key, value); ok {
+			private[key] = value
+		}
+	}
+	return privateLogger{log: l.log.WithFields(private), hasher: l.hasher}
+}
+
+func (l privateLogger) Debug(msg string) { l.log.Debug(msg) }
+func (l privateLogger) Info(msg string)  { l.log.Info(msg) }
+func (l privateLogger) Warn(msg string)  { l.log.Warn(msg) }
+func (l privateLogger) Error(msg string) { l.log.Error(msg) }
+
+// privateField gets the value a field should be logged with in privacy mode,
+// or false if it shouldn't be logged at all.
+func (h channelHasher) privateField(key string, value interface{}) (interface{}, bool) {
+	switch {
+	case privateFields[key]:
+		return nil, false
+	case key == "channel":
+		name, ok := value.(string)
+		if !ok {
+			return nil, false
+		}
+		return h.hash(name), true
+	}
+	// Network errors, and the disconnect reasons made from them, name the addresses at each end of the connection.
+	switch value := value.(type) {
+	case string:
+		return redactIPs(value), true
+	case error:
+		return redactIPs(value.Error()), true
+	}
+	return value, true
+}
+
+// private removes clients' addresses from the event, and hashes its channel's name, if the server is in privacy mode.
+func (reg *registry) private(e Event) Event {
+	if !reg.privacy {
+		return e
+	}
+	if e.Client != nil {
+		client := *e.Client
+		client.RemoteHost = ""
+		e.Client = &client
+	}
+	if e.Channel != "" {
+		e.Channel = reg.channelHasher.hash(e.Channel)
+	}
+	e.Reason = redactIPs(e.Reason)
+	return e
+}
@@ -0,0 +1,31 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// TestChannelHashesAreKeyed checks that channel hashes can't be worked out from a guessed name alone,
+// and only stay the same across runs of the server when the key is set.
+func TestChannelHashesAreKeyed(t *testing.T) {
+	const name = "family"
+	plain := sha256.Sum256([]byte(name))
+	first, second := newChannelHasher(""), newChannelHasher("")
+	if hash := first.hash(name); hash == hex.EncodeToString(plain[:8]) {
+		t.Error("channel hash is the name's unkeyed SHA-256")
+	}
+	if first.hash(name) != first.hash(name) {
+		t.Error("channel hash changed within a run")
+	}
+	if first.hash(name) == second.hash(name) {
+		t.Error("random keys gave the same channel hash")
+	}
+	if newChannelHasher("secret").hash(name) != newChannelHasher("secret").hash(name) {
+		t.Error("the same key gave different channel hashes")
+	}
+}
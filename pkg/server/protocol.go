@@ -0,0 +1,134 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// defaultProtocolVersion is the version of the protocol spoken by clients that don't say,
+// and the only one the server speaks unless others are enabled.
+// It is the version NVDA Remote speaks.
+const defaultProtocolVersion = 2
+
+// protocol is how the server behaves towards clients speaking a version of the protocol.
+type protocol struct {
+	version int
+
+	// acknowledge confirms the version a client negotiated with a protocol_version response.
+	// Version 2 clients don't expect one.
+	acknowledge bool
+
+	// kickOnly sends clients being disconnected just a kick response.
+	// Version 2 clients don't know kick responses, so are sent the reason as an error first.
+	kickOnly bool
+
+	// timedPings pings clients with a ping message they answer, rather than a newline, so that their latency is measured.
+	timedPings bool
+}
+
+// protocols are the versions of the protocol the server knows.
+// Versions other than defaultProtocolVersion are only spoken if the server's ProtocolVersions enable them.
+var protocols = map[int]*protocol{
+	2: {version: 2},
+	// Version 3 is still taking shape, so it is only spoken by servers that enable it.
+	3: {version: 3, acknowledge: true, kickOnly: true, timedPings: true},
+}
+
+// WithProtocolVersions sets the versions of the protocol clients may negotiate.
+// Clients that don't negotiate a version are spoken to with version 2, whether or not it is enabled.
+func WithProtocolVersions(versions ...int) Option {
+	return func(srv *Server) error {
+		for i, version := range versions {
+			if protocols[version] == nil {
+				return errors.Errorf("unknown protocol version %d", version)
+			}
+			for _, prev := range versions[:i] {
+				if prev == version {
+					return errors.Errorf("protocol version %d is given more than once", version)
+				}
+			}
+		}
+		srv.ProtocolVersions = versions
+		return nil
+	}
+}
+
+// protocolVersions gets the versions of the protocol clients may negotiate, newest first.
+func (srv *Server) protocolVersions() []int {
+	if len(srv.ProtocolVersions) == 0 {
+		return []int{defaultProtocolVersion}
+	}
+	versions := append([]int(nil), srv.ProtocolVersions...)
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+	return versions
+}
+
+// ClientProtocolVersionMessage contains the protocol version sent by a client.
+type ClientProtocolVersionMessage struct {
+	GenericClientMessage
+	Version int `json:"version"`
+
+	// Versions lists every version the client speaks, so the server can choose the newest it has enabled.
+	// If given, Version is ignored, and the server always responds with the version chosen.
+	Versions []int `json:"versions,omitempty"`
+}
+
+// Name gets this ClientProtocolVersionMessage's name.
+func (ClientProtocolVersionMessage) Name() string {
+	return "protocol_version"
+}
+
+// ClientProtocolVersionResponse tells a client which version of the protocol the server will speak to it.
+type ClientProtocolVersionResponse struct {
+	Type    string `json:"type"`
+	Version int    `json:"version"`
+}
+
+// Name gets this ClientProtocolVersionResponse's name.
+func (ClientProtocolVersionResponse) Name() string {
+	return "protocol_version"
+}
+
+func handleClientProtocolVersion(c *client, msg Message) {
+	protvMSG := msg.(*ClientProtocolVersionMessage)
+	offered := protvMSG.Versions
+	if len(offered) == 0 {
+		offered = []int{protvMSG.Version}
+	}
+	// Allow clients to continue without providing a version, but kick those who provide none the server speaks.
+	var p *protocol
+	for _, version := range c.srv.protocolVersions() {
+		for _, v := range offered {
+			if v == version {
+				p = protocols[version]
+				break
+			}
+		}
+		if p != nil {
+			break
+		}
+	}
+	if p == nil {
+		c.sendKick(KickProtocolError, "version unsupported")
+		c.stop("protocol version unsupported")
+		return
+	}
+
+	c.protocol = p
+	if p.acknowledge || len(protvMSG.Versions) > 0 {
+		c.send(ClientProtocolVersionResponse{
+			Type:    "protocol_version",
+			Version: p.version,
+		})
+	}
+}
+
+// ProtocolVersion gets the version of the protocol the client speaks.
+func (c *client) ProtocolVersion() int {
+	return c.protocol.version
+}
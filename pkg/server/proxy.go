@@ -0,0 +1,97 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// ProxiedConn is a connection relayed by a proxy that says which client is on the other side,
+// such as one from a listener speaking the PROXY protocol, or a WebSocket behind a reverse proxy.
+// Connections given to ServeConn by such transports should implement it,
+// so that the client's own address is the one banned, locked out, and logged, rather than the proxy's.
+type ProxiedConn interface {
+	net.Conn
+
+	// ClientAddr gets the address of the client, as given by the proxy, or nil if it didn't give one.
+	ClientAddr() net.Addr
+}
+
+// WithTrustedProxies sets the proxies whose word on a client's address is taken, as IP addresses or networks in CIDR notation.
+// A ProxiedConn's ClientAddr is only used if the connection's own peer is one of them;
+// otherwise, anyone could claim to be connecting from anywhere.
+func WithTrustedProxies(proxies ...string) Option {
+	return func(srv *Server) error {
+		networks := make([]*net.IPNet, 0, len(proxies))
+		for _, proxy := range proxies {
+			network, err := parseBanAddr(proxy)
+			if err != nil {
+				return errors.Wrapf(err, "trusted proxy %q", proxy)
+			}
+			networks = append(networks, network)
+		}
+		srv.TrustedProxies = networks
+		return nil
+	}
+}
+
+// clientAddr gets the address of the client connected over conn.
+// This is the address given by the proxy, if conn was relayed by a trusted one, or else the connection's peer.
+func (srv *Server) clientAddr(conn net.Conn) net.Addr {
+	peer := conn.RemoteAddr()
+	pc, ok := conn.(ProxiedConn)
+	if !ok {
+		return peer
+	}
+	addr := pc.ClientAddr()
+	if addr == nil {
+		return peer
+	}
+	if !srv.trustedProxy(peer) {
+		srv.Log.WithFields(Fields{
+			"proxy":       peer.String(),
+			"client_addr": addr.String(),
+		}).Info("Ignoring the client address given by an untrusted proxy")
+		return peer
+	}
+	return addr
+}
+
+// trustedProxy checks whether addr is one of the server's TrustedProxies.
+func (srv *Server) trustedProxy(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range srv.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP gets the IP address of addr, or nil if it isn't one, such as the address of a pipe.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return net.ParseIP(addrHost(addr))
+}
+
+// addrHost gets addr without its port.
+// Addresses without a port, such as those of pipes, are returned whole.
+func addrHost(addr net.Addr) string {
+	s := addr.String()
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return s
+}
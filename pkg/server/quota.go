@@ -0,0 +1,178 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ChannelQuota limits the number of bytes sent to each channel's members per hour and per day.
+// Hours and days start on the hour and at midnight UTC.
+// A limit of 0 isn't enforced.
+type ChannelQuota struct {
+	// HourlySoft and DailySoft are the number of bytes after which a warning is logged.
+	HourlySoft int64
+	DailySoft  int64
+
+	// HourlyHard and DailyHard are the number of bytes after which the channel is disbanded,
+	// and can't be joined again until the hour or day is over.
+	HourlyHard int64
+	DailyHard  int64
+}
+
+// quotaWindow counts the bytes a channel has used in the current hour or day.
+type quotaWindow struct {
+	start  time.Time
+	bytes  int64
+	warned bool // Whether the soft quota was reported
+}
+
+// advance starts a new window if the period containing now is different from the window's.
+func (w *quotaWindow) advance(now time.Time, period time.Duration) {
+	if start := now.Truncate(period); !w.start.Equal(start) {
+		*w = quotaWindow{start: start}
+	}
+}
+
+// channelUsage is the bandwidth used by a channel.
+// It is kept by name, so a channel that is disbanded and created again doesn't start over.
+type channelUsage struct {
+	hour quotaWindow
+	day  quotaWindow
+}
+
+// channelQuotas tracks the bandwidth used by channels, and enforces the server's quota.
+type channelQuotas struct {
+	quota ChannelQuota
+
+	lock  sync.Mutex
+	usage map[string]*channelUsage
+}
+
+// quotaPeriod is one of the periods a ChannelQuota limits.
+type quotaPeriod struct {
+	name       string
+	period     time.Duration
+	window     *quotaWindow
+	soft, hard int64
+}
+
+func (q *channelQuotas) periods(usage *channelUsage) []quotaPeriod {
+	return []quotaPeriod{
+		{"hourly", time.Hour, &usage.hour, q.quota.HourlySoft, q.quota.HourlyHard},
+		{"daily", 24 * time.Hour, &usage.day, q.quota.DailySoft, q.quota.DailyHard},
+	}
+}
+
+// exceeded gets why the named channel may not be used, if it has exceeded a hard quota.
+func (q *channelQuotas) exceeded(name string, now time.Time) (string, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	usage := q.usage[name]
+	if usage == nil {
+		return "", false
+	}
+	for _, p := range q.periods(usage) {
+		p.window.advance(now, p.period)
+		if p.hard > 0 && p.window.bytes > p.hard {
+			return fmt.Sprintf("channel quota exceeded: this channel has used its %s bandwidth; try again later", p.name), true
+		}
+	}
+	return "", false
+}
+
+// current gets the bytes the named channel has used this hour and today.
+func (q *channelQuotas) current(name string, now time.Time) (hour, day int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	usage := q.usage[name]
+	if usage == nil {
+		return 0, 0
+	}
+	usage.hour.advance(now, time.Hour)
+	usage.day.advance(now, 24*time.Hour)
+	return usage.hour.bytes, usage.day.bytes
+}
+
+// prune forgets the usage of channels that have used nothing this hour and today.
+func (q *channelQuotas) prune(now time.Time) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for name, usage := range q.usage {
+		usage.hour.advance(now, time.Hour)
+		usage.day.advance(now, 24*time.Hour)
+		if usage.hour.bytes == 0 && usage.day.bytes == 0 {
+			delete(q.usage, name)
+		}
+	}
+}
+
+// accountQuotas adds the bytes sent to each channel since the last call to its usage,
+// and disbands channels that have exceeded a hard quota.
+// It must only be called from runTimers.
+func (reg *registry) accountQuotas(now time.Time) {
+	q := &reg.quotas
+	disband := make(map[string]string) // Reasons, by channel name
+	for _, shard := range reg.dispatcher.shards {
+		shard.lock.Lock()
+		for name, c := range shard.channels {
+			sent := c.traffic.bytesSent.Load()
+			n := sent - c.quotaCounted
+			c.quotaCounted = sent
+			if n == 0 {
+				continue
+			}
+
+			q.lock.Lock()
+			usage := q.usage[name]
+			if usage == nil {
+				usage = &channelUsage{}
+				q.usage[name] = usage
+			}
+			for _, p := range q.periods(usage) {
+				p.window.advance(now, p.period)
+				p.window.bytes += n
+				if p.soft > 0 && p.window.bytes > p.soft && !p.window.warned {
+					p.window.warned = true
+					reg.log.WithFields(Fields{
+						"channel": name,
+						"period":  p.name,
+						"bytes":   p.window.bytes,
+						"quota":   p.soft,
+					}).Warn("Channel exceeded its soft quota")
+				}
+				if p.hard > 0 && p.window.bytes > p.hard {
+					if _, ok := disband[name]; !ok {
+						reg.log.WithFields(Fields{
+							"channel": name,
+							"period":  p.name,
+							"bytes":   p.window.bytes,
+							"quota":   p.hard,
+						}).Warn("Disbanding channel that exceeded its hard quota")
+					}
+					disband[name] = fmt.Sprintf("channel quota exceeded: this channel has used its %s bandwidth; try again later", p.name)
+				}
+			}
+			q.lock.Unlock()
+		}
+		shard.lock.Unlock()
+	}
+
+	if len(disband) == 0 {
+		return
+	}
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	for _, member := range reg.clients {
+		reason, ok := disband[member.channel]
+		if !ok || !member.client.slow.CompareAndSwap(false, true) {
+			continue
+		}
+		reg.emit(Event{Type: EventClientKicked, Client: member.client.eventClient(), Channel: member.channel, Reason: "channel quota exceeded"})
+		member.client.kick(KickQuota, reason)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"math"
+	"time"
+)
+
+// RateLimit limits the rate at which each client may send messages.
+// Clients sending faster than the limit are throttled, by reading from them no faster than the limit allows,
+// and kicked if they are throttled for too long.
+type RateLimit struct {
+	// Rate is the number of messages per second a client may send, on average.
+	// If 0, clients are not rate limited.
+	Rate float64
+
+	// Burst is the number of messages a client may send at once, after having been idle.
+	// If less than 1, it is 1.
+	Burst int
+
+	// KickAfter is how long a client may be continuously throttled before it is kicked.
+	// If 0, throttled clients are never kicked.
+	KickAfter time.Duration
+}
+
+// tokenBucket implements a token bucket, which holds up to burst tokens, and gains rate tokens per second.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	burst := math.Max(1, float64(limit.Burst))
+	return &tokenBucket{
+		rate:   limit.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+// take takes a token from the bucket, returning how long to wait until the token would have been available.
+// If the bucket has a token, no waiting is needed.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
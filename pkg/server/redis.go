@@ -0,0 +1,141 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisBackplane is a Backplane over Redis pub/sub.
+// It connects when first used, and reconnects and resubscribes if the connection is lost,
+// though messages published while it is disconnected are missed.
+//
+// Redis has no replies, so each message is sent as the topic to reply to, if any, a newline, then the payload.
+type RedisBackplane struct {
+	client *redis.Client
+	pubsub *redis.PubSub
+
+	receiveOnce sync.Once
+	lock        sync.Mutex // Protects handlers
+	handlers    map[string]BackplaneHandler
+}
+
+// NewRedisBackplane creates a Backplane over the Redis server at url, such as "redis://localhost:6379/0".
+// If tlsConfig isn't nil, Redis is connected to over TLS with it, even if url's scheme is redis://.
+func NewRedisBackplane(url string, tlsConfig *tls.Config) (*RedisBackplane, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid Redis URL")
+	}
+	if tlsConfig != nil {
+		tlsConfig = tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(opts.Addr)
+		}
+		opts.TLSConfig = tlsConfig
+	}
+	client := redis.NewClient(opts)
+	return &RedisBackplane{
+		client:   client,
+		pubsub:   client.Subscribe(context.Background()),
+		handlers: make(map[string]BackplaneHandler),
+	}, nil
+}
+
+// Publish publishes payload to topic.
+func (b *RedisBackplane) Publish(ctx context.Context, topic string, payload []byte) error {
+	return b.client.Publish(ctx, topic, redisFrame("", payload)).Err()
+}
+
+// Subscribe subscribes to topic, calling handler with each message published to it.
+func (b *RedisBackplane) Subscribe(ctx context.Context, topic string, handler BackplaneHandler) (func(ctx context.Context) error, error) {
+	b.receiveOnce.Do(func() {
+		go b.receive()
+	})
+	b.lock.Lock()
+	b.handlers[topic] = handler
+	b.lock.Unlock()
+	unsubscribe := func(ctx context.Context) error {
+		b.lock.Lock()
+		delete(b.handlers, topic)
+		b.lock.Unlock()
+		return b.pubsub.Unsubscribe(ctx, topic)
+	}
+	if err := b.pubsub.Subscribe(ctx, topic); err != nil {
+		// Otherwise, the pubsub would keep trying to subscribe when it reconnects.
+		unsubscribe(ctx)
+		return nil, err
+	}
+	return unsubscribe, nil
+}
+
+// MemberSync publishes request to topic, and gathers the replies, which are published to a topic of their own.
+func (b *RedisBackplane) MemberSync(ctx context.Context, topic string, request []byte, want int) ([][]byte, error) {
+	inbox := fmt.Sprintf("%s.reply.%016x", topic, rand.Uint64())
+	sub := b.client.Subscribe(ctx, inbox)
+	defer sub.Close()
+	// Until Redis confirms the subscription, replies could be missed.
+	if _, err := sub.Receive(ctx); err != nil {
+		return nil, errors.Wrap(err, "Subscribe to replies")
+	}
+	if err := b.client.Publish(ctx, topic, redisFrame(inbox, request)).Err(); err != nil {
+		return nil, err
+	}
+
+	var replies [][]byte
+	for len(replies) < want {
+		msg, err := sub.ReceiveMessage(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			return replies, err
+		}
+		replies = append(replies, []byte(msg.Payload))
+	}
+	return replies, nil
+}
+
+// Close closes the connections to Redis.
+func (b *RedisBackplane) Close() error {
+	b.pubsub.Close()
+	return b.client.Close()
+}
+
+// receive passes messages to the handlers of their topics, until the backplane is closed.
+func (b *RedisBackplane) receive() {
+	for msg := range b.pubsub.Channel() {
+		b.lock.Lock()
+		handler := b.handlers[msg.Channel]
+		b.lock.Unlock()
+		inbox, payload, ok := bytes.Cut([]byte(msg.Payload), []byte("\n"))
+		if handler == nil || !ok {
+			continue
+		}
+		var reply func(payload []byte) error
+		if len(inbox) > 0 {
+			reply = func(payload []byte) error {
+				ctx, cancel := context.WithTimeout(context.Background(), clusterTimeout)
+				defer cancel()
+				return b.client.Publish(ctx, string(inbox), payload).Err()
+			}
+		}
+		handler(payload, reply)
+	}
+}
+
+// redisFrame prepends the topic to reply to, which may be empty, to payload.
+func redisFrame(inbox string, payload []byte) []byte {
+	return append([]byte(inbox+"\n"), payload...)
+}
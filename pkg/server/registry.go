@@ -5,48 +5,321 @@
 package server
 
 import (
+	"os"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 type registry struct {
 	lock            sync.RWMutex // Protects the entire registry
 	clients         map[uint64]channelMember
-	channels        map[string]*channel
-	statsPassword   string
+	dispatcher      *dispatcher // Owns the channels
+	tracer          trace.Tracer
+	relayMode       RelayMode
+	capacity        Capacity
+	quotas          channelQuotas   // Has its own lock, which may be taken while holding a shard's
+	creations       creationLimiter // Has its own lock, which may be taken while holding a shard's and the registry's
+	sessions        sessionTable    // Has its own lock
+	numChannels     int
+	lockout         passwordLockout // Locks out addresses that guess the stats password
+	abuse           abuseStrikes    // Counts how often addresses misbehave, to ban those that keep at it
+	hosts           hostCache       // Host names of clients' addresses; has its own lock
+	numConnections  int             // Number of connected clients, whether or not they've joined a channel
+	connected       map[uint64]*client
 	createdTime     time.Time
 	numE2eChannels  int
 	maxChannels     int
 	maxChannelsTime time.Time
 	maxClients      int
 	maxClientsTime  time.Time
+
+	// Traffic received from clients in the current second.
+	// These are updated without holding lock, and sampled once per second into the peaks below.
+	secondMessages atomic.Int64
+	secondBytes    atomic.Int64
+
+	// traffic counts all traffic since the server started.
+	traffic trafficCounters
+	// messageTypes counts relayed channel messages by their type since the server started.
+	messageTypes messageTypeCounters
+
+	maxMessageRate     int64
+	maxMessageRateTime time.Time
+	maxByteRate        int64
+	maxByteRateTime    time.Time
+
+	churn churn
+
+	// Messages dropped, and clients disconnected, by the slow client policy.
+	slowClientDrops       atomic.Int64
+	slowClientDisconnects atomic.Int64
+
+	// Joins refused because the channel wasn't end-to-end encrypted, and the server is E2E only.
+	nonE2eJoins atomic.Int64
+
+	// Clients throttled, and kicked, for exceeding the rate limit.
+	rateLimitThrottles atomic.Int64
+	rateLimitKicks     atomic.Int64
+
+	// Channel messages rejected for being over the message limits.
+	messageLimitViolations atomic.Int64
+
+	// Sessions resumed by clients that lost their connection.
+	sessionsResumed atomic.Int64
+
+	// Connections and joins rejected for being over the server's capacity.
+	capacityRejections capacityRejections
+
+	blocklist channelBlocklist
+
+	bans banList
+
+	// ipFilter is nil unless the server has IP lists.
+	ipFilter *ipFilter
+
+	// debugChannels maps channel names to the time until which they should be debug logged.
+	// Channels created while their name is in this map will be debug logged.
+	debugChannels map[string]time.Time
+	// debugNetworks holds the addresses whose clients should be debug logged, by the address given to debug_client.
+	// Clients that connect from them are debug logged.
+	debugNetworks map[string]debugNetwork
+
+	nextID atomic.Uint64 // ID of the next client to connect
+
+	// randomIDs gives clients random IDs instead of nextID.
+	// reservedIDs holds the random IDs given to clients that are connecting, until they are in connected.
+	randomIDs   bool
+	reservedIDs map[uint64]struct{}
+
+	// webhooks are sent events as they happen.
+	webhooks []*webhook
+
+	// eventStreams are sent events as they happen, for as long as someone watches the admin event stream.
+	eventStreams eventStreams
+
+	// cluster shares channels with the other nodes of the server's cluster, or is nil if it isn't clustered.
+	cluster *clusterNode
+
+	// hooks are the server's Hooks, called as channels are created and destroyed.
+	hooks Hooks
+
+	// listenAddrs are the addresses the server is listening on.
+	listenAddrs []string
+
+	// privacy keeps clients' addresses and channel names out of stats and events.
+	privacy bool
+	// channelHasher identifies channels in stats, events and state dumps in place of their names.
+	channelHasher channelHasher
+
+	log Logger
 }
 
+// StatsVersion is the version of the Stats JSON schema.
+// It changes when a field is removed, or its meaning changes, but not when fields are added.
+const StatsVersion = 1
+
 // Stats contains summary information about a registry.
+// It is the one stats schema used by the stat message, admin commands, and tools built on them.
 type Stats struct {
+	// Version is the StatsVersion of the server that produced these stats.
+	Version int `json:"version"`
+
+	ListenAddrs     []string      `json:"listen_addrs"`
 	Uptime          time.Duration `json:"uptime"`
 	NumChannels     int           `json:"num_channels"`
 	NumE2eChannels  int           `json:"num_e2e_channels"`
 	MaxChannels     int           `json:"max_channels"`
 	MaxChannelsTime time.Time     `json:"max_channels_at"`
+	NumConnections  int           `json:"num_connections"`
 	NumClients      int           `json:"num_clients"`
 	MaxClients      int           `json:"max_clients"`
 	MaxClientsTime  time.Time     `json:"max_clients_at"`
+
+	// Peak traffic received from clients, per second.
+	MaxMessageRate     int64     `json:"max_message_rate"`
+	MaxMessageRateTime time.Time `json:"max_message_rate_at"`
+	MaxByteRate        int64     `json:"max_byte_rate"`
+	MaxByteRateTime    time.Time `json:"max_byte_rate_at"`
+
+	// Traffic since the server started.
+	// BytesReceived counts everything read from clients, and BytesSent everything written to them.
+	// MessagesRelayed counts messages relayed over channels, once per message, however many members received it.
+	BytesReceived   int64 `json:"bytes_received"`
+	BytesSent       int64 `json:"bytes_sent"`
+	MessagesRelayed int64 `json:"messages_relayed"`
+
+	// TopChannels lists the traffic of the channels that have sent the most bytes, busiest first.
+	TopChannels []ChannelTraffic `json:"top_channels"`
+
+	// TopMessageTypes lists the traffic of the channel message types that have been relayed the most, most relayed first.
+	TopMessageTypes []MessageTypeTraffic `json:"top_message_types"`
+
+	Churn ChurnStats `json:"churn"`
+
+	Latency LatencyStats `json:"latency"`
+
+	// Cluster summarizes the cluster the server belongs to, if it is clustered.
+	Cluster *ClusterStats `json:"cluster,omitempty"`
+
+	// BlockedJoins is the number of joins rejected by the channel blocklist.
+	BlockedJoins int64 `json:"blocked_joins"`
+
+	// CreationLimitedJoins is the number of joins rejected because they would have created a channel over the CreationLimit.
+	CreationLimitedJoins int64 `json:"creation_limited_joins"`
+
+	// NonE2eJoins is the number of joins refused because the channel wasn't end-to-end encrypted, and the server is E2E only.
+	NonE2eJoins int64 `json:"non_e2e_joins"`
+
+	// RateLimitThrottles is the number of times clients started being throttled for exceeding the rate limit,
+	// and RateLimitKicks is the number of clients kicked for staying over it.
+	RateLimitThrottles int64 `json:"rate_limit_throttles"`
+	RateLimitKicks     int64 `json:"rate_limit_kicks"`
+
+	// MessageLimitViolations is the number of channel messages rejected for being over the message limits.
+	MessageLimitViolations int64 `json:"message_limit_violations"`
+
+	// SlowClientDrops is the number of messages discarded because a client's queue was full,
+	// and SlowClientDisconnects is the number of clients disconnected for not keeping up.
+	SlowClientDrops       int64 `json:"slow_client_drops"`
+	SlowClientDisconnects int64 `json:"slow_client_disconnects"`
+
+	// SessionsResumed is the number of times a client that lost its connection resumed its session from a new one.
+	SessionsResumed int64 `json:"sessions_resumed"`
+
+	// FullConnections is the number of connections refused because the server had its max connections,
+	// and FullClientJoins and FullChannelJoins the number of joins rejected because it had its max clients or channels.
+	FullConnections  int64 `json:"full_connections"`
+	FullClientJoins  int64 `json:"full_client_joins"`
+	FullChannelJoins int64 `json:"full_channel_joins"`
+
+	// BannedConnections is the number of connections rejected because their address was banned.
+	BannedConnections int64 `json:"banned_connections"`
+
+	// DeniedConnections is the number of connections rejected because the IP allowlist, denylist or a deny feed didn't let their address in,
+	// and DeniedBySource breaks it down into "allowlist", "denylist", and each feed's URL.
+	DeniedConnections int64            `json:"denied_connections"`
+	DeniedBySource    map[string]int64 `json:"denied_by_source,omitempty"`
+
+	// Process resource usage, to spot leaks early.
+	HeapInUse     uint64 `json:"heap_in_use"`
+	TotalAlloc    uint64 `json:"total_alloc"`
+	NumGoroutines int    `json:"num_goroutines"`
+	// OpenFiles is the number of open file descriptors, or -1 if they can't be counted on this platform.
+	OpenFiles int `json:"open_files"`
 }
 
 // Stats gets stats for this registry.
 func (reg *registry) Stats() Stats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	topChannels := reg.dispatcher.topChannels(numTopChannels)
+	if reg.privacy {
+		for i := range topChannels {
+			topChannels[i].Channel = reg.channelHasher.hash(topChannels[i].Channel)
+		}
+	}
+
 	reg.lock.RLock()
 	defer reg.lock.RUnlock()
 
+	var cluster *ClusterStats
+	if reg.cluster != nil {
+		cluster = reg.cluster.stats(reg.clusterNodeStatsLocked())
+	}
 	return Stats{
+		Version:         StatsVersion,
+		ListenAddrs:     append([]string(nil), reg.listenAddrs...),
 		Uptime:          time.Since(reg.createdTime),
-		NumChannels:     len(reg.channels),
+		NumChannels:     reg.numChannels,
 		NumE2eChannels:  reg.numE2eChannels,
 		MaxChannels:     reg.maxChannels,
 		MaxChannelsTime: reg.maxChannelsTime,
+		NumConnections:  reg.numConnections,
 		NumClients:      len(reg.clients),
 		MaxClients:      reg.maxClients,
 		MaxClientsTime:  reg.maxClientsTime,
+
+		MaxMessageRate:     reg.maxMessageRate,
+		MaxMessageRateTime: reg.maxMessageRateTime,
+		MaxByteRate:        reg.maxByteRate,
+		MaxByteRateTime:    reg.maxByteRateTime,
+
+		BytesReceived:   reg.traffic.bytesReceived.Load(),
+		BytesSent:       reg.traffic.bytesSent.Load(),
+		MessagesRelayed: reg.traffic.messagesRelayed.Load(),
+		TopChannels:     topChannels,
+		TopMessageTypes: reg.messageTypes.top(numTopMessageTypes),
+
+		Churn:                reg.churn.stats(),
+		Latency:              reg.latencyStats(),
+		Cluster:              cluster,
+		BlockedJoins:         reg.blocklist.numRejected(),
+		CreationLimitedJoins: reg.creations.rejected.Load(),
+		NonE2eJoins:          reg.nonE2eJoins.Load(),
+
+		RateLimitThrottles: reg.rateLimitThrottles.Load(),
+		RateLimitKicks:     reg.rateLimitKicks.Load(),
+
+		MessageLimitViolations: reg.messageLimitViolations.Load(),
+
+		SlowClientDrops:       reg.slowClientDrops.Load(),
+		SlowClientDisconnects: reg.slowClientDisconnects.Load(),
+
+		SessionsResumed: reg.sessionsResumed.Load(),
+
+		FullConnections:  reg.capacityRejections.connections.Load(),
+		FullClientJoins:  reg.capacityRejections.clients.Load(),
+		FullChannelJoins: reg.capacityRejections.channels.Load(),
+
+		BannedConnections: reg.bans.numRejected(),
+		DeniedConnections: reg.ipFilter.numRejected(),
+		DeniedBySource:    reg.ipFilter.rejectedBySource(),
+
+		HeapInUse:     mem.HeapInuse,
+		TotalAlloc:    mem.TotalAlloc,
+		NumGoroutines: runtime.NumGoroutine(),
+		OpenFiles:     countOpenFiles(),
+	}
+}
+
+// countTraffic counts a message of size bytes received from a client.
+// This method is safe to use concurrently, without holding the registry lock.
+func (reg *registry) countTraffic(size int64) {
+	reg.secondMessages.Add(1)
+	reg.secondBytes.Add(size)
+	reg.traffic.bytesReceived.Add(size)
+}
+
+// sampleTraffic ends the current second of traffic, updating the peak rates if it was busier than any before.
+// It should be called once per second.
+func (reg *registry) sampleTraffic() {
+	messages := reg.secondMessages.Swap(0)
+	bytes := reg.secondBytes.Swap(0)
+	now := time.Now()
+
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if messages > reg.maxMessageRate {
+		reg.maxMessageRate = messages
+		reg.maxMessageRateTime = now
+	}
+	if bytes > reg.maxByteRate {
+		reg.maxByteRate = bytes
+		reg.maxByteRateTime = now
+	}
+}
+
+// countOpenFiles counts the file descriptors open by this process.
+// If the platform doesn't provide a way to list them, -1 is returned.
+func countOpenFiles() int {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if entries, err := os.ReadDir(dir); err == nil {
+			return len(entries) - 1 // Don't count the descriptor used to read the directory.
+		}
 	}
+	return -1
 }
@@ -0,0 +1,39 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import "github.com/pkg/errors"
+
+// A RelayMode decides which members of a channel receive the messages relayed from another member.
+type RelayMode string
+
+const (
+	// RelayAll relays messages to every member except the one who sent them.
+	RelayAll RelayMode = "all"
+
+	// RelayOpposite relays messages only to members with a different connection type than the one who sent them,
+	// so a master's messages go to slaves, and a slave's messages go to masters.
+	RelayOpposite RelayMode = "opposite"
+)
+
+// ParseRelayMode parses the name of a relay mode.
+// An empty name is RelayAll.
+func ParseRelayMode(name string) (RelayMode, error) {
+	switch mode := RelayMode(name); mode {
+	case "":
+		return RelayAll, nil
+	case RelayAll, RelayOpposite:
+		return mode, nil
+	}
+	return "", errors.Errorf("unknown relay mode %q; must be all or opposite", name)
+}
+
+// relaysTo reports whether a message from a member with connection type originType is relayed to member.
+func (mode RelayMode) relaysTo(originType string, member channelMember) bool {
+	if mode == RelayOpposite {
+		return member.connectionType != originType
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultReverseDNSTimeout is how long looking up a client's host name may take, if the server's ReverseDNS doesn't say.
+const defaultReverseDNSTimeout = 2 * time.Second
+
+// ReverseDNS configures looking up the host names of the addresses clients connect from,
+// which are shown alongside the addresses in logs and client listings.
+type ReverseDNS struct {
+	// Disabled skips looking up host names, so clients are only known by their addresses.
+	Disabled bool
+
+	// Timeout is how long a lookup may take before the client is known by its address.
+	// If 0, lookups time out after 2 seconds.
+	Timeout time.Duration
+
+	// CacheTTL is how long the host name of an address, or the failure to find one, is remembered,
+	// so that clients reconnecting from the same address don't wait on the resolver again.
+	// If 0, host names aren't cached.
+	CacheTTL time.Duration
+}
+
+// WithReverseDNS sets how the host names of clients' addresses are looked up.
+func WithReverseDNS(rdns ReverseDNS) Option {
+	return func(srv *Server) error {
+		if err := notNegative("reverse DNS timeout", rdns.Timeout); err != nil {
+			return err
+		}
+		if err := notNegative("reverse DNS cache TTL", rdns.CacheTTL); err != nil {
+			return err
+		}
+		srv.ReverseDNS = rdns
+		return nil
+	}
+}
+
+// hostCache looks up the host names of addresses, remembering them for a while.
+// Its methods are safe to use concurrently.
+type hostCache struct {
+	lock    sync.Mutex
+	entries map[string]*hostEntry
+}
+
+// hostEntry is the host name of an address, once ready is closed.
+type hostEntry struct {
+	ready   chan struct{}
+	host    string
+	expires time.Time
+}
+
+// lookup gets the host name of addr, as "names (addr)", or addr if it has none or rdns is disabled.
+// Clients connecting from the same address at once share a single lookup.
+func (hc *hostCache) lookup(addr string, rdns ReverseDNS) string {
+	if rdns.Disabled {
+		return addr
+	}
+
+	hc.lock.Lock()
+	if e, ok := hc.entries[addr]; ok {
+		select {
+		case <-e.ready:
+			if time.Now().Before(e.expires) {
+				hc.lock.Unlock()
+				return e.host
+			}
+		default:
+			hc.lock.Unlock()
+			<-e.ready
+			return e.host
+		}
+	}
+	if hc.entries == nil {
+		hc.entries = make(map[string]*hostEntry)
+	}
+	e := &hostEntry{ready: make(chan struct{})}
+	hc.entries[addr] = e
+	hc.lock.Unlock()
+
+	timeout := rdns.Timeout
+	if timeout == 0 {
+		timeout = defaultReverseDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// No need to report errors; just fall back to the address.
+	names, _ := net.DefaultResolver.LookupAddr(ctx, addr)
+	e.host = formatHost(addr, names)
+
+	hc.lock.Lock()
+	e.expires = time.Now().Add(rdns.CacheTTL)
+	close(e.ready)
+	if rdns.CacheTTL == 0 {
+		delete(hc.entries, addr)
+	}
+	hc.lock.Unlock()
+	return e.host
+}
+
+// prune forgets host names that have expired.
+func (hc *hostCache) prune(now time.Time) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+	for addr, e := range hc.entries {
+		select {
+		case <-e.ready:
+			if !now.Before(e.expires) {
+				delete(hc.entries, addr)
+			}
+		default:
+		}
+	}
+}
+
+// formatHost formats the host names of addr.
+// If it has none, it is just the address.
+func formatHost(addr string, names []string) string {
+	hosts := strings.Join(names, ", ")
+	if hosts == "" {
+		return addr
+	}
+	return fmt.Sprintf("%s (%s)", hosts, addr)
+}
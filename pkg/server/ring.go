@@ -0,0 +1,71 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas is how many points each node has on a hashRing, so that channels are spread evenly between nodes.
+const ringReplicas = 64
+
+// hashRing assigns keys to nodes by consistent hashing,
+// so that when a node joins or leaves, only the keys it owned, or takes over, change owner.
+type hashRing struct {
+	points []ringPoint // Sorted by hash
+}
+
+// ringPoint is one of a node's points on a hashRing.
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// newHashRing creates a hashRing over nodes.
+func newHashRing(nodes []string) hashRing {
+	points := make([]ringPoint, 0, len(nodes)*ringReplicas)
+	for _, node := range nodes {
+		for i := 0; i < ringReplicas; i++ {
+			points = append(points, ringPoint{hash: ringHash(node + "#" + strconv.Itoa(i)), node: node})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].node < points[j].node
+	})
+	return hashRing{points: points}
+}
+
+// owner gets the node that owns key, which is the node of the first point at or after key's hash, wrapping around.
+// If the ring has no nodes, it returns "".
+func (r hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// ringHash hashes s onto a hashRing.
+// FNV alone leaves strings that differ only in their last characters close together, so its hash is mixed further.
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
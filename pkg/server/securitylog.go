@@ -0,0 +1,80 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SecurityEvent is the kind of an event written to the security log.
+type SecurityEvent string
+
+const (
+	// SecurityAuthFailure is for a wrong stats or channel password, an attempt while locked out for guessing,
+	// or a client rejected by the server's Authenticator.
+	SecurityAuthFailure SecurityEvent = "auth_failure"
+
+	// SecurityProtocolViolation is for a client kicked for breaking the protocol, such as by sending a malformed message.
+	SecurityProtocolViolation SecurityEvent = "protocol_violation"
+
+	// SecurityBan and SecurityUnban are for an address being banned, whether automatically or by an admin, and unbanned by an admin.
+	SecurityBan   SecurityEvent = "ban"
+	SecurityUnban SecurityEvent = "unban"
+
+	// SecurityRefused is for a connection refused because its address is banned, or not allowed by the IP lists.
+	SecurityRefused SecurityEvent = "refused"
+)
+
+// securityLogTag starts every line of the security log after the time, so that rules can tell it apart from other logs.
+const securityLogTag = "nvremoted-security:"
+
+// WithSecurityLog writes security events to w, one per line, in a format that tools such as fail2ban can match reliably.
+// Each line looks like:
+//
+//	2006-01-02T15:04:05Z nvremoted-security: event=auth_failure addr=203.0.113.7 detail="wrong stats password"
+//
+// The time is in UTC. The fields always come in this order, event is one of the SecurityEvent values,
+// addr is an IP address, or a network in CIDR notation for bans, and detail is a double-quoted string, escaped as in Go.
+// New fields are only ever added after detail. A fail2ban filter could match it with:
+//
+//	failregex = ^\S+ nvremoted-security: event=(auth_failure|protocol_violation) addr=<HOST>
+func WithSecurityLog(w io.Writer) Option {
+	return func(srv *Server) error {
+		srv.SecurityLog = w
+		return nil
+	}
+}
+
+// securityLog serializes writes to the server's security log.
+type securityLog struct {
+	lock sync.Mutex
+}
+
+// securityEvent writes an event about addr to the security log, if the server has one.
+func (srv *Server) securityEvent(event SecurityEvent, addr, detail string) {
+	if srv.SecurityLog == nil {
+		return
+	}
+	line := fmt.Sprintf("%s %s event=%s addr=%s detail=%s\n",
+		time.Now().UTC().Format(time.RFC3339), securityLogTag, event, addr, strconv.Quote(detail))
+	srv.securityLog.lock.Lock()
+	_, err := io.WriteString(srv.SecurityLog, line)
+	srv.securityLog.lock.Unlock()
+	if err != nil {
+		srv.Log.WithField("error", err).Error("Error writing to the security log")
+	}
+}
+
+// securityEvent writes an event about the client's address to the security log.
+// Clients that didn't connect from an IP address, such as over the control socket, aren't logged.
+func (c *client) securityEvent(event SecurityEvent, detail string) {
+	if ip := addrIP(c.addr); ip != nil {
+		c.srv.securityEvent(event, ip.String(), detail)
+	}
+}
@@ -6,20 +6,24 @@
 package server
 
 import (
-	"fmt"
+	"context"
+	"io"
 	"net"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 
 	"crypto/tls"
 )
 
 // Server Contains state for an NVRemoted server.
+// Servers should be created with NewServer, whose options check the configuration up front.
+// Setting the exported fields directly still works, but isn't checked.
 type Server struct {
 	// TimeBetweenPings specifies the amount of time that will elapse before clients will be sent a ping.
+	// Clients that have sent a message in that time aren't idle, so aren't pinged.
 	// If 0, no pings will be sent.
 	TimeBetweenPings time.Duration
 
@@ -27,39 +31,257 @@ type Server struct {
 	// If TimeBetweenPings is 0, this field has no effect.
 	PingsUntilTimeout int
 
+	// WriteTimeout specifies how long a write to a client may block before the connection is considered dead.
+	// Peers that stop acknowledging data are reaped once a write times out, instead of lingering until the read timeout.
+	// If 0, writes never time out.
+	WriteTimeout time.Duration
+
+	// FlushSize is the size in bytes of each client's output buffer.
+	// Buffered output is written as soon as it reaches this size, without waiting for FlushDelay.
+	// If 0, a 4KB buffer is used.
+	FlushSize int
+
+	// FlushDelay specifies how long output may wait in a client's buffer for more output to be sent along with it.
+	// Longer delays mean fewer, larger writes at the cost of latency.
+	// If 0, output is flushed as soon as there are no more events queued for the client.
+	FlushDelay time.Duration
+
+	// ReverseDNS configures looking up the host names of clients' addresses.
+	ReverseDNS ReverseDNS
+
+	// TrustedProxies are the networks of proxies whose word on a client's address is taken, for connections that are a ProxiedConn.
+	TrustedProxies []*net.IPNet
+
+	// Capacity limits how many connections, clients in channels, and channels the server takes on at once.
+	Capacity Capacity
+
+	// RateLimit limits the rate at which each client may send messages.
+	RateLimit RateLimit
+
+	// MaxAcceptRate is the number of connections accepted per second, across all listeners,
+	// so that a flood of connections can't starve the clients already connected.
+	// A second's worth may be accepted at once. If 0, accepts aren't limited.
+	MaxAcceptRate float64
+	acceptLimit   acceptLimiter
+
+	// MessageLimits bound the nesting and number of keys of the messages clients send to their channels.
+	MessageLimits MessageLimits
+
+	// ChannelQuota limits the bandwidth each channel may use per hour and per day.
+	ChannelQuota ChannelQuota
+
+	// CreationLimit limits how many channels each IP address may create per minute and per hour.
+	CreationLimit CreationLimit
+
+	// QueueSize is the number of messages that can be queued for each client, waiting to be written.
+	// If 0, 32 messages can be queued.
+	QueueSize int
+
+	// SlowClientPolicy decides what happens when a client's queue is full.
+	// If empty, SlowClientBlock is used.
+	SlowClientPolicy SlowClientPolicy
+
+	// MasterPolicy decides what happens when a master joins a channel that already has one.
+	// If empty, MasterAllow is used.
+	MasterPolicy MasterPolicy
+
+	// RelayMode decides which members of a channel receive each message.
+	// If empty, RelayAll is used.
+	RelayMode RelayMode
+
+	// SessionGrace is how long a client whose connection was lost keeps its place in its channel,
+	// so that it can resume its session from a new connection without the channel's other members noticing.
+	// Messages sent to it in the meantime are lost.
+	// If 0, sessions can't be resumed.
+	SessionGrace time.Duration
+
+	// DispatchShards is the number of goroutines that relay messages over channels.
+	// Each channel is handled by one of them, chosen by its name, so a channel's messages are relayed in order.
+	// With SlowClientBlock, a slow client holds up every channel on its shard, not just its own.
+	// If 0, 64 shards are used.
+	DispatchShards int
+
 	// TLSConfig optionally provides a TLS configuration for use by ListenAndServeTLS.
 	TLSConfig *tls.Config
 
+	// TLSMinVersion and TLSMaxVersion limit the TLS versions clients may use, such as tls.VersionTLS12.
+	// If 0, the TLSConfig's limits are used.
+	TLSMinVersion uint16
+	TLSMaxVersion uint16
+
+	// TLSCipherSuites restricts the cipher suites used with TLS 1.2 and earlier.
+	// If empty, the TLSConfig's cipher suites are used.
+	TLSCipherSuites []uint16
+
 	// MOTD contains the message of the day, which will be sent to clients when connecting.
-	MOTD string
+	// Use SetMOTD to change it while the server is running.
+	MOTD     string
+	motdLock sync.RWMutex // Protects MOTD
 
 	// StatsPassword sets the password for retreiving stats.
+	// It may be a bcrypt hash of the password, from HashPassword.
 	StatsPassword string
 
-	Log *logrus.Logger
+	// AllowedChannels restricts the channels clients may join to those matching at least one pattern.
+	// If empty, any channel may be joined.
+	AllowedChannels []ChannelPattern
+
+	// E2eOnly refuses joins to channels that aren't used with end-to-end encryption,
+	// telling clients to upgrade to a version of NVDA Remote that supports it.
+	E2eOnly bool
+
+	// ProtocolVersions are the versions of the protocol clients may negotiate.
+	// If empty, only version 2 is spoken.
+	ProtocolVersions []int
+
+	// HideCapabilities stops clients being sent the server's capabilities when they connect.
+	// Clients can still ask for them.
+	HideCapabilities bool
+
+	// BlockedChannels lists patterns of channels clients may not join when the server starts.
+	// Patterns can be added to or removed from the blocklist with admin commands while the server is running.
+	BlockedChannels []ChannelPattern
+
+	// BanFile is the file banned addresses are saved to, and loaded from when the server starts.
+	// Addresses are banned and unbanned with admin commands.
+	// If empty, bans last until the server stops.
+	BanFile string
+
+	// SecurityLog, if not nil, is written a line for each failed authentication, protocol violation, ban, and refused connection.
+	// See WithSecurityLog for its format.
+	SecurityLog io.Writer
+	securityLog securityLog
+
+	// Privacy keeps clients' addresses and host names, and channel names, out of logs, stats, events and traces.
+	// Channels are identified by ChannelHash instead, and hashes can only be linked to each other within a single run of the server,
+	// unless PrivacyKey is set. See WithPrivacy.
+	Privacy bool
+
+	// PrivacyKey is the secret ChannelHash is keyed with, so that channels keep the same hashes when the server restarts.
+	// If empty, a random key is chosen each time the server starts. See WithPrivacyKey.
+	PrivacyKey string
+
+	// RandomIDs gives clients random IDs, rather than numbering them in the order they connect.
+	// See WithRandomIDs.
+	RandomIDs bool
+
+	// AbuseBans temporarily bans addresses that keep breaking the protocol or giving wrong stats passwords.
+	AbuseBans AbuseBans
+
+	// IPLists names files of addresses that may, or may not, connect, which are reloaded when they change,
+	// and feeds of addresses that may not, which are fetched periodically.
+	IPLists  IPLists
+	ipFilter *ipFilter
+
+	// ChannelPasswords lists patterns of channels that require a password to join.
+	ChannelPasswords []ChannelPassword
+
+	// Webhooks lists URLs that are sent a JSON POST for each Event, such as clients connecting or channels being created.
+	// Events are delivered in the background, and are dropped if a webhook can't keep up, or still fails after several retries.
+	Webhooks []string
+
+	// Pprof serves net/http/pprof profiles under /debug/pprof/ on the health listener,
+	// to those who give the stats password with HTTP basic authentication.
+	Pprof bool
+
+	// Dashboard serves a web dashboard of the server's clients, channels and traffic under /admin/ on the health listener,
+	// along with the admin API it uses, to those who give the stats password or a token with HTTP basic authentication.
+	Dashboard bool
+
+	// Statsd optionally pushes metrics to a statsd server.
+	Statsd Statsd
+
+	// Cluster optionally shares the server's channels with other servers, so that clients connected to any of them can share a channel.
+	Cluster Cluster
+
+	// Tokens are named passwords for stats and admin commands, each allowing only some of them.
+	// They can be replaced while the server runs with SetTokens.
+	Tokens []Token
+
+	// History optionally records the server's stats over time, to be fetched with the history admin command.
+	History StatsHistory
+
+	// TracerProvider provides the tracer for OpenTelemetry spans covering clients' sessions, joins, and relayed messages.
+	// If nil, the global tracer provider is used, which discards spans unless one has been set.
+	TracerProvider trace.TracerProvider
+
+	// Hooks are called as clients and channels come and go.
+	Hooks Hooks
+
+	// Authenticator, if set, decides whether clients may connect and join channels.
+	Authenticator Authenticator
+
+	// Codecs are encodings clients may switch to from JSON, such as MessagePack, by sending a codec message.
+	Codecs []Codec
+
+	// Compression lists the stream compression algorithms offered to clients that ask for it, in order of preference.
+	Compression []string
+
+	// Bind controls what happens when ListenAndServe or ListenAndServeTLS can't bind their address.
+	// By default, they fail immediately.
+	Bind BindPolicy
+
+	// Log is what the server logs to, such as a logrus logger adapted with NewLogrusLogger.
+	Log Logger
 
 	// registry stores information about clients and channels on the server.
 	registry registry
+
+	goroutineHistory goroutineHistory
+
+	shutdown shutdownState
+
+	drain drainState
+
+	handoff handoffState
+
+	tokens tokenSet
+
+	// messageTypesByName holds the types of message clients can send, which Handle adds to.
+	messageTypesByName map[string]messageType
+	messageTypesOnce   sync.Once
+	middleware         []Middleware // Wraps every message type's handler, added with Use
+
+	startOnce sync.Once // Starts the server when it begins serving its first listener
+}
+
+// ListenConfig describes an address for the server to listen on.
+type ListenConfig struct {
+	Addr string
+
+	// TLS wraps connections to this address with TLS, using the server's TLSConfig.
+	TLS bool
 }
 
 // ListenAndServe listens for connections on the network, and connects them to the NVDA Remote server.
 func (srv *Server) ListenAndServe(addr string) error {
-	listener, err := net.Listen("tcp", addr)
+	return srv.ListenAndServeContext(context.Background(), addr)
+}
+
+// ListenAndServeContext behaves like ListenAndServe, but shuts the server down when ctx is canceled, as ServeContext does.
+// If ctx is canceled while waiting to retry binding addr, the error is returned.
+func (srv *Server) ListenAndServeContext(ctx context.Context, addr string) error {
+	listener, err := srv.listen(ctx, addr, srv.Bind.FallbackAddrs)
 	if err != nil {
-		return errors.Wrap(err, "Listen")
+		return err
 	}
 	defer listener.Close()
 
-	srv.Log.WithFields(logrus.Fields{
-		"addr":        addr,
+	srv.Log.WithFields(Fields{
+		"addr":        listener.Addr().String(),
 		"tls_enabled": false,
 	}).Info("Listening for incoming connections")
-	srv.Serve(listener)
+	srv.ServeContext(ctx, listener)
 	return nil
 }
 
 // ListenAndServeTLS behaves just like ListenAndServe, but wraps the connection with TLS.
 func (srv *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	return srv.ListenAndServeTLSContext(context.Background(), addr, certFile, keyFile)
+}
+
+// ListenAndServeTLSContext behaves like ListenAndServeTLS, but shuts the server down when ctx is canceled, as ServeContext does.
+func (srv *Server) ListenAndServeTLSContext(ctx context.Context, addr, certFile, keyFile string) error {
 	if certFile != "" && keyFile != "" {
 		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 		if err != nil {
@@ -71,59 +293,274 @@ func (srv *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
 		return errors.New("No TLSConfig set in server, and no certFile/keyFile given")
 	}
 
-	listener, err := tls.Listen("tcp", addr, srv.TLSConfig)
+	listener, err := srv.listen(ctx, addr, srv.Bind.FallbackAddrs)
 	if err != nil {
-		return errors.Wrap(err, "Listen TLS")
+		return err
 	}
+	listener = tls.NewListener(listener, srv.tlsConfig())
 	defer listener.Close()
 
-	srv.Log.WithFields(logrus.Fields{
-		"addr":        addr,
+	srv.Log.WithFields(Fields{
+		"addr":        listener.Addr().String(),
 		"tls_enabled": true,
 	}).Info("Listening for incoming connections")
-	srv.Serve(listener)
+	srv.ServeContext(ctx, listener)
 	return nil
 }
 
-func (srv *Server) acceptClients(listener net.Listener) {
-	var nextID uint64
-	for {
-		conn, err := listener.Accept()
+// ListenAndServeAll listens on several addresses, each with or without TLS,
+// and serves clients connecting to any of them, who share the same channels.
+// Bind fallback addresses aren't used, since they are for a single address, but retries are.
+// It returns once all of the listeners have been closed.
+func (srv *Server) ListenAndServeAll(configs []ListenConfig) error {
+	return srv.ListenAndServeAllContext(context.Background(), configs)
+}
+
+// ListenAndServeAllContext behaves like ListenAndServeAll, but shuts the server down when ctx is canceled, as ServeContext does.
+func (srv *Server) ListenAndServeAllContext(ctx context.Context, configs []ListenConfig) error {
+	listeners := make([]net.Listener, 0, len(configs))
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+	for _, config := range configs {
+		if config.TLS && srv.TLSConfig == nil {
+			return errors.Errorf("No TLSConfig set in server for %s", config.Addr)
+		}
+		listener, err := srv.listen(ctx, config.Addr, nil)
 		if err != nil {
-			srv.Log.WithFields(logrus.Fields{
-				"error": err,
-			}).Error("Error accepting connection")
-			continue
+			return err
 		}
-		if tcpConn, ok := conn.(*net.TCPConn); ok {
-			tcpConn.SetKeepAlive(true)
-			tcpConn.SetKeepAlivePeriod(srv.TimeBetweenPings)
+		if config.TLS {
+			listener = tls.NewListener(listener, srv.tlsConfig())
 		}
+		listeners = append(listeners, listener)
+		srv.Log.WithFields(Fields{
+			"addr":        listener.Addr().String(),
+			"tls_enabled": config.TLS,
+		}).Info("Listening for incoming connections")
+	}
 
-		remoteAddr, _, err := net.SplitHostPort(conn.RemoteAddr().String())
-		remoteHost := getHostFromAddrIfPossible(remoteAddr)
-		srv.serveClient(conn, nextID, remoteHost)
-		nextID++
+	defer srv.shutdownOnCancel(ctx)()
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			srv.Serve(listener)
+		}(listener)
 	}
+	wg.Wait()
+	return nil
 }
 
-// Serve serves clients the NVDA Remote service.
+// acceptClients accepts clients connecting to listener until it is closed.
+// Connections over the MaxAcceptRate wait in the listener's backlog.
+func (srv *Server) acceptClients(listener net.Listener) {
+	srv.acceptLoop(listener, "connection", func(conn net.Conn) {
+		srv.acceptConn(conn)
+		srv.acceptLimit.wait(srv.MaxAcceptRate)
+	})
+}
+
+// acceptConn starts serving a client that has connected, unless the server is shutting down or its address is banned.
+// It returns a channel that is closed once the client has disconnected, or its connection was refused and closed.
+func (srv *Server) acceptConn(conn net.Conn) <-chan struct{} {
+	if srv.shutdown.closing.Load() {
+		conn.Close()
+		return nil
+	}
+	addr := srv.clientAddr(conn)
+	if ip := addrIP(addr); ip != nil && srv.registry.ipFilter != nil && !srv.registry.ipFilter.allowed(ip) {
+		srv.Log.WithField("remote_addr", ip.String()).Info("Rejected connection from address not allowed by the IP lists")
+		srv.securityEvent(SecurityRefused, ip.String(), "not allowed by the IP lists")
+		return srv.refuseConn(conn, KickBanned, "banned: connections from your address are not allowed")
+	}
+	if ip := addrIP(addr); ip != nil && srv.registry.bans.banned(ip) {
+		srv.Log.WithField("remote_addr", ip.String()).Info("Rejected connection from banned address")
+		srv.securityEvent(SecurityRefused, ip.String(), "banned")
+		return srv.refuseConn(conn, KickBanned, "banned: connections from your address are not allowed")
+	}
+	id, ok := srv.registry.reserveConnection(srv.Capacity.MaxConnections)
+	if !ok {
+		srv.Log.WithField("remote_addr", addrHost(addr)).Info("Rejected connection because the server is full")
+		return srv.refuseConn(conn, KickServerFull, ErrServerFull.Error())
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(srv.TimeBetweenPings)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// Looking up the client's host name may wait on a slow resolver, which mustn't hold up accepting other connections.
+		remoteHost := srv.registry.hosts.lookup(addrHost(addr), srv.ReverseDNS)
+		if srv.shutdown.closing.Load() {
+			srv.registry.releaseConnection(id)
+			conn.Close()
+			close(done)
+			return
+		}
+		srv.serveClient(conn, id, addr, remoteHost, done)
+	}()
+	return done
+}
+
+// refuseTimeout is how long telling a refused connection why may take, if the server has no WriteTimeout.
+const refuseTimeout = 5 * time.Second
+
+// refuseConn tells a connection the server won't serve why, as it would a version 2 client it disconnected, and closes it.
+// This happens in the background, so a connection that doesn't read can't hold up accepting others.
+// It returns a channel that is closed once conn has been closed.
+func (srv *Server) refuseConn(conn net.Conn, code KickCode, reason string) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer conn.Close()
+		timeout := srv.WriteTimeout
+		if timeout <= 0 {
+			timeout = refuseTimeout
+		}
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		for _, resp := range protocols[defaultProtocolVersion].kickResponses(code, reason) {
+			buf, err := jsonCodec{}.Marshal(resp)
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// ServeConn serves the NVDA Remote service to a single client connected over conn,
+// which may come from a custom transport, such as an SSH tunnel, inetd, or a net.Pipe in a test.
+// It returns once the client has disconnected, and conn has been closed.
+// Connections from banned addresses are told so and closed, and any made once the server has shut down are closed, without being served.
+func (srv *Server) ServeConn(conn net.Conn) {
+	srv.startOnce.Do(srv.start)
+	if done := srv.acceptConn(conn); done != nil {
+		<-done
+	}
+}
+
+// Serve serves clients connecting to listener the NVDA Remote service.
+// Serve may be called with several listeners at once, whose clients will share the same channels.
+// It returns when the listener is closed, including by Shutdown, or once a Handoff has drained the server's connections.
 func (srv *Server) Serve(listener net.Listener) {
-	srv.Log.WithFields(logrus.Fields{
+	srv.startOnce.Do(srv.start)
+	srv.shutdown.addListener(listener)
+
+	srv.registry.lock.Lock()
+	srv.registry.listenAddrs = append(srv.registry.listenAddrs, listener.Addr().String())
+	srv.registry.lock.Unlock()
+
+	srv.acceptClients(listener)
+	srv.handoff.wait()
+}
+
+// ServeContext behaves like Serve, but shuts the server down when ctx is canceled:
+// every listener stops accepting connections, and clients are kicked, as when a Shutdown comes due.
+// It returns once the clients have disconnected, or have been given ten seconds to do so.
+func (srv *Server) ServeContext(ctx context.Context, listener net.Listener) {
+	defer srv.shutdownOnCancel(ctx)()
+	srv.Serve(listener)
+}
+
+// start initializes the server's state, and starts its periodic tasks.
+func (srv *Server) start() {
+	hasher := newChannelHasher(srv.PrivacyKey)
+	if srv.Privacy {
+		srv.Log = newPrivateLogger(srv.Log, hasher)
+	}
+	srv.applyMiddleware()
+	srv.Log.WithFields(Fields{
 		"time_between_pings":  srv.TimeBetweenPings,
 		"pings_until_timeout": srv.PingsUntilTimeout,
+		"write_timeout":       srv.WriteTimeout,
+		"flush_size":          srv.FlushSize,
+		"flush_delay":         srv.FlushDelay,
 	}).Info("Server started")
 
 	now := time.Now()
+	stop := srv.shutdown.done()
 	srv.registry = registry{
-		clients:         make(map[uint64]channelMember),
-		channels:        make(map[string]*channel),
-		statsPassword:   srv.StatsPassword,
+		clients:    make(map[uint64]channelMember),
+		connected:  make(map[uint64]*client),
+		dispatcher: newDispatcher(srv.DispatchShards, stop),
+		tracer:     srv.tracer(),
+		relayMode:  srv.RelayMode,
+		capacity:   srv.Capacity,
+		hooks:      srv.Hooks,
+		privacy:    srv.Privacy,
+		randomIDs:  srv.RandomIDs,
+
+		channelHasher: hasher,
+		quotas: channelQuotas{
+			quota: srv.ChannelQuota,
+			usage: make(map[string]*channelUsage),
+		},
+		creations:       creationLimiter{limit: srv.CreationLimit},
+		sessions:        sessionTable{sessions: make(map[string]*session)},
+		debugChannels:   make(map[string]time.Time),
+		debugNetworks:   make(map[string]debugNetwork),
+		reservedIDs:     make(map[uint64]struct{}),
 		createdTime:     now,
 		maxChannelsTime: now,
 		maxClientsTime:  now,
+
+		maxMessageRateTime: now,
+		maxByteRateTime:    now,
+
+		log: srv.Log,
+	}
+	if srv.Cluster.Backplane != nil {
+		srv.registry.cluster = newClusterNode(srv.Cluster, &srv.registry)
+	}
+	for _, url := range srv.Webhooks {
+		srv.registry.webhooks = append(srv.registry.webhooks, newWebhook(url, srv.Log, stop))
+	}
+	for _, pattern := range srv.BlockedChannels {
+		srv.registry.blocklist.add(pattern)
+	}
+	if srv.BanFile != "" {
+		if err := srv.registry.bans.load(srv.BanFile); err != nil {
+			srv.Log.WithFields(Fields{
+				"file":  srv.BanFile,
+				"error": err,
+			}).Error("Error loading bans")
+		}
 	}
-	go srv.acceptClients(listener)
+	if srv.ipFilter == nil && (srv.IPLists.AllowFile != "" || srv.IPLists.DenyFile != "" || len(srv.IPLists.DenyURLs) > 0) {
+		filter, err := newIPFilter(srv.IPLists)
+		if err != nil {
+			// Serving nobody is safer than serving the addresses the lists were meant to keep out.
+			srv.Log.WithField("error", err).Error("Error loading IP lists; refusing all connections until they load")
+		}
+		srv.ipFilter = filter
+	}
+	if srv.ipFilter != nil {
+		srv.registry.ipFilter = srv.ipFilter
+		go srv.watchIPLists(srv.ipFilter)
+		if len(srv.ipFilter.feeds) > 0 {
+			go srv.fetchIPFeeds(srv.ipFilter)
+		}
+	}
+	if srv.Statsd.Addr != "" {
+		go srv.pushStatsd()
+	}
+	if srv.History.File != "" {
+		go srv.recordHistory()
+	}
+	go srv.runTimers()
+}
+
+// runTimers runs the server's periodic tasks, until it shuts down.
+func (srv *Server) runTimers() {
+	stop := srv.shutdown.done()
 
 	// Setup a ping timer to periodically ping clients.
 	// If timeBetweenPings is 0,
@@ -136,36 +573,72 @@ func (srv *Server) Serve(listener net.Listener) {
 	}
 	pingMSG := pingMessage{}
 
+	// Traffic rates, churn, and channels' quota usage are counted per second.
+	trafficTicker := time.NewTicker(time.Second)
+	defer trafficTicker.Stop()
+
+	// Addresses that stopped guessing the stats password, and idle channels' quota usage, are forgotten once in a while.
+	lockoutTicker := time.NewTicker(time.Minute)
+	defer lockoutTicker.Stop()
+
 	for {
 		select {
-		case <-pingsCH:
+		case <-stop:
+			return
+
+		case now := <-trafficTicker.C:
+			srv.registry.sampleTraffic()
+			srv.registry.advanceChurn()
+			srv.registry.accountQuotas(now)
+
+		case now := <-lockoutTicker.C:
+			srv.registry.lockout.prune(now)
+			srv.registry.abuse.prune(now, srv.AbuseBans.Window)
+			srv.registry.creations.prune(now)
+			srv.registry.hosts.prune(now)
+			srv.registry.quotas.prune(now)
+
+		case now := <-pingsCH:
+			// Clients that have sent something since the last tick aren't idle, so don't need waking to be pinged.
+			idleSince := now.Add(-srv.TimeBetweenPings).UnixNano()
 			srv.registry.lock.RLock()
 			for _, member := range srv.registry.clients {
-				member.events <- pingMSG
+				if member.client.lastActive.Load() > idleSince {
+					continue
+				}
+				// Clients with a full queue have output pending, which does a ping's job.
+				select {
+				case member.events <- pingMSG:
+				default:
+				}
 			}
 			srv.registry.lock.RUnlock()
 		}
 	}
 }
 
-type pingMessage struct{}
+// SetMOTD changes the message of the day sent to clients when they connect.
+// This method is safe to use while the server is running.
+func (srv *Server) SetMOTD(motd string) {
+	srv.motdLock.Lock()
+	srv.MOTD = motd
+	srv.motdLock.Unlock()
+}
 
-func (pingMessage) Name() string {
-	return "ping"
+// getMOTD gets the current message of the day.
+func (srv *Server) getMOTD() string {
+	srv.motdLock.RLock()
+	defer srv.motdLock.RUnlock()
+	return srv.MOTD
 }
 
-// getHostFromAddrIfPossible tries to get the reverse dns host for an address.
-// If that isn't possible, it just returns the address.
-func getHostFromAddrIfPossible(addr string) string {
-	var hosts string
-	names, err := net.LookupAddr(addr)
-	if err == nil { // No need to report errors; just fallback to IP
-		hosts = strings.Join(names, ", ")
-	}
+// Stats gets stats for the running server.
+func (srv *Server) Stats() Stats {
+	return srv.registry.Stats()
+}
 
-	if hosts == "" {
-		return addr
-	}
+type pingMessage struct{}
 
-	return fmt.Sprintf("%s (%s)", hosts, addr)
+func (pingMessage) Name() string {
+	return "ping"
 }
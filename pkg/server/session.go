@@ -0,0 +1,264 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sessionTokenSize is the number of random bytes in a session token.
+const sessionTokenSize = 16
+
+// A session lets a client whose connection was lost resume its place in a channel from a new connection,
+// without the channel's other members seeing it leave and join again.
+// The resumed client takes over the member ID of the one it replaces.
+type session struct {
+	token  string
+	client *client // The client the session belongs to
+
+	// The fields below are protected by the session table's lock.
+	// held is set once the client's connection is gone, and the session is waiting to be resumed.
+	held bool
+	// claimed is set once a new client has started resuming the session.
+	claimed bool
+
+	// resume receives the client resuming the session from its handler, once it has been claimed.
+	// The channel's other members are sent on done once the client has taken over, or nil if it couldn't.
+	resume chan *client
+	done   chan []channelMember
+}
+
+// sessionTable holds the sessions of clients in channels, by token.
+type sessionTable struct {
+	lock     sync.Mutex
+	sessions map[string]*session
+}
+
+// open starts a session for a client that has joined a channel.
+func (t *sessionTable) open(c *client) (*session, error) {
+	buf := make([]byte, sessionTokenSize)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	sess := &session{
+		token:  hex.EncodeToString(buf),
+		client: c,
+		resume: make(chan *client),
+		done:   make(chan []channelMember, 1),
+	}
+	t.lock.Lock()
+	t.sessions[sess.token] = sess
+	t.lock.Unlock()
+	return sess, nil
+}
+
+// claim takes the session with token for a client resuming it.
+// If the session's client still seems connected, it is disconnected, since its connection is presumed lost.
+// It returns nil if there is no such session, or its client is being disconnected for some other reason.
+func (t *sessionTable) claim(token string) *session {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	sess := t.sessions[token]
+	if sess == nil {
+		return nil
+	}
+	if !sess.held {
+		old := sess.client
+		old.drop("Session resumed on a new connection")
+		if !old.wasDropped() {
+			return nil
+		}
+		old.conn.Close() // Unblock any write in progress, rather than waiting for it to time out
+	}
+	sess.claimed = true
+	delete(t.sessions, token)
+	return sess
+}
+
+// release is called when the session's client disconnects.
+// If hold is set, the session is kept for the client to resume, and held is returned.
+// If the session has already been claimed, it must be handed over instead.
+func (t *sessionTable) release(sess *session, hold bool) (claimed, held bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if sess.claimed {
+		return true, false
+	}
+	if hold {
+		sess.held = true
+		return false, true
+	}
+	delete(t.sessions, sess.token)
+	return false, false
+}
+
+// expire ends a held session, returning false if it has already been claimed.
+func (t *sessionTable) expire(sess *session) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if sess.claimed {
+		return false
+	}
+	delete(t.sessions, sess.token)
+	return true
+}
+
+// holdSession keeps a disconnected client's place in its channel for the server's SessionGrace,
+// so that it can be resumed from a new connection.
+// It returns true if the session was handed over to a new client, in which case the client must not leave its channel.
+// It is called while tearing down the client, which is still in the registry's connected clients.
+func (c *client) holdSession() bool {
+	sess := c.session
+	if sess == nil {
+		return false
+	}
+	// Clients that closed their connection, or were disconnected by the server, aren't coming back.
+	hold := c.wasDropped() && c.srv.SessionGrace > 0 && !c.srv.shutdown.draining.Load()
+	sessions := &c.registry.sessions
+	claimed, held := sessions.release(sess, hold)
+	if !claimed && !held {
+		return false
+	}
+
+	var expired <-chan time.Time
+	if held {
+		c.log.WithFields(Fields{
+			"id":      c.id,
+			"channel": c.channel.name,
+			"grace":   c.srv.SessionGrace,
+		}).Info("Holding session for client that lost its connection")
+		timer := time.NewTimer(c.srv.SessionGrace)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	// Until the session is resumed or expires, the client is still a member of its channel,
+	// so anything sent to it must be drained.
+	for {
+		select {
+		case msg := <-c.events:
+			// A kicked client isn't coming back.
+			if _, ok := msg.(kickMessage); ok && sessions.expire(sess) {
+				return false
+			}
+		case <-expired:
+			expired = nil
+			if sessions.expire(sess) {
+				c.log.WithFields(Fields{
+					"id":      c.id,
+					"channel": c.channel.name,
+				}).Info("Session expired")
+				return false
+			}
+		case newClient := <-sess.resume:
+			if !hold {
+				sess.done <- nil
+				return false
+			}
+			c.handOver(newClient, sess)
+			return true
+		}
+	}
+}
+
+// handOver gives the client's ID and place in its channel to a client resuming its session.
+func (c *client) handOver(newClient *client, sess *session) {
+	newClient.log.WithFields(Fields{
+		"id":                     newClient.id,
+		"resumed_id":             c.id,
+		"resumed_correlation_id": c.correlationID,
+		"channel":                c.channel.name,
+	}).Info("Client resumed its session")
+	newClient.span.AddEvent("session resumed", trace.WithAttributes(attribute.Int64("nvremoted.session.resumed_id", int64(c.id))))
+	c.registry.sessionsResumed.Add(1)
+
+	// The new client's goroutines are waiting for the resume to finish,
+	// and anything else reading its ID holds the registry lock.
+	reg := c.registry
+	reg.lock.Lock()
+	delete(reg.connected, newClient.id)
+	newClient.id = c.id
+	reg.connected[c.id] = newClient
+	for k, v := range c.annotations {
+		if newClient.annotations == nil {
+			newClient.annotations = make(Annotations, len(c.annotations))
+		}
+		if _, ok := newClient.annotations[k]; !ok {
+			newClient.annotations[k] = v
+		}
+	}
+	reg.lock.Unlock()
+
+	var members []channelMember
+	c.drainWhile(func() {
+		members = c.channel.attach(newClient)
+	})
+	sess.done <- members
+}
+
+// drainWhile runs f, discarding events sent to the client until it returns.
+// A channel's shard may be blocked delivering to the client, and can't get to f's request until there's room in its queue.
+func (c *client) drainWhile(f func()) {
+	finished := make(chan struct{})
+	go func() {
+		f()
+		close(finished)
+	}()
+	for {
+		select {
+		case <-c.events:
+		case <-finished:
+			return
+		}
+	}
+}
+
+type attachChannelRequest struct {
+	client *client
+	resp   chan []channelMember
+}
+
+// attach replaces the member with the client's ID with the client, which is resuming its session.
+// The channel's other members are returned, and aren't told.
+func (c *channel) attach(cl *client) []channelMember {
+	req := attachChannelRequest{
+		client: cl,
+		resp:   make(chan []channelMember, 1),
+	}
+	if !c.shard.send(channelOp{channel: c, attach: &req}) {
+		return nil
+	}
+	members, _ := awaitShard(c.shard, req.resp)
+	return members
+}
+
+func (c *channel) handleAttach(req attachChannelRequest) {
+	others := []channelMember{}
+	for i, member := range c.members {
+		if member.id != req.client.id {
+			others = append(others, member)
+			continue
+		}
+		member.events = req.client.events
+		member.client = req.client
+		c.members[i] = member
+		c.reg.lock.Lock()
+		c.reg.clients[member.id] = member
+		c.reg.lock.Unlock()
+		if c.debugging() {
+			c.log.WithFields(Fields{
+				"channel":        c.name,
+				"id":             member.id,
+				"correlation_id": member.client.correlationID,
+			}).Info("Channel debug: client resumed")
+		}
+	}
+	req.resp <- c.withRemote(others)
+}
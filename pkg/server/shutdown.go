@@ -0,0 +1,234 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// shutdownKickReason is sent to clients still connected when the server shuts down.
+	shutdownKickReason = "server shutting down"
+
+	// shutdownReminder is how long before a scheduled shutdown clients are reminded of it.
+	shutdownReminder = time.Minute
+
+	// shutdownDrainTimeout is how long kicked clients are given to disconnect before the listeners are closed.
+	shutdownDrainTimeout = 10 * time.Second
+)
+
+// shutdownState tracks a scheduled shutdown, and the listeners to close when it happens.
+type shutdownState struct {
+	lock      sync.Mutex // Protects everything below, except the atomics
+	at        time.Time  // When the server shuts down, or zero if no shutdown is scheduled
+	cancel    chan struct{}
+	listeners []net.Listener
+	// stopped is closed once the server has shut down, to stop its background goroutines. It is made by done.
+	stopped chan struct{}
+
+	// draining is set once a shutdown is scheduled, so that channels can't be joined.
+	draining atomic.Bool
+	// closing is set when the server shuts down, so that new connections are refused.
+	closing atomic.Bool
+}
+
+// addListener records a listener to be closed when the server shuts down.
+// If the server has already shut down, the listener is closed now.
+func (s *shutdownState) addListener(listener net.Listener) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closing.Load() {
+		listener.Close()
+		return
+	}
+	s.listeners = append(s.listeners, listener)
+}
+
+// done returns a channel that is closed once the server has shut down,
+// which the server's background goroutines stop on.
+func (s *shutdownState) done() <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped == nil {
+		s.stopped = make(chan struct{})
+	}
+	return s.stopped
+}
+
+// Shutdown schedules the server to shut down after delay, announcing it to all clients with message.
+// Until then, clients may not join channels.
+// When the time comes, clients are kicked, and the listeners are closed,
+// so that ListenAndServe and the other serving methods return, and the server's background goroutines are stopped.
+// Only one shutdown may be scheduled at a time.
+func (srv *Server) Shutdown(delay time.Duration, message string) (time.Time, error) {
+	s := &srv.shutdown
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.at.IsZero() {
+		return time.Time{}, errors.Errorf("a shutdown is already scheduled for %s", s.at.Format(time.RFC1123))
+	}
+	s.at = time.Now().Add(delay).Round(0)
+	s.cancel = make(chan struct{})
+	s.draining.Store(true)
+
+	srv.Log.WithFields(Fields{
+		"at":      s.at,
+		"message": message,
+	}).Warn("Shutdown scheduled")
+	go srv.runShutdown(s.at, message, s.cancel)
+	return s.at, nil
+}
+
+// CancelShutdown cancels a scheduled shutdown, and reports whether there was one to cancel.
+// It is too late to cancel once clients are being kicked.
+func (srv *Server) CancelShutdown() bool {
+	s := &srv.shutdown
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.at.IsZero() || s.closing.Load() {
+		return false
+	}
+	close(s.cancel)
+	s.at = time.Time{}
+	s.draining.Store(false)
+	srv.Log.Warn("Shutdown canceled")
+	return true
+}
+
+// runShutdown announces a shutdown, and shuts down the server at the scheduled time, unless canceled.
+func (srv *Server) runShutdown(at time.Time, message string, cancel <-chan struct{}) {
+	announce := func() {
+		left := time.Until(at).Round(time.Second)
+		announcement := fmt.Sprintf("This server is shutting down in %s.", left)
+		if message != "" {
+			announcement = message + "\n" + announcement
+		}
+		srv.Broadcast(announcement)
+	}
+	if time.Until(at) > 0 {
+		announce()
+	}
+
+	var reminder <-chan time.Time
+	if until := time.Until(at); until > 2*shutdownReminder {
+		timer := time.NewTimer(until - shutdownReminder)
+		defer timer.Stop()
+		reminder = timer.C
+	}
+	shutdownTimer := time.NewTimer(time.Until(at))
+	defer shutdownTimer.Stop()
+	for {
+		select {
+		case <-cancel:
+			srv.Broadcast("The scheduled shutdown of this server has been canceled.")
+			return
+		case <-reminder:
+			announce()
+		case <-shutdownTimer.C:
+			srv.shutdownNow()
+			return
+		}
+	}
+}
+
+// shutdownOnCancel shuts the server down as soon as ctx is canceled.
+// The returned function stops waiting for ctx.
+func (srv *Server) shutdownOnCancel(ctx context.Context) func() bool {
+	return context.AfterFunc(ctx, func() {
+		srv.Log.WithField("error", ctx.Err()).Info("Context done; shutting down")
+		srv.shutdownNow()
+	})
+}
+
+// shutdownNow kicks all clients, gives them time to disconnect, closes the listeners,
+// and stops the server's background goroutines.
+// Only the first call does anything, so a scheduled shutdown and a canceled context can both call it.
+func (srv *Server) shutdownNow() {
+	s := &srv.shutdown
+	s.lock.Lock()
+	if s.closing.Load() {
+		s.lock.Unlock()
+		return
+	}
+	s.closing.Store(true)
+	s.lock.Unlock()
+
+	reg := &srv.registry
+	reg.lock.RLock()
+	for _, c := range reg.connected {
+		c.kick(KickShutdown, shutdownKickReason)
+	}
+	reg.lock.RUnlock()
+
+	srv.waitForConnections(shutdownDrainTimeout)
+	srv.registry.cluster.leave()
+
+	srv.Log.Warn("Shutting down")
+	s.lock.Lock()
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	if s.stopped == nil {
+		s.stopped = make(chan struct{})
+	}
+	close(s.stopped)
+	s.lock.Unlock()
+}
+
+// ShutdownArgs holds the arguments to the shutdown admin command.
+type ShutdownArgs struct {
+	// Delay is how long until the server shuts down, parsable by time.ParseDuration.
+	// If empty, the server shuts down immediately.
+	Delay string `json:"delay,omitempty"`
+
+	// Message is announced to clients along with the time until the shutdown.
+	Message string `json:"message,omitempty"`
+
+	// Cancel cancels the scheduled shutdown, instead of scheduling one.
+	Cancel bool `json:"cancel,omitempty"`
+}
+
+// ShutdownResult holds the result of the shutdown admin command.
+type ShutdownResult struct {
+	// At is when the server will shut down, or zero if the shutdown was canceled.
+	At time.Time `json:"at"`
+}
+
+func adminShutdown(srv *Server, args json.RawMessage) (interface{}, error) {
+	var shutdownArgs ShutdownArgs
+	if err := decodeAdminArgs(args, &shutdownArgs); err != nil {
+		return nil, err
+	}
+	if shutdownArgs.Cancel {
+		if !srv.CancelShutdown() {
+			return nil, errors.New("no shutdown is scheduled")
+		}
+		return ShutdownResult{}, nil
+	}
+
+	var delay time.Duration
+	if shutdownArgs.Delay != "" {
+		var err error
+		if delay, err = time.ParseDuration(shutdownArgs.Delay); err != nil {
+			return nil, errors.Wrap(err, "invalid delay")
+		}
+		if delay < 0 {
+			return nil, errors.New("delay must not be negative")
+		}
+	}
+	at, err := srv.Shutdown(delay, shutdownArgs.Message)
+	if err != nil {
+		return nil, err
+	}
+	return ShutdownResult{At: at}, nil
+}
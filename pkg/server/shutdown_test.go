@@ -0,0 +1,104 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backgroundGoroutines are the functions the server runs in the background, which must return once it shuts down.
+var backgroundGoroutines = []string{
+	"(*dispatchShard).run",
+	"(*Server).runTimers",
+	"(*Server).pushStatsd",
+	"(*Server).recordHistory",
+	"(*Server).watchIPLists",
+	"(*Server).fetchIPFeeds",
+	"(*webhook).run",
+}
+
+// runningBackgroundGoroutines returns those of backgroundGoroutines that are running.
+func runningBackgroundGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	stacks := string(buf)
+	var running []string
+	for _, name := range backgroundGoroutines {
+		if strings.Contains(stacks, "pkg/server."+name+"(") {
+			running = append(running, name)
+		}
+	}
+	return running
+}
+
+// TestCancelStopsBackgroundGoroutines serves with every background task enabled, cancels the context,
+// and checks that none of the server's goroutines outlive it.
+func TestCancelStopsBackgroundGoroutines(t *testing.T) {
+	dir := t.TempDir()
+	denyFile := filepath.Join(dir, "deny.txt")
+	if err := os.WriteFile(denyFile, []byte("192.0.2.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(
+		WithLogger(NewSlogLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))),
+		WithDispatchShards(4),
+		WithStatsd(Statsd{Addr: "127.0.0.1:9", Interval: time.Hour}),
+		WithHistory(StatsHistory{File: filepath.Join(dir, "history.db"), Interval: time.Hour}),
+		WithWebhooks("http://127.0.0.1:9/events"),
+		WithIPLists(IPLists{DenyFile: denyFile, DenyURLs: []string{"https://127.0.0.1:9/feed"}, FeedInterval: time.Hour}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		srv.ServeContext(ctx, listener)
+		close(served)
+	}()
+	joinTestChannel(t, listener.Addr().String(), "background", "master", 5*time.Second)
+	if running := runningBackgroundGoroutines(); len(running) != len(backgroundGoroutines) {
+		t.Fatalf("only %v were running while serving", running)
+	}
+
+	cancel()
+	select {
+	case <-served:
+	case <-time.After(shutdownDrainTimeout + 5*time.Second):
+		t.Fatal("ServeContext didn't return after the context was canceled")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		running := runningBackgroundGoroutines()
+		if len(running) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v still running after the server shut down", running)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/pkg/errors"
+)
+
+// A SlowClientPolicy decides what happens when a message can't be queued for a client,
+// because the client isn't keeping up with the messages sent to it.
+type SlowClientPolicy string
+
+const (
+	// SlowClientBlock waits for room in the client's queue, holding up everyone else in its channel,
+	// and the other channels run by the same dispatch shard.
+	SlowClientBlock SlowClientPolicy = "block"
+
+	// SlowClientDropOldest discards the oldest message in the client's queue to make room.
+	SlowClientDropOldest SlowClientPolicy = "drop-oldest"
+
+	// SlowClientDropClient disconnects the client immediately.
+	SlowClientDropClient SlowClientPolicy = "drop-client"
+
+	// SlowClientKick discards the client's queue, sends it an error explaining why, and disconnects it.
+	// If the client's connection is stalled, the error is given until the write timeout to get through.
+	SlowClientKick SlowClientPolicy = "kick"
+)
+
+// ParseSlowClientPolicy parses the name of a slow client policy.
+// An empty name is SlowClientBlock.
+func ParseSlowClientPolicy(name string) (SlowClientPolicy, error) {
+	switch policy := SlowClientPolicy(name); policy {
+	case "":
+		return SlowClientBlock, nil
+	case SlowClientBlock, SlowClientDropOldest, SlowClientDropClient, SlowClientKick:
+		return policy, nil
+	}
+	return "", errors.Errorf("unknown slow client policy %q; must be block, drop-oldest, drop-client, or kick", name)
+}
+
+// kickMessage is queued for a client to disconnect it with an error.
+// readFromClient also hands them to handleClient, along with the messages it reads.
+type kickMessage struct {
+	code   KickCode
+	reason string
+	// stopReason is why the client is recorded as stopping, if it isn't reason.
+	stopReason string
+	// drop is set if the client lost its connection, so that its session may be resumed.
+	drop bool
+}
+
+func (kickMessage) Name() string {
+	return "kick"
+}
+
+// deliver queues a message for a channel member, applying the server's slow client policy if its queue is full.
+func (c *channel) deliver(member channelMember, msg Message) {
+	select {
+	case member.events <- msg:
+		return
+	default:
+	}
+
+	cl := member.client
+	if cl.slow.Load() {
+		return // Already being disconnected; nothing more needs to reach it.
+	}
+	switch cl.srv.SlowClientPolicy {
+	case SlowClientDropOldest:
+		for {
+			select {
+			case <-member.events:
+				c.reg.slowClientDrops.Add(1)
+			default:
+			}
+			select {
+			case member.events <- msg:
+				return
+			default:
+			}
+		}
+
+	case SlowClientDropClient, SlowClientKick:
+		if !cl.slow.CompareAndSwap(false, true) {
+			return
+		}
+		c.reg.slowClientDisconnects.Add(1)
+		c.log.WithFields(Fields{
+			"id":      cl.id,
+			"channel": c.name,
+			"policy":  cl.srv.SlowClientPolicy,
+		}).Warn("Disconnecting client that isn't keeping up with its channel")
+		c.reg.emit(Event{Type: EventClientKicked, Client: cl.eventClient(), Channel: c.name, Reason: "too slow"})
+		if cl.srv.SlowClientPolicy == SlowClientKick {
+			cl.kick(KickSlow, "too slow")
+			return
+		}
+		cl.stop("too slow")
+		cl.conn.Close() // Unblock any write in progress, rather than waiting for it to time out
+
+	default:
+		member.events <- msg
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// StateDump is a snapshot of the server's internal state, for attaching to bug reports, such as about stuck channels.
+// It is sanitized so that it can be shared: channels are identified by ChannelHash rather than by name,
+// and clients' addresses, hosts and annotations are left out, including from the reasons they are being disconnected.
+type StateDump struct {
+	Time           time.Time     `json:"time"`
+	Uptime         time.Duration `json:"uptime"`
+	NumConnections int           `json:"num_connections"`
+	NumClients     int           `json:"num_clients"`
+	NumChannels    int           `json:"num_channels"`
+	HeldSessions   int           `json:"held_sessions"`
+	Draining       bool          `json:"draining"`
+	ShuttingDown   bool          `json:"shutting_down"`
+
+	Shards     []ShardState    `json:"shards"`
+	Channels   []ChannelState  `json:"channels"`
+	Clients    []ClientState   `json:"clients"`
+	Goroutines GoroutineReport `json:"goroutines"`
+}
+
+// ShardState is the state of one of the shards that run channels' joins, parts and messages.
+// A shard whose queue stays full is stuck, and so are all of its channels.
+type ShardState struct {
+	Index         int `json:"index"`
+	Channels      int `json:"channels"`
+	QueueLength   int `json:"queue_length"`
+	QueueCapacity int `json:"queue_capacity"`
+}
+
+// ChannelState is the state of a channel.
+type ChannelState struct {
+	Hash    string    `json:"hash"`
+	Shard   int       `json:"shard"`
+	Created time.Time `json:"created"`
+	E2e     bool      `json:"e2e"`
+
+	// Members counts the channel's members on this node by connection type.
+	Members map[string]int `json:"members"`
+	// PendingJoins is the number of clients that have found the channel, but haven't finished joining it.
+	// A channel with no members is only destroyed once this is 0.
+	PendingJoins int `json:"pending_joins"`
+	// MaxMemberQueue is the most events waiting to be written to any one member.
+	MaxMemberQueue int  `json:"max_member_queue"`
+	Debugging      bool `json:"debugging"`
+
+	BytesReceived   int64 `json:"bytes_received"`
+	BytesSent       int64 `json:"bytes_sent"`
+	MessagesRelayed int64 `json:"messages_relayed"`
+}
+
+// ClientState is the state of a connected client.
+type ClientState struct {
+	ID            uint64    `json:"id"`
+	CorrelationID string    `json:"correlation_id"`
+	Connected     time.Time `json:"connected"`
+	LastActive    time.Time `json:"last_active,omitempty"`
+
+	// Channel is the ChannelHash of the channel the client is in, if any.
+	Channel        string `json:"channel,omitempty"`
+	ConnectionType string `json:"connection_type,omitempty"`
+
+	QueueLength   int `json:"queue_length"`
+	QueueCapacity int `json:"queue_capacity"`
+
+	// Stopped is set once the client is being disconnected, for StopReason.
+	Stopped    bool   `json:"stopped"`
+	StopReason string `json:"stop_reason,omitempty"`
+	// Slow is set once the client is being disconnected for not keeping up, or displaced by a new master.
+	Slow      bool `json:"slow"`
+	Admin     bool `json:"admin"`
+	Debugging bool `json:"debugging"`
+}
+
+// ipPattern matches IPv4 addresses, and IPv6 addresses in brackets, as the net package puts them in errors.
+var ipPattern = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b|\[[0-9A-Fa-f:.]*:[0-9A-Fa-f:.]*(?:%\w+)?\]`)
+
+// redactIPs replaces the IP addresses in s, such as those in the reasons clients were disconnected for network errors.
+func redactIPs(s string) string {
+	return ipPattern.ReplaceAllString(s, "[redacted]")
+}
+
+func adminDump(srv *Server, args json.RawMessage) (interface{}, error) {
+	return srv.StateDump(), nil
+}
+
+// StateDump takes a sanitized snapshot of the server's internal state.
+func (srv *Server) StateDump() StateDump {
+	reg := &srv.registry
+	dump := StateDump{
+		Time:         time.Now().Round(0),
+		Draining:     srv.drain.active.Load() || srv.shutdown.draining.Load(),
+		ShuttingDown: srv.shutdown.closing.Load(),
+		Shards:       []ShardState{},
+		Channels:     []ChannelState{},
+		Clients:      []ClientState{},
+	}
+
+	// Shards lock the registry while holding their own lock, so the channels are gathered before locking the registry.
+	byName := make(map[string]int) // Indexes of channels in dump.Channels
+	for i, shard := range reg.dispatcher.shards {
+		shard.lock.Lock()
+		dump.Shards = append(dump.Shards, ShardState{
+			Index:         i,
+			Channels:      len(shard.channels),
+			QueueLength:   len(shard.work),
+			QueueCapacity: cap(shard.work),
+		})
+		for name, c := range shard.channels {
+			byName[name] = len(dump.Channels)
+			dump.Channels = append(dump.Channels, ChannelState{
+				Hash:            reg.channelHasher.hash(name),
+				Shard:           i,
+				Created:         c.created.Round(0),
+				E2e:             c.isE2e(),
+				Members:         make(map[string]int),
+				PendingJoins:    c.pendingJoins,
+				Debugging:       c.debugging(),
+				BytesReceived:   c.traffic.bytesReceived.Load(),
+				BytesSent:       c.traffic.bytesSent.Load(),
+				MessagesRelayed: c.traffic.messagesRelayed.Load(),
+			})
+		}
+		shard.lock.Unlock()
+	}
+
+	reg.lock.RLock()
+	dump.Uptime = time.Since(reg.createdTime)
+	dump.NumConnections = reg.numConnections
+	dump.NumClients = len(reg.clients)
+	dump.NumChannels = reg.numChannels
+	for _, member := range reg.clients {
+		if i, ok := byName[member.channel]; ok {
+			info := &dump.Channels[i]
+			info.Members[member.connectionType]++
+			if queued := len(member.events); queued > info.MaxMemberQueue {
+				info.MaxMemberQueue = queued
+			}
+		}
+	}
+	for id, c := range reg.connected {
+		state := ClientState{
+			ID:            id,
+			CorrelationID: c.correlationID,
+			Connected:     c.connected.Round(0),
+			QueueLength:   len(c.events),
+			QueueCapacity: cap(c.events),
+			Slow:          c.slow.Load(),
+			Admin:         c.admin.Load(),
+			Debugging:     c.debugging(),
+		}
+		if lastActive := c.lastActive.Load(); lastActive != 0 {
+			state.LastActive = time.Unix(0, lastActive)
+		}
+		if member, ok := reg.clients[id]; ok {
+			state.Channel = reg.channelHasher.hash(member.channel)
+			state.ConnectionType = member.connectionType
+		}
+		c.stopMTX.RLock()
+		state.Stopped, state.StopReason = c.stopped, redactIPs(c.stopReason)
+		c.stopMTX.RUnlock()
+		dump.Clients = append(dump.Clients, state)
+	}
+	reg.lock.RUnlock()
+	sort.Slice(dump.Channels, func(i, j int) bool { return dump.Channels[i].Hash < dump.Channels[j].Hash })
+	sort.Slice(dump.Clients, func(i, j int) bool { return dump.Clients[i].ID < dump.Clients[j].ID })
+
+	reg.sessions.lock.Lock()
+	for _, sess := range reg.sessions.sessions {
+		if sess.held {
+			dump.HeldSessions++
+		}
+	}
+	reg.sessions.lock.Unlock()
+
+	dump.Goroutines = srv.GoroutineReport()
+	return dump
+}
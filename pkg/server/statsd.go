@@ -0,0 +1,183 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultStatsdInterval is how often metrics are pushed if the server doesn't set an interval.
+	defaultStatsdInterval = 10 * time.Second
+
+	// statsdPacketSize is the largest UDP packet sent to statsd, which fits in a typical MTU without fragmenting.
+	statsdPacketSize = 1432
+)
+
+// Statsd configures pushing metrics to a statsd server, for operators who don't scrape stats with Prometheus.
+type Statsd struct {
+	// Addr is the host:port of the statsd server, which metrics are sent to over UDP.
+	// If empty, metrics aren't pushed.
+	Addr string
+
+	// Prefix is prepended to the name of every metric, such as "nvremoted.".
+	Prefix string
+
+	// Interval is how often metrics are pushed. If 0, they are pushed every 10 seconds.
+	Interval time.Duration
+}
+
+// statsdCounters gets the stats pushed as counters, which are sent as the change since the last push.
+// The most relayed message types are counted as message_types.<type>.messages and message_types.<type>.bytes.
+func statsdCounters(stats Stats) map[string]int64 {
+	counters := map[string]int64{
+		"bytes_received":   stats.BytesReceived,
+		"bytes_sent":       stats.BytesSent,
+		"messages_relayed": stats.MessagesRelayed,
+		"connects":         stats.Churn.TotalConnects,
+		"disconnects":      stats.Churn.TotalDisconnects,
+
+		"banned_connections": stats.BannedConnections,
+		"denied_connections": stats.DeniedConnections,
+	}
+	for _, t := range stats.TopMessageTypes {
+		name := "message_types." + statsdMetricName(t.Type)
+		counters[name+".messages"] = t.Messages
+		counters[name+".bytes"] = t.Bytes
+	}
+	return counters
+}
+
+// statsdGauges gets the stats pushed as gauges.
+func statsdGauges(stats Stats) map[string]int64 {
+	gauges := map[string]int64{
+		"clients":      int64(stats.NumClients),
+		"connections":  int64(stats.NumConnections),
+		"channels":     int64(stats.NumChannels),
+		"e2e_channels": int64(stats.NumE2eChannels),
+		"goroutines":   int64(stats.NumGoroutines),
+		"heap_in_use":  int64(stats.HeapInUse),
+	}
+	if stats.OpenFiles >= 0 {
+		gauges["open_files"] = int64(stats.OpenFiles)
+	}
+	return gauges
+}
+
+// pushStatsd pushes the server's metrics to srv.Statsd.Addr, every srv.Statsd.Interval, until the server shuts down.
+func (srv *Server) pushStatsd() {
+	stop := srv.shutdown.done()
+	interval := srv.Statsd.Interval
+	if interval <= 0 {
+		interval = defaultStatsdInterval
+	}
+	log := srv.Log.WithFields(Fields{
+		"addr":   srv.Statsd.Addr,
+		"prefix": srv.Statsd.Prefix,
+	})
+	log.WithField("interval", interval).Info("Pushing metrics to statsd")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	last := statsdCounters(srv.registry.Stats())
+	failing := false // Errors are only logged when pushing starts failing, so a statsd server that is down doesn't flood the log.
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		stats := srv.registry.Stats()
+		counters := statsdCounters(stats)
+		var lines []string
+		for name, value := range counters {
+			// A message type that has just become one of the most relayed was already counted,
+			// so it is only pushed from the next interval on, once there is something to take its change from.
+			if _, ok := last[name]; !ok {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%s%s:%d|c", srv.Statsd.Prefix, name, value-last[name]))
+		}
+		last = counters
+		for name, value := range statsdGauges(stats) {
+			lines = append(lines, fmt.Sprintf("%s%s:%d|g", srv.Statsd.Prefix, name, value))
+		}
+		sort.Strings(lines)
+
+		var err error
+		if conn == nil {
+			// The address is resolved again after a failure, in case the statsd server moved.
+			conn, err = net.Dial("udp", srv.Statsd.Addr)
+		}
+		if err == nil {
+			err = writeStatsd(conn, lines)
+		}
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+				conn = nil
+			}
+			if !failing {
+				log.WithField("error", err).Warn("Error pushing metrics to statsd")
+			}
+			failing = true
+			continue
+		}
+		if failing {
+			log.Info("Pushing metrics to statsd again")
+		}
+		failing = false
+	}
+}
+
+// writeStatsd writes metric lines to conn, in as few packets as possible.
+func writeStatsd(conn net.Conn, lines []string) error {
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		_, err := conn.Write(packet.Bytes())
+		return err
+	}
+	return nil
+}
+
+// statsdMetricName makes a message type safe to use in the name of a statsd metric.
+// Letters, digits and underscores, which NVDA Remote's types are made of, are kept,
+// and any other byte, including a hyphen, is written as a hyphen and its hex code, so "(other)" becomes "-28other-29".
+// No two types get the same name, so one type's counts can't overwrite another's.
+func statsdMetricName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "-%02x", c)
+		}
+	}
+	return b.String()
+}
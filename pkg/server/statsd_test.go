@@ -0,0 +1,43 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import "testing"
+
+// TestStatsdMetricNamesDontCollide checks that message types differing only in characters statsd can't take get different names.
+func TestStatsdMetricNamesDontCollide(t *testing.T) {
+	types := []string{"a.b", "a_b", "a-b", "a-2eb", "a:b", "a b", "(other)", "_other_", "send_SAS", "é"}
+	names := make(map[string]string)
+	for _, msgType := range types {
+		name := statsdMetricName(msgType)
+		if other, ok := names[name]; ok {
+			t.Errorf("%q and %q both have the name %q", other, msgType, name)
+		}
+		names[name] = msgType
+	}
+	if name := statsdMetricName("send_SAS"); name != "send_SAS" {
+		t.Errorf("send_SAS has the name %q", name)
+	}
+	if name := statsdMetricName(otherMessageType); name != "-28other-29" {
+		t.Errorf("%s has the name %q", otherMessageType, name)
+	}
+}
+
+// TestUnknownMessageTypesCountedTogether checks that only NVDA Remote's message types get their own counters.
+func TestUnknownMessageTypesCountedTogether(t *testing.T) {
+	var m messageTypeCounters
+	m.count("speak", 10)
+	m.count("", 1)
+	for i := 0; i < 1000; i++ {
+		m.count(string(rune('a'+i%26))+"custom", 1)
+	}
+	top := m.top(100)
+	if len(top) != 3 {
+		t.Fatalf("counted %v, want speak, %s and %s", top, otherMessageType, noMessageType)
+	}
+	if top[0].Type != otherMessageType || top[0].Messages != 1000 {
+		t.Errorf("most relayed is %+v, want 1000 of %s", top[0], otherMessageType)
+	}
+}
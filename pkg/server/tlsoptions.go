@@ -0,0 +1,76 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+
+	"github.com/pkg/errors"
+)
+
+// tlsVersions maps TLS version names, as used in configuration, to their values.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a TLS version, such as "1.2".
+// An empty version is 0, which leaves the choice to crypto/tls.
+func ParseTLSVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+	version, ok := tlsVersions[name]
+	if !ok {
+		return 0, errors.Errorf("unknown TLS version %q; must be 1.0, 1.1, 1.2, or 1.3", name)
+	}
+	return version, nil
+}
+
+// ParseCipherSuites parses the names of cipher suites, such as "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+// Only suites that crypto/tls considers secure, and that can be configured, are accepted;
+// TLS 1.3 suites can't be configured, and are always enabled.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	suites := make(map[string]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		suite := suites[name]
+		switch {
+		case insecure[name]:
+			return nil, errors.Errorf("cipher suite %s is insecure", name)
+		case suite == nil:
+			return nil, errors.Errorf("unknown cipher suite %s", name)
+		case len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13:
+			return nil, errors.Errorf("cipher suite %s is for TLS 1.3, whose cipher suites can't be configured", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+// tlsConfig gets the TLS configuration for listeners, with the server's TLS options applied.
+func (srv *Server) tlsConfig() *tls.Config {
+	config := srv.TLSConfig.Clone()
+	if srv.TLSMinVersion != 0 {
+		config.MinVersion = srv.TLSMinVersion
+	}
+	if srv.TLSMaxVersion != 0 {
+		config.MaxVersion = srv.TLSMaxVersion
+	}
+	if len(srv.TLSCipherSuites) > 0 {
+		config.CipherSuites = srv.TLSCipherSuites
+	}
+	return config
+}
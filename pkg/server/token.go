@@ -0,0 +1,133 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Scopes that a Token can grant.
+const (
+	// ScopeStats allows fetching stats, stats history, and goroutine reports.
+	ScopeStats = "stats"
+
+	// ScopeList allows listing clients, channels, bans, and blocked channels.
+	ScopeList = "list"
+
+	// ScopeKick allows kicking clients, and banning and unbanning addresses.
+	ScopeKick = "kick"
+
+	// ScopeAdmin allows everything, including every admin command, and profiling.
+	ScopeAdmin = "admin"
+)
+
+// adminCommandScopes gives the scope each admin command needs, other than ScopeAdmin.
+// Commands that aren't listed need ScopeAdmin.
+var adminCommandScopes = map[string]string{
+	"stats":            ScopeStats,
+	"goroutines":       ScopeStats,
+	"history":          ScopeStats,
+	"clients":          ScopeList,
+	"channels":         ScopeList,
+	"bans":             ScopeList,
+	"blocked_channels": ScopeList,
+	"kick":             ScopeKick,
+	"ban":              ScopeKick,
+	"unban":            ScopeKick,
+}
+
+// Token is a named password for stats and admin commands, limited to some scopes,
+// so that monitoring systems and people don't need to share the stats password, and each can be revoked on its own.
+type Token struct {
+	// Name identifies the token in the log.
+	Name string
+
+	// Password is the token's password, or its bcrypt hash from HashPassword.
+	Password string
+
+	// Scopes lists what the token allows: ScopeStats, ScopeList, ScopeKick, or ScopeAdmin.
+	Scopes []string
+}
+
+// Validate checks that the token has a name, a password, and only known scopes.
+func (t Token) Validate() error {
+	if t.Name == "" {
+		return errors.New("token has no name")
+	}
+	if t.Password == "" {
+		return errors.Errorf("token %q has no password", t.Name)
+	}
+	for _, scope := range t.Scopes {
+		switch scope {
+		case ScopeStats, ScopeList, ScopeKick, ScopeAdmin:
+		default:
+			return errors.Errorf("token %q has unknown scope %q", t.Name, scope)
+		}
+	}
+	return nil
+}
+
+// allows reports whether the token grants scope.
+func (t *Token) allows(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsCommand reports whether the token may run an admin command.
+func (t *Token) allowsCommand(command string) bool {
+	if scope, ok := adminCommandScopes[command]; ok {
+		return t.allows(scope)
+	}
+	return t.allows(ScopeAdmin)
+}
+
+// tokenSet holds the tokens in use, which can be replaced while the server runs.
+type tokenSet struct {
+	lock   sync.RWMutex // Protects tokens
+	tokens []Token
+	set    bool // Whether SetTokens has been called, replacing srv.Tokens
+}
+
+// SetTokens replaces the server's tokens, such as after the configuration is reloaded.
+// Tokens that are removed can't be used from then on.
+func (srv *Server) SetTokens(tokens []Token) error {
+	for _, token := range tokens {
+		if err := token.Validate(); err != nil {
+			return err
+		}
+	}
+	srv.tokens.lock.Lock()
+	srv.tokens.tokens = append([]Token(nil), tokens...)
+	srv.tokens.set = true
+	srv.tokens.lock.Unlock()
+	return nil
+}
+
+// findToken gets the token whose password is password.
+// The stats password is a token with every scope, named "statsPassword".
+func (srv *Server) findToken(password string) *Token {
+	if checkPassword(srv.StatsPassword, password) {
+		return &Token{Name: "statsPassword", Scopes: []string{ScopeAdmin}}
+	}
+	srv.tokens.lock.RLock()
+	defer srv.tokens.lock.RUnlock()
+	tokens := srv.Tokens
+	if srv.tokens.set {
+		tokens = srv.tokens.tokens
+	}
+	for i := range tokens {
+		if checkPassword(tokens[i].Password, password) {
+			token := tokens[i]
+			return &token
+		}
+	}
+	return nil
+}
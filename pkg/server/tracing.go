@@ -0,0 +1,76 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans created by the server.
+const tracerName = "github.com/n0ot/nvremoted/pkg/server"
+
+// Spans are named for the parts of a client's lifecycle they cover.
+// Channel names are never recorded, since they are the keys clients use to find each other.
+const (
+	// spanSession covers a client's whole connection, ending with the disconnect reason.
+	spanSession = "session"
+
+	// spanJoin covers joining a channel, including waiting for the channel's dispatch shard.
+	spanJoin = "join"
+
+	// spanRelay covers a channel message, from when it is read from its origin,
+	// through rate limiting, handleClient, and the channel's dispatch shard, until it is queued for every recipient.
+	spanRelay = "relay"
+)
+
+// tracer gets the tracer for the server's spans, from srv.TracerProvider, or the global provider if that isn't set.
+func (srv *Server) tracer() trace.Tracer {
+	provider := srv.TracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+// startSession starts the span covering a client's connection.
+// In privacy mode, the client's address isn't recorded.
+func (c *client) startSession() {
+	attributes := []attribute.KeyValue{
+		attribute.Int64("nvremoted.client.id", int64(c.id)),
+		attribute.String("nvremoted.client.correlation_id", c.correlationID),
+	}
+	if !c.registry.privacy {
+		attributes = append(attributes, attribute.String("nvremoted.client.remote_host", c.remoteHost))
+	}
+	c.ctx, c.span = c.registry.tracer.Start(context.Background(), spanSession,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(c.connected),
+		trace.WithAttributes(attributes...))
+}
+
+// endSession ends the client's session span, recording why it disconnected.
+// In privacy mode, addresses in the reason, such as those of a network error, aren't recorded.
+func (c *client) endSession(reason string) {
+	if c.registry.privacy {
+		reason = redactIPs(reason)
+	}
+	c.span.SetAttributes(attribute.String("nvremoted.disconnect.reason", reason))
+	c.span.End()
+}
+
+// startRelay starts the span for a channel message read from the client.
+func (c *client) startRelay(msg *channelMessage) {
+	msgType, _ := msg.msg["type"].(string)
+	_, msg.span = c.registry.tracer.Start(c.ctx, spanRelay,
+		trace.WithTimestamp(msg.received),
+		trace.WithAttributes(
+			attribute.String("nvremoted.message.type", msgType),
+			attribute.Int("nvremoted.message.size", msg.size),
+		))
+}
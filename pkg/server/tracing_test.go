@@ -0,0 +1,88 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// unwritableConn is a connection from a client whose writes fail as a reset TCP connection's do,
+// with an error naming the addresses at each end.
+type unwritableConn struct {
+	net.Conn
+	local, remote *net.TCPAddr
+}
+
+func (c unwritableConn) Write(b []byte) (int, error) {
+	return 0, &net.OpError{Op: "write", Net: "tcp", Source: c.local, Addr: c.remote, Err: syscall.ECONNRESET}
+}
+
+func (c unwritableConn) LocalAddr() net.Addr  { return c.local }
+func (c unwritableConn) RemoteAddr() net.Addr { return c.remote }
+
+// TestPrivacyKeepsAddressesOutOfSpans drops a client on a write error, in privacy mode,
+// and checks that neither address from the error reaches its spans.
+func TestPrivacyKeepsAddressesOutOfSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	srv, err := NewServer(
+		WithLogger(NewSlogLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))),
+		WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))),
+		WithPrivacy(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverEnd, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+	conn := unwritableConn{
+		Conn:   serverEnd,
+		local:  &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 6837},
+		remote: &net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 40000},
+	}
+	go io.WriteString(clientEnd, `{"type": "protocol_version", "version": 2}`+"\n"+`{"type": "join", "channel": "private", "connection_type": "master"}`+"\n")
+	go io.Copy(io.Discard, clientEnd)
+
+	served := make(chan struct{})
+	go func() {
+		srv.ServeConn(conn)
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-time.After(10 * time.Second):
+		t.Fatal("client wasn't dropped")
+	}
+
+	var reason string
+	for _, span := range recorder.Ended() {
+		for _, attr := range span.Attributes() {
+			if attr.Key == "nvremoted.disconnect.reason" {
+				reason = attr.Value.AsString()
+			}
+			if value := attr.Value.Emit(); strings.Contains(value, "192.0.2.1") || strings.Contains(value, "203.0.113.9") {
+				t.Errorf("span %s records %s as %q", span.Name(), attr.Key, value)
+			}
+		}
+		for _, event := range span.Events() {
+			for _, attr := range event.Attributes {
+				if value := attr.Value.Emit(); strings.Contains(value, "192.0.2.1") || strings.Contains(value, "203.0.113.9") {
+					t.Errorf("span %s's %s event records %s as %q", span.Name(), event.Name, attr.Key, value)
+				}
+			}
+		}
+	}
+	if !strings.HasPrefix(reason, "Connection lost: ") {
+		t.Errorf("disconnect reason is %q, want a lost connection", reason)
+	}
+}
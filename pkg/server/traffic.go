@@ -0,0 +1,78 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// numTopChannels is the number of busiest channels reported in stats.
+const numTopChannels = 10
+
+// trafficCounters count the traffic through the whole server, or a single channel.
+// They are safe to update concurrently.
+type trafficCounters struct {
+	bytesReceived   atomic.Int64
+	bytesSent       atomic.Int64
+	messagesRelayed atomic.Int64
+}
+
+// ChannelTraffic is the traffic through a channel since it was created.
+type ChannelTraffic struct {
+	Channel string `json:"channel"`
+
+	// BytesReceived is the size of the messages members sent to be relayed.
+	BytesReceived int64 `json:"bytes_received"`
+	// BytesSent is everything written to the channel's members while they were in it, including messages from the server.
+	BytesSent       int64 `json:"bytes_sent"`
+	MessagesRelayed int64 `json:"messages_relayed"`
+}
+
+// countSent counts bytes written to a client, both for the server and the client's channel.
+// It must only be called from handleClient, which owns the client's channel.
+func (c *client) countSent(n int) {
+	c.registry.traffic.bytesSent.Add(int64(n))
+	if c.channel != nil {
+		c.channel.traffic.bytesSent.Add(int64(n))
+	}
+}
+
+// countRelayed counts a message relayed over the channel, both for the channel and the server, and by its type.
+func (c *channel) countRelayed(msg channelMessage) {
+	c.traffic.bytesReceived.Add(int64(msg.size))
+	c.traffic.messagesRelayed.Add(1)
+	c.reg.traffic.messagesRelayed.Add(1)
+	msgType, _ := msg.msg["type"].(string)
+	c.reg.messageTypes.count(msgType, msg.size)
+}
+
+// topChannels gets the traffic of the n channels that have sent the most bytes.
+// It locks each shard in turn, so must not be called while holding the registry lock.
+func (d *dispatcher) topChannels(n int) []ChannelTraffic {
+	var top []ChannelTraffic
+	for _, shard := range d.shards {
+		shard.lock.Lock()
+		for name, c := range shard.channels {
+			top = append(top, ChannelTraffic{
+				Channel:         name,
+				BytesReceived:   c.traffic.bytesReceived.Load(),
+				BytesSent:       c.traffic.bytesSent.Load(),
+				MessagesRelayed: c.traffic.messagesRelayed.Load(),
+			})
+		}
+		shard.lock.Unlock()
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].BytesSent != top[j].BytesSent {
+			return top[i].BytesSent > top[j].BytesSent
+		}
+		return top[i].Channel < top[j].Channel
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
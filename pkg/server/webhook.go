@@ -0,0 +1,205 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Types of server events.
+const (
+	EventClientConnected    = "client_connected"
+	EventClientDisconnected = "client_disconnected"
+	EventClientKicked       = "client_kicked"
+	EventClientJoined       = "client_joined"
+	EventClientLeft         = "client_left"
+	EventProtocolError      = "protocol_error"
+	EventChannelCreated     = "channel_created"
+	EventChannelDestroyed   = "channel_destroyed"
+)
+
+// Event is something that happened on the server, which is sent to webhooks and event streams.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	// Client is the client the event is about, if any.
+	Client *EventClient `json:"client,omitempty"`
+
+	// Channel is the channel the event is about, if any.
+	Channel string `json:"channel,omitempty"`
+
+	// ConnectionType is the connection type a client joined a channel with.
+	ConnectionType string `json:"connection_type,omitempty"`
+
+	// Reason is why a client was disconnected or kicked, or what protocol error it made.
+	Reason string `json:"reason,omitempty"`
+}
+
+// EventClient identifies the client an event is about.
+type EventClient struct {
+	ID uint64 `json:"id"`
+	// RemoteHost is left out in privacy mode.
+	RemoteHost string `json:"remote_host,omitempty"`
+	// CorrelationID identifies the client's connection in the server's logs.
+	CorrelationID string `json:"correlation_id"`
+}
+
+const (
+	// webhookQueueSize is the number of events that can wait to be delivered to each webhook.
+	// Events are dropped while the queue is full, so a webhook that is down can't hold up the server.
+	webhookQueueSize = 256
+
+	// webhookAttempts is the number of times delivering an event is tried, before it is dropped.
+	webhookAttempts = 4
+
+	// webhookRetryDelay is how long to wait before the first retry; each retry waits twice as long as the last.
+	webhookRetryDelay = time.Second
+
+	// webhookTimeout is how long a webhook has to respond.
+	webhookTimeout = 10 * time.Second
+)
+
+// webhook delivers events to a URL in the background, as JSON POST requests.
+type webhook struct {
+	url    string
+	events chan Event
+	client *http.Client
+	log    Logger
+	// stop is closed when the server shuts down, after which the events already queued are delivered, and no more.
+	stop <-chan struct{}
+}
+
+// newWebhook creates a webhook for url, and starts delivering events queued for it, until stop is closed.
+func newWebhook(url string, log Logger, stop <-chan struct{}) *webhook {
+	w := &webhook{
+		url:    url,
+		events: make(chan Event, webhookQueueSize),
+		client: &http.Client{Timeout: webhookTimeout},
+		log:    log,
+		stop:   stop,
+	}
+	go w.run()
+	return w
+}
+
+// enqueue queues an event to be delivered, without blocking.
+// If the queue is full, the event is dropped.
+func (w *webhook) enqueue(e Event) {
+	select {
+	case w.events <- e:
+	default:
+		w.log.WithFields(Fields{
+			"url":   w.url,
+			"event": e.Type,
+		}).Warn("Webhook queue is full; dropping event")
+	}
+}
+
+// run delivers queued events in order, until the server shuts down.
+// Events queued by then, such as those for the clients it kicked, are still delivered, though not retried.
+func (w *webhook) run() {
+	for {
+		select {
+		case e := <-w.events:
+			w.deliver(e)
+		case <-w.stop:
+			for {
+				select {
+				case e := <-w.events:
+					w.deliver(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver delivers an event, retrying failed deliveries until the server shuts down.
+func (w *webhook) deliver(e Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		w.log.WithFields(Fields{
+			"event": e.Type,
+			"error": err,
+		}).Error("Error marshaling webhook event")
+		return
+	}
+
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		err = w.post(body)
+		if err == nil {
+			break
+		}
+		if attempt == webhookAttempts || w.stopped() {
+			w.log.WithFields(Fields{
+				"url":   w.url,
+				"event": e.Type,
+				"error": err,
+			}).Error("Error delivering webhook event; giving up")
+			break
+		}
+		w.log.WithFields(Fields{
+			"url":     w.url,
+			"event":   e.Type,
+			"attempt": attempt,
+			"error":   err,
+		}).Warn("Error delivering webhook event; retrying")
+		select {
+		case <-time.After(delay):
+		case <-w.stop:
+		}
+		delay *= 2
+	}
+}
+
+// stopped reports whether the server has shut down.
+func (w *webhook) stopped() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// post sends one event, and checks that the webhook accepted it.
+func (w *webhook) post(body []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Post event")
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("Webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// emit sends an event to all webhooks and event streams, without blocking.
+// This method is safe to use concurrently, without holding the registry lock.
+func (reg *registry) emit(e Event) {
+	if len(reg.webhooks) == 0 && !reg.eventStreams.watched() {
+		return
+	}
+	e = reg.private(e)
+	e.Time = time.Now()
+	for _, w := range reg.webhooks {
+		w.enqueue(e)
+	}
+	reg.eventStreams.publish(e)
+}
+
+// eventClient identifies the client in an event.
+func (c *client) eventClient() *EventClient {
+	return &EventClient{ID: c.id, RemoteHost: c.remoteHost, CorrelationID: c.correlationID}
+}
@@ -0,0 +1,89 @@
+// Copyright © 2023 Niko Carpenter <niko@nikocarpenter.com>
+//
+// This source code is governed by the MIT license, which can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// ClientWhoamiMessage is received when a client asks what the server knows about its connection.
+type ClientWhoamiMessage struct {
+	GenericClientMessage
+}
+
+// Name gets this ClientWhoamiMessage's name.
+func (ClientWhoamiMessage) Name() string {
+	return "whoami"
+}
+
+// ClientWhoamiResponse tells a client what the server knows about its connection,
+// such as the address the server sees it connecting from, to help debug NAT and proxies.
+type ClientWhoamiResponse struct {
+	Type string `json:"type"`
+
+	// ID is the client's ID, which other members of its channel know it by.
+	ID uint64 `json:"id"`
+
+	// RemoteAddr is the address and port the client's connection comes from, as seen by the server,
+	// and RemoteHost the host name it resolves to, or the address if it has none.
+	RemoteAddr string `json:"remote_addr"`
+	RemoteHost string `json:"remote_host"`
+
+	// ProxyAddr is the address of the trusted proxy that relayed the client's connection, if one did.
+	ProxyAddr string `json:"proxy_addr,omitempty"`
+
+	// TLS describes the client's TLS connection, or is nil if it isn't using TLS.
+	TLS *ClientTLSInfo `json:"tls,omitempty"`
+
+	// ProtocolVersion is the version of the protocol the client negotiated, or the default if it didn't.
+	ProtocolVersion int    `json:"protocol_version"`
+	Codec           string `json:"codec"`
+	Compression     string `json:"compression,omitempty"`
+
+	// Connected is when the client connected, and ConnectedFor how long ago that was, in seconds.
+	Connected    time.Time `json:"connected"`
+	ConnectedFor float64   `json:"connected_for"`
+}
+
+// Name gets this ClientWhoamiResponse's name.
+func (ClientWhoamiResponse) Name() string {
+	return "whoami"
+}
+
+// ClientTLSInfo describes a client's TLS connection.
+type ClientTLSInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ServerName  string `json:"server_name,omitempty"`
+}
+
+func handleClientWhoami(c *client, msg Message) {
+	now := time.Now()
+	resp := ClientWhoamiResponse{
+		Type:            "whoami",
+		ID:              c.id,
+		RemoteAddr:      c.addr.String(),
+		RemoteHost:      c.remoteHost,
+		ProtocolVersion: c.protocol.version,
+		Codec:           c.codec.Name(),
+		Compression:     c.compression,
+		Connected:       c.connected,
+		ConnectedFor:    now.Sub(c.connected).Seconds(),
+	}
+	if peer := c.conn.RemoteAddr(); peer.String() != c.addr.String() {
+		resp.ProxyAddr = peer.String()
+	}
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		// The handshake has finished, since the client's message was read over it.
+		state := tlsConn.ConnectionState()
+		resp.TLS = &ClientTLSInfo{
+			Version:     tls.VersionName(state.Version),
+			CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+			ServerName:  state.ServerName,
+		}
+	}
+	c.send(resp)
+}